@@ -38,6 +38,12 @@ const (
 	alertInappropriateFallback  alert = 86
 	alertUserCanceled           alert = 90
 	alertNoRenegotiation        alert = 100
+	alertMissingExtension       alert = 109
+	alertUnsupportedExtension   alert = 110
+	alertUnrecognizedName       alert = 112
+	alertBadCertStatusResponse  alert = 113
+	alertCertificateRequired    alert = 116
+	alertNoApplicationProtocol  alert = 120
 )
 
 var alertText = map[alert]string{
@@ -64,6 +70,12 @@ var alertText = map[alert]string{
 	alertInappropriateFallback:  "inappropriate fallback",
 	alertUserCanceled:           "user canceled",
 	alertNoRenegotiation:        "no renegotiation",
+	alertMissingExtension:       "missing extension",
+	alertUnsupportedExtension:   "unsupported extension",
+	alertUnrecognizedName:       "unrecognized name",
+	alertBadCertStatusResponse:  "bad certificate status response",
+	alertCertificateRequired:    "certificate required",
+	alertNoApplicationProtocol:  "no application protocol",
 }
 
 func (e alert) String() string {
@@ -77,3 +89,14 @@ func (e alert) String() string {
 func (e alert) Error() string {
 	return e.String()
 }
+
+// AlertError is returned when the peer ends the handshake or the connection
+// with a fatal alert.
+// Alert holds the alert description code, e.g., 80 for internal_error.
+type AlertError struct {
+	Alert uint8
+}
+
+func (e *AlertError) Error() string {
+	return "tls: received alert: " + alert(e.Alert).String()
+}
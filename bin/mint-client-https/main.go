@@ -14,7 +14,7 @@ func main() {
 	flagURL := flag.String("URL", "https://localhost:4430", "URL to send request")
 	flag.Parse()
 	mintdial := func(network, addr string) (net.Conn, error) {
-		return mint.Dial(network, addr, nil)
+		return mint.Dial(network, addr, &mint.Config{InsecureSkipVerify: true})
 	}
 
 	tr := &http.Transport{
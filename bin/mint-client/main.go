@@ -6,7 +6,7 @@ import (
 )
 
 func main() {
-	conn, err := mint.Dial("tcp", "localhost:4430", nil)
+	conn, err := mint.Dial("tcp", "localhost:4430", &mint.Config{InsecureSkipVerify: true})
 
 	if err != nil {
 		fmt.Println("TLS handshake failed:", err)
@@ -0,0 +1,273 @@
+package mint
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// The ChaCha20-Poly1305 AEAD of RFC 8439.  The standard library doesn't
+// export one, so this is a straightforward implementation of the RFC: ChaCha20
+// one block at a time, and Poly1305 with 26-bit limbs.
+
+const (
+	chachaKeyLen   = 32
+	chachaNonceLen = 12
+	poly1305TagLen = 16
+)
+
+type chacha20Poly1305 struct {
+	key [chachaKeyLen]byte
+}
+
+func newChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	if len(key) != chachaKeyLen {
+		return nil, fmt.Errorf("tls.chacha20poly1305: Bad key length")
+	}
+
+	aead := &chacha20Poly1305{}
+	copy(aead.key[:], key)
+	return aead, nil
+}
+
+func (aead *chacha20Poly1305) NonceSize() int {
+	return chachaNonceLen
+}
+
+func (aead *chacha20Poly1305) Overhead() int {
+	return poly1305TagLen
+}
+
+func (aead *chacha20Poly1305) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != chachaNonceLen {
+		panic("tls.chacha20poly1305: Bad nonce length")
+	}
+
+	ret, out := sliceForAppend(dst, len(plaintext)+poly1305TagLen)
+	ciphertext, tag := out[:len(plaintext)], out[len(plaintext):]
+
+	var polyKey [64]byte
+	chacha20Block(&polyKey, &aead.key, 0, nonce)
+	chacha20XOR(ciphertext, plaintext, &aead.key, 1, nonce)
+	mac := aeadMAC(polyKey[:32], additionalData, ciphertext)
+	copy(tag, mac[:])
+	zeroBytes(polyKey[:])
+	return ret
+}
+
+func (aead *chacha20Poly1305) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != chachaNonceLen {
+		panic("tls.chacha20poly1305: Bad nonce length")
+	}
+	if len(ciphertext) < poly1305TagLen {
+		return nil, fmt.Errorf("tls.chacha20poly1305: Ciphertext too short")
+	}
+
+	tag := ciphertext[len(ciphertext)-poly1305TagLen:]
+	ciphertext = ciphertext[:len(ciphertext)-poly1305TagLen]
+
+	var polyKey [64]byte
+	chacha20Block(&polyKey, &aead.key, 0, nonce)
+	mac := aeadMAC(polyKey[:32], additionalData, ciphertext)
+	zeroBytes(polyKey[:])
+	if subtle.ConstantTimeCompare(mac[:], tag) != 1 {
+		return nil, fmt.Errorf("tls.chacha20poly1305: Authentication failed")
+	}
+
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	chacha20XOR(out, ciphertext, &aead.key, 1, nonce)
+	return ret, nil
+}
+
+// sliceForAppend extends in by n bytes, returning the whole slice and the
+// new part
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
+
+// aeadMAC computes the Poly1305 tag over the padded additional data and
+// ciphertext, followed by their lengths (RFC 8439, Section 2.8)
+func aeadMAC(polyKey, additionalData, ciphertext []byte) [poly1305TagLen]byte {
+	pad := func(data []byte) []byte {
+		if rem := len(data) % 16; rem > 0 {
+			return append(data, make([]byte, 16-rem)...)
+		}
+		return data
+	}
+
+	macData := pad(append([]byte{}, additionalData...))
+	macData = pad(append(macData, ciphertext...))
+	var lengths [16]byte
+	binary.LittleEndian.PutUint64(lengths[:8], uint64(len(additionalData)))
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(len(ciphertext)))
+	macData = append(macData, lengths[:]...)
+
+	return poly1305(polyKey, macData)
+}
+
+// chacha20Block computes one 64-byte block of the ChaCha20 keystream (RFC
+// 8439, Section 2.3)
+func chacha20Block(out *[64]byte, key *[chachaKeyLen]byte, counter uint32, nonce []byte) {
+	var state, x [16]uint32
+	state[0], state[1], state[2], state[3] = 0x61707865, 0x3320646e, 0x79622d32, 0x6b206574
+	for i := 0; i < 8; i++ {
+		state[4+i] = binary.LittleEndian.Uint32(key[4*i:])
+	}
+	state[12] = counter
+	for i := 0; i < 3; i++ {
+		state[13+i] = binary.LittleEndian.Uint32(nonce[4*i:])
+	}
+
+	quarterRound := func(a, b, c, d int) {
+		x[a] += x[b]
+		x[d] = bits.RotateLeft32(x[d]^x[a], 16)
+		x[c] += x[d]
+		x[b] = bits.RotateLeft32(x[b]^x[c], 12)
+		x[a] += x[b]
+		x[d] = bits.RotateLeft32(x[d]^x[a], 8)
+		x[c] += x[d]
+		x[b] = bits.RotateLeft32(x[b]^x[c], 7)
+	}
+
+	x = state
+	for i := 0; i < 10; i++ {
+		quarterRound(0, 4, 8, 12)
+		quarterRound(1, 5, 9, 13)
+		quarterRound(2, 6, 10, 14)
+		quarterRound(3, 7, 11, 15)
+		quarterRound(0, 5, 10, 15)
+		quarterRound(1, 6, 11, 12)
+		quarterRound(2, 7, 8, 13)
+		quarterRound(3, 4, 9, 14)
+	}
+	for i := range x {
+		binary.LittleEndian.PutUint32(out[4*i:], x[i]+state[i])
+	}
+}
+
+// chacha20XOR encrypts or decrypts in to out with the keystream starting at
+// the given block counter.  out and in may be the same slice.
+func chacha20XOR(out, in []byte, key *[chachaKeyLen]byte, counter uint32, nonce []byte) {
+	var block [64]byte
+	for len(in) > 0 {
+		chacha20Block(&block, key, counter, nonce)
+		counter++
+
+		n := len(in)
+		if n > len(block) {
+			n = len(block)
+		}
+		for i := 0; i < n; i++ {
+			out[i] = in[i] ^ block[i]
+		}
+		in, out = in[n:], out[n:]
+	}
+	zeroBytes(block[:])
+}
+
+// poly1305 computes the one-time authenticator of RFC 8439, Section 2.5.  The
+// accumulator and r are held in five 26-bit limbs, so that products fit in
+// 64 bits.
+func poly1305(key, msg []byte) [poly1305TagLen]byte {
+	const mask = 0x3ffffff
+
+	// r is clamped as it is read
+	r0 := uint64(binary.LittleEndian.Uint32(key[0:]) & 0x3ffffff)
+	r1 := uint64((binary.LittleEndian.Uint32(key[3:]) >> 2) & 0x3ffff03)
+	r2 := uint64((binary.LittleEndian.Uint32(key[6:]) >> 4) & 0x3ffc0ff)
+	r3 := uint64((binary.LittleEndian.Uint32(key[9:]) >> 6) & 0x3f03fff)
+	r4 := uint64((binary.LittleEndian.Uint32(key[12:]) >> 8) & 0x00fffff)
+	s1, s2, s3, s4 := r1*5, r2*5, r3*5, r4*5
+
+	var h0, h1, h2, h3, h4 uint64
+	for len(msg) > 0 {
+		// Each block gets a high 1 bit, which for a short final block is
+		// placed right after the message
+		var block [17]byte
+		n := copy(block[:16], msg)
+		block[n] = 1
+		msg = msg[n:]
+
+		h0 += uint64(binary.LittleEndian.Uint32(block[0:]) & mask)
+		h1 += uint64((binary.LittleEndian.Uint32(block[3:]) >> 2) & mask)
+		h2 += uint64((binary.LittleEndian.Uint32(block[6:]) >> 4) & mask)
+		h3 += uint64((binary.LittleEndian.Uint32(block[9:]) >> 6) & mask)
+		h4 += uint64(binary.LittleEndian.Uint32(block[12:])>>8) | uint64(block[16])<<24
+
+		// h *= r, modulo 2^130 - 5
+		d0 := h0*r0 + h1*s4 + h2*s3 + h3*s2 + h4*s1
+		d1 := h0*r1 + h1*r0 + h2*s4 + h3*s3 + h4*s2
+		d2 := h0*r2 + h1*r1 + h2*r0 + h3*s4 + h4*s3
+		d3 := h0*r3 + h1*r2 + h2*r1 + h3*r0 + h4*s4
+		d4 := h0*r4 + h1*r3 + h2*r2 + h3*r1 + h4*r0
+
+		d1 += d0 >> 26
+		h0 = d0 & mask
+		d2 += d1 >> 26
+		h1 = d1 & mask
+		d3 += d2 >> 26
+		h2 = d2 & mask
+		d4 += d3 >> 26
+		h3 = d3 & mask
+		h0 += (d4 >> 26) * 5
+		h4 = d4 & mask
+		h1 += h0 >> 26
+		h0 &= mask
+	}
+
+	// Fully carry h
+	h2 += h1 >> 26
+	h1 &= mask
+	h3 += h2 >> 26
+	h2 &= mask
+	h4 += h3 >> 26
+	h3 &= mask
+	h0 += (h4 >> 26) * 5
+	h4 &= mask
+	h1 += h0 >> 26
+	h0 &= mask
+
+	// Compute h + -p, and use it if it doesn't underflow
+	g0 := h0 + 5
+	g1 := h1 + (g0 >> 26)
+	g0 &= mask
+	g2 := h2 + (g1 >> 26)
+	g1 &= mask
+	g3 := h3 + (g2 >> 26)
+	g2 &= mask
+	g4 := h4 + (g3 >> 26) - (1 << 26)
+	g3 &= mask
+
+	useG := (g4 >> 63) - 1
+	h0 = (h0 &^ useG) | (g0 & useG)
+	h1 = (h1 &^ useG) | (g1 & useG)
+	h2 = (h2 &^ useG) | (g2 & useG)
+	h3 = (h3 &^ useG) | (g3 & useG)
+	h4 = (h4 &^ useG) | (g4 & useG)
+
+	// tag = (h + s) mod 2^128
+	f0 := (h0 | h1<<26) & 0xffffffff
+	f1 := (h1>>6 | h2<<20) & 0xffffffff
+	f2 := (h2>>12 | h3<<14) & 0xffffffff
+	f3 := (h3>>18 | h4<<8) & 0xffffffff
+
+	var tag [poly1305TagLen]byte
+	f0 += uint64(binary.LittleEndian.Uint32(key[16:]))
+	f1 += uint64(binary.LittleEndian.Uint32(key[20:])) + f0>>32
+	f2 += uint64(binary.LittleEndian.Uint32(key[24:])) + f1>>32
+	f3 += uint64(binary.LittleEndian.Uint32(key[28:])) + f2>>32
+	binary.LittleEndian.PutUint32(tag[0:], uint32(f0))
+	binary.LittleEndian.PutUint32(tag[4:], uint32(f1))
+	binary.LittleEndian.PutUint32(tag[8:], uint32(f2))
+	binary.LittleEndian.PutUint32(tag[12:], uint32(f3))
+	return tag
+}
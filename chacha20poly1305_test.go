@@ -0,0 +1,120 @@
+package mint
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// Test vectors from RFC 8439
+var (
+	chachaBlockKeyHex   = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	chachaBlockNonceHex = "000000090000004a00000000"
+	chachaBlockHex      = "10f1e7e4d13b5915500fdd1fa32071c4c7d1f4c733c068030422aa9ac3d46c4e" +
+		"d2826446079faa0914c2d705d98b02a2b5129cd1de164eb9cbd083e8a2503c4e"
+
+	poly1305KeyHex = "85d6be7857556d337f4452fe42d506a80103808afb0db2fd4abff6af4149f51b"
+	poly1305Msg    = "Cryptographic Forum Research Group"
+	poly1305TagHex = "a8061dc1305136c6c22b8baf0c0127a9"
+
+	aeadPlaintext = "Ladies and Gentlemen of the class of '99: If I could offer you " +
+		"only one tip for the future, sunscreen would be it."
+	aeadAADHex        = "50515253c0c1c2c3c4c5c6c7"
+	aeadKeyHex        = "808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f"
+	aeadNonceHex      = "070000004041424344454647"
+	aeadCiphertextHex = "d31a8d34648e60db7b86afbc53ef7ec2a4aded51296e08fea9e2b5a736ee62d6" +
+		"3dbea45e8ca9671282fafb69da92728b1a71de0a9e060b2905d6a5b67ecd3b36" +
+		"92ddbd7f2d778b8c9803aee328091b58fab324e4fad675945585808b4831d7bc" +
+		"3ff4def08e4b7a9de576d26586cec64b6116"
+	aeadTagHex = "1ae10b594f09e26a7e902ecbd0600691"
+)
+
+func TestChaCha20Block(t *testing.T) {
+	keyBytes, _ := hex.DecodeString(chachaBlockKeyHex)
+	nonce, _ := hex.DecodeString(chachaBlockNonceHex)
+	expected, _ := hex.DecodeString(chachaBlockHex)
+
+	var key [chachaKeyLen]byte
+	var block [64]byte
+	copy(key[:], keyBytes)
+	chacha20Block(&block, &key, 1, nonce)
+	assertByteEquals(t, block[:], expected)
+}
+
+func TestPoly1305(t *testing.T) {
+	key, _ := hex.DecodeString(poly1305KeyHex)
+	expected, _ := hex.DecodeString(poly1305TagHex)
+
+	tag := poly1305(key, []byte(poly1305Msg))
+	assertByteEquals(t, tag[:], expected)
+}
+
+func TestChaCha20Poly1305(t *testing.T) {
+	key, _ := hex.DecodeString(aeadKeyHex)
+	nonce, _ := hex.DecodeString(aeadNonceHex)
+	aad, _ := hex.DecodeString(aeadAADHex)
+	ciphertext, _ := hex.DecodeString(aeadCiphertextHex)
+	tag, _ := hex.DecodeString(aeadTagHex)
+	sealed := append(ciphertext, tag...)
+
+	aead, err := newChaCha20Poly1305(key)
+	assertNotError(t, err, "Failed to create AEAD")
+	assertEquals(t, aead.NonceSize(), 12)
+	assertEquals(t, aead.Overhead(), 16)
+
+	// Test the known answer in both directions
+	out := aead.Seal(nil, nonce, []byte(aeadPlaintext), aad)
+	assertByteEquals(t, out, sealed)
+	pt, err := aead.Open(nil, nonce, sealed, aad)
+	assertNotError(t, err, "Failed to open a valid ciphertext")
+	assertByteEquals(t, pt, []byte(aeadPlaintext))
+
+	// Test that output is appended to dst, including in place
+	prefix := []byte{0xA0, 0xA1}
+	out = aead.Seal(append([]byte{}, prefix...), nonce, []byte(aeadPlaintext), aad)
+	assertByteEquals(t, out, append(append([]byte{}, prefix...), sealed...))
+	inPlace := append([]byte{}, sealed...)
+	pt, err = aead.Open(inPlace[:0], nonce, inPlace, aad)
+	assertNotError(t, err, "Failed to open in place")
+	assertByteEquals(t, pt, []byte(aeadPlaintext))
+
+	// Test that empty plaintext still gets a tag
+	out = aead.Seal(nil, nonce, nil, aad)
+	assertEquals(t, len(out), 16)
+	pt, err = aead.Open(nil, nonce, out, aad)
+	assertNotError(t, err, "Failed to open an empty ciphertext")
+	assertEquals(t, len(pt), 0)
+
+	// Test failure cases for modified ciphertext, tag and additional data,
+	// and for a truncated ciphertext
+	for _, i := range []int{0, len(ciphertext)} {
+		modified := append([]byte{}, sealed...)
+		modified[i] ^= 0x01
+		_, err = aead.Open(nil, nonce, modified, aad)
+		assertError(t, err, "Opened a modified ciphertext")
+	}
+	_, err = aead.Open(nil, nonce, sealed, aad[1:])
+	assertError(t, err, "Opened with modified additional data")
+	_, err = aead.Open(nil, nonce, sealed[:15], aad)
+	assertError(t, err, "Opened a truncated ciphertext")
+
+	// Test failure case for a bad key length
+	_, err = newChaCha20Poly1305(key[:16])
+	assertError(t, err, "Created an AEAD with a short key")
+
+	// Test that the keystream continues across blocks, by comparing
+	// encryption of a long message in one call with block-sized pieces
+	long := bytes.Repeat([]byte{0x5a}, 200)
+	whole := aead.Seal(nil, nonce, long, nil)
+	var k [chachaKeyLen]byte
+	copy(k[:], key)
+	pieces := make([]byte, len(long))
+	for i := 0; i < len(long); i += 64 {
+		end := i + 64
+		if end > len(long) {
+			end = len(long)
+		}
+		chacha20XOR(pieces[i:end], long[i:end], &k, uint32(1+i/64), nonce)
+	}
+	assertByteEquals(t, whole[:len(long)], pieces)
+}
@@ -1,5 +1,27 @@
 package mint
 
+const (
+	tls12Version  uint16 = 0x0303
+	tls13Version  uint16 = 0x0304
+	dtls13Version uint16 = 0xfefc
+)
+
+// A TLS 1.3 server that negotiates an earlier version sets the last eight
+// bytes of its ServerHello random to one of these values
+var (
+	downgradeSentinelTLS12 = []byte{0x44, 0x4F, 0x57, 0x4E, 0x47, 0x52, 0x44, 0x01}
+	downgradeSentinelTLS11 = []byte{0x44, 0x4F, 0x57, 0x4E, 0x47, 0x52, 0x44, 0x00}
+)
+
+// A ServerHello with this random value is a HelloRetryRequest.  It is
+// SHA-256("HelloRetryRequest").
+var helloRetryRequestRandom = [32]byte{
+	0xCF, 0x21, 0xAD, 0x74, 0xE5, 0x9A, 0x61, 0x11,
+	0xBE, 0x1D, 0x8C, 0x02, 0x1E, 0x65, 0xB8, 0x91,
+	0xC2, 0xA2, 0x11, 0x16, 0x7A, 0xBB, 0x8C, 0x5E,
+	0x07, 0x9E, 0x09, 0xE2, 0xC8, 0xA8, 0x33, 0x9C,
+}
+
 var (
 	draftVersionImplemented = 11
 
@@ -13,9 +35,10 @@ var (
 type recordType byte
 
 const (
-	recordTypeAlert           recordType = 21
-	recordTypeHandshake       recordType = 22
-	recordTypeApplicationData recordType = 23
+	recordTypeChangeCipherSpec recordType = 20
+	recordTypeAlert            recordType = 21
+	recordTypeHandshake        recordType = 22
+	recordTypeApplicationData  recordType = 23
 )
 
 // enum {...} HandshakeType;
@@ -26,6 +49,7 @@ const (
 	handshakeTypeClientHello         handshakeType = 1
 	handshakeTypeServerHello         handshakeType = 2
 	handshakeTypeSessionTicket       handshakeType = 4
+	handshakeTypeEndOfEarlyData      handshakeType = 5
 	handshakeTypeHelloRetryRequest   handshakeType = 6
 	handshakeTypeEncryptedExtensions handshakeType = 8
 	handshakeTypeCertificate         handshakeType = 11
@@ -34,6 +58,9 @@ const (
 	handshakeTypeServerConfiguration handshakeType = 17
 	handshakeTypeFinished            handshakeType = 20
 	handshakeTypeKeyUpdate           handshakeType = 24
+
+	handshakeTypeClientEncryptedExtensions handshakeType = 203 // From draft-vvv-tls-alps
+	handshakeTypeMessageHash               handshakeType = 254 // Synthetic, for HelloRetryRequest
 )
 
 // uint8 CipherSuite[2];
@@ -83,6 +110,37 @@ type signatureAndHashAlgorithm struct {
 	signature signatureAlgorithm
 }
 
+func (alg signatureAndHashAlgorithm) scheme() SignatureScheme {
+	return SignatureScheme(uint16(alg.hash)<<8 | uint16(alg.signature))
+}
+
+func (scheme SignatureScheme) algorithm() signatureAndHashAlgorithm {
+	return signatureAndHashAlgorithm{hashAlgorithm(scheme >> 8), signatureAlgorithm(scheme)}
+}
+
+// SignatureScheme identifies a signature algorithm together with its hash.
+// The value is the two-byte SignatureAndHashAlgorithm as sent on the wire.
+type SignatureScheme uint16
+
+const (
+	RSA_PKCS1_SHA256       SignatureScheme = 0x0401
+	RSA_PKCS1_SHA384       SignatureScheme = 0x0501
+	RSA_PKCS1_SHA512       SignatureScheme = 0x0601
+	ECDSA_SECP256R1_SHA256 SignatureScheme = 0x0403
+	ECDSA_SECP384R1_SHA384 SignatureScheme = 0x0503
+	ECDSA_SECP521R1_SHA512 SignatureScheme = 0x0603
+
+	// RSA-PSS with an rsaEncryption key (rsae) or an RSASSA-PSS key (pss),
+	// from RFC 8446.  These do not split into a hash and a signature
+	// algorithm.
+	RSA_PSS_RSAE_SHA256 SignatureScheme = 0x0804
+	RSA_PSS_RSAE_SHA384 SignatureScheme = 0x0805
+	RSA_PSS_RSAE_SHA512 SignatureScheme = 0x0806
+	RSA_PSS_PSS_SHA256  SignatureScheme = 0x0809
+	RSA_PSS_PSS_SHA384  SignatureScheme = 0x080a
+	RSA_PSS_PSS_SHA512  SignatureScheme = 0x080b
+)
+
 // enum {...} ExtensionType
 type helloExtensionType uint16
 
@@ -91,8 +149,19 @@ const (
 	extensionTypeServerName          helloExtensionType = 0
 	extensionTypeSupportedGroups     helloExtensionType = 10
 	extensionTypeSignatureAlgorithms helloExtensionType = 13
+	extensionTypeALPN                helloExtensionType = 16     // From RFC 7301
+	extensionTypePadding             helloExtensionType = 21     // From RFC 7685
+	extensionTypeRecordSizeLimit     helloExtensionType = 28     // From RFC 8449
 	extensionTypeKeyShare            helloExtensionType = 40     // Provisional value, from NSS
+	extensionTypePreSharedKey        helloExtensionType = 41     // From RFC 8446
+	extensionTypeEarlyData           helloExtensionType = 42     // From RFC 8446
+	extensionTypeSupportedVersions   helloExtensionType = 43     // From RFC 8446
+	extensionTypeCookie              helloExtensionType = 44     // From RFC 8446
+	extensionTypePSKKeyExchangeModes helloExtensionType = 45     // From RFC 8446
+	extensionTypePostHandshakeAuth   helloExtensionType = 49     // From RFC 8446
 	extensionTypeDraftVersion        helloExtensionType = 0xff02 // Required for NSS
+
+	extensionTypeApplicationSettings helloExtensionType = 17513 // From draft-vvv-tls-alps
 )
 
 // enum {...} NamedGroup
@@ -118,6 +187,14 @@ const (
 	namedGroupFF8192 namedGroup = 250
 )
 
+// enum { psk_ke(0), psk_dhe_ke(1), (255) } PskKeyExchangeMode;
+type pskKeyExchangeMode uint8
+
+const (
+	pskModeKE    pskKeyExchangeMode = 0
+	pskModeDHEKE pskKeyExchangeMode = 1
+)
+
 type marshaler interface {
 	Marshal() ([]byte, error)
 }
@@ -2,7 +2,11 @@ package mint
 
 import (
 	"bytes"
+	"context"
 	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"fmt"
 	"io"
@@ -15,18 +19,607 @@ import (
 // server instance.  The settings for client and server are pretty different,
 // but we just throw them all in here.
 type Config struct {
-	// TODO
+	// The name of the server, sent by the client in the server_name
+	// extension.  A client must set it; Dial infers it from the address.
+	// The client checks that the server's certificate is valid for it.
+	ServerName string
+
+	// If true, the client doesn't check that the server's certificate is
+	// valid for ServerName, or that it chains to a trusted root.  The
+	// connection is then open to an active attacker, so this should only be
+	// used for testing.
+	InsecureSkipVerify bool
+
+	// The roots that a client trusts to issue server certificates.  The
+	// server's chain is built from its leaf to one of them, using the other
+	// certificates in its Certificate message as intermediates.  If nil, the
+	// system roots are used.
+	RootCAs *x509.CertPool
+
+	// The roots that a server trusts to issue client certificates, with
+	// RequireAndVerifyClientCert.  The client's chain is built from its leaf
+	// to one of them, for client authentication, using the other
+	// certificates in its Certificate message as intermediates.  If nil, the
+	// system roots are used.
+	ClientCAs *x509.CertPool
+
+	// If set, a client calls VerifyPeerCertificate with the server's
+	// certificates, as DER, after its own checks, and with the chains that
+	// they built from the leaf to RootCAs.  With InsecureSkipVerify, it is
+	// called in place of those checks, with no chains.  A server likewise
+	// calls it with the client's certificates, if any, and with the chains
+	// to ClientCAs if it required them.  An error aborts the handshake with
+	// a bad_certificate alert, e.g., to pin a key.
+	VerifyPeerCertificate func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+
+	// If set, Time returns the current time, which is used to check the
+	// validity periods of certificates.  If nil, time.Now is used.
+	Time func() time.Time
+
+	// The cipher suites to use, in order of preference.  A client offers them
+	// in this order, and a server selects the first one that the client
+	// offered.  If empty, all supported suites are used.  Suites that are not
+	// supported are ignored.
+	CipherSuites []cipherSuite
+
+	// Cipher suites that should be removed from the default list, e.g., to
+	// disable a suite that is considered weak
+	ExcludeCipherSuites []cipherSuite
+
+	// The groups to use for key exchange, in order of preference.  A client
+	// lists them in this order in supported_groups; if a server has no key
+	// share in a group it supports, it asks for one in the first of its
+	// groups that the client supports.  If empty, all supported groups are
+	// used.  Groups that are not supported are ignored.
+	Groups []namedGroup
+
+	// The groups that a client sends key shares for in its first
+	// ClientHello, in order.  Groups that are not in Groups are ignored.  If
+	// the server wants a share in another group, it asks for one with a
+	// HelloRetryRequest.  If empty, KeyShareCount is used.
+	KeyShareGroups []namedGroup
+
+	// The number of groups, from the front of Groups, that a client sends key
+	// shares for when KeyShareGroups is empty.  If zero, a share is sent only
+	// for the first group.
+	KeyShareCount int
+
+	// Source of randomness for the Hello randoms and the ephemeral key
+	// shares.  If nil, crypto/rand is used.  A deterministic source makes the
+	// key exchange reproducible, e.g., for testing against known vectors.
+	//
+	// Each draw is named in the crypto log, and draws are made in a fixed
+	// order, so that a byte stream recorded from another implementation can
+	// be replayed:
+	//
+	//   - A client draws a key share for each group that it sends one for,
+	//     in order (by default only X25519), then the ClientHello random.
+	//     After a HelloRetryRequest, it draws a key share for the group that
+	//     the server selected.
+	//   - A server draws its key share, then the ServerHello random.
+	//   - A server draws the context of each post-handshake
+	//     CertificateRequest.
+	//   - A server draws the nonce and ticket_age_add of each session
+	//     ticket, then the nonce that the ticket is sealed with.
+	//
+	// A key share draw takes the size of the group's private key, e.g., 32
+	// bytes for X25519 or P-256.  A P-curve draw is repeated in the unlikely
+	// case that the value is out of range.  Signatures and the server's
+	// certificate are not drawn from Rand.
+	Rand io.Reader
+
+	// The maximum number of server handshakes that a listener will run at
+	// once.  Connections accepted beyond this limit wait for a slot before
+	// starting their handshake, which counts against HandshakeTimeout and
+	// ends if the context given to HandshakeContext is done.  Zero means no
+	// limit.
+	MaxConcurrentHandshakes int
+
+	// The longest that a handshake may run, on either side.  A connection
+	// whose handshake takes longer, e.g., because the peer stalls, is closed
+	// and Handshake returns context.DeadlineExceeded.  Zero means no limit.
+	HandshakeTimeout time.Duration
+
+	// If true, ECDSA signatures in CertificateVerify use deterministic nonces
+	// (RFC 6979), so the same transcript always yields the same signature.
+	DeterministicSignatures bool
+
+	// In DTLS, if the peer doesn't respond to a flight of handshake messages
+	// within HandshakeRetransmitTimeout, the flight is sent again, up to
+	// MaxHandshakeRetransmits times.  If zero, a timeout of one second is
+	// used.  TLS runs over a reliable transport, where a repeated record
+	// would only confuse the peer, so it never retransmits.
+	HandshakeRetransmitTimeout time.Duration
+	MaxHandshakeRetransmits    int
+
+	// If true, the raw handshake messages are kept after the handshake, so
+	// that they can be retrieved with Conn.HandshakeMessages.
+	ExportHandshakeMessages bool
+
+	// If true, the exporter master secret can be retrieved with
+	// Conn.ExporterSecret, for protocols that derive their own keys from it.
+	// Anyone who holds this secret can compute every exported value for the
+	// connection, so it has to be kept as carefully as the traffic keys.
+	ExportExporterSecret bool
+
+	// If true, the time spent in the expensive parts of the handshake is
+	// recorded in ConnectionState.HandshakeTimings.
+	RecordHandshakeTimings bool
+
+	// If set, NewTranscriptHash is called with the negotiated hash function
+	// to create the running hash over the handshake transcript, e.g., so that
+	// it can be computed outside of this process.  If nil, the standard
+	// library implementation is used.
+	NewTranscriptHash func(alg crypto.Hash) TranscriptHash
+
+	// If true, each side checks its own bookkeeping when it verifies the
+	// peer's Finished: the transcript hash is computed again from the
+	// handshake messages actually read and written, and if it differs, the
+	// handshake is aborted with an internal_error alert.  This is meant for
+	// debugging, since it hashes the transcript twice.
+	Strict bool
+
+	// The maximum number of certificates the client will accept in the
+	// server's Certificate message.  Longer chains are rejected with a
+	// bad_certificate alert.  If zero, a default of 10 is used.
+	MaxCertificateChainLength int
+
+	// The initial size of the buffer used to reassemble handshake messages,
+	// which grows as needed for longer messages.  If zero, a default of 4096
+	// bytes is used; smaller values are raised to 256 bytes.
+	HandshakeReadBufferSize int
+
+	// If true, the client offers post-handshake authentication, so that the
+	// server can ask it for a certificate after the handshake
+	PostHandshakeAuth bool
+
+	// The certificates to authenticate with.  When a server asks a client
+	// for a certificate, the client sends the first one that can sign with an
+	// algorithm the server accepts, or an empty Certificate if there is none.
+	// A server sends the first one that can sign with an algorithm the
+	// client accepts and whose leaf is valid for the name that the client
+	// asked for, or else the first one that can sign at all.  If there are
+	// none at all, it uses a self-signed certificate for example.com.
+	Certificates []Certificate
+
+	// If set, a server calls GetCertificate with the ClientHello to get the
+	// certificate to authenticate with, instead of using Certificates.  If
+	// it returns nil, Certificates is used after all.  An error aborts the
+	// handshake with an internal_error alert.
+	GetCertificate func(*clientHelloBody) (*Certificate, error)
+
+	// If set, a server calls OnClientHello with the contents of the client's
+	// first ClientHello as soon as it has been parsed, before responding.
+	// An error aborts the handshake with the OnClientHelloAlert alert, and
+	// Handshake returns it.
+	OnClientHello func(*ClientHelloInfo) error
+
+	// If set, a server calls GetConfigForClient with the contents of the
+	// client's first ClientHello, after OnClientHello.  If it returns a
+	// Config, that Config is used for the rest of the connection, e.g., to
+	// select certificates or NextProtos by ServerName.  Settings that apply
+	// before the ClientHello is read, such as RecordPadding and
+	// HandshakeRetransmitTimeout, are still taken from the original Config.
+	// An error aborts the handshake with an internal_error alert.
+	GetConfigForClient func(*ClientHelloInfo) (*Config, error)
+
+	// The alert description code that a server sends when OnClientHello
+	// returns an error, e.g., 49 for access_denied.  If zero,
+	// handshake_failure is sent.
+	OnClientHelloAlert uint8
+
+	// If true, a server refuses a handshake with an unrecognized_name alert
+	// when its certificate is not valid for the name that the client asked
+	// for, instead of sending it anyway
+	StrictSNI bool
+
+	// Whether a server asks the client for a certificate during the
+	// handshake, and whether the client has to send one.  A resumed session
+	// brings the certificate from the handshake that issued its ticket, and
+	// is only resumed if that certificate passes the same checks.
+	ClientAuth ClientAuthType
+
+	// If set, a client stores the session tickets that servers issue, and
+	// offers one to resume the session in later handshakes with the same
+	// ServerName.  Resumption skips the server's certificate, but still does
+	// a fresh key exchange.
+	ClientSessionCache ClientSessionCache
+
+	// If true, a client neither offers nor stores session tickets, and a
+	// server doesn't issue them or resume sessions
+	SessionTicketsDisabled bool
+
+	// The maximum number of times that a client writes a ticket from one
+	// connection to ClientSessionCache.  Any more tickets that the server
+	// sends are dropped.  The cache keeps one session per server, so this
+	// bounds the work a server can cause, not the memory held.  If zero, a
+	// default of 4 is used.
+	MaxStoredTickets int
+
+	// The key that a server seals its session tickets with.  Servers that
+	// share a key can resume each other's sessions.  If zero, a random key is
+	// used for the life of the process.
+	SessionTicketKey [32]byte
+
+	// If positive, a server's tickets allow the client to send up to this
+	// many bytes of early data (0-RTT) when it resumes, and the server
+	// accepts it.  Early data isn't protected against replay: an attacker
+	// can send the client's first flight again, to this server or to another
+	// that shares the SessionTicketKey.  A server that accepts early data has
+	// to guard against that, e.g., with EarlyDataReplayCheck.
+	MaxEarlyData uint32
+
+	// If set, a server calls EarlyDataReplayCheck with the hash of each
+	// ClientHello that carries early data it would accept, and rejects the
+	// early data if it returns true, i.e., if that ClientHello was seen
+	// before.  The client then sends the data again after the handshake.
+	EarlyDataReplayCheck func(clientHelloHash []byte) bool
+
+	// Application protocols for ALPN, in order of preference.  A client
+	// offers them in this order; a server selects the first one in its own
+	// list that the client offered, and aborts with no_application_protocol
+	// if the client offered none of them.  If empty, ALPN is not used.
+	NextProtos []string
+
+	// Settings to exchange with application-layer protocol settings (ALPS),
+	// keyed by ALPN protocol.  Settings are exchanged only if the negotiated
+	// protocol has an entry on both sides; the peer's are then available as
+	// ConnectionState.PeerApplicationSettings.
+	ApplicationSettings map[string][]byte
+
+	// If true, the client requires the server to staple an OCSP response to
+	// its certificate, as it always does for a certificate with the OCSP
+	// must-staple (TLS feature) extension.  XXX: Stapling is not supported
+	// yet, so such a handshake always fails.
+	RequireStapling bool
+
+	// The kinds of key that a client accepts in the server's leaf
+	// certificate, e.g., only x509.ECDSA.  A certificate with any other kind
+	// of key is rejected with an unsupported_certificate alert.  If empty,
+	// any kind that can sign is accepted.
+	AcceptableCertKeyTypes []x509.PublicKeyAlgorithm
+
+	// If true, the server only authenticates with signature algorithms that
+	// use neither SHA-1 nor PKCS#1 v1.5, and aborts with a handshake_failure
+	// alert if the client offers no other algorithm
+	RejectDeprecatedSignatureAlgorithms bool
+
+	// If positive, small writes are coalesced in a buffer of this size, and
+	// only sent once the buffer fills or Conn.Flush is called.  This saves
+	// the per-record overhead when an application makes many tiny writes.
+	WriteBufferSize int
+
+	// If set, RecordPadding is called with the length of each application
+	// data record, and the record is padded with the number of zero bytes it
+	// returns, e.g., to hide the length of the content from an observer.
+	// Padding is limited to what fits in a record.
+	RecordPadding func(plaintextLen int) int
+
+	// If nonzero, the record_size_limit to advertise to the peer (RFC 8449),
+	// at least 64.  A client sends it in the ClientHello.  A server answers
+	// a client that sent one with this, or with 16385 if it is zero.  The
+	// peer's limit is reported in ConnectionState.PeerMaxRecordSize.
+	RecordSizeLimit uint16
+}
+
+// Certificate is a certificate chain, leaf first, together with the private
+// key for the leaf
+type Certificate struct {
+	Chain      []*x509.Certificate
+	PrivateKey crypto.Signer
+}
+
+// CertificateVerificationError is returned when a client rejects the
+// server's certificate.  It records the name that the client expected and
+// what the certificate presented, along with the underlying reason, e.g., an
+// x509.HostnameError or x509.UnknownAuthorityError.
+type CertificateVerificationError struct {
+	ServerName string   // The name that the client expected
+	Subject    string   // The subject of the server's leaf certificate
+	Names      []string // The DNS names and IP addresses in the leaf certificate
+	Err        error
+}
+
+func (e *CertificateVerificationError) Error() string {
+	return fmt.Sprintf("tls: certificate for %q (subject %q, names %v) failed verification: %v",
+		e.ServerName, e.Subject, e.Names, e.Err)
+}
+
+func (e *CertificateVerificationError) Unwrap() error {
+	return e.Err
+}
+
+// verifyServerName checks that a server's leaf certificate is valid for the
+// name that the client asked for
+func verifyServerName(leaf *x509.Certificate, serverName string) error {
+	err := leaf.VerifyHostname(serverName)
+	if err == nil {
+		return nil
+	}
+	return newCertificateVerificationError(leaf, serverName, err)
+}
+
+// verifyServerCertificate checks that a server's chain is valid for
+// ServerName and leads from the leaf to one of RootCAs, and returns the
+// chains that it built.  If not, it returns the alert that the client should
+// send along with the error.
+func (c Config) verifyServerCertificate(chain []*x509.Certificate) ([][]*x509.Certificate, alert, error) {
+	leaf := chain[0]
+	err := verifyServerName(leaf, c.ServerName)
+	if err != nil {
+		return nil, alertBadCertificate, err
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	verifiedChains, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         c.RootCAs,
+		Intermediates: intermediates,
+		CurrentTime:   c.now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err == nil {
+		return verifiedChains, 0, nil
+	}
+
+	al := alertBadCertificate
+	switch e := err.(type) {
+	case x509.UnknownAuthorityError:
+		al = alertUnknownCA
+	case x509.CertificateInvalidError:
+		if e.Reason == x509.Expired {
+			al = alertCertificateExpired
+		}
+	}
+	return nil, al, newCertificateVerificationError(leaf, c.ServerName, err)
+}
+
+func newCertificateVerificationError(leaf *x509.Certificate, serverName string, err error) error {
+	names := append([]string{}, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return &CertificateVerificationError{
+		ServerName: serverName,
+		Subject:    leaf.Subject.String(),
+		Names:      names,
+		Err:        err,
+	}
+}
+
+// verifyClientCertificateChain checks a client's chain as the server's
+// configuration asks: with RequireAndVerifyClientCert, the chain has to lead
+// from the leaf to one of ClientCAs, and VerifyPeerCertificate, if set, gets
+// the last word.
+func (c Config) verifyClientCertificateChain(chain []*x509.Certificate) error {
+	var verifiedChains [][]*x509.Certificate
+	if c.ClientAuth == RequireAndVerifyClientCert {
+		intermediates := x509.NewCertPool()
+		for _, cert := range chain[1:] {
+			intermediates.AddCert(cert)
+		}
+		var err error
+		verifiedChains, err = chain[0].Verify(x509.VerifyOptions{
+			Roots:         c.ClientCAs,
+			Intermediates: intermediates,
+			CurrentTime:   c.now(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.VerifyPeerCertificate != nil {
+		return c.VerifyPeerCertificate(rawCertificates(chain), verifiedChains)
+	}
+	return nil
+}
+
+// rawCertificates returns the DER encodings of a chain
+func rawCertificates(chain []*x509.Certificate) [][]byte {
+	rawCerts := make([][]byte, len(chain))
+	for i, cert := range chain {
+		rawCerts[i] = cert.Raw
+	}
+	return rawCerts
+}
+
+// ClientAuthType is a server's policy for client certificates
+type ClientAuthType int
+
+const (
+	NoClientCert               ClientAuthType = iota // Don't ask for a certificate
+	RequestClientCert                                // Ask, but also accept an empty Certificate
+	RequireAndVerifyClientCert                       // Abort with certificate_required if there is none, and verify it against ClientCAs
+)
+
+func (c Config) rand() io.Reader {
+	if c.Rand == nil {
+		return prng
+	}
+	return c.Rand
+}
+
+// draw returns the random source for one named draw.  Reads are logged with
+// the name, so that the order of draws can be followed.
+func (c Config) draw(name string) io.Reader {
+	return namedReader{name: name, r: c.rand()}
+}
+
+type namedReader struct {
+	name string
+	r    io.Reader
+}
+
+func (nr namedReader) Read(p []byte) (int, error) {
+	n, err := nr.r.Read(p)
+	logf(logTypeCrypto, "Random draw for %s [%d]", nr.name, n)
+	return n, err
+}
+
+func (c Config) now() time.Time {
+	if c.Time == nil {
+		return time.Now()
+	}
+	return c.Time()
+}
+
+func (c Config) retransmitTimeout(datagram bool) time.Duration {
+	if !datagram {
+		return 0
+	}
+	if c.HandshakeRetransmitTimeout == 0 {
+		return defaultDatagramRetransmitTimeout
+	}
+	return c.HandshakeRetransmitTimeout
+}
+
+func (c Config) maxCertificateChainLength() int {
+	if c.MaxCertificateChainLength == 0 {
+		return defaultMaxCertificateChainLength
+	}
+	return c.MaxCertificateChainLength
+}
+
+func (c Config) acceptsCertKeyType(keyType x509.PublicKeyAlgorithm) bool {
+	if len(c.AcceptableCertKeyTypes) == 0 {
+		return true
+	}
+	for _, t := range c.AcceptableCertKeyTypes {
+		if t == keyType {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Config) groups() []namedGroup {
+	if len(c.Groups) == 0 {
+		return supportedGroups
+	}
+
+	groups := []namedGroup{}
+	for _, group := range c.Groups {
+		for _, supported := range supportedGroups {
+			if group == supported {
+				groups = append(groups, group)
+				break
+			}
+		}
+	}
+	return groups
+}
+
+// ClientHelloInfo describes a ClientHello that a server has received
+type ClientHelloInfo struct {
+	// The name that the client asked for with server_name
 	ServerName string
+
+	// The cipher suites, groups and signature algorithms that the client
+	// offered, in its order of preference
+	CipherSuites        []cipherSuite
+	SupportedGroups     []namedGroup
+	SignatureAlgorithms []signatureAndHashAlgorithm
+
+	// The application protocols that the client offered with ALPN, if any
+	SupportedProtos []string
+
+	// All of the extensions in the ClientHello, in the order sent
+	Extensions extensionList
+
+	// The connection that the ClientHello arrived on, e.g., to look at the
+	// client's address
+	Conn net.Conn
+}
+
+// keyShareGroups returns the groups that a client sends key shares for in
+// its first ClientHello
+func (c Config) keyShareGroups() []namedGroup {
+	groups := c.groups()
+	if len(c.KeyShareGroups) > 0 {
+		shared := []namedGroup{}
+		for _, group := range c.KeyShareGroups {
+			for _, g := range groups {
+				if g == group {
+					shared = append(shared, group)
+					break
+				}
+			}
+		}
+		return shared
+	}
+
+	count := c.KeyShareCount
+	if count <= 0 {
+		count = 1
+	}
+	if count < len(groups) {
+		return groups[:count]
+	}
+	return groups
+}
+
+func (c Config) handshakeReadBufferSize() int {
+	switch {
+	case c.HandshakeReadBufferSize == 0:
+		return defaultHandshakeReadBufferSize
+	case c.HandshakeReadBufferSize < minHandshakeReadBufferSize:
+		return minHandshakeReadBufferSize
+	}
+	return c.HandshakeReadBufferSize
+}
+
+func (c Config) maxRetransmits() int {
+	if c.MaxHandshakeRetransmits == 0 {
+		return defaultMaxHandshakeRetransmits
+	}
+	return c.MaxHandshakeRetransmits
+}
+
+// cipherSuites returns the cipher suites enabled by this configuration, in
+// order of preference
+func (c Config) cipherSuites() []cipherSuite {
+	candidates := supportedCipherSuites
+	if len(c.CipherSuites) > 0 {
+		candidates = []cipherSuite{}
+		for _, suite := range c.CipherSuites {
+			for _, supported := range supportedCipherSuites {
+				if suite == supported {
+					candidates = append(candidates, suite)
+					break
+				}
+			}
+		}
+	}
+
+	suites := []cipherSuite{}
+	for _, suite := range candidates {
+		excluded := false
+		for _, excludedSuite := range c.ExcludeCipherSuites {
+			if suite == excludedSuite {
+				excluded = true
+				break
+			}
+		}
+
+		if !excluded {
+			suites = append(suites, suite)
+		}
+	}
+	return suites
 }
 
 func (c Config) validForServer() bool {
 	// TODO
-	return true
+	return len(c.cipherSuites()) > 0 && len(c.groups()) > 0
 }
 
 func (c Config) validForClient() bool {
 	// TODO
-	return true
+	return len(c.cipherSuites()) > 0 && len(c.groups()) > 0 && len(c.ServerName) > 0
 }
 
 func defaultConfig() *Config {
@@ -34,15 +627,25 @@ func defaultConfig() *Config {
 	return &Config{}
 }
 
+const (
+	defaultMaxCertificateChainLength = 10
+	maxCertificateEntryLen           = 1 << 16 // budget per certificate in a chain
+	defaultHandshakeReadBufferSize   = 4096
+	minHandshakeReadBufferSize       = 256
+)
+
 var (
 	supportedCipherSuites = []cipherSuite{
 		TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
 		TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
 		TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
 		TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+		TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
 	}
 
 	supportedGroups = []namedGroup{
+		namedGroupX25519,
 		namedGroupP256,
 		namedGroupP384,
 		namedGroupP521,
@@ -55,9 +658,85 @@ var (
 		signatureAndHashAlgorithm{hashAlgorithmSHA384, signatureAlgorithmECDSA},
 		signatureAndHashAlgorithm{hashAlgorithmSHA512, signatureAlgorithmRSA},
 		signatureAndHashAlgorithm{hashAlgorithmSHA512, signatureAlgorithmECDSA},
+		RSA_PSS_RSAE_SHA256.algorithm(),
+		RSA_PSS_RSAE_SHA384.algorithm(),
+		RSA_PSS_RSAE_SHA512.algorithm(),
+		RSA_PSS_PSS_SHA256.algorithm(),
+		RSA_PSS_PSS_SHA384.algorithm(),
+		RSA_PSS_PSS_SHA512.algorithm(),
 	}
 )
 
+// ConnectionState records basic TLS details about the connection.
+type ConnectionState struct {
+	HandshakeComplete   bool     // TLS handshake is complete
+	HandshakeRoundTrips int      // Number of ClientHello/ServerHello exchanges, or zero with early data
+	ClientRandom        [32]byte // Random value from the ClientHello
+	ServerRandom        [32]byte // Random value from the ServerHello
+
+	Version     uint16      // Negotiated protocol version
+	CipherSuite cipherSuite // Negotiated cipher suite
+	NamedGroup  namedGroup  // Group used for the key exchange
+
+	PeerSignatureScheme  SignatureScheme // Scheme of the peer's CertificateVerify
+	LocalSignatureScheme SignatureScheme // Scheme of our CertificateVerify
+
+	// The raw SubjectPublicKeyInfo of the peer's leaf certificate, and its
+	// SHA-256 hash, e.g., for public key pinning
+	PeerPublicKeyInfo   []byte
+	PeerPublicKeySHA256 [32]byte
+
+	// On the server, whether the client authenticated with a certificate
+	// that was verified against Config.ClientCAs, under
+	// RequireAndVerifyClientCert.  A certificate that was only requested is
+	// in PeerCertificates too, but its chain isn't checked, so it doesn't
+	// count.
+	ClientAuthenticated bool
+
+	// Whether the handshake resumed an earlier session with a PSK.  The
+	// server's certificate is then not sent again.
+	DidResume bool
+
+	// Whether the server accepted the client's early data (0-RTT)
+	EarlyDataAccepted bool
+
+	ServerName         string              // Server name from the client's server_name extension
+	NegotiatedProtocol string              // Application protocol selected with ALPN, if any
+	PeerCertificates   []*x509.Certificate // Certificate chain sent by the peer, if any
+
+	// The peer's ALPS settings for the negotiated protocol, if exchanged
+	PeerApplicationSettings []byte
+
+	// The most data, including any padding, that a record to the peer can
+	// carry: the record_size_limit that the peer advertised, less the byte
+	// for the content type, or 16384 if it didn't send one.  Writes are split
+	// into records of at most this size.
+	PeerMaxRecordSize int
+
+	// Only recorded if Config.RecordHandshakeTimings is set
+	HandshakeTimings HandshakeTimings
+}
+
+// HandshakeTimings breaks down where the time in a handshake went.  Each
+// field is the total over the handshake.
+type HandshakeTimings struct {
+	KeyShareGeneration time.Duration // Generating our key shares
+	Signing            time.Duration // Signing our CertificateVerify
+	Verification       time.Duration // Verifying the peer's CertificateVerify
+	NetworkRead        time.Duration // Waiting for handshake records from the peer
+	Total              time.Duration // The whole handshake, including the above
+}
+
+// startTimer returns a function that adds the time since startTimer was
+// called to d.  If handshake timings are not being recorded, it does nothing.
+func (c *Conn) startTimer(d *time.Duration) func() {
+	if !c.config.RecordHandshakeTimings {
+		return func() {}
+	}
+	start := time.Now()
+	return func() { *d += time.Since(start) }
+}
+
 // Conn implements the net.Conn interface, as with "crypto/tls"
 // * Read, Write, and Close are provided locally
 // * LocalAddr, RemoteAddr, and Set*Deadline are forwarded to the inner Conn
@@ -65,56 +744,210 @@ type Conn struct {
 	config   *Config
 	conn     net.Conn
 	isClient bool
+	datagram bool // DTLS rather than TLS
 
 	handshakeMutex    sync.Mutex
 	handshakeErr      error
 	handshakeComplete bool
+	handshakeSlots    chan struct{} // Shared by a listener to bound concurrent handshakes
+	handshakeMessages [][]byte      // Only kept if Config.ExportHandshakeMessages is set
+	postHandshakeAuth bool          // The client offered post-handshake authentication
+	state             ConnectionState
+
+	deadlineMutex     sync.Mutex
+	readDeadline      time.Time // As last set by SetDeadline or SetReadDeadline
+	writeDeadline     time.Time // As last set by SetDeadline or SetWriteDeadline
+	handshakeCanceled bool      // HandshakeContext has moved the deadlines to cancel the handshake
+
+	errMutex sync.Mutex
+	err      error // The first fatal error, returned by every later Read and Write
+
+	closeMutex      sync.Mutex
+	closed          bool
+	sendCloseNotify bool // The handshake has completed, so Close sends closeNotify
+
+	// Post-handshake client authentication.  On the server, requests and
+	// completed responses are kept by their context, and the response being
+	// read is held until its Finished arrives.
+	certRequestMutex    sync.Mutex
+	certRequests        map[string]*handshakeMessage
+	certResponses       map[string][]*x509.Certificate
+	pendingCertRequest  *handshakeMessage
+	pendingCertResponse *certificateBody
+	pendingCertMessage  *handshakeMessage
+	pendingCertVerify   *handshakeMessage
+	postHandshakeBuffer []byte // Partial handshake message read after the handshake
+
+	exchangedMessages []*handshakeMessage // Handshake messages read and written, in strict mode
+
+	// Session tickets.  A client counts the tickets it has stored.
+	ticketsAllowed bool // The client can resume with a ticket from the server
+	storedTickets  int
+	earlyData      []byte // Written by the client before the handshake
 
 	readBuffer        []byte
+	readClosed        bool   // The peer sent closeNotify, so nothing more will be read
+	writeBuffer       []byte // Unsent application data, if Config.WriteBufferSize is set
 	in, out           *recordLayer
 	inMutex, outMutex sync.Mutex
 	context           cryptoContext
 }
 
 func newConn(conn net.Conn, config *Config, isClient bool) *Conn {
+	if config == nil {
+		config = defaultConfig()
+	}
+
 	c := &Conn{conn: conn, config: config, isClient: isClient}
+	c.state.PeerMaxRecordSize = maxFragmentLen
 	c.in = newRecordLayer(c.conn)
 	c.out = newRecordLayer(c.conn)
+	c.out.padding = config.RecordPadding
 	return c
 }
 
-func (c *Conn) extendBuffer(n int) error {
+// version returns the protocol version that this connection negotiates
+func (c *Conn) version() uint16 {
+	if c.datagram {
+		return dtls13Version
+	}
+	return tls13Version
+}
+
+// handshakeLayers returns the layers for reading and writing handshake
+// messages.  In datagram mode, the reading layer retransmits the writing
+// layer's last flight while it waits for the peer.
+func (c *Conn) handshakeLayers() (hIn, hOut *handshakeLayer) {
+	if c.datagram {
+		hIn, hOut = newDatagramHandshakeLayer(c.in), newDatagramHandshakeLayer(c.out)
+	} else {
+		hIn, hOut = newHandshakeLayer(c.in), newHandshakeLayer(c.out)
+	}
+
+	hIn.buffer = make([]byte, 0, c.config.handshakeReadBufferSize())
+	if c.config.RecordHandshakeTimings {
+		hIn.readTime = &c.state.HandshakeTimings.NetworkRead
+	}
+
+	if timeout := c.config.retransmitTimeout(c.datagram); timeout > 0 {
+		hIn.retransmitFlights(c.out, timeout, c.config.maxRetransmits(), c.setRetransmitDeadline)
+	}
+
+	// Bound the Certificate message by what the longest acceptable chain
+	// could legitimately need
+	hIn.maxMessageLen = map[handshakeType]int{
+		handshakeTypeCertificate: c.config.maxCertificateChainLength() * maxCertificateEntryLen,
+	}
+
+	if c.config.Strict {
+		c.exchangedMessages = nil
+		hIn.exchanged = c.addExchangedMessage
+		hOut.exchanged = c.addExchangedMessage
+	}
+	return hIn, hOut
+}
+
+// setRetransmitDeadline sets the read deadline of the underlying connection
+// to t for the retransmission timer, unless the deadline set with
+// SetDeadline or SetReadDeadline comes first, or the handshake is being
+// canceled.  A zero t restores that deadline.
+func (c *Conn) setRetransmitDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	if c.handshakeCanceled {
+		return nil
+	}
+	if t.IsZero() || (!c.readDeadline.IsZero() && c.readDeadline.Before(t)) {
+		t = c.readDeadline
+	}
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) addExchangedMessage(hm *handshakeMessage) {
+	c.exchangedMessages = append(c.exchangedMessages, hm)
+}
+
+// checkTranscript compares the transcript hash in ctx with one computed
+// afresh from the handshake messages that were read and written, in strict
+// mode.  A difference means that a message was hashed but not sent, or sent
+// but not hashed, which is a bug on our side.
+func (c *Conn) checkTranscript(ctx *cryptoContext) error {
+	if !c.config.Strict {
+		return nil
+	}
+
+	// After a HelloRetryRequest, the first ClientHello is replaced by its
+	// hash, as in cryptoContext.Init
+	messages := c.exchangedMessages
+	h := ctx.params.hash.New()
+	if ctx.helloRetryRequest != nil && len(messages) >= 2 {
+		ch1 := ctx.params.hash.New()
+		ch1.Write(messages[0].Marshal())
+		messageHash := &handshakeMessage{msgType: handshakeTypeMessageHash, body: ch1.Sum(nil)}
+		h.Write(messageHash.Marshal())
+		messages = messages[1:]
+	}
+	for _, msg := range messages {
+		h.Write(msg.Marshal())
+	}
+
+	if !bytes.Equal(h.Sum(nil), ctx.transcriptHash()) {
+		logf(logTypeHandshake, "Transcript hash does not match the %d messages exchanged", len(c.exchangedMessages))
+		return alertInternalError
+	}
+	return nil
+}
+
+func (c *Conn) extendBuffer() error {
 	// XXX: crypto/tls bounds the number of empty records that can be read.  Should we?
-	// if there's no more data left, stop reading
-	if len(c.in.nextData) == 0 && len(c.readBuffer) > 0 {
+	// if there's data left over from an earlier record, deliver that first
+	if len(c.readBuffer) > 0 {
 		return nil
 	}
+	if c.readClosed {
+		return io.EOF
+	}
 
-	for len(c.readBuffer) <= n {
+	for len(c.readBuffer) == 0 {
 		pt, err := c.in.ReadRecord()
 
 		if pt == nil {
+			if a, ok := err.(alert); ok {
+				return c.sendAlert(a)
+			}
 			return err
 		}
 
 		switch pt.contentType {
+		case recordTypeChangeCipherSpec:
+			// ChangeCipherSpec is only tolerated during the handshake
+			return c.sendAlert(alertUnexpectedMessage)
 		case recordTypeHandshake:
-			// TODO: Handle post-handshake handshake messages
+			if herr := c.readPostHandshakeMessages(pt.fragment); herr != nil {
+				if a, ok := herr.(alert); ok {
+					return c.sendAlert(a)
+				}
+				return herr
+			}
 		case recordTypeAlert:
 			logf(logTypeIO, "extended buffer (for alert): [%d] %x", len(c.readBuffer), c.readBuffer)
 			if len(pt.fragment) != 2 {
 				c.sendAlert(alertUnexpectedMessage)
 				return io.EOF
 			}
+			// Any data that arrived ahead of the closeNotify has already
+			// been delivered, so this is the end of the stream
 			if alert(pt.fragment[1]) == alertCloseNotify {
+				c.readClosed = true
 				return io.EOF
 			}
 
 			switch pt.fragment[0] {
 			case alertLevelWarning:
-				// drop on the floor
+				logf(logTypeIO, "Ignoring warning alert [%v]", alert(pt.fragment[1]))
 			case alertLevelError:
-				return alert(pt.fragment[1])
+				logf(logTypeIO, "Received fatal alert [%v]", alert(pt.fragment[1]))
+				return &AlertError{Alert: pt.fragment[1]}
 			default:
 				c.sendAlert(alertUnexpectedMessage)
 				return io.EOF
@@ -123,6 +956,7 @@ func (c *Conn) extendBuffer(n int) error {
 		case recordTypeApplicationData:
 			c.readBuffer = append(c.readBuffer, pt.fragment...)
 			logf(logTypeIO, "extended buffer: [%d] %x", len(c.readBuffer), c.readBuffer)
+			zeroBytes(pt.fragment)
 		}
 
 		if err != nil {
@@ -133,11 +967,6 @@ func (c *Conn) extendBuffer(n int) error {
 		if len(c.in.nextData) == 0 {
 			return nil
 		}
-
-		// if we're over the limit and the next record is not an alert, exit
-		if len(c.readBuffer) == n && recordType(c.in.nextData[0]) != recordTypeAlert {
-			return nil
-		}
 	}
 	return nil
 }
@@ -148,53 +977,156 @@ func (c *Conn) Read(buffer []byte) (int, error) {
 	if err := c.Handshake(); err != nil {
 		return 0, err
 	}
+	if err := c.fatalError(); err != nil {
+		return 0, err
+	}
 
 	// Lock the input channel
 	c.in.Lock()
 	defer c.in.Unlock()
 
-	n := len(buffer)
-	err := c.extendBuffer(n)
-	var read int
-	if len(c.readBuffer) < n {
-		buffer = buffer[:len(c.readBuffer)]
-		copy(buffer, c.readBuffer)
-		read = len(c.readBuffer)
+	// Return whatever is available, up to the size of the buffer, rather
+	// than waiting for enough records to fill it
+	err := c.setFatalError(c.extendBuffer())
+	read := copy(buffer, c.readBuffer)
+	zeroBytes(c.readBuffer[:read])
+	if read == len(c.readBuffer) {
 		c.readBuffer = c.readBuffer[:0]
 	} else {
-		logf(logTypeIO, "read buffer larger than than input buffer")
-		copy(buffer[:n], c.readBuffer[:n])
-		c.readBuffer = c.readBuffer[n:]
-		read = n
+		c.readBuffer = c.readBuffer[read:]
 	}
 
 	return read, err
 }
 
+// ReadContext is like Read, but gives up if ctx is done before the read
+// completes, returning the context's error.  A blocked read is interrupted by
+// moving the read deadline of the underlying connection, and the deadline is
+// restored afterward.
+func (c *Conn) ReadContext(ctx context.Context, buffer []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			c.conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	n, err := c.Read(buffer)
+	close(done)
+	<-stopped
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		c.deadlineMutex.Lock()
+		c.conn.SetReadDeadline(c.readDeadline)
+		c.deadlineMutex.Unlock()
+
+		if isTimeout(err) {
+			return n, ctxErr
+		}
+	}
+	return n, err
+}
+
 // Write application data
 func (c *Conn) Write(buffer []byte) (int, error) {
 	// XXX crypto/tls has an interlock with Close here.  Do we need that?
 	if err := c.Handshake(); err != nil {
 		return 0, err
 	}
+	if err := c.fatalError(); err != nil {
+		return 0, err
+	}
 
 	// Lock the output channel
 	c.out.Lock()
 	defer c.out.Unlock()
 
+	if c.config.WriteBufferSize > 0 {
+		c.writeBuffer = append(c.writeBuffer, buffer...)
+		if len(c.writeBuffer) < c.config.WriteBufferSize {
+			return len(buffer), nil
+		}
+		return len(buffer), c.setFatalError(c.flushWriteBuffer())
+	}
+
+	n, err := c.writeApplicationData(buffer)
+	return n, c.setFatalError(err)
+}
+
+// fatalError returns the error that broke the connection, if any.
+func (c *Conn) fatalError() error {
+	c.errMutex.Lock()
+	defer c.errMutex.Unlock()
+	return c.err
+}
+
+// setFatalError records err as the error that broke the connection, unless
+// the connection is already broken, and returns the recorded error.  The end
+// of the stream and timeouts leave the connection usable, so they are
+// returned unchanged.
+func (c *Conn) setFatalError(err error) error {
+	if err == nil || err == io.EOF || isTimeout(err) {
+		return err
+	}
+
+	c.errMutex.Lock()
+	defer c.errMutex.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+	return c.err
+}
+
+// Flush sends any application data held back by the write buffer.  It does
+// nothing if Config.WriteBufferSize is not set.
+func (c *Conn) Flush() error {
+	if err := c.fatalError(); err != nil {
+		return err
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+	return c.setFatalError(c.flushWriteBuffer())
+}
+
+// c.out.Mutex <= L.
+func (c *Conn) flushWriteBuffer() error {
+	if len(c.writeBuffer) == 0 {
+		return nil
+	}
+
+	_, err := c.writeApplicationData(c.writeBuffer)
+	zeroBytes(c.writeBuffer)
+	c.writeBuffer = c.writeBuffer[:0]
+	return err
+}
+
+// writeApplicationData sends buffer in as few records as possible, each
+// within the peer's record_size_limit.
+// c.out.Mutex <= L.
+func (c *Conn) writeApplicationData(buffer []byte) (int, error) {
 	// Send full-size fragments
 	var start int
 	sent := 0
-	for start = 0; len(buffer)-start >= maxFragmentLen; start += maxFragmentLen {
+	fragmentLen := c.out.fragmentLimit()
+	for start = 0; len(buffer)-start >= fragmentLen; start += fragmentLen {
 		err := c.out.WriteRecord(&tlsPlaintext{
 			contentType: recordTypeApplicationData,
-			fragment:    buffer[start : start+maxFragmentLen],
+			fragment:    buffer[start : start+fragmentLen],
 		})
 
 		if err != nil {
 			return sent, err
 		}
-		sent += maxFragmentLen
+		sent += fragmentLen
 	}
 
 	// Send a final partial fragment if necessary
@@ -212,15 +1144,27 @@ func (c *Conn) Write(buffer []byte) (int, error) {
 	return sent, nil
 }
 
-// sendAlert sends a TLS alert message.
-// c.out.Mutex <= L.
+// setPeerRecordSizeLimit holds the protected records that we send to the
+// record_size_limit that the peer advertised.  In TLS 1.3 the limit counts
+// the content type, so a record carries one byte less than it.
+func (c *Conn) setPeerRecordSizeLimit(limit uint16) {
+	size := int(limit) - 1
+	if size > maxFragmentLen {
+		size = maxFragmentLen
+	}
+	c.state.PeerMaxRecordSize = size
+	c.out.maxProtectedLen = size
+}
+
+// sendAlert sends a TLS alert message.  It takes c.out.Mutex, so the caller
+// must not hold it.
 func (c *Conn) sendAlert(err alert) error {
-	c.handshakeMutex.Lock()
-	defer c.handshakeMutex.Unlock()
+	c.out.Lock()
+	defer c.out.Unlock()
 
 	tmp := make([]byte, 2)
 	switch err {
-	case alertNoRenegotiation, alertCloseNotify:
+	case alertNoRenegotiation, alertCloseNotify, alertUserCanceled:
 		tmp[0] = alertLevelWarning
 	default:
 		tmp[0] = alertLevelError
@@ -238,12 +1182,62 @@ func (c *Conn) sendAlert(err alert) error {
 	return nil
 }
 
-// Close closes the connection.
+// Close closes the connection.  If the handshake has completed, a closeNotify
+// alert is sent first, so that the peer can tell a graceful shutdown from a
+// truncated connection.  Any key material held by the connection is zeroed.
+// Closing a connection that is already closed does nothing.
 func (c *Conn) Close() error {
 	// XXX crypto/tls has an interlock with Write here.  Do we need that?
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	// Buffered data goes out ahead of the closeNotify.  Without a completed
+	// handshake, there are no keys to protect either, so only the transport
+	// is closed.
+	if c.sendCloseNotify {
+		c.Flush()
+		c.sendAlert(alertCloseNotify)
+	}
+	err := c.conn.Close()
+
+	// Closing the transport unblocks any pending Read, so it's safe to wait
+	// for the locks here
+	c.in.Lock()
+	c.in.Wipe()
+	zeroBytes(c.readBuffer)
+	c.in.Unlock()
+
+	c.out.Lock()
+	c.out.Wipe()
+	zeroBytes(c.writeBuffer)
+	c.out.Unlock()
+
+	// A handshake that is still running may be deriving keys from the
+	// context, which closing the transport doesn't stop.  If so, it wipes
+	// the context itself when it lets go of handshakeMutex.
+	if c.handshakeMutex.TryLock() {
+		c.context.Wipe()
+		c.handshakeMutex.Unlock()
+	}
+	return err
+}
 
-	c.sendAlert(alertCloseNotify)
-	return c.conn.Close()
+// unlockHandshake releases c.handshakeMutex, first wiping the context if the
+// connection was closed while it was held.  Holding closeMutex across both
+// steps means that Close either sees the mutex free or has already marked
+// the connection closed.
+// c.handshakeMutex <= L.
+func (c *Conn) unlockHandshake() {
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+	if c.closed {
+		c.context.Wipe()
+	}
+	c.handshakeMutex.Unlock()
 }
 
 // LocalAddr returns the local network address.
@@ -260,12 +1254,19 @@ func (c *Conn) RemoteAddr() net.Addr {
 // A zero value for t means Read and Write will not time out.
 // After a Write has timed out, the TLS state is corrupt and all future writes will return the same error.
 func (c *Conn) SetDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
 	return c.conn.SetDeadline(t)
 }
 
 // SetReadDeadline sets the read deadline on the underlying connection.
 // A zero value for t means Read will not time out.
 func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	c.readDeadline = t
 	return c.conn.SetReadDeadline(t)
 }
 
@@ -273,14 +1274,105 @@ func (c *Conn) SetReadDeadline(t time.Time) error {
 // A zero value for t means Write will not time out.
 // After a Write has timed out, the TLS state is corrupt and all future writes will return the same error.
 func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	c.writeDeadline = t
 	return c.conn.SetWriteDeadline(t)
 }
 
 // Handshake causes a TLS handshake on the connection.  The `isClient` member
 // determines whether a client or server handshake is performed.  If a
 // handshake has already been performed, then its result will be returned.
+//
+// If Config.HandshakeTimeout is set, the connection is closed if the
+// handshake doesn't complete in time.
+//
+// Handshake is safe to call from several goroutines at once, e.g., through
+// concurrent calls to Read and Write.  Only one of them runs the handshake;
+// the others wait for it and return its result.
 func (c *Conn) Handshake() error {
-	// TODO Lock handshakeMutex
+	c.handshakeMutex.Lock()
+	defer c.unlockHandshake()
+	return c.handshakeWithTimeout(context.Background())
+}
+
+// HandshakeContext is like Handshake, but gives up if ctx is done before the
+// handshake completes.  A blocked handshake is interrupted by moving the
+// deadlines of the underlying connection, which are restored afterward.  A
+// handshake that gives up this way has failed, and returns the context's
+// error from then on.  Config.HandshakeTimeout still applies.
+func (c *Conn) HandshakeContext(ctx context.Context) error {
+	c.handshakeMutex.Lock()
+	defer c.unlockHandshake()
+	return c.handshakeWithTimeout(ctx)
+}
+
+// handshakeWithTimeout runs the handshake under ctx, limited to
+// Config.HandshakeTimeout if that is set.
+// c.handshakeMutex <= L.
+func (c *Conn) handshakeWithTimeout(ctx context.Context) error {
+	timeout := c.config.HandshakeTimeout
+	if timeout <= 0 || c.handshakeComplete || c.handshakeErr != nil {
+		return c.handshakeContext(ctx)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := c.handshakeContext(timeoutCtx)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		logf(logTypeHandshake, "Handshake did not complete within %v", timeout)
+		c.conn.Close()
+	}
+	return err
+}
+
+// c.handshakeMutex <= L.
+func (c *Conn) handshakeContext(ctx context.Context) error {
+	// A context that can never be done needs no watching
+	if c.handshakeComplete || c.handshakeErr != nil || ctx.Done() == nil {
+		return c.handshake(ctx)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			c.deadlineMutex.Lock()
+			c.handshakeCanceled = true
+			c.conn.SetDeadline(time.Now())
+			c.deadlineMutex.Unlock()
+		case <-done:
+		}
+	}()
+
+	err := c.handshake(ctx)
+	close(done)
+	<-stopped
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		c.deadlineMutex.Lock()
+		c.handshakeCanceled = false
+		c.conn.SetReadDeadline(c.readDeadline)
+		c.conn.SetWriteDeadline(c.writeDeadline)
+		c.deadlineMutex.Unlock()
+
+		if isTimeout(err) {
+			c.handshakeErr = ctxErr
+			return ctxErr
+		}
+	}
+	return err
+}
+
+// handshake runs the handshake.  A server that has to wait for a slot under
+// Config.MaxConcurrentHandshakes gives up waiting when ctx is done.
+// c.handshakeMutex <= L.
+func (c *Conn) handshake(ctx context.Context) error {
 	if err := c.handshakeErr; err != nil {
 		return err
 	}
@@ -288,96 +1380,635 @@ func (c *Conn) Handshake() error {
 		return nil
 	}
 
+	defer c.startTimer(&c.state.HandshakeTimings.Total)()
 	if c.isClient {
+		if !c.config.validForClient() {
+			return fmt.Errorf("tls.client: Invalid configuration")
+		}
 		c.handshakeErr = c.clientHandshake()
 	} else {
+		if !c.config.validForServer() {
+			return fmt.Errorf("tls.server: Invalid configuration")
+		}
+		if c.handshakeSlots != nil {
+			select {
+			case c.handshakeSlots <- struct{}{}:
+			case <-ctx.Done():
+				c.handshakeErr = ctx.Err()
+				return c.handshakeErr
+			}
+			defer func() { <-c.handshakeSlots }()
+		}
 		c.handshakeErr = c.serverHandshake()
 	}
+
+	// A bare alert means that the handshake failed on something the peer
+	// sent, and that we have not yet told the peer
+	if a, ok := c.handshakeErr.(alert); ok {
+		c.handshakeErr = c.sendAlert(a)
+	}
 	c.handshakeComplete = (c.handshakeErr == nil)
+	c.state.HandshakeComplete = c.handshakeComplete
+	if c.handshakeComplete {
+		c.closeMutex.Lock()
+		c.sendCloseNotify = true
+		c.closeMutex.Unlock()
+	}
 	return c.handshakeErr
 }
 
-func (c *Conn) clientHandshake() error {
-	hIn := newHandshakeLayer(c.in)
-	hOut := newHandshakeLayer(c.out)
-
-	// XXX Config
-	config := struct {
-		serverName   string
-		authCallback func(chain []*x509.Certificate) error
-	}{
-		serverName:   "example.com",
-		authCallback: func(chain []*x509.Certificate) error { return nil },
+// RequestClientCertificate asks the client for a certificate after the
+// handshake, using a post-handshake CertificateRequest.  This is only allowed
+// on the server side, and only if the client offered post-handshake
+// authentication.
+//
+// The returned context identifies the request.  The client's response is
+// read by Read, after which it can be retrieved with ClientCertificate.
+func (c *Conn) RequestClientCertificate() ([]byte, error) {
+	if err := c.Handshake(); err != nil {
+		return nil, err
 	}
-
-	// Construct some extensions
-	privateKeys := map[namedGroup][]byte{}
-	ks := keyShareExtension{
-		roleIsServer: false,
-		shares:       make([]keyShare, len(supportedGroups)),
+	if c.isClient {
+		return nil, fmt.Errorf("tls.client: Only a server can request a client certificate")
 	}
-	for i, group := range supportedGroups {
-		pub, priv, err := newKeyShare(group)
-		if err != nil {
-			return err
+	if !c.postHandshakeAuth {
+		return nil, fmt.Errorf("tls.server: Client did not offer post-handshake authentication")
+	}
+
+	c.certRequestMutex.Lock()
+	defer c.certRequestMutex.Unlock()
+
+	// The context must be unique among outstanding requests, so that the
+	// client's responses can be told apart
+	cr := &certificateRequestBody{certificateRequestContext: make([]byte, 8)}
+	for {
+		_, err := io.ReadFull(c.config.draw("certificate request context"), cr.certificateRequestContext)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := c.certRequests[string(cr.certificateRequestContext)]; !dup {
+			break
+		}
+	}
+	err := cr.extensions.Add(&signatureAlgorithmsExtension{algorithms: signatureAlgorithms})
+	if err != nil {
+		return nil, err
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+	crm, err := newHandshakeLayer(c.out).WriteMessageBody(cr)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.certRequests == nil {
+		c.certRequests = map[string]*handshakeMessage{}
+	}
+	c.certRequests[string(cr.certificateRequestContext)] = crm
+	return cr.certificateRequestContext, nil
+}
+
+// ClientCertificate returns the certificate chain that the client sent in
+// response to the post-handshake CertificateRequest with the given context.
+// The second return value is false until the complete response has been
+// read.
+func (c *Conn) ClientCertificate(requestContext []byte) ([]*x509.Certificate, bool) {
+	c.certRequestMutex.Lock()
+	defer c.certRequestMutex.Unlock()
+
+	chain, ok := c.certResponses[string(requestContext)]
+	return chain, ok
+}
+
+// readPostHandshakeMessages processes the handshake messages that arrive
+// after the handshake.  Messages can span records, so incomplete messages are
+// kept until the rest arrives.
+// c.in.Mutex <= L.
+func (c *Conn) readPostHandshakeMessages(fragment []byte) error {
+	c.postHandshakeBuffer = append(c.postHandshakeBuffer, fragment...)
+	for len(c.postHandshakeBuffer) >= handshakeHeaderLen {
+		data := c.postHandshakeBuffer
+		msgLen := (int(data[1]) << 16) + (int(data[2]) << 8) + int(data[3])
+		if len(data) < handshakeHeaderLen+msgLen {
+			return nil
+		}
+
+		hm := &handshakeMessage{
+			msgType: handshakeType(data[0]),
+			body:    append([]byte{}, data[handshakeHeaderLen:handshakeHeaderLen+msgLen]...),
+		}
+		c.postHandshakeBuffer = data[handshakeHeaderLen+msgLen:]
+
+		var err error
+		switch {
+		case hm.msgType == handshakeTypeCertificateRequest && c.isClient:
+			err = c.answerCertificateRequest(hm)
+		case hm.msgType == handshakeTypeCertificate && !c.isClient:
+			err = c.readCertificateResponse(hm)
+		case hm.msgType == handshakeTypeCertificateVerify && !c.isClient:
+			err = c.readCertificateResponseVerify(hm)
+		case hm.msgType == handshakeTypeFinished && !c.isClient:
+			err = c.readCertificateResponseFinished(hm)
+		case hm.msgType == handshakeTypeSessionTicket && c.isClient:
+			err = c.readNewSessionTicket(hm)
+		case hm.msgType == handshakeTypeCertificateRequest,
+			hm.msgType == handshakeTypeCertificate,
+			hm.msgType == handshakeTypeCertificateVerify,
+			hm.msgType == handshakeTypeFinished,
+			hm.msgType == handshakeTypeSessionTicket:
+			logf(logTypeHandshake, "Unexpected post-handshake message [%d]", hm.msgType)
+			err = alertUnexpectedMessage
+		default:
+			// TODO: Handle other post-handshake handshake messages
+			logf(logTypeHandshake, "Ignoring post-handshake message [%d]", hm.msgType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// answerCertificateRequest responds to a post-handshake CertificateRequest,
+// echoing its context, in the same way as during the handshake.
+func (c *Conn) answerCertificateRequest(crm *handshakeMessage) error {
+	if !c.config.PostHandshakeAuth {
+		logf(logTypeHandshake, "CertificateRequest without post-handshake auth")
+		return alertUnexpectedMessage
+	}
+
+	cr := new(certificateRequestBody)
+	_, err := cr.Unmarshal(crm.body)
+	if err != nil {
+		logf(logTypeHandshake, "Error processing CertificateRequest: %v", err)
+		return alertDecodeError
+	}
+
+	// The transcript runs through our Finished from the handshake
+	cfinm, err := handshakeMessageFromBody(c.context.clientFinished)
+	if err != nil {
+		return err
+	}
+	transcript := append(append([]*handshakeMessage{}, c.context.transcript...), cfinm, crm)
+	certMessages, err := c.clientCertificateMessages(cr, transcript)
+	if err != nil {
+		return err
+	}
+
+	verifyData := c.context.postHandshakeFinishedData(append([]*handshakeMessage{crm}, certMessages...)...)
+	finm, err := handshakeMessageFromBody(&finishedBody{
+		verifyDataLen: len(verifyData),
+		verifyData:    verifyData,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+	return newHandshakeLayer(c.out).WriteMessages(append(certMessages, finm))
+}
+
+// readCertificateResponse matches the client's Certificate to an outstanding
+// request by its context.  The response is complete once the CertificateVerify
+// (unless the chain is empty) and the Finished that follow it have been
+// verified.
+func (c *Conn) readCertificateResponse(certm *handshakeMessage) error {
+	if c.pendingCertResponse != nil {
+		logf(logTypeHandshake, "Certificate while another response is incomplete")
+		return alertUnexpectedMessage
+	}
+
+	cert := new(certificateBody)
+	_, err := cert.Unmarshal(certm.body)
+	if err != nil {
+		logf(logTypeHandshake, "Error processing Certificate: %v", err)
+		return alertDecodeError
+	}
+
+	c.certRequestMutex.Lock()
+	crm, ok := c.certRequests[string(cert.certificateRequestContext)]
+	c.certRequestMutex.Unlock()
+	if !ok {
+		logf(logTypeHandshake, "Certificate for an unknown request context [%x]", cert.certificateRequestContext)
+		return alertIllegalParameter
+	}
+
+	c.pendingCertRequest = crm
+	c.pendingCertResponse = cert
+	c.pendingCertMessage = certm
+	return nil
+}
+
+func (c *Conn) readCertificateResponseVerify(certvm *handshakeMessage) error {
+	if c.pendingCertResponse == nil || len(c.pendingCertResponse.certificateList) == 0 || c.pendingCertVerify != nil {
+		logf(logTypeHandshake, "CertificateVerify without a client certificate")
+		return alertUnexpectedMessage
+	}
+
+	cfinm, err := handshakeMessageFromBody(c.context.clientFinished)
+	if err != nil {
+		return err
+	}
+	transcript := append(append([]*handshakeMessage{}, c.context.transcript...), cfinm, c.pendingCertRequest, c.pendingCertMessage)
+	_, err = c.verifyClientCertificate(c.pendingCertResponse.certificateList, certvm, transcript)
+	if err != nil {
+		return err
+	}
+	err = c.config.verifyClientCertificateChain(c.pendingCertResponse.certificateList)
+	if err != nil {
+		logf(logTypeHandshake, "Client certificate rejected: %v", err)
+		return alertBadCertificate
+	}
+
+	c.pendingCertVerify = certvm
+	return nil
+}
+
+func (c *Conn) readCertificateResponseFinished(finm *handshakeMessage) error {
+	if c.pendingCertResponse == nil {
+		logf(logTypeHandshake, "Finished without a certificate response")
+		return alertUnexpectedMessage
+	}
+
+	responseMessages := []*handshakeMessage{c.pendingCertRequest, c.pendingCertMessage}
+	if len(c.pendingCertResponse.certificateList) > 0 {
+		if c.pendingCertVerify == nil {
+			logf(logTypeHandshake, "Finished without a CertificateVerify")
+			return alertUnexpectedMessage
+		}
+		responseMessages = append(responseMessages, c.pendingCertVerify)
+	}
+	verifyData := c.context.postHandshakeFinishedData(responseMessages...)
+	fin := &finishedBody{verifyDataLen: len(verifyData)}
+	_, err := fin.Unmarshal(finm.body)
+	if err != nil {
+		logf(logTypeHandshake, "Error processing Finished: %v", err)
+		return alertDecodeError
+	}
+	if !hmac.Equal(fin.verifyData, verifyData) {
+		logf(logTypeHandshake, "Client's post-handshake Finished failed to verify")
+		return alertDecryptError
+	}
+
+	requestContext := string(c.pendingCertResponse.certificateRequestContext)
+	c.certRequestMutex.Lock()
+	delete(c.certRequests, requestContext)
+	if c.certResponses == nil {
+		c.certResponses = map[string][]*x509.Certificate{}
+	}
+	c.certResponses[requestContext] = c.pendingCertResponse.certificateList
+	c.certRequestMutex.Unlock()
+
+	c.pendingCertRequest = nil
+	c.pendingCertResponse = nil
+	c.pendingCertMessage = nil
+	c.pendingCertVerify = nil
+	return nil
+}
+
+// ConnectionState returns basic TLS details about the connection.  Until the
+// handshake has completed, it returns a zero value.
+func (c *Conn) ConnectionState() ConnectionState {
+	c.handshakeMutex.Lock()
+	defer c.unlockHandshake()
+
+	if !c.handshakeComplete {
+		return ConnectionState{}
+	}
+	return c.state
+}
+
+// HandshakeMessages returns the handshake messages exchanged on this
+// connection, in order, each with its four-byte handshake header.  These are
+// the messages covered by the handshake transcript, from ClientHello through
+// the client's Finished.  Messages are only kept if the connection was
+// configured with ExportHandshakeMessages; otherwise this returns nil.
+func (c *Conn) HandshakeMessages() [][]byte {
+	c.handshakeMutex.Lock()
+	defer c.unlockHandshake()
+
+	if !c.handshakeComplete || c.handshakeMessages == nil {
+		return nil
+	}
+
+	messages := make([][]byte, len(c.handshakeMessages))
+	for i, msg := range c.handshakeMessages {
+		messages[i] = append([]byte{}, msg...)
+	}
+	return messages
+}
+
+// ExporterSecret returns the exporter_master_secret of the connection (RFC
+// 8446, Section 7.5), for callers that need to run their own expansion
+// instead of the standard exporter construction.  It is only available if
+// the connection was configured with ExportExporterSecret.
+//
+// The secret is as sensitive as the traffic keys: with it, anyone can
+// compute the keying material that the two sides export, e.g., to bind
+// credentials to the connection.  Callers should expand it with a label
+// that no other protocol uses, and zero their copy once they are done.
+func (c *Conn) ExporterSecret() ([]byte, error) {
+	c.handshakeMutex.Lock()
+	defer c.unlockHandshake()
+
+	if !c.config.ExportExporterSecret {
+		return nil, fmt.Errorf("tls: ExportExporterSecret is not set in Config")
+	}
+	if !c.handshakeComplete {
+		return nil, fmt.Errorf("tls: Handshake is not complete")
+	}
+	return append([]byte{}, c.context.exporterSecret...), nil
+}
+
+// exportHandshakeMessages records the complete transcript of a finished
+// handshake, if the configuration asks for it.
+func (c *Conn) exportHandshakeMessages(clientFinished *handshakeMessage) {
+	if !c.config.ExportHandshakeMessages {
+		return
+	}
+
+	c.handshakeMessages = make([][]byte, 0, len(c.context.transcript)+1)
+	for _, msg := range append(c.context.transcript, clientFinished) {
+		c.handshakeMessages = append(c.handshakeMessages, msg.Marshal())
+	}
+}
+
+func (c *Conn) clientHandshake() error {
+	hIn, hOut := c.handshakeLayers()
+
+	// Construct some extensions
+	privateKeys := map[namedGroup][]byte{}
+	keyShareGroups := c.config.keyShareGroups()
+	ks := keyShareExtension{
+		roleIsServer: false,
+		shares:       make([]keyShare, len(keyShareGroups)),
+	}
+	stopTimer := c.startTimer(&c.state.HandshakeTimings.KeyShareGeneration)
+	for i, group := range keyShareGroups {
+		pub, priv, err := newKeyShare(group, c.config.draw("client key share"))
+		if err != nil {
+			return err
 		}
 
 		ks.shares[i].group = group
 		ks.shares[i].keyExchange = pub
 		privateKeys[group] = priv
 	}
-	sni := serverNameExtension(config.serverName)
-	sg := supportedGroupsExtension{groups: supportedGroups}
+	stopTimer()
+	sni := serverNameExtension(c.config.ServerName)
+	c.state.ServerName = c.config.ServerName
+	sv := supportedVersionsExtension{versions: []uint16{c.version()}}
+	sg := supportedGroupsExtension{groups: c.config.groups()}
 	sa := signatureAlgorithmsExtension{algorithms: signatureAlgorithms}
 	dv := draftVersionExtension{version: draftVersionImplemented}
 
 	// Construct and write ClientHello
 	ch := &clientHelloBody{
-		cipherSuites: supportedCipherSuites,
+		cipherSuites: c.config.cipherSuites(),
+	}
+	_, err := io.ReadFull(c.config.draw("client random"), ch.random[:])
+	if err != nil {
+		return err
 	}
-	for _, ext := range []extensionBody{&sni, &ks, &sg, &sa, &dv} {
+	for _, ext := range []extensionBody{&sni, &sv, &ks, &sg, &sa, &dv} {
 		err := ch.extensions.Add(ext)
 		if err != nil {
 			return err
 		}
 	}
+	if c.config.RecordSizeLimit != 0 {
+		err = ch.extensions.Add(&recordSizeLimitExtension{limit: c.config.RecordSizeLimit})
+		if err != nil {
+			return err
+		}
+	}
+	if c.config.PostHandshakeAuth {
+		err = ch.extensions.Add(&postHandshakeAuthExtension{})
+		if err != nil {
+			return err
+		}
+	}
+	if len(c.config.NextProtos) > 0 {
+		err = ch.extensions.Add(&alpnExtension{protocols: c.config.NextProtos})
+		if err != nil {
+			return err
+		}
+	}
+	alpsProtocols := []string{}
+	for _, protocol := range c.config.NextProtos {
+		if _, ok := c.config.ApplicationSettings[protocol]; ok {
+			alpsProtocols = append(alpsProtocols, protocol)
+		}
+	}
+	if len(alpsProtocols) > 0 {
+		err = ch.extensions.Add(&applicationSettingsExtension{inClientHello: true, protocols: alpsProtocols})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Ask for session tickets, and offer one if we have it, with our early
+	// data if the session allows that much.  The pre_shared_key extension
+	// has to come last.
+	session := c.resumableSession()
+	sendingEarlyData := session != nil && len(c.earlyData) > 0 && !c.datagram &&
+		uint64(len(c.earlyData)) <= uint64(session.session.maxEarlyData)
+	if c.config.ClientSessionCache != nil && !c.config.SessionTicketsDisabled {
+		err = ch.extensions.Add(&pskKeyExchangeModesExtension{modes: []pskKeyExchangeMode{pskModeDHEKE}})
+		if err != nil {
+			return err
+		}
+		if sendingEarlyData {
+			err = ch.extensions.Add(&earlyDataExtension{})
+			if err != nil {
+				return err
+			}
+		}
+		err = offerSession(ch, session, nil)
+		if err != nil {
+			return err
+		}
+	}
 	chm, err := hOut.WriteMessageBody(ch)
 	if err != nil {
 		return err
 	}
 	logf(logTypeHandshake, "Sent ClientHello")
 
-	// Read ServerHello
-	sh := new(serverHelloBody)
-	shm, err := hIn.ReadMessageBody(sh)
-	if err != nil {
-		logf(logTypeHandshake, "Error reading ServerHello")
-		return err
+	var earlyOut *recordLayer
+	if sendingEarlyData {
+		earlyOut, err = c.sendEarlyData(session, chm)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Read ServerHello.  If it is a HelloRetryRequest, send the ClientHello
+	// again with a key share in the group that the server selected.
+	var shm, firstClientHello, helloRetryRequest *handshakeMessage
+	var sh, hrr *serverHelloBody
+	for {
+		shm, err = hIn.ReadMessage()
+		if err != nil {
+			logf(logTypeHandshake, "Error reading ServerHello")
+			return err
+		}
+		if shm.msgType != handshakeTypeServerHello {
+			logf(logTypeHandshake, "Expected ServerHello, got message type %v", shm.msgType)
+			return c.sendAlert(alertUnexpectedMessage)
+		}
+		sh = new(serverHelloBody)
+		read, err := sh.Unmarshal(shm.body)
+		if err != nil || read < len(shm.body) {
+			logf(logTypeHandshake, "Error processing ServerHello: %v", err)
+			return c.sendAlert(alertDecodeError)
+		}
+		logf(logTypeHandshake, "Received ServerHello")
+		c.state.HandshakeRoundTrips++
+
+		// The server selects the version in supported_versions.  Without it,
+		// the server is negotiating an earlier version, which we don't
+		// support.
+		serverVersion := supportedVersionsExtension{roleIsServer: true}
+		if !sh.extensions.Find(&serverVersion) {
+			logf(logTypeHandshake, "ServerHello did not carry supported_versions")
+			return c.sendAlert(alertIllegalParameter)
+		}
+		if serverVersion.versions[0] != c.version() {
+			logf(logTypeHandshake, "Server selected a version we didn't offer [%04x]", serverVersion.versions[0])
+			return c.sendAlert(alertIllegalParameter)
+		}
+
+		offeredSuite := false
+		for _, suite := range ch.cipherSuites {
+			if suite == sh.cipherSuite {
+				offeredSuite = true
+				break
+			}
+		}
+		if !offeredSuite {
+			logf(logTypeHandshake, "Server selected a cipher suite we didn't offer [%04x]", sh.cipherSuite)
+			return c.sendAlert(alertIllegalParameter)
+		}
+		if hrr != nil && sh.cipherSuite != hrr.cipherSuite {
+			logf(logTypeHandshake, "Server changed its cipher suite after HelloRetryRequest [%04x]", sh.cipherSuite)
+			return c.sendAlert(alertIllegalParameter)
+		}
+
+		if sh.random != helloRetryRequestRandom {
+			break
+		}
+		if hrr != nil {
+			logf(logTypeHandshake, "Second HelloRetryRequest")
+			return c.sendAlert(alertUnexpectedMessage)
+		}
+		hrr, firstClientHello, helloRetryRequest = sh, chm, shm
+		err = c.answerHelloRetryRequest(ch, hrr, privateKeys)
+		if err != nil {
+			return err
+		}
+
+		// Early data can't be accepted after a HelloRetryRequest, so it is
+		// sent again after the handshake
+		if earlyOut != nil {
+			extensions := extensionList{}
+			for _, ext := range ch.extensions {
+				if ext.extensionType != extensionTypeEarlyData {
+					extensions = append(extensions, ext)
+				}
+			}
+			ch.extensions = extensions
+			earlyOut = nil
+		}
+
+		// The binder now also covers the first ClientHello and the
+		// HelloRetryRequest, under the hash of the suite that the server
+		// selected.  A session with another hash can't be resumed.
+		if session != nil {
+			if cipherSuiteMap[session.session.cipherSuite].hash != cipherSuiteMap[hrr.cipherSuite].hash {
+				session = nil
+			}
+			retry := &cryptoContext{
+				params:            cipherSuiteMap[hrr.cipherSuite],
+				firstClientHello:  firstClientHello,
+				helloRetryRequest: helloRetryRequest,
+			}
+			err = offerSession(ch, session, retry.retryTranscript())
+			if err != nil {
+				return err
+			}
+		}
+		chm, err = hOut.WriteMessageBody(ch)
+		if err != nil {
+			return err
+		}
+	}
+
+	// We only offer TLS 1.3, so a downgrade sentinel means that someone is
+	// trying to push the connection to an earlier version
+	serverRandomTail := sh.random[len(sh.random)-len(downgradeSentinelTLS12):]
+	if bytes.Equal(serverRandomTail, downgradeSentinelTLS12) || bytes.Equal(serverRandomTail, downgradeSentinelTLS11) {
+		logf(logTypeHandshake, "ServerHello random carries a downgrade sentinel")
+		return c.sendAlert(alertIllegalParameter)
 	}
-	logf(logTypeHandshake, "Received ServerHello")
+	c.state.ClientRandom = ch.random
+	c.state.ServerRandom = sh.random
 
 	// Read the key_share extension and do key agreement
 	serverKeyShares := keyShareExtension{roleIsServer: true}
 	found := sh.extensions.Find(&serverKeyShares)
-	if !found {
+	if !found || len(serverKeyShares.shares) == 0 {
 		logf(logTypeHandshake, "Server key shares extension not found")
-		return err
+		return c.sendAlert(alertMissingExtension)
 	}
 	sks := serverKeyShares.shares[0]
 	priv, ok := privateKeys[sks.group]
 	if !ok {
-		return fmt.Errorf("tls.client: Server sent a private key for a group we didn't send")
+		// The server must use one of our shares
+		logf(logTypeHandshake, "Server sent a key share for a group we didn't send [%04x]", sks.group)
+		return c.sendAlert(alertIllegalParameter)
 	}
 	ES, err := keyAgreement(sks.group, sks.keyExchange, priv)
 	if err != nil {
-		logf(logTypeHandshake, "Error doing key agreement")
-		return err
+		logf(logTypeHandshake, "Error doing key agreement: %v", err)
+		return c.sendAlert(alertIllegalParameter)
 	}
 	logf(logTypeHandshake, "Completed key agreement")
 
+	// If the server accepted our session, it has to be one we offered for
+	// the suite it selected
+	var psk []byte
+	serverPSK := &preSharedKeyExtension{roleIsServer: true}
+	gotPSK, err := sh.extensions.Parse(serverPSK)
+	if gotPSK {
+		if err != nil {
+			logf(logTypeHandshake, "Error processing pre_shared_key: %v", err)
+			return c.sendAlert(alertDecodeError)
+		}
+		if session == nil || serverPSK.selectedIdentity != 0 ||
+			cipherSuiteMap[session.session.cipherSuite].hash != cipherSuiteMap[sh.cipherSuite].hash {
+			logf(logTypeHandshake, "Server selected a PSK we didn't offer [%d]", serverPSK.selectedIdentity)
+			return c.sendAlert(alertIllegalParameter)
+		}
+		psk = session.session.psk
+	}
+
 	// Init crypto context and rekey
-	ctx := cryptoContext{}
-	ctx.Init(chm, shm, ES, ES, sh.cipherSuite)
+	ctx := cryptoContext{
+		newTranscriptHash: c.config.NewTranscriptHash,
+		firstClientHello:  firstClientHello,
+		helloRetryRequest: helloRetryRequest,
+	}
+	err = ctx.Init(chm, shm, psk, ES, sh.cipherSuite)
+	if err != nil {
+		return err
+	}
+	c.state.Version = c.version()
+	c.state.CipherSuite = sh.cipherSuite
+	c.state.NamedGroup = sks.group
+	c.state.DidResume = psk != nil
 	err = c.in.Rekey(ctx.suite, ctx.handshakeKeys.serverWriteKey, ctx.handshakeKeys.serverWriteIV)
 	if err != nil {
 		logf(logTypeHandshake, "Unable to rekey inbound")
@@ -390,10 +2021,111 @@ func (c *Conn) clientHandshake() error {
 	}
 	logf(logTypeHandshake, "Completed rekey")
 
+	// Read EncryptedExtensions, which must immediately follow ServerHello,
+	// even if it is empty
+	eem, err := hIn.ReadMessage()
+	if err != nil {
+		logf(logTypeHandshake, "Error reading EncryptedExtensions: %v", err)
+		return err
+	}
+	if eem.msgType != handshakeTypeEncryptedExtensions {
+		logf(logTypeHandshake, "Expected EncryptedExtensions, got message type %v", eem.msgType)
+		return c.sendAlert(alertUnexpectedMessage)
+	}
+	ee := new(encryptedExtensionsBody)
+	_, err = ee.Unmarshal(eem.body)
+	if err != nil {
+		logf(logTypeHandshake, "Error processing EncryptedExtensions: %v", err)
+		return c.sendAlert(alertDecodeError)
+	}
+
+	// The server can only answer extensions that we offered, and only those
+	// that belong in EncryptedExtensions
+	for _, ext := range *ee {
+		if !encryptedExtensionTypes[ext.extensionType] {
+			logf(logTypeHandshake, "Extension not allowed in EncryptedExtensions [%04x]", ext.extensionType)
+			return c.sendAlert(alertIllegalParameter)
+		}
+		if !ch.extensions.Contains(ext.extensionType) {
+			logf(logTypeHandshake, "Server sent an extension we didn't offer [%04x]", ext.extensionType)
+			return c.sendAlert(alertUnsupportedExtension)
+		}
+	}
+
+	// The server may select one of the protocols we offered
+	serverALPN := new(alpnExtension)
+	if extensionList(*ee).Find(serverALPN) {
+		if len(serverALPN.protocols) != 1 {
+			logf(logTypeHandshake, "Server selected %d protocols", len(serverALPN.protocols))
+			return c.sendAlert(alertIllegalParameter)
+		}
+		offered := false
+		for _, protocol := range c.config.NextProtos {
+			if protocol == serverALPN.protocols[0] {
+				offered = true
+				break
+			}
+		}
+		if !offered {
+			logf(logTypeHandshake, "Server selected a protocol we didn't offer [%s]", serverALPN.protocols[0])
+			return c.sendAlert(alertIllegalParameter)
+		}
+		c.state.NegotiatedProtocol = serverALPN.protocols[0]
+	}
+
+	// If the server sent ALPS settings, they must be for a negotiated protocol
+	// that we offered ALPS for, and we answer with our own
+	serverALPS := new(applicationSettingsExtension)
+	usingALPS := extensionList(*ee).Find(serverALPS)
+	if usingALPS {
+		offered := false
+		for _, protocol := range alpsProtocols {
+			if protocol == c.state.NegotiatedProtocol {
+				offered = true
+				break
+			}
+		}
+		if !offered {
+			logf(logTypeHandshake, "Server sent ALPS settings for a protocol we didn't offer [%s]", c.state.NegotiatedProtocol)
+			return c.sendAlert(alertIllegalParameter)
+		}
+		c.state.PeerApplicationSettings = serverALPS.settings
+	}
+
+	// The server only sends a record_size_limit in reply to ours
+	serverLimit := new(recordSizeLimitExtension)
+	gotLimit, err := extensionList(*ee).Parse(serverLimit)
+	if gotLimit {
+		if err != nil || c.config.RecordSizeLimit == 0 {
+			logf(logTypeHandshake, "Invalid or unsolicited record_size_limit from the server: %v", err)
+			return c.sendAlert(alertIllegalParameter)
+		}
+		c.setPeerRecordSizeLimit(serverLimit.limit)
+	}
+
+	// If the server accepted our early data, the handshake has to carry on
+	// with the session that it was sent under
+	if extensionList(*ee).Find(&earlyDataExtension{}) {
+		if earlyOut == nil {
+			logf(logTypeHandshake, "Server accepted early data that we didn't send")
+			return c.sendAlert(alertUnsupportedExtension)
+		}
+		if !c.state.DidResume || sh.cipherSuite != session.session.cipherSuite {
+			logf(logTypeHandshake, "Server accepted early data without resuming its session")
+			return c.sendAlert(alertIllegalParameter)
+		}
+		if c.state.NegotiatedProtocol != session.session.alpn {
+			logf(logTypeHandshake, "Server changed the protocol from the early data [%s]", c.state.NegotiatedProtocol)
+			return c.sendAlert(alertIllegalParameter)
+		}
+		c.state.EarlyDataAccepted = true
+	}
+
 	// Read to Finished
-	transcript := []*handshakeMessage{}
+	transcript := []*handshakeMessage{eem}
 	var cert *certificateBody
 	var certVerify *certificateVerifyBody
+	var certRequest *certificateRequestBody
 	var finishedMessage *handshakeMessage
 	for {
 		hm, err := hIn.ReadMessage()
@@ -410,102 +2142,491 @@ func (c *Conn) clientHandshake() error {
 			if hm.msgType == handshakeTypeCertificate {
 				cert = new(certificateBody)
 				_, err = cert.Unmarshal(hm.body)
+				// Unlike a client, a server can't send an empty Certificate
+				// (RFC 8446, Section 4.4.2.4)
+				if err == nil && len(cert.certificateList) == 0 {
+					logf(logTypeHandshake, "Server sent an empty Certificate")
+					return c.sendAlert(alertDecodeError)
+				}
+				if err == nil && len(cert.certificateList) > c.config.maxCertificateChainLength() {
+					logf(logTypeHandshake, "Server certificate chain too long [%d]", len(cert.certificateList))
+					return c.sendAlert(alertBadCertificate)
+				}
+				if err == nil {
+					err = checkCertificateSignatureAlgorithms(cert.certificateList, signatureAlgorithms)
+					if err != nil {
+						logf(logTypeHandshake, "Error checking server certificate chain: %v", err)
+						return c.sendAlert(alertBadCertificate)
+					}
+				}
+				// XXX: The Certificate message has no room for a stapled OCSP
+				// response in this version of the protocol, so a requirement
+				// for one can never be met.
+				if err == nil &&
+					(c.config.RequireStapling || requiresStapling(cert.certificateList[0])) {
+					logf(logTypeHandshake, "Server certificate requires a stapled OCSP response")
+					return c.sendAlert(alertBadCertStatusResponse)
+				}
+				if err == nil &&
+					!c.config.acceptsCertKeyType(cert.certificateList[0].PublicKeyAlgorithm) {
+					logf(logTypeHandshake, "Server certificate key type not acceptable [%v]", cert.certificateList[0].PublicKeyAlgorithm)
+					return c.sendAlert(alertUnsupportedCertificate)
+				}
 			} else if hm.msgType == handshakeTypeCertificateVerify {
 				certVerify = new(certificateVerifyBody)
 				_, err = certVerify.Unmarshal(hm.body)
+			} else if hm.msgType == handshakeTypeCertificateRequest {
+				certRequest = new(certificateRequestBody)
+				_, err = certRequest.Unmarshal(hm.body)
+				// Only a post-handshake CertificateRequest has a context
+				if err == nil && len(certRequest.certificateRequestContext) > 0 {
+					logf(logTypeHandshake, "Server sent a CertificateRequest with a context [%x]", certRequest.certificateRequestContext)
+					return c.sendAlert(alertIllegalParameter)
+				}
 			}
 			transcript = append(transcript, hm)
 		}
 
-		if err != nil {
-			logf(logTypeHandshake, "Error processing handshake message: %v", err)
-			return err
+		if err != nil {
+			logf(logTypeHandshake, "Error processing handshake message: %v", err)
+			return err
+		}
+	}
+	logf(logTypeHandshake, "Done reading server's first flight")
+
+	// Verify the server's certificate if required.  A resumed session was
+	// authenticated by the handshake that issued the ticket, but a
+	// certificate that the server sends anyway is still checked.
+	resumedWithoutCertificate := c.state.DidResume && cert == nil && certVerify == nil
+	if !resumedWithoutCertificate {
+		if cert == nil || certVerify == nil {
+			logf(logTypeHandshake, "Server did not send Certificate and CertificateVerify")
+			return c.sendAlert(alertUnexpectedMessage)
+		}
+
+		transcriptForCertVerify := append(ctx.retryTranscript(), chm, shm)
+		transcriptForCertVerify = append(transcriptForCertVerify, transcript[:len(transcript)-1]...)
+		logf(logTypeHandshake, "Transcript for certVerify")
+		for _, hm := range transcriptForCertVerify {
+			logf(logTypeHandshake, "  [%d] %x", hm.msgType, hm.body)
+		}
+		logf(logTypeHandshake, "===")
+
+		// The signature scheme has to match the kind of key in the
+		// certificate, not just the key itself
+		serverPublicKey, pssKey, err := certificatePublicKey(cert.certificateList[0])
+		if err != nil {
+			logf(logTypeHandshake, "Error reading server public key: %v", err)
+			return c.sendAlert(alertBadCertificate)
+		}
+		if _, ok := serverPublicKey.(*rsa.PublicKey); ok && !usableWithRSAKey(certVerify.alg, pssKey) {
+			logf(logTypeHandshake, "Server signature scheme doesn't match its key [%04x]", certVerify.alg.scheme())
+			return c.sendAlert(alertIllegalParameter)
+		}
+
+		stopTimer = c.startTimer(&c.state.HandshakeTimings.Verification)
+		err = certVerify.Verify(serverPublicKey, transcriptForCertVerify, contextServerCertificateVerify)
+		stopTimer()
+		if err != nil {
+			logf(logTypeHandshake, "Server's CertificateVerify failed to verify: %v", err)
+			return c.sendAlert(alertDecryptError)
+		}
+		c.state.PeerSignatureScheme = certVerify.alg.scheme()
+		c.state.PeerCertificates = cert.certificateList
+		c.state.PeerPublicKeyInfo = cert.certificateList[0].RawSubjectPublicKeyInfo
+		c.state.PeerPublicKeySHA256 = sha256.Sum256(c.state.PeerPublicKeyInfo)
+
+		// The certificate has to be for the server we meant to reach, and
+		// issued by a root we trust, before the application gets to look at
+		// it
+		var verifiedChains [][]*x509.Certificate
+		if !c.config.InsecureSkipVerify {
+			var al alert
+			verifiedChains, al, err = c.config.verifyServerCertificate(cert.certificateList)
+			if err != nil {
+				logf(logTypeHandshake, "Server certificate rejected: %v", err)
+				c.sendAlert(al)
+				return err
+			}
+		}
+		if c.config.VerifyPeerCertificate != nil {
+			if err = c.config.VerifyPeerCertificate(rawCertificates(cert.certificateList), verifiedChains); err != nil {
+				logf(logTypeHandshake, "Server certificate rejected by the application: %v", err)
+				c.sendAlert(alertBadCertificate)
+				return err
+			}
+		}
+	}
+
+	// Update the crypto context with all but the Finished
+	ctx.Update(transcript)
+
+	// Verify server finished
+	sfin := new(finishedBody)
+	sfin.verifyDataLen = ctx.serverFinished.verifyDataLen
+	_, err = sfin.Unmarshal(finishedMessage.body)
+	if err != nil {
+		logf(logTypeHandshake, "Error processing server Finished: %v", err)
+		return c.sendAlert(alertDecodeError)
+	}
+	if !bytes.Equal(sfin.verifyData, ctx.serverFinished.verifyData) {
+		logf(logTypeHandshake, "Server's Finished failed to verify")
+		return c.sendAlert(alertDecryptError)
+	}
+	if err = c.checkTranscript(&ctx); err != nil {
+		return c.sendAlert(alertInternalError)
+	}
+
+	// End our early data, under its own keys, before the rest of our flight
+	if c.state.EarlyDataAccepted {
+		eoedm, err := handshakeMessageFromBody(&endOfEarlyDataBody{})
+		if err != nil {
+			return err
+		}
+		eoedOut := newHandshakeLayer(earlyOut)
+		eoedOut.exchanged = hOut.exchanged
+		err = eoedOut.WriteMessage(eoedm)
+		if err != nil {
+			return err
+		}
+		earlyOut.Wipe()
+		err = ctx.UpdateClientFinished([]*handshakeMessage{eoedm})
+		if err != nil {
+			return err
+		}
+		c.state.HandshakeRoundTrips = 0
+	}
+
+	// Send ClientEncryptedExtensions if needed, our Certificate and
+	// CertificateVerify if the server asked for them, and client Finished
+	clientFlight := []*handshakeMessage{}
+	if usingALPS {
+		cee := &clientEncryptedExtensionsBody{}
+		err = (*extensionList)(cee).Add(&applicationSettingsExtension{
+			settings: c.config.ApplicationSettings[c.state.NegotiatedProtocol],
+		})
+		if err != nil {
+			return err
+		}
+		ceem, err := handshakeMessageFromBody(cee)
+		if err != nil {
+			return err
+		}
+		err = ctx.UpdateClientFinished([]*handshakeMessage{ceem})
+		if err != nil {
+			return err
+		}
+		clientFlight = append(clientFlight, ceem)
+	}
+	if certRequest != nil {
+		transcript := append([]*handshakeMessage{}, ctx.transcript...)
+		stopTimer = c.startTimer(&c.state.HandshakeTimings.Signing)
+		certMessages, err := c.clientCertificateMessages(certRequest, transcript)
+		stopTimer()
+		if err != nil {
+			return err
+		}
+		if len(certMessages) > 1 {
+			certificateVerify := new(certificateVerifyBody)
+			_, err = certificateVerify.Unmarshal(certMessages[1].body)
+			if err != nil {
+				return err
+			}
+			c.state.LocalSignatureScheme = certificateVerify.alg.scheme()
+		}
+		err = ctx.UpdateClientFinished(certMessages)
+		if err != nil {
+			return err
+		}
+		clientFlight = append(clientFlight, certMessages...)
+	}
+
+	cfinm, err := handshakeMessageFromBody(ctx.clientFinished)
+	if err != nil {
+		return err
+	}
+	err = hOut.WriteMessages(append(clientFlight, cfinm))
+	if err != nil {
+		return err
+	}
+
+	// Rekey to application keys
+	err = c.in.Rekey(ctx.suite, ctx.applicationKeys.serverWriteKey, ctx.applicationKeys.serverWriteIV)
+	if err != nil {
+		return err
+	}
+	err = c.out.Rekey(ctx.suite, ctx.applicationKeys.clientWriteKey, ctx.applicationKeys.clientWriteIV)
+	if err != nil {
+		return err
+	}
+	ctx.handshakeKeys.wipe()
+
+	c.context = ctx
+	c.exportHandshakeMessages(cfinm)
+
+	// Early data that the server didn't accept is sent again now
+	if len(c.earlyData) > 0 && !c.state.EarlyDataAccepted {
+		logf(logTypeHandshake, "Sending %d bytes of early data after the handshake", len(c.earlyData))
+		c.out.Lock()
+		_, err = c.writeApplicationData(c.earlyData)
+		c.out.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	zeroBytes(c.earlyData)
+	c.earlyData = nil
+	return nil
+}
+
+// selectServerCertificate chooses the certificate that the server
+// authenticates with, and the algorithm that it signs with, following
+// Config.Certificates.  On failure, the error is the alert to send.
+func (c *Conn) selectServerCertificate(ch *clientHelloBody, algorithms []signatureAndHashAlgorithm) (*Certificate, signatureAndHashAlgorithm, error) {
+	var certificates []Certificate
+	if c.config.GetCertificate != nil {
+		cert, err := c.config.GetCertificate(ch)
+		if err != nil {
+			logf(logTypeHandshake, "Error getting server certificate: %v", err)
+			return nil, signatureAndHashAlgorithm{}, alertInternalError
+		}
+		if cert != nil {
+			certificates = []Certificate{*cert}
+		}
+	}
+	if certificates == nil {
+		certificates = c.config.Certificates
+	}
+
+	// Without a configured certificate, authenticate with a freshly
+	// generated self-signed one
+	if len(certificates) == 0 {
+		privateKey, _ := newSigningKey(signatureAlgorithmRSA)
+		leaf, _ := newSelfSigned("example.com",
+			signatureAndHashAlgorithm{hashAlgorithmSHA256, signatureAlgorithmRSA}, privateKey)
+		certificates = []Certificate{{Chain: []*x509.Certificate{leaf}, PrivateKey: privateKey}}
+	}
+
+	var fallback *Certificate
+	var fallbackAlg signatureAndHashAlgorithm
+	for i, cert := range certificates {
+		if len(cert.Chain) == 0 || cert.PrivateKey == nil {
+			continue
+		}
+		_, pssKey, err := certificatePublicKey(cert.Chain[0])
+		if err != nil {
+			continue
+		}
+		alg, ok := selectSignatureAlgorithm(cert.PrivateKey, pssKey, algorithms)
+		if !ok {
+			continue
+		}
+		if cert.Chain[0].VerifyHostname(c.state.ServerName) == nil {
+			return &certificates[i], alg, nil
+		}
+		if fallback == nil {
+			fallback, fallbackAlg = &certificates[i], alg
+		}
+	}
+
+	if fallback == nil {
+		logf(logTypeHandshake, "No signature algorithm compatible with the server key")
+		return nil, signatureAndHashAlgorithm{}, alertHandshakeFailure
+	}
+	if c.config.StrictSNI {
+		logf(logTypeHandshake, "No certificate for the requested name [%s]", c.state.ServerName)
+		return nil, signatureAndHashAlgorithm{}, alertUnrecognizedName
+	}
+	return fallback, fallbackAlg, nil
+}
+
+// clientCertificateMessages answers a CertificateRequest with the first of our
+// certificates that can sign with an algorithm the server accepts, and a
+// CertificateVerify over the transcript through it.  If none of them can, the
+// Certificate is empty and there is no CertificateVerify.
+func (c *Conn) clientCertificateMessages(cr *certificateRequestBody, transcript []*handshakeMessage) ([]*handshakeMessage, error) {
+	serverAlgorithms := new(signatureAlgorithmsExtension)
+	if !cr.extensions.Find(serverAlgorithms) {
+		logf(logTypeHandshake, "CertificateRequest without signature_algorithms")
+		return nil, alertMissingExtension
+	}
+
+	var chosen *Certificate
+	var sigAlg signatureAndHashAlgorithm
+	for i, cert := range c.config.Certificates {
+		if len(cert.Chain) == 0 || cert.PrivateKey == nil {
+			continue
+		}
+		_, pssKey, err := certificatePublicKey(cert.Chain[0])
+		if err != nil {
+			continue
+		}
+		alg, ok := selectSignatureAlgorithm(cert.PrivateKey, pssKey, serverAlgorithms.algorithms)
+		if ok {
+			chosen, sigAlg = &c.config.Certificates[i], alg
+			break
+		}
+	}
+
+	certificate := &certificateBody{certificateRequestContext: cr.certificateRequestContext}
+	if chosen == nil {
+		logf(logTypeHandshake, "No certificate for the server's signature algorithms")
+		certm, err := handshakeMessageFromBody(certificate)
+		if err != nil {
+			return nil, err
+		}
+		return []*handshakeMessage{certm}, nil
+	}
+
+	certificate.certificateList = chosen.Chain
+	certm, err := handshakeMessageFromBody(certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	signer := chosen.PrivateKey
+	if c.config.DeterministicSignatures {
+		signer = newDeterministicSigner(signer)
+	}
+	certificateVerify := &certificateVerifyBody{alg: sigAlg}
+	err = certificateVerify.Sign(signer, append(transcript, certm), contextClientCertificateVerify)
+	if err != nil {
+		return nil, err
+	}
+	certvm, err := handshakeMessageFromBody(certificateVerify)
+	if err != nil {
+		return nil, err
+	}
+	return []*handshakeMessage{certm, certvm}, nil
+}
+
+// answerHelloRetryRequest replaces the key shares in the ClientHello with one
+// in the group that the HelloRetryRequest selected, so that it can be sent
+// again.  The rest of the ClientHello is unchanged.
+func (c *Conn) answerHelloRetryRequest(ch *clientHelloBody, hrr *serverHelloBody, privateKeys map[namedGroup][]byte) error {
+	retryShare := keyShareExtension{helloRetry: true}
+	if !hrr.extensions.Find(&retryShare) {
+		logf(logTypeHandshake, "HelloRetryRequest without key_share")
+		return c.sendAlert(alertMissingExtension)
+	}
+
+	// The server must select a group that we support, but didn't already
+	// send a key share for
+	group := retryShare.selectedGroup
+	supported := false
+	for _, g := range c.config.groups() {
+		if g == group {
+			supported = true
+			break
+		}
+	}
+	if _, sent := privateKeys[group]; !supported || sent {
+		logf(logTypeHandshake, "HelloRetryRequest selected an unacceptable group [%04x]", group)
+		return c.sendAlert(alertIllegalParameter)
+	}
+
+	stopTimer := c.startTimer(&c.state.HandshakeTimings.KeyShareGeneration)
+	pub, priv, err := newKeyShare(group, c.config.draw("client retry key share"))
+	stopTimer()
+	if err != nil {
+		return err
+	}
+	for g := range privateKeys {
+		delete(privateKeys, g)
+	}
+	privateKeys[group] = priv
+
+	ks := keyShareExtension{
+		roleIsServer: false,
+		shares:       []keyShare{keyShare{group: group, keyExchange: pub}},
+	}
+	data, err := ks.Marshal()
+	if err != nil {
+		return err
+	}
+	for i := range ch.extensions {
+		if ch.extensions[i].extensionType == extensionTypeKeyShare {
+			ch.extensions[i].extensionData = data
 		}
 	}
-	logf(logTypeHandshake, "Done reading server's first flight")
 
-	// Verify the server's certificate if required
-	if config.authCallback != nil {
-		if cert == nil || certVerify == nil {
-			return fmt.Errorf("tls.client: No server auth data provided")
-		}
+	logf(logTypeHandshake, "Sending ClientHello with a key share for [%04x]", group)
+	return nil
+}
 
-		transcriptForCertVerify := append([]*handshakeMessage{chm, shm}, transcript[:len(transcript)-1]...)
-		logf(logTypeHandshake, "Transcript for certVerify")
-		for _, hm := range transcriptForCertVerify {
-			logf(logTypeHandshake, "  [%d] %x", hm.msgType, hm.body)
+// serverKeyAgreement does key agreement with the first of the client's key
+// shares that is in a group we support.  If there is none, it returns a nil
+// extension.
+func (c *Conn) serverKeyAgreement(shares []keyShare) (*keyShareExtension, []byte, error) {
+	groups := c.config.groups()
+	for _, share := range shares {
+		supported := false
+		for _, group := range groups {
+			if group == share.group {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			continue
 		}
-		logf(logTypeHandshake, "===")
 
-		serverPublicKey := cert.certificateList[0].PublicKey
-		if err = certVerify.Verify(serverPublicKey, transcriptForCertVerify); err != nil {
-			return err
+		stopTimer := c.startTimer(&c.state.HandshakeTimings.KeyShareGeneration)
+		pub, priv, err := newKeyShare(share.group, c.config.draw("server key share"))
+		stopTimer()
+		if err != nil {
+			return nil, nil, err
 		}
 
-		if err = config.authCallback(cert.certificateList); err != nil {
-			return err
+		ES, err := keyAgreement(share.group, share.keyExchange, priv)
+		if err != nil {
+			logf(logTypeHandshake, "Error doing key agreement: %v", err)
+			return nil, nil, c.sendAlert(alertIllegalParameter)
 		}
+		serverKeyShare := &keyShareExtension{
+			roleIsServer: true,
+			shares:       []keyShare{keyShare{group: share.group, keyExchange: pub}},
+		}
+		return serverKeyShare, ES, nil
 	}
+	return nil, nil, nil
+}
 
-	// Update the crypto context with all but the Finished
-	ctx.Update(transcript)
-
-	// Verify server finished
-	sfin := new(finishedBody)
-	sfin.verifyDataLen = ctx.serverFinished.verifyDataLen
-	_, err = sfin.Unmarshal(finishedMessage.body)
-	if err != nil {
-		return err
-	}
-	if !bytes.Equal(sfin.verifyData, ctx.serverFinished.verifyData) {
-		return fmt.Errorf("tls.client: Server's Finished failed to verify")
+// verifyClientCertificate checks the client's CertificateVerify, which has to
+// be signed with the key in the leaf of its chain, over the transcript through
+// its Certificate.  It returns the scheme of the signature.
+func (c *Conn) verifyClientCertificate(chain []*x509.Certificate, certvm *handshakeMessage, transcript []*handshakeMessage) (SignatureScheme, error) {
+	if certvm.msgType != handshakeTypeCertificateVerify {
+		logf(logTypeHandshake, "Expected CertificateVerify, got message type %v", certvm.msgType)
+		return 0, alertUnexpectedMessage
 	}
-
-	// Send client Finished
-
-	_, err = hOut.WriteMessageBody(ctx.clientFinished)
+	certVerify := new(certificateVerifyBody)
+	_, err := certVerify.Unmarshal(certvm.body)
 	if err != nil {
-		return err
+		logf(logTypeHandshake, "Error processing client CertificateVerify: %v", err)
+		return 0, alertDecodeError
 	}
 
-	// Rekey to application keys
-	err = c.in.Rekey(ctx.suite, ctx.applicationKeys.serverWriteKey, ctx.applicationKeys.serverWriteIV)
+	clientPublicKey, pssKey, err := certificatePublicKey(chain[0])
 	if err != nil {
-		return err
+		logf(logTypeHandshake, "Error reading client public key: %v", err)
+		return 0, alertBadCertificate
 	}
-	err = c.out.Rekey(ctx.suite, ctx.applicationKeys.clientWriteKey, ctx.applicationKeys.clientWriteIV)
-	if err != nil {
-		return err
+	if _, ok := clientPublicKey.(*rsa.PublicKey); ok && !usableWithRSAKey(certVerify.alg, pssKey) {
+		logf(logTypeHandshake, "Client signature scheme doesn't match its key [%04x]", certVerify.alg.scheme())
+		return 0, alertIllegalParameter
 	}
 
-	c.context = ctx
-	return nil
+	err = certVerify.Verify(clientPublicKey, transcript, contextClientCertificateVerify)
+	if err != nil {
+		logf(logTypeHandshake, "Client's CertificateVerify failed to verify: %v", err)
+		return 0, alertDecryptError
+	}
+	return certVerify.alg.scheme(), nil
 }
 
 func (c *Conn) serverHandshake() error {
-	hIn := newHandshakeLayer(c.in)
-	hOut := newHandshakeLayer(c.out)
-
-	// Config
-	config := struct {
-		supportedGroup       map[namedGroup]bool
-		supportedCiphersuite map[cipherSuite]bool
-		privateKey           crypto.Signer
-		certicate            *x509.Certificate
-	}{
-		supportedGroup: map[namedGroup]bool{
-			namedGroupP256: true,
-			namedGroupP384: true,
-			namedGroupP521: true,
-		},
-		supportedCiphersuite: map[cipherSuite]bool{
-			TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: true,
-			TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   true,
-		},
-	}
-	config.privateKey, _ = newSigningKey(signatureAlgorithmRSA)
-	config.certicate, _ = newSelfSigned("example.com",
-		signatureAndHashAlgorithm{hashAlgorithmSHA256, signatureAlgorithmRSA}, config.privateKey)
+	hIn, hOut := c.handshakeLayers()
 
 	// Read ClientHello and extract extensions
 	ch := new(clientHelloBody)
@@ -513,76 +2634,352 @@ func (c *Conn) serverHandshake() error {
 	if err != nil {
 		return err
 	}
+	c.state.HandshakeRoundTrips++
+
+	// A client that doesn't send supported_versions is offering TLS 1.2 or
+	// earlier, which we don't support
+	clientVersions := &supportedVersionsExtension{roleIsServer: false}
+	if !ch.extensions.Find(clientVersions) {
+		logf(logTypeHandshake, "Client did not send supported_versions")
+		return c.sendAlert(alertProtocolVersion)
+	}
+	offeredTLS13 := false
+	for _, version := range clientVersions.versions {
+		if version == c.version() {
+			offeredTLS13 = true
+			break
+		}
+	}
+	if !offeredTLS13 {
+		logf(logTypeHandshake, "Client did not offer TLS 1.3 (%x)", clientVersions.versions)
+		return c.sendAlert(alertProtocolVersion)
+	}
 
 	serverName := new(serverNameExtension)
 	supportedGroups := new(supportedGroupsExtension)
-	signatureAlgorithms := new(signatureAlgorithmsExtension)
+	clientSignatureAlgorithms := new(signatureAlgorithmsExtension)
 	clientKeyShares := &keyShareExtension{roleIsServer: false}
 
 	gotServerName := ch.extensions.Find(serverName)
-	gotSupportedGroups := ch.extensions.Find(supportedGroups)
-	gotSignatureAlgorithms := ch.extensions.Find(signatureAlgorithms)
-	gotKeyShares := ch.extensions.Find(clientKeyShares)
+	gotSupportedGroups, supportedGroupsErr := ch.extensions.Parse(supportedGroups)
+	gotSignatureAlgorithms := ch.extensions.Find(clientSignatureAlgorithms)
+	gotKeyShares, keySharesErr := ch.extensions.Parse(clientKeyShares)
+	for _, err := range []error{supportedGroupsErr, keySharesErr} {
+		if err == error(alertIllegalParameter) {
+			logf(logTypeHandshake, "Client listed a group twice")
+			return c.sendAlert(alertIllegalParameter)
+		}
+	}
+	gotSupportedGroups = gotSupportedGroups && supportedGroupsErr == nil
+	gotKeyShares = gotKeyShares && keySharesErr == nil
 	if !gotServerName || !gotSupportedGroups || !gotSignatureAlgorithms || !gotKeyShares {
-		return fmt.Errorf("tls.server: Missing extension in ClientHello (%v %v %v %v)",
+		logf(logTypeHandshake, "Missing extension in ClientHello (%v %v %v %v)",
 			gotServerName, gotSupportedGroups, gotSignatureAlgorithms, gotKeyShares)
+		return c.sendAlert(alertMissingExtension)
 	}
+	c.state.ServerName = string(*serverName)
+	c.postHandshakeAuth = ch.extensions.Find(&postHandshakeAuthExtension{})
 
-	// Find key_share extension and do key agreement
-	var serverKeyShare *keyShareExtension
-	var ES []byte
-	for _, share := range clientKeyShares.shares {
-		if config.supportedGroup[share.group] {
-			pub, priv, err := newKeyShare(share.group)
-			if err != nil {
-				return err
+	clientLimit := new(recordSizeLimitExtension)
+	gotLimit, err := ch.extensions.Parse(clientLimit)
+	if err != nil {
+		logf(logTypeHandshake, "Invalid record_size_limit: %v", err)
+		return c.sendAlert(alertIllegalParameter)
+	}
+	if gotLimit {
+		c.setPeerRecordSizeLimit(clientLimit.limit)
+	}
+
+	info := &ClientHelloInfo{
+		ServerName:          string(*serverName),
+		CipherSuites:        ch.cipherSuites,
+		SupportedGroups:     supportedGroups.groups,
+		SignatureAlgorithms: clientSignatureAlgorithms.algorithms,
+		Extensions:          ch.extensions,
+		Conn:                c.conn,
+	}
+	if clientALPN := new(alpnExtension); ch.extensions.Find(clientALPN) {
+		info.SupportedProtos = clientALPN.protocols
+	}
+
+	if c.config.OnClientHello != nil {
+		if err = c.config.OnClientHello(info); err != nil {
+			logf(logTypeHandshake, "ClientHello rejected by the application: %v", err)
+			rejection := alert(c.config.OnClientHelloAlert)
+			if rejection == alertCloseNotify {
+				rejection = alertHandshakeFailure
 			}
+			c.sendAlert(rejection)
+			return err
+		}
+	}
 
-			ES, err = keyAgreement(share.group, share.keyExchange, priv)
-			serverKeyShare = &keyShareExtension{
-				roleIsServer: true,
-				shares:       []keyShare{keyShare{group: share.group, keyExchange: pub}},
+	if c.config.GetConfigForClient != nil {
+		config, err := c.config.GetConfigForClient(info)
+		if err != nil {
+			logf(logTypeHandshake, "Error getting config for client: %v", err)
+			return c.sendAlert(alertInternalError)
+		}
+		if config != nil {
+			if !config.validForServer() {
+				logf(logTypeHandshake, "Invalid config for client %q", info.ServerName)
+				return c.sendAlert(alertInternalError)
 			}
-			if err != nil {
-				return err
+			c.config = config
+		}
+	}
+
+	acceptableAlgorithms := clientSignatureAlgorithms.algorithms
+	if c.config.RejectDeprecatedSignatureAlgorithms {
+		acceptableAlgorithms = []signatureAndHashAlgorithm{}
+		for _, alg := range clientSignatureAlgorithms.algorithms {
+			if !isDeprecatedSignatureAlgorithm(alg) {
+				acceptableAlgorithms = append(acceptableAlgorithms, alg)
 			}
-			break
+		}
+		if len(acceptableAlgorithms) == 0 {
+			logf(logTypeHandshake, "Client offered only deprecated signature algorithms")
+			return c.sendAlert(alertHandshakeFailure)
 		}
 	}
-	if serverKeyShare == nil {
-		return fmt.Errorf("tls.server: Did not find a matching key share")
+
+	// Select the first of our protocols that the client offered.  If there
+	// is none, the client can't speak anything we do (RFC 7301).
+	clientALPN := new(alpnExtension)
+	if len(c.config.NextProtos) > 0 && ch.extensions.Find(clientALPN) {
+		for _, protocol := range c.config.NextProtos {
+			for _, offered := range clientALPN.protocols {
+				if protocol == offered {
+					c.state.NegotiatedProtocol = protocol
+					break
+				}
+			}
+			if c.state.NegotiatedProtocol != "" {
+				break
+			}
+		}
+		if c.state.NegotiatedProtocol == "" {
+			logf(logTypeHandshake, "No common application protocol (%v)", clientALPN.protocols)
+			return c.sendAlert(alertNoApplicationProtocol)
+		}
 	}
-	if len(ES) == 0 {
-		return fmt.Errorf("tls.server: Key agreement failed")
+
+	// Exchange ALPS settings if the client supports them for the negotiated
+	// protocol and we have some
+	var serverSettings []byte
+	usingALPS := false
+	clientALPS := &applicationSettingsExtension{inClientHello: true}
+	settings, ok := c.config.ApplicationSettings[c.state.NegotiatedProtocol]
+	if ok && c.state.NegotiatedProtocol != "" && ch.extensions.Find(clientALPS) {
+		for _, protocol := range clientALPS.protocols {
+			if protocol == c.state.NegotiatedProtocol {
+				serverSettings = settings
+				usingALPS = true
+				break
+			}
+		}
 	}
 
-	// Pick a ciphersuite
+	// Pick a ciphersuite, in our order of preference
+	offeredSuites := map[cipherSuite]bool{}
+	for _, suite := range ch.cipherSuites {
+		offeredSuites[suite] = true
+	}
 	var chosenSuite cipherSuite
 	foundCipherSuite := false
-	for _, suite := range ch.cipherSuites {
-		if config.supportedCiphersuite[suite] {
+	for _, suite := range c.config.cipherSuites() {
+		if offeredSuites[suite] {
 			chosenSuite = suite
 			foundCipherSuite = true
+			break
 		}
 	}
 	if !foundCipherSuite {
-		return fmt.Errorf("tls.server: No acceptable ciphersuites")
+		logf(logTypeHandshake, "No acceptable ciphersuites (%x)", ch.cipherSuites)
+		return c.sendAlert(alertHandshakeFailure)
+	}
+
+	// Find key_share extension and do key agreement.  If the client didn't
+	// send a share in any group we support, ask it to try again with one.
+	var firstClientHello, helloRetryRequest *handshakeMessage
+	serverKeyShare, ES, err := c.serverKeyAgreement(clientKeyShares.shares)
+	if err != nil {
+		return err
+	}
+	if serverKeyShare == nil {
+		var selectedGroup namedGroup
+		foundGroup := false
+		for _, group := range c.config.groups() {
+			for _, offered := range supportedGroups.groups {
+				if group == offered {
+					selectedGroup = group
+					foundGroup = true
+					break
+				}
+			}
+			if foundGroup {
+				break
+			}
+		}
+		if !foundGroup {
+			logf(logTypeHandshake, "Did not find a matching group")
+			return c.sendAlert(alertHandshakeFailure)
+		}
+
+		hrr := &serverHelloBody{
+			random:      helloRetryRequestRandom,
+			cipherSuite: chosenSuite,
+		}
+		err = hrr.extensions.Add(&supportedVersionsExtension{roleIsServer: true, versions: []uint16{c.version()}})
+		if err != nil {
+			return err
+		}
+		err = hrr.extensions.Add(&keyShareExtension{helloRetry: true, selectedGroup: selectedGroup})
+		if err != nil {
+			return err
+		}
+		logf(logTypeHandshake, "Sending HelloRetryRequest for [%04x]", selectedGroup)
+		hrrm, err := hOut.WriteMessageBody(hrr)
+		if err != nil {
+			return err
+		}
+
+		// The second ClientHello must match the first, except that it carries
+		// a single key share in the group we selected.  Any early data sent
+		// with the first is skipped on the way.
+		if ch.extensions.Find(&earlyDataExtension{}) {
+			c.in.skipEarlyData = c.config.earlyDataSkipLimit()
+		}
+		ch2m, err := hIn.ReadMessage()
+		c.in.skipEarlyData = 0
+		if err != nil {
+			return err
+		}
+		if ch2m.msgType != handshakeTypeClientHello {
+			logf(logTypeHandshake, "Expected ClientHello, got message type %v", ch2m.msgType)
+			return c.sendAlert(alertUnexpectedMessage)
+		}
+		ch2 := new(clientHelloBody)
+		read, err := ch2.Unmarshal(ch2m.body)
+		if err != nil || read < len(ch2m.body) {
+			logf(logTypeHandshake, "Error processing second ClientHello: %v", err)
+			return c.sendAlert(alertDecodeError)
+		}
+		c.state.HandshakeRoundTrips++
+		err = checkRetriedClientHello(ch, ch2)
+		if err != nil {
+			return c.sendAlert(alertIllegalParameter)
+		}
+		clientKeyShares = &keyShareExtension{roleIsServer: false}
+		if !ch2.extensions.Find(clientKeyShares) || len(clientKeyShares.shares) != 1 ||
+			clientKeyShares.shares[0].group != selectedGroup {
+			logf(logTypeHandshake, "Second ClientHello did not carry a key share for [%04x]", selectedGroup)
+			return c.sendAlert(alertIllegalParameter)
+		}
+
+		serverKeyShare, ES, err = c.serverKeyAgreement(clientKeyShares.shares)
+		if err != nil {
+			return err
+		}
+		firstClientHello, helloRetryRequest = chm, hrrm
+		ch, chm = ch2, ch2m
+	}
+	if len(ES) == 0 {
+		logf(logTypeHandshake, "Key agreement failed")
+		return c.sendAlert(alertInternalError)
+	}
+
+	// Resume the session that the client offered, if we can, and accept its
+	// early data if the session and our configuration allow it
+	var psk []byte
+	var session *sessionState
+	var serverPSK *preSharedKeyExtension
+	if !c.config.SessionTicketsDisabled {
+		retry := &cryptoContext{
+			params:            cipherSuiteMap[chosenSuite],
+			firstClientHello:  firstClientHello,
+			helloRetryRequest: helloRetryRequest,
+		}
+		session, serverPSK, err = c.acceptSession(ch, chm, chosenSuite, retry.retryTranscript())
+		if err != nil {
+			return err
+		}
+	}
+	offeredEarlyData := ch.extensions.Find(&earlyDataExtension{})
+	if session != nil {
+		psk = session.psk
+		c.state.EarlyDataAccepted = offeredEarlyData && firstClientHello == nil &&
+			c.acceptEarlyData(session, serverPSK, chosenSuite, chm)
+
+		// The client authenticated in the handshake that issued the ticket
+		if c.config.ClientAuth != NoClientCert && len(session.clientCertificates) > 0 {
+			c.state.ClientAuthenticated = c.config.ClientAuth == RequireAndVerifyClientCert
+			c.state.PeerCertificates = session.clientCertificates
+			c.state.PeerPublicKeyInfo = session.clientCertificates[0].RawSubjectPublicKeyInfo
+			c.state.PeerPublicKeySHA256 = sha256.Sum256(c.state.PeerPublicKeyInfo)
+		}
 	}
 
+	// The server's flight is written all at once, after Finished.  Anything
+	// still held back when the handshake fails, such as an alert, is written
+	// on the way out.
+	c.out.beginBatch()
+	defer c.out.flushBatch()
+
 	// Create and write ServerHello
 	sh := &serverHelloBody{
 		cipherSuite: chosenSuite,
 	}
+	_, err = io.ReadFull(c.config.draw("server random"), sh.random[:])
+	if err != nil {
+		return err
+	}
+	err = sh.extensions.Add(&supportedVersionsExtension{roleIsServer: true, versions: []uint16{c.version()}})
+	if err != nil {
+		return err
+	}
 	sh.extensions.Add(serverKeyShare)
+	if serverPSK != nil {
+		err = sh.extensions.Add(serverPSK)
+		if err != nil {
+			return err
+		}
+	}
 	shm, err := hOut.WriteMessageBody(sh)
 	if err != nil {
 		return err
 	}
+	c.state.ClientRandom = ch.random
+	c.state.ServerRandom = sh.random
+	c.state.Version = c.version()
+	c.state.CipherSuite = chosenSuite
+	c.state.NamedGroup = serverKeyShare.shares[0].group
+	c.state.DidResume = psk != nil
 
 	// Init context and rekey to handshake keys
-	ctx := cryptoContext{}
-	ctx.Init(chm, shm, ES, ES, chosenSuite)
-	err = c.in.Rekey(ctx.suite, ctx.handshakeKeys.clientWriteKey, ctx.handshakeKeys.clientWriteIV)
+	ctx := cryptoContext{
+		newTranscriptHash: c.config.NewTranscriptHash,
+		firstClientHello:  firstClientHello,
+		helloRetryRequest: helloRetryRequest,
+	}
+	err = ctx.Init(chm, shm, psk, ES, chosenSuite)
+	if err != nil {
+		zeroBytes(psk)
+		return err
+	}
+	if c.state.EarlyDataAccepted {
+		// Read the client's early data before anything else it sends
+		earlyKey, earlyIV := earlyTrafficKeys(chosenSuite, psk, chm)
+		err = c.in.Rekey(ctx.suite, earlyKey, earlyIV)
+		zeroBytes(earlyKey)
+		zeroBytes(earlyIV)
+	} else {
+		err = c.in.Rekey(ctx.suite, ctx.handshakeKeys.clientWriteKey, ctx.handshakeKeys.clientWriteIV)
+		if offeredEarlyData && firstClientHello == nil {
+			c.in.skipEarlyData = c.config.earlyDataSkipLimit()
+		}
+	}
+	zeroBytes(psk)
 	if err != nil {
 		return err
 	}
@@ -591,53 +2988,236 @@ func (c *Conn) serverHandshake() error {
 		return err
 	}
 
-	// Send an EncryptedExtensions message (even if it's empty)
+	// Create an EncryptedExtensions message (even if it's empty).  The rest
+	// of the flight is assembled first and then written together, so that
+	// the messages share as few records as possible.
 	ee := &encryptedExtensionsBody{}
-	eem, err := hOut.WriteMessageBody(ee)
+	if c.state.NegotiatedProtocol != "" {
+		err = (*extensionList)(ee).Add(&alpnExtension{protocols: []string{c.state.NegotiatedProtocol}})
+		if err != nil {
+			return err
+		}
+	}
+	if usingALPS {
+		err = (*extensionList)(ee).Add(&applicationSettingsExtension{settings: serverSettings})
+		if err != nil {
+			return err
+		}
+	}
+	if gotLimit {
+		limit := c.config.RecordSizeLimit
+		if limit == 0 {
+			limit = maxFragmentLen + 1
+		}
+		err = (*extensionList)(ee).Add(&recordSizeLimitExtension{limit: limit})
+		if err != nil {
+			return err
+		}
+	}
+	if c.state.EarlyDataAccepted {
+		err = (*extensionList)(ee).Add(&earlyDataExtension{})
+		if err != nil {
+			return err
+		}
+		c.state.HandshakeRoundTrips = 0
+	}
+	eem, err := handshakeMessageFromBody(ee)
 	if err != nil {
 		return err
 	}
+	flight := []*handshakeMessage{eem}
+
+	// Ask for the client's certificate if we want one.  The context is only
+	// used by post-handshake requests, so it is empty here.  When resuming,
+	// neither side authenticates again: the client's certificate, if any,
+	// comes from the session.
+	if c.config.ClientAuth != NoClientCert && !c.state.DidResume {
+		cr := &certificateRequestBody{}
+		err = cr.extensions.Add(&signatureAlgorithmsExtension{algorithms: signatureAlgorithms})
+		if err != nil {
+			return err
+		}
+		crm, err := handshakeMessageFromBody(cr)
+		if err != nil {
+			return err
+		}
+		flight = append(flight, crm)
+	}
+
+	// Create Certificate, CertificateVerify, unless we are resuming
+	if !c.state.DidResume {
+		chosen, sigAlg, err := c.selectServerCertificate(ch, acceptableAlgorithms)
+		if err != nil {
+			return c.sendAlert(err.(alert))
+		}
+
+		certificate := &certificateBody{certificateList: chosen.Chain}
+		certm, err := handshakeMessageFromBody(certificate)
+		if err != nil {
+			return err
+		}
+		flight = append(flight, certm)
+
+		signer := chosen.PrivateKey
+		if c.config.DeterministicSignatures {
+			signer = newDeterministicSigner(signer)
+		}
+		certificateVerify := &certificateVerifyBody{alg: sigAlg}
+		stopTimer := c.startTimer(&c.state.HandshakeTimings.Signing)
+		err = certificateVerify.Sign(signer, append(append(ctx.retryTranscript(), chm, shm), flight...), contextServerCertificateVerify)
+		stopTimer()
+		if err != nil {
+			return err
+		}
+		c.state.LocalSignatureScheme = certificateVerify.alg.scheme()
+		certvm, err := handshakeMessageFromBody(certificateVerify)
+		if err != nil {
+			return err
+		}
 
-	// Create and send Certificate, CertificateVerify
-	// TODO Certificate selection based on ClientHello
-	certificate := &certificateBody{
-		certificateList: []*x509.Certificate{config.certicate},
+		flight = append(flight, certvm)
 	}
-	certm, err := hOut.WriteMessageBody(certificate)
+
+	// Update the crypto context
+	ctx.Update(flight)
+
+	// Create server Finished, and write the flight
+	finm, err := handshakeMessageFromBody(ctx.serverFinished)
 	if err != nil {
 		return err
 	}
-
-	certificateVerify := &certificateVerifyBody{
-		alg: signatureAndHashAlgorithm{hashAlgorithmSHA256, signatureAlgorithmRSA},
-	}
-	err = certificateVerify.Sign(config.privateKey, []*handshakeMessage{chm, shm, eem, certm})
+	err = hOut.WriteMessages(append(flight, finm))
 	if err != nil {
 		return err
 	}
-	certvm, err := hOut.WriteMessageBody(certificateVerify)
+	err = c.out.flushBatch()
 	if err != nil {
 		return err
 	}
 
-	// Update the crypto context
-	ctx.Update([]*handshakeMessage{eem, certm, certvm})
-
-	// Create and write server Finished
-	_, err = hOut.WriteMessageBody(ctx.serverFinished)
+	// Anything we send after our Finished, including an alert about the
+	// client's flight, is under the application keys
+	err = c.out.Rekey(ctx.suite, ctx.applicationKeys.serverWriteKey, ctx.applicationKeys.serverWriteIV)
 	if err != nil {
 		return err
 	}
 
-	// Read and verify client Finished
+	// Read the early data that we accepted, up to EndOfEarlyData, and then
+	// switch to the client's handshake keys for the rest of its flight
+	if c.state.EarlyDataAccepted {
+		eoedm, err := c.readEarlyData(hIn)
+		if err != nil {
+			return err
+		}
+		err = ctx.UpdateClientFinished([]*handshakeMessage{eoedm})
+		if err != nil {
+			return err
+		}
+		err = c.in.Rekey(ctx.suite, ctx.handshakeKeys.clientWriteKey, ctx.handshakeKeys.clientWriteIV)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Read the client's ALPS settings, which must precede its Finished
+	if usingALPS {
+		ceem, err := hIn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if ceem.msgType != handshakeTypeClientEncryptedExtensions {
+			logf(logTypeHandshake, "Expected ClientEncryptedExtensions, got message type %v", ceem.msgType)
+			return c.sendAlert(alertUnexpectedMessage)
+		}
+		cee := new(clientEncryptedExtensionsBody)
+		_, err = cee.Unmarshal(ceem.body)
+		if err != nil {
+			logf(logTypeHandshake, "Error processing ClientEncryptedExtensions: %v", err)
+			return c.sendAlert(alertDecodeError)
+		}
+		clientSettings := new(applicationSettingsExtension)
+		if !extensionList(*cee).Find(clientSettings) {
+			logf(logTypeHandshake, "ClientEncryptedExtensions without ALPS settings")
+			return c.sendAlert(alertIllegalParameter)
+		}
+		err = ctx.UpdateClientFinished([]*handshakeMessage{ceem})
+		if err != nil {
+			return err
+		}
+		c.state.PeerApplicationSettings = clientSettings.settings
+	}
+
+	// Read the client's Certificate, and its CertificateVerify unless the
+	// Certificate is empty
+	if c.config.ClientAuth != NoClientCert && !c.state.DidResume {
+		certm, err := hIn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if certm.msgType != handshakeTypeCertificate {
+			logf(logTypeHandshake, "Expected Certificate, got message type %v", certm.msgType)
+			return c.sendAlert(alertUnexpectedMessage)
+		}
+		cert := new(certificateBody)
+		_, err = cert.Unmarshal(certm.body)
+		if err != nil {
+			logf(logTypeHandshake, "Error processing client Certificate: %v", err)
+			return c.sendAlert(alertDecodeError)
+		}
+		clientMessages := []*handshakeMessage{certm}
+
+		if len(cert.certificateList) == 0 {
+			if c.config.ClientAuth == RequireAndVerifyClientCert {
+				logf(logTypeHandshake, "Client did not send a certificate")
+				return c.sendAlert(alertCertificateRequired)
+			}
+		} else {
+			certvm, err := hIn.ReadMessage()
+			if err != nil {
+				return err
+			}
+			transcript := append(append([]*handshakeMessage{}, ctx.transcript...), certm)
+			stopTimer := c.startTimer(&c.state.HandshakeTimings.Verification)
+			scheme, err := c.verifyClientCertificate(cert.certificateList, certvm, transcript)
+			stopTimer()
+			if err != nil {
+				return err
+			}
+			if err = c.config.verifyClientCertificateChain(cert.certificateList); err != nil {
+				logf(logTypeHandshake, "Client certificate rejected: %v", err)
+				c.sendAlert(alertBadCertificate)
+				return err
+			}
+			c.state.ClientAuthenticated = c.config.ClientAuth == RequireAndVerifyClientCert
+			c.state.PeerSignatureScheme = scheme
+			c.state.PeerCertificates = cert.certificateList
+			c.state.PeerPublicKeyInfo = cert.certificateList[0].RawSubjectPublicKeyInfo
+			c.state.PeerPublicKeySHA256 = sha256.Sum256(c.state.PeerPublicKeyInfo)
+			clientMessages = append(clientMessages, certvm)
+		}
+
+		err = ctx.UpdateClientFinished(clientMessages)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Read and verify client Finished.  By now the expected value covers the
+	// client's whole flight, including its certificate, so a Finished that
+	// leaves any of it out doesn't match.
 	cfin := new(finishedBody)
 	cfin.verifyDataLen = ctx.clientFinished.verifyDataLen
-	_, err = hIn.ReadMessageBody(cfin)
+	hIn.exchanged = nil // The Finished is not part of the transcript it covers
+	cfinm, err := hIn.ReadMessageBody(cfin)
 	if err != nil {
 		return err
 	}
-	if !bytes.Equal(cfin.verifyData, ctx.clientFinished.verifyData) {
-		return fmt.Errorf("tls.client: Client's Finished failed to verify")
+	if err = c.checkTranscript(&ctx); err != nil {
+		return c.sendAlert(alertInternalError)
+	}
+	if !hmac.Equal(cfin.verifyData, ctx.clientFinished.verifyData) {
+		logf(logTypeHandshake, "Client's Finished failed to verify")
+		return c.sendAlert(alertDecryptError)
 	}
 
 	// Rekey to application keys
@@ -645,11 +3225,16 @@ func (c *Conn) serverHandshake() error {
 	if err != nil {
 		return err
 	}
-	err = c.out.Rekey(ctx.suite, ctx.applicationKeys.serverWriteKey, ctx.applicationKeys.serverWriteIV)
-	if err != nil {
-		return err
-	}
+	ctx.handshakeKeys.wipe()
 
 	c.context = ctx
+	c.exportHandshakeMessages(cfinm)
+
+	// Issue a ticket if the client can resume with one
+	clientModes := &pskKeyExchangeModesExtension{}
+	c.ticketsAllowed = !c.config.SessionTicketsDisabled && ch.extensions.Find(clientModes) && includesMode(clientModes.modes, pskModeDHEKE)
+	if c.ticketsAllowed {
+		return c.sendSessionTicket()
+	}
 	return nil
 }
@@ -1,8 +1,24 @@
 package mint
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type pipeReadWriter struct {
@@ -24,17 +40,72 @@ func (p *pipeReadWriter) Write(data []byte) (n int, err error) {
 	return p.w.Write(data)
 }
 
+// bufferedConn queues writes to a net.Conn and delivers them from another
+// goroutine, so that a writer doesn't wait for the peer to read, as it would
+// on a bare net.Pipe.  The underlying connection is closed once everything
+// written before Close has been delivered.
+type bufferedConn struct {
+	net.Conn
+	mutex  sync.Mutex
+	queue  chan []byte
+	closed bool
+	err    error // The first failed delivery
+}
+
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	b := &bufferedConn{Conn: conn, queue: make(chan []byte, 100)}
+	go func() {
+		for data := range b.queue {
+			if _, err := conn.Write(data); err != nil {
+				b.mutex.Lock()
+				if b.err == nil {
+					b.err = err
+				}
+				b.mutex.Unlock()
+			}
+		}
+		conn.Close()
+	}()
+	return b
+}
+
+func (b *bufferedConn) Write(data []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return 0, &net.OpError{Op: "write", Net: "pipe", Err: net.ErrClosed}
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	b.queue <- append([]byte{}, data...)
+	return len(data), nil
+}
+
+func (b *bufferedConn) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	return nil
+}
+
 func TestBasicFlow(t *testing.T) {
 	c2s := pipe()
 	s2c := pipe()
 
+	cert, roots := testServerChain()
 	client := &Conn{
-		in:  newRecordLayer(s2c),
-		out: newRecordLayer(c2s),
+		config: &Config{ServerName: "example.com", RootCAs: roots},
+		in:     newRecordLayer(s2c),
+		out:    newRecordLayer(c2s),
 	}
 	server := &Conn{
-		in:  newRecordLayer(c2s),
-		out: newRecordLayer(s2c),
+		config: &Config{Certificates: []Certificate{cert}},
+		in:     newRecordLayer(c2s),
+		out:    newRecordLayer(s2c),
 	}
 
 	done := make(chan bool)
@@ -54,18 +125,3454 @@ func TestBasicFlow(t *testing.T) {
 	assertEquals(t, client.context.suite, server.context.suite)
 	assertEquals(t, client.context.params, server.context.params)
 	assertEquals(t, len(client.context.transcript), len(server.context.transcript))
-	assertByteEquals(t, client.context.ES, server.context.ES)
-	assertByteEquals(t, client.context.SS, server.context.SS)
-	assertByteEquals(t, client.context.xES, server.context.xES)
-	assertByteEquals(t, client.context.xSS, server.context.xSS)
+	assertByteEquals(t, client.context.PSK, server.context.PSK)
+	assertByteEquals(t, client.context.DHE, server.context.DHE)
+	assertByteEquals(t, client.context.earlySecret, server.context.earlySecret)
+	assertByteEquals(t, client.context.handshakeSecret, server.context.handshakeSecret)
+	assertByteEquals(t, client.context.clientHandshakeTrafficSecret, server.context.clientHandshakeTrafficSecret)
+	assertByteEquals(t, client.context.serverHandshakeTrafficSecret, server.context.serverHandshakeTrafficSecret)
 	assertDeepEquals(t, client.context.handshakeKeys, client.context.handshakeKeys)
-	assertByteEquals(t, client.context.mES, server.context.mES)
-	assertByteEquals(t, client.context.mSS, server.context.mSS)
 	assertByteEquals(t, client.context.masterSecret, server.context.masterSecret)
 	assertByteEquals(t, client.context.serverFinishedKey, server.context.serverFinishedKey)
 	assertByteEquals(t, client.context.serverFinishedData, server.context.serverFinishedData)
 	assertByteEquals(t, client.context.clientFinishedKey, server.context.clientFinishedKey)
 	assertByteEquals(t, client.context.clientFinishedData, server.context.clientFinishedData)
-	assertByteEquals(t, client.context.trafficSecret, server.context.trafficSecret)
+	assertByteEquals(t, client.context.clientTrafficSecret, server.context.clientTrafficSecret)
+	assertByteEquals(t, client.context.serverTrafficSecret, server.context.serverTrafficSecret)
 	assertDeepEquals(t, client.context.applicationKeys, client.context.applicationKeys)
 }
+
+// newTestChain issues a certificate for name, valid between notBefore and
+// notAfter, through an intermediate under a fresh root.  It returns the
+// leaf and intermediate with the leaf's key, and a pool holding the root.
+// The leaf is for server authentication, unless other usages are given.
+func newTestChain(name string, leafKey crypto.Signer, notBefore, notAfter time.Time, usages ...x509.ExtKeyUsage) (Certificate, *x509.CertPool, error) {
+	if len(usages) == 0 {
+		usages = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+
+	issue := func(template, issuer *x509.Certificate, pub crypto.PublicKey, issuerKey crypto.Signer) (*x509.Certificate, error) {
+		der, err := x509.CreateCertificate(prng, template, issuer, pub, issuerKey)
+		if err != nil {
+			return nil, err
+		}
+		return x509.ParseCertificate(der)
+	}
+	caTemplate := func(serial int64, name string) *x509.Certificate {
+		return &x509.Certificate{
+			SerialNumber:          big.NewInt(serial),
+			Subject:               pkix.Name{CommonName: name},
+			NotBefore:             notBefore,
+			NotAfter:              notAfter,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}
+	}
+
+	rootKey, _ := newSigningKey(signatureAlgorithmECDSA)
+	rootTemplate := caTemplate(1, "Test Root")
+	root, err := issue(rootTemplate, rootTemplate, rootKey.Public(), rootKey)
+	if err != nil {
+		return Certificate{}, nil, err
+	}
+	intermediateKey, _ := newSigningKey(signatureAlgorithmECDSA)
+	intermediate, err := issue(caTemplate(2, "Test Intermediate"), root, intermediateKey.Public(), rootKey)
+	if err != nil {
+		return Certificate{}, nil, err
+	}
+	leaf, err := issue(&x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  usages,
+	}, intermediate, leafKey.Public(), intermediateKey)
+	if err != nil {
+		return Certificate{}, nil, err
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	return Certificate{Chain: []*x509.Certificate{leaf, intermediate}, PrivateKey: leafKey}, roots, nil
+}
+
+var (
+	testServerOnce        sync.Once
+	testServerCertificate Certificate
+	testRootCAs           *x509.CertPool
+)
+
+// testServerChain returns an RSA certificate chain for example.com, and
+// the roots that it chains to, shared by the tests that don't need a chain
+// of their own
+func testServerChain() (Certificate, *x509.CertPool) {
+	testServerOnce.Do(func() {
+		leafKey, _ := newSigningKey(signatureAlgorithmRSA)
+		now := time.Now()
+		var err error
+		testServerCertificate, testRootCAs, err = newTestChain("example.com", leafKey, now.Add(-time.Hour), now.Add(24*time.Hour))
+		if err != nil {
+			panic(err)
+		}
+	})
+	return testServerCertificate, testRootCAs
+}
+
+// handshakeOverPipe runs a client and a server handshake against each other
+// over an in-memory connection, returning both ends along with any errors.
+// If the client config has no ServerName, "example.com" is used.  Unless the
+// client sets its own roots or skips verification, or the server has its
+// own certificates, the server authenticates with the test chain and the
+// client trusts its root.  A server that requires client certificates
+// without its own ClientCAs trusts the client's certificates themselves.
+func handshakeOverPipe(clientConfig, serverConfig *Config) (*Conn, *Conn, error, error) {
+	if clientConfig.ServerName == "" {
+		withName := *clientConfig
+		withName.ServerName = "example.com"
+		clientConfig = &withName
+	}
+	if !clientConfig.InsecureSkipVerify && clientConfig.RootCAs == nil && len(serverConfig.Certificates) == 0 {
+		cert, roots := testServerChain()
+		withRoots := *clientConfig
+		withRoots.RootCAs = roots
+		clientConfig = &withRoots
+		withCert := *serverConfig
+		withCert.Certificates = []Certificate{cert}
+		serverConfig = &withCert
+	}
+	if serverConfig.ClientAuth == RequireAndVerifyClientCert && serverConfig.ClientCAs == nil {
+		withCAs := *serverConfig
+		withCAs.ClientCAs = x509.NewCertPool()
+		for _, cert := range clientConfig.Certificates {
+			withCAs.ClientCAs.AddCert(cert.Chain[0])
+		}
+		serverConfig = &withCAs
+	}
+
+	// A server writes its session tickets as soon as the handshake is done,
+	// before the client reads anything, so its writes are buffered
+	cConn, pConn := net.Pipe()
+	sConn := net.Conn(pConn)
+	if clientConfig.ClientSessionCache != nil {
+		sConn = newBufferedConn(pConn)
+	}
+	client := Client(cConn, clientConfig)
+	server := Server(sConn, serverConfig)
+
+	done := make(chan error, 1)
+	go func() {
+		err := server.Handshake()
+		if err != nil {
+			sConn.Close()
+		}
+		done <- err
+	}()
+
+	clientErr := client.Handshake()
+	if clientErr != nil {
+		cConn.Close()
+	}
+	serverErr := <-done
+	return client, server, clientErr, serverErr
+}
+
+func TestChaCha20Poly1305Handshake(t *testing.T) {
+	suite := TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256
+	client, server, clientErr, serverErr := handshakeOverPipe(
+		&Config{CipherSuites: []cipherSuite{suite}}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assertEquals(t, client.ConnectionState().CipherSuite, suite)
+	assertEquals(t, server.ConnectionState().CipherSuite, suite)
+	assertEquals(t, len(client.context.applicationKeys.clientWriteKey), 32)
+	assertEquals(t, len(client.context.applicationKeys.clientWriteIV), 12)
+
+	// Test that application data gets through in both directions
+	for _, pair := range [][2]*Conn{{client, server}, {server, client}} {
+		data := []byte("chacha over the pipe")
+		go func(w *Conn) {
+			w.Write(data)
+		}(pair[0])
+		buf := make([]byte, len(data))
+		_, err := io.ReadFull(pair[1], buf)
+		assertNotError(t, err, "Failed to read application data")
+		assertByteEquals(t, buf, data)
+	}
+}
+
+func TestApplicationDataKeys(t *testing.T) {
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	keys := client.context.applicationKeys
+	assert(t, !bytes.Equal(keys.clientWriteKey, keys.serverWriteKey), "Client and server write keys are equal")
+
+	// Test that each side encrypts with its own write key, by decrypting what
+	// it sends with a record layer keyed independently from the key schedule
+	for _, direction := range []struct {
+		sender, receiver *Conn
+		key, iv          []byte
+		data             []byte
+	}{
+		{client, server, keys.clientWriteKey, keys.clientWriteIV, []byte("ping")},
+		{server, client, keys.serverWriteKey, keys.serverWriteIV, []byte("pong")},
+	} {
+		go direction.sender.Write(direction.data)
+
+		in := newRecordLayer(direction.receiver.conn)
+		err := in.Rekey(client.context.suite, direction.key, direction.iv)
+		assertNotError(t, err, "Failed to rekey")
+		pt, err := in.ReadRecord()
+		assertNotError(t, err, "Failed to decrypt with the sender's write key")
+		assertEquals(t, pt.contentType, recordTypeApplicationData)
+		assertByteEquals(t, pt.fragment, direction.data)
+	}
+}
+
+func TestCloseZeroesKeys(t *testing.T) {
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+
+	// Hold on to the underlying buffers so that we can inspect them after Close
+	keys := client.context.applicationKeys
+	clientSecret := client.context.clientTrafficSecret
+	serverSecret := client.context.serverTrafficSecret
+	masterSecret := client.context.masterSecret
+	inNonce := client.in.nonce
+	outNonce := client.out.nonce
+
+	// Drain the closeNotify on the server side
+	go server.Read(make([]byte, 1))
+
+	err := client.Close()
+	assertNotError(t, err, "Failed to close client")
+
+	for _, secret := range [][]byte{
+		keys.clientWriteKey, keys.clientWriteIV,
+		keys.serverWriteKey, keys.serverWriteIV,
+		clientSecret, serverSecret, masterSecret, inNonce, outNonce,
+	} {
+		assert(t, len(secret) > 0, "Secret was empty before Close")
+		assertByteEquals(t, secret, make([]byte, len(secret)))
+	}
+	assert(t, client.in.cipher == nil && client.out.cipher == nil, "Cipher retained after Close")
+	assert(t, !client.context.initialized, "Context still initialized after Close")
+}
+
+func TestCloseNotify(t *testing.T) {
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+
+	// Test that the server reads a clean EOF after the client's closeNotify,
+	// and that a second Close does nothing
+	go client.Close()
+	n, err := server.Read(make([]byte, 1))
+	assertEquals(t, n, 0)
+	assertEquals(t, err, io.EOF)
+	assertNotError(t, client.Close(), "Second Close failed")
+
+	// Test that the closeNotify is a warning alert under the client's
+	// application keys
+	client, server, clientErr, serverErr = handshakeOverPipe(&Config{}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	keys := client.context.applicationKeys
+	in := newRecordLayer(server.conn)
+	err = in.Rekey(client.context.suite, keys.clientWriteKey, keys.clientWriteIV)
+	assertNotError(t, err, "Failed to rekey")
+
+	go client.Close()
+	pt, err := in.ReadRecord()
+	assertNotError(t, err, "Failed to read closeNotify")
+	assertEquals(t, pt.contentType, recordTypeAlert)
+	assertByteEquals(t, pt.fragment, []byte{alertLevelWarning, byte(alertCloseNotify)})
+
+	// Test that closing before the handshake only closes the transport
+	cConn, sConn := net.Pipe()
+	go Client(cConn, &Config{ServerName: "example.com"}).Close()
+	n, err = sConn.Read(make([]byte, 1))
+	assertEquals(t, n, 0)
+	assertEquals(t, err, io.EOF)
+
+	// Test that Close can run while the handshake does, e.g., to abort it
+	// from another goroutine, and that the handshake then fails
+	cConn, sConn = net.Pipe()
+	defer sConn.Close()
+	client = Client(cConn, &Config{ServerName: "example.com"})
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Handshake()
+	}()
+	_, err = sConn.Read(make([]byte, 1))
+	assertNotError(t, err, "Failed to read ClientHello")
+	assertNotError(t, client.Close(), "Close failed during the handshake")
+	assertError(t, <-done, "Handshake succeeded after Close")
+	assert(t, !client.context.initialized, "Context still initialized after Close")
+}
+
+func TestExcludeCipherSuites(t *testing.T) {
+	aes256Suites := []cipherSuite{
+		TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	}
+	clientConfig := &Config{
+		ExcludeCipherSuites: []cipherSuite{
+			TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	}
+
+	// Test that only the AES-256 suites remain
+	assertDeepEquals(t, clientConfig.cipherSuites(), aes256Suites)
+
+	// Test that the handshake negotiates one of the remaining suites
+	client, server, clientErr, serverErr := handshakeOverPipe(clientConfig, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assertEquals(t, client.context.suite, aes256Suites[0])
+	assertEquals(t, server.context.suite, aes256Suites[0])
+
+	// Test that a config excluding every suite is invalid
+	emptyConfig := &Config{ServerName: "example.com", ExcludeCipherSuites: supportedCipherSuites}
+	assert(t, !emptyConfig.validForClient(), "Config with no cipher suites valid for client")
+	assert(t, !emptyConfig.validForServer(), "Config with no cipher suites valid for server")
+	err := Client(nil, emptyConfig).Handshake()
+	assertError(t, err, "Handshake succeeded with no cipher suites")
+}
+
+func TestCipherSuites(t *testing.T) {
+	aes128Suites := []cipherSuite{
+		TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	}
+	aes256Suites := []cipherSuite{
+		TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	}
+
+	// Test that the configured list replaces the default, in order, and that
+	// unsupported suites are dropped
+	reversed := &Config{
+		CipherSuites: []cipherSuite{
+			TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			cipherSuite(0xFFFF),
+			TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		},
+	}
+	assertDeepEquals(t, reversed.cipherSuites(), []cipherSuite{
+		TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	})
+
+	// Test that the server selects according to its own preference
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{}, &Config{
+		CipherSuites: []cipherSuite{aes256Suites[0], aes128Suites[0]},
+	})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assertEquals(t, client.context.suite, aes256Suites[0])
+	assertEquals(t, server.context.suite, aes256Suites[0])
+
+	// Test that a server with no suite in common rejects the ClientHello
+	_, _, clientErr, serverErr = handshakeOverPipe(
+		&Config{CipherSuites: aes128Suites},
+		&Config{CipherSuites: aes256Suites})
+	assertError(t, serverErr, "Server accepted a ClientHello with no common suite")
+	assertEquals(t, serverErr.(*net.OpError).Err, error(alertHandshakeFailure))
+	alertErr, ok := clientErr.(*AlertError)
+	assert(t, ok, "Client did not receive an alert")
+	assertEquals(t, alert(alertErr.Alert), alertHandshakeFailure)
+
+	// Test that a config whose suites are all excluded or unsupported is invalid
+	excluded := &Config{
+		ServerName:          "example.com",
+		CipherSuites:        aes128Suites,
+		ExcludeCipherSuites: aes128Suites,
+	}
+	assert(t, !excluded.validForClient(), "Config with no cipher suites valid for client")
+	assert(t, !excluded.validForServer(), "Config with no cipher suites valid for server")
+	unsupported := &Config{ServerName: "example.com", CipherSuites: []cipherSuite{0xFFFF}}
+	assert(t, !unsupported.validForClient(), "Config with no supported suites valid for client")
+}
+
+func TestClientServerName(t *testing.T) {
+	// Test that the ClientHello carries the configured name
+	cConn, sConn := net.Pipe()
+	defer cConn.Close()
+	defer sConn.Close()
+	client := Client(cConn, &Config{ServerName: "mint.example.org"})
+	go client.Handshake()
+
+	ch := new(clientHelloBody)
+	_, err := newHandshakeLayer(newRecordLayer(sConn)).ReadMessageBody(ch)
+	assertNotError(t, err, "Failed to read ClientHello")
+	sni := new(serverNameExtension)
+	assert(t, ch.extensions.Find(sni), "ClientHello has no server_name")
+	assertEquals(t, string(*sni), "mint.example.org")
+
+	// Test that a client without a name fails before sending anything
+	assert(t, !(&Config{}).validForClient(), "Config without ServerName valid for client")
+	err = Client(nil, &Config{}).Handshake()
+	assertError(t, err, "Handshake succeeded without a ServerName")
+}
+
+func TestHelloRandomsFromConfig(t *testing.T) {
+	// The Rand also supplies the key shares, so provide more than the randoms
+	clientRandom := bytes.Repeat([]byte{0xA0}, 32)
+	serverRandom := bytes.Repeat([]byte{0xB0}, 32)
+	clientConfig := &Config{Rand: bytes.NewReader(bytes.Repeat(clientRandom[:1], 1024))}
+	serverConfig := &Config{Rand: bytes.NewReader(bytes.Repeat(serverRandom[:1], 1024))}
+
+	// Test that the state is empty before the handshake
+	client := Client(nil, clientConfig)
+	assertDeepEquals(t, client.ConnectionState(), ConnectionState{})
+
+	// Test that both sides report the randoms drawn from the configured Rand
+	client, server, clientErr, serverErr := handshakeOverPipe(clientConfig, serverConfig)
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	for _, state := range []ConnectionState{client.ConnectionState(), server.ConnectionState()} {
+		assert(t, state.HandshakeComplete, "Handshake not reported as complete")
+		assertByteEquals(t, state.ClientRandom[:], clientRandom)
+		assertByteEquals(t, state.ServerRandom[:], serverRandom)
+	}
+
+	// Test that the handshake fails if the Rand is exhausted
+	_, _, clientErr, _ = handshakeOverPipe(&Config{Rand: bytes.NewReader(nil)}, &Config{})
+	assertError(t, clientErr, "Client handshake succeeded without randomness")
+}
+
+func TestHandshakeRoundTrips(t *testing.T) {
+	// Test that a full handshake takes one round trip on both sides
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assertEquals(t, client.ConnectionState().HandshakeRoundTrips, 1)
+	assertEquals(t, server.ConnectionState().HandshakeRoundTrips, 1)
+}
+
+func TestSupportedVersions(t *testing.T) {
+	// Test that the client offers TLS 1.3 in supported_versions, and that the
+	// server selects it there
+	config := &Config{ExportHandshakeMessages: true}
+	client, _, clientErr, serverErr := handshakeOverPipe(config, config)
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	messages := client.HandshakeMessages()
+
+	ch := new(clientHelloBody)
+	_, err := ch.Unmarshal(messages[0][handshakeHeaderLen:])
+	assertNotError(t, err, "Failed to parse ClientHello")
+	clientVersions := supportedVersionsExtension{}
+	assert(t, ch.extensions.Find(&clientVersions), "ClientHello did not carry supported_versions")
+	assertDeepEquals(t, clientVersions.versions, []uint16{tls13Version})
+
+	sh := new(serverHelloBody)
+	_, err = sh.Unmarshal(messages[1][handshakeHeaderLen:])
+	assertNotError(t, err, "Failed to parse ServerHello")
+	serverVersion := supportedVersionsExtension{roleIsServer: true}
+	assert(t, sh.extensions.Find(&serverVersion), "ServerHello did not carry supported_versions")
+	assertDeepEquals(t, serverVersion.versions, []uint16{tls13Version})
+	assertEquals(t, client.ConnectionState().Version, tls13Version)
+}
+
+func TestSupportedVersionsRequired(t *testing.T) {
+	sni := serverNameExtension("example.com")
+	sg := supportedGroupsExtension{groups: supportedGroups}
+	sa := signatureAlgorithmsExtension{algorithms: signatureAlgorithms}
+
+	for _, versions := range [][]uint16{nil, []uint16{tls12Version}} {
+		c2s := pipe()
+		s2c := pipe()
+		server := &Conn{
+			config: &Config{},
+			in:     newRecordLayer(c2s),
+			out:    newRecordLayer(s2c),
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- server.serverHandshake()
+		}()
+
+		records := make(chan *tlsPlaintext, 1)
+		go func() {
+			pt, _ := newRecordLayer(s2c).ReadRecord()
+			records <- pt
+		}()
+
+		// Send a ClientHello that is otherwise TLS 1.3, but either omits
+		// supported_versions or only offers TLS 1.2
+		ch := &clientHelloBody{cipherSuites: supportedCipherSuites}
+		for _, ext := range []extensionBody{&sni, &sg, &sa} {
+			assertNotError(t, ch.extensions.Add(ext), "Failed to add extension")
+		}
+		if versions != nil {
+			sv := supportedVersionsExtension{versions: versions}
+			assertNotError(t, ch.extensions.Add(&sv), "Failed to add supported_versions")
+		}
+		_, err := newHandshakeLayer(newRecordLayer(c2s)).WriteMessageBody(ch)
+		assertNotError(t, err, "Failed to send ClientHello")
+
+		err = <-done
+		assertError(t, err, "Server accepted a ClientHello without TLS 1.3 in supported_versions")
+		assertEquals(t, err.(*net.OpError).Err, error(alertProtocolVersion))
+
+		// Test that the server responded with a protocol_version alert
+		s2c.w.Close()
+		pt := <-records
+		assert(t, pt != nil, "Failed to read server response")
+		assertEquals(t, pt.contentType, recordTypeAlert)
+		assertByteEquals(t, pt.fragment, []byte{alertLevelError, byte(alertProtocolVersion)})
+	}
+}
+
+func TestSignatureSchemes(t *testing.T) {
+	// Test that schemes use the wire encoding of the algorithm pair
+	alg := signatureAndHashAlgorithm{hashAlgorithmSHA256, signatureAlgorithmECDSA}
+	assertEquals(t, alg.scheme(), ECDSA_SECP256R1_SHA256)
+
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+
+	// Test that the client reports the scheme the server signed with
+	assertEquals(t, server.ConnectionState().LocalSignatureScheme, RSA_PKCS1_SHA256)
+	assertEquals(t, client.ConnectionState().PeerSignatureScheme, RSA_PKCS1_SHA256)
+
+	// Without client authentication, there is nothing in the other direction
+	assertEquals(t, client.ConnectionState().LocalSignatureScheme, SignatureScheme(0))
+	assertEquals(t, server.ConnectionState().PeerSignatureScheme, SignatureScheme(0))
+}
+
+func TestEmptyEncryptedExtensions(t *testing.T) {
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+
+	// Test that both sides have an empty EncryptedExtensions right after
+	// ServerHello in the transcript
+	for _, conn := range []*Conn{client, server} {
+		transcript := conn.context.transcript
+		assert(t, len(transcript) > 2, "Transcript too short")
+		assertEquals(t, transcript[2].msgType, handshakeTypeEncryptedExtensions)
+		assertByteEquals(t, transcript[2].body, []byte{0x00, 0x00})
+	}
+}
+
+func TestClientHelloRetransmission(t *testing.T) {
+	// Test that a TLS client does not retransmit, even with a timeout
+	// configured, since the transport is reliable
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	client := Client(clientConn, &Config{
+		ServerName:                 "example.com",
+		InsecureSkipVerify:         true,
+		HandshakeRetransmitTimeout: 20 * time.Millisecond,
+	})
+	go client.Handshake()
+
+	r := newRecordLayer(serverConn)
+	_, err := r.ReadRecord()
+	assertNotError(t, err, "Failed to read ClientHello")
+	serverConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = r.ReadRecord()
+	assert(t, isTimeout(err), "TLS client retransmitted its ClientHello")
+}
+
+func TestExportHandshakeMessages(t *testing.T) {
+	// Test that messages are not kept by default
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assert(t, client.HandshakeMessages() == nil, "Client kept handshake messages without being asked")
+	assert(t, server.HandshakeMessages() == nil, "Server kept handshake messages without being asked")
+
+	// Test that when enabled, both sides export the same messages, ending
+	// with the client Finished
+	config := &Config{ExportHandshakeMessages: true}
+	client, server, clientErr, serverErr = handshakeOverPipe(config, config)
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	messages := client.HandshakeMessages()
+	assertDeepEquals(t, server.HandshakeMessages(), messages)
+	assertEquals(t, handshakeType(messages[0][0]), handshakeTypeClientHello)
+	assertEquals(t, handshakeType(messages[len(messages)-1][0]), handshakeTypeFinished)
+
+	// Test that the transcript hash recomputed from the exported messages
+	// (through the server Finished) matches the internal one, and that the
+	// client Finished verifies against it
+	h := client.context.params.hash.New()
+	for _, msg := range messages[:len(messages)-1] {
+		h.Write(msg)
+	}
+	transcriptHash := h.Sum(nil)
+	assertByteEquals(t, transcriptHash, client.context.transcriptHash())
+
+	_, verifyData := computeFinishedData(client.context.params.hash,
+		client.context.clientHandshakeTrafficSecret, transcriptHash)
+	assertByteEquals(t, messages[len(messages)-1][handshakeHeaderLen:], verifyData)
+
+	// Test that callers get their own copy
+	messages[0][0] ^= 0xff
+	assertEquals(t, handshakeType(client.HandshakeMessages()[0][0]), handshakeTypeClientHello)
+}
+
+// fragmentingConn splits the first record written through it into several
+// records, each carrying a part of the original fragment.
+type fragmentingConn struct {
+	net.Conn
+	fragments int
+	done      bool
+}
+
+func (c *fragmentingConn) Write(data []byte) (int, error) {
+	if c.done || len(data) < recordHeaderLen {
+		return c.Conn.Write(data)
+	}
+	c.done = true
+
+	fragmentLen := (int(data[3]) << 8) + int(data[4])
+	fragment := data[recordHeaderLen : recordHeaderLen+fragmentLen]
+	rest := data[recordHeaderLen+fragmentLen:]
+	out := []byte{}
+	step := (len(fragment) + c.fragments - 1) / c.fragments
+	for len(fragment) > 0 {
+		n := step
+		if n > len(fragment) {
+			n = len(fragment)
+		}
+		out = append(out, data[0], data[1], data[2], byte(n>>8), byte(n))
+		out = append(out, fragment[:n]...)
+		fragment = fragment[n:]
+	}
+	out = append(out, rest...)
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func TestFragmentedClientHello(t *testing.T) {
+	// Test that the server reassembles a ClientHello delivered in three
+	// records, and completes the handshake with the client that sent it
+	cert, roots := testServerChain()
+	cConn, sConn := net.Pipe()
+	client := Client(&fragmentingConn{Conn: cConn, fragments: 3}, &Config{ServerName: "example.com", RootCAs: roots})
+	server := Server(sConn, &Config{Certificates: []Certificate{cert}})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Handshake()
+	}()
+	assertNotError(t, client.Handshake(), "Client failed handshake")
+	assertNotError(t, <-done, "Server failed to read a fragmented ClientHello")
+	assertEquals(t, server.ConnectionState().ServerName, "example.com")
+}
+
+func TestServerNameVerification(t *testing.T) {
+	// Test that a certificate matching ServerName is accepted
+	_, _, clientErr, serverErr := handshakeOverPipe(&Config{ServerName: "example.com"}, &Config{})
+	assertNotError(t, clientErr, "Client rejected a matching certificate")
+	assertNotError(t, serverErr, "Server failed handshake")
+
+	// Test that a mismatched name fails with a descriptive error, and that the
+	// server is told why
+	_, _, clientErr, serverErr = handshakeOverPipe(&Config{ServerName: "other.example"}, &Config{})
+	verifyErr, ok := clientErr.(*CertificateVerificationError)
+	assert(t, ok, "Client did not return a CertificateVerificationError")
+	assertEquals(t, verifyErr.ServerName, "other.example")
+	assertDeepEquals(t, verifyErr.Names, []string{"example.com"})
+	_, ok = verifyErr.Err.(x509.HostnameError)
+	assert(t, ok, "Verification error does not wrap an x509.HostnameError")
+	alertErr, ok := serverErr.(*AlertError)
+	assert(t, ok, "Server did not receive an alert")
+	assertEquals(t, alert(alertErr.Alert), alertBadCertificate)
+
+	// Test that verification can be skipped
+	_, _, clientErr, serverErr = handshakeOverPipe(&Config{ServerName: "other.example", InsecureSkipVerify: true}, &Config{})
+	assertNotError(t, clientErr, "Client verified the name despite InsecureSkipVerify")
+	assertNotError(t, serverErr, "Server failed handshake")
+}
+
+func TestServerCertificateVerification(t *testing.T) {
+	leafKey, _ := newSigningKey(signatureAlgorithmECDSA)
+	now := time.Now()
+	cert, roots, err := newTestChain("example.com", leafKey, now.Add(-time.Hour), now.Add(time.Hour))
+	assertNotError(t, err, "Failed to issue certificate chain")
+	_, otherRoots, err := newTestChain("example.com", leafKey, now.Add(-time.Hour), now.Add(time.Hour))
+	assertNotError(t, err, "Failed to issue certificate chain")
+	serverConfig := &Config{Certificates: []Certificate{cert}}
+
+	// Test that a chain through the intermediate in the Certificate message
+	// to a trusted root is accepted
+	client, _, clientErr, serverErr := handshakeOverPipe(&Config{RootCAs: roots}, serverConfig)
+	assertNotError(t, clientErr, "Client rejected a valid chain")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assertEquals(t, len(client.ConnectionState().PeerCertificates), 2)
+
+	// Test that an expired leaf, an untrusted root, or a leaf that isn't
+	// valid yet are rejected with the matching alerts
+	cases := []struct {
+		name   string
+		config *Config
+		alert  alert
+	}{
+		{"expired", &Config{RootCAs: roots, Time: func() time.Time { return now.Add(2 * time.Hour) }}, alertCertificateExpired},
+		{"not yet valid", &Config{RootCAs: roots, Time: func() time.Time { return now.Add(-2 * time.Hour) }}, alertCertificateExpired},
+		{"untrusted root", &Config{RootCAs: otherRoots}, alertUnknownCA},
+	}
+	for _, c := range cases {
+		_, _, clientErr, serverErr := handshakeOverPipe(c.config, serverConfig)
+		verifyErr, ok := clientErr.(*CertificateVerificationError)
+		assert(t, ok, fmt.Sprintf("Client did not return a CertificateVerificationError [%s]: %v", c.name, clientErr))
+		assertEquals(t, verifyErr.Subject, "CN=example.com")
+		alertErr, ok := serverErr.(*AlertError)
+		assert(t, ok, fmt.Sprintf("Server did not receive an alert [%s]", c.name))
+		assertEquals(t, alert(alertErr.Alert), c.alert)
+	}
+	_, _, clientErr, _ = handshakeOverPipe(&Config{RootCAs: otherRoots}, serverConfig)
+	_, ok := clientErr.(*CertificateVerificationError).Err.(x509.UnknownAuthorityError)
+	assert(t, ok, "Verification error does not wrap an x509.UnknownAuthorityError")
+
+	// Test that verification can be skipped
+	_, _, clientErr, serverErr = handshakeOverPipe(&Config{RootCAs: otherRoots, InsecureSkipVerify: true}, serverConfig)
+	assertNotError(t, clientErr, "Client verified the chain despite InsecureSkipVerify")
+	assertNotError(t, serverErr, "Server failed handshake")
+}
+
+func TestCertificateVerificationError(t *testing.T) {
+	leafKey, _ := newSigningKey(signatureAlgorithmECDSA)
+	now := time.Now()
+	cert, roots, err := newTestChain("example.com", leafKey, now.Add(-time.Hour), now.Add(time.Hour))
+	assertNotError(t, err, "Failed to issue certificate chain")
+	serverConfig := &Config{Certificates: []Certificate{cert}}
+
+	// Test that the error names the server and the certificate, and tells an
+	// expired certificate from one for another name
+	cases := []struct {
+		name       string
+		serverName string
+		time       func() time.Time
+		reason     string
+	}{
+		{"name mismatch", "other.example", nil, "not other.example"},
+		{"expired", "example.com", func() time.Time { return now.Add(2 * time.Hour) }, "expired"},
+	}
+	for _, c := range cases {
+		_, _, clientErr, _ := handshakeOverPipe(&Config{ServerName: c.serverName, RootCAs: roots, Time: c.time}, serverConfig)
+		verifyErr, ok := clientErr.(*CertificateVerificationError)
+		assert(t, ok, fmt.Sprintf("Client did not return a CertificateVerificationError [%s]: %v", c.name, clientErr))
+		assertEquals(t, verifyErr.ServerName, c.serverName)
+		assertEquals(t, verifyErr.Subject, "CN=example.com")
+		assertDeepEquals(t, verifyErr.Names, []string{"example.com"})
+		message := verifyErr.Error()
+		for _, part := range []string{c.serverName, "CN=example.com", c.reason} {
+			assert(t, strings.Contains(message, part), fmt.Sprintf("Error does not mention %q [%s]: %s", part, c.name, message))
+		}
+	}
+}
+
+func TestVerifyPeerCertificate(t *testing.T) {
+	cert, roots := testServerChain()
+	pin := sha256.Sum256(cert.Chain[0].RawSubjectPublicKeyInfo)
+	errPinMismatch := fmt.Errorf("public key does not match the pin")
+	var gotRaw [][]byte
+	var gotChains [][]*x509.Certificate
+	pinning := func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		gotRaw, gotChains = rawCerts, verifiedChains
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		if sha256.Sum256(leaf.RawSubjectPublicKeyInfo) != pin {
+			return errPinMismatch
+		}
+		return nil
+	}
+
+	// Test that the callback sees the raw certificates and the verified
+	// chain, and that the pinned key is accepted
+	_, _, clientErr, serverErr := handshakeOverPipe(
+		&Config{RootCAs: roots, VerifyPeerCertificate: pinning},
+		&Config{Certificates: []Certificate{cert}})
+	assertNotError(t, clientErr, "Client rejected the pinned key")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assertEquals(t, len(gotRaw), 2)
+	assertByteEquals(t, gotRaw[1], cert.Chain[1].Raw)
+	assertEquals(t, len(gotChains), 1)
+	assertEquals(t, len(gotChains[0]), 3)
+
+	// Test that a different key is rejected with bad_certificate, even when
+	// the callback replaces the built-in checks
+	leafKey, _ := newSigningKey(signatureAlgorithmECDSA)
+	now := time.Now()
+	other, _, err := newTestChain("example.com", leafKey, now.Add(-time.Hour), now.Add(time.Hour))
+	assertNotError(t, err, "Failed to issue certificate chain")
+	_, _, clientErr, serverErr = handshakeOverPipe(
+		&Config{InsecureSkipVerify: true, VerifyPeerCertificate: pinning},
+		&Config{Certificates: []Certificate{other}})
+	assertEquals(t, clientErr, errPinMismatch)
+	assert(t, gotChains == nil, "Callback got verified chains without verification")
+	alertErr, ok := serverErr.(*AlertError)
+	assert(t, ok, "Server did not receive an alert")
+	assertEquals(t, alert(alertErr.Alert), alertBadCertificate)
+}
+
+func TestServerCertificateSelection(t *testing.T) {
+	now := time.Now()
+	certs := map[string]Certificate{}
+	roots := map[string]*x509.CertPool{}
+	for _, name := range []string{"a.example", "b.example"} {
+		leafKey, _ := newSigningKey(signatureAlgorithmECDSA)
+		cert, pool, err := newTestChain(name, leafKey, now.Add(-time.Hour), now.Add(time.Hour))
+		assertNotError(t, err, "Failed to issue certificate chain")
+		certs[name], roots[name] = cert, pool
+	}
+	serverConfig := &Config{Certificates: []Certificate{certs["a.example"], certs["b.example"]}}
+
+	// Test that the server sends the whole chain for the name that the
+	// client asked for
+	for _, name := range []string{"a.example", "b.example"} {
+		client, _, clientErr, serverErr := handshakeOverPipe(&Config{ServerName: name, RootCAs: roots[name]}, serverConfig)
+		assertNotError(t, clientErr, "Client failed handshake for "+name)
+		assertNotError(t, serverErr, "Server failed handshake for "+name)
+		assertDeepEquals(t, client.ConnectionState().PeerCertificates, certs[name].Chain)
+	}
+
+	// Test that the first certificate is sent for an unknown name, unless
+	// the server is strict about it
+	client, _, clientErr, serverErr := handshakeOverPipe(&Config{ServerName: "c.example", InsecureSkipVerify: true}, serverConfig)
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assertDeepEquals(t, client.ConnectionState().PeerCertificates, certs["a.example"].Chain)
+
+	strictConfig := &Config{Certificates: serverConfig.Certificates, StrictSNI: true}
+	_, _, clientErr, serverErr = handshakeOverPipe(&Config{ServerName: "c.example", InsecureSkipVerify: true}, strictConfig)
+	assertError(t, serverErr, "Server accepted an unknown name")
+	assertEquals(t, serverErr.(*net.OpError).Err, error(alertUnrecognizedName))
+	alertErr, ok := clientErr.(*AlertError)
+	assert(t, ok, "Client did not receive an alert")
+	assertEquals(t, alert(alertErr.Alert), alertUnrecognizedName)
+
+	// Test that GetCertificate takes precedence, sees the name in the
+	// ClientHello, and can defer to Certificates or abort the handshake
+	var requested string
+	getConfig := &Config{
+		Certificates: serverConfig.Certificates,
+		GetCertificate: func(ch *clientHelloBody) (*Certificate, error) {
+			serverName := new(serverNameExtension)
+			ch.extensions.Find(serverName)
+			requested = string(*serverName)
+			switch requested {
+			case "a.example":
+				cert := certs["b.example"]
+				return &cert, nil
+			case "b.example":
+				return nil, nil
+			}
+			return nil, fmt.Errorf("no certificate for %s", requested)
+		},
+	}
+	client, _, clientErr, serverErr = handshakeOverPipe(&Config{ServerName: "a.example", InsecureSkipVerify: true}, getConfig)
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assertEquals(t, requested, "a.example")
+	assertDeepEquals(t, client.ConnectionState().PeerCertificates, certs["b.example"].Chain)
+
+	client, _, clientErr, serverErr = handshakeOverPipe(&Config{ServerName: "b.example", RootCAs: roots["b.example"]}, getConfig)
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assertDeepEquals(t, client.ConnectionState().PeerCertificates, certs["b.example"].Chain)
+
+	_, _, clientErr, serverErr = handshakeOverPipe(&Config{ServerName: "c.example", InsecureSkipVerify: true}, getConfig)
+	assertError(t, serverErr, "Server ignored an error from GetCertificate")
+	assertEquals(t, serverErr.(*net.OpError).Err, error(alertInternalError))
+}
+
+func TestOnClientHello(t *testing.T) {
+	errBlocked := errors.New("blocked name")
+	var seen *ClientHelloInfo
+	serverConfig := &Config{
+		OnClientHello: func(info *ClientHelloInfo) error {
+			seen = info
+			if info.ServerName == "blocked.example" {
+				return errBlocked
+			}
+			return nil
+		},
+		OnClientHelloAlert: uint8(alertAccessDenied),
+	}
+
+	// Test that the hook sees the parsed ClientHello and can let the
+	// handshake go ahead
+	clientConfig := &Config{ServerName: "example.com", NextProtos: []string{"h2"}, InsecureSkipVerify: true}
+	_, server, clientErr, serverErr := handshakeOverPipe(clientConfig, serverConfig)
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assertNotNil(t, seen, "OnClientHello was not called")
+	assertEquals(t, seen.ServerName, "example.com")
+	assertDeepEquals(t, seen.CipherSuites, clientConfig.cipherSuites())
+	assertDeepEquals(t, seen.SupportedGroups, clientConfig.groups())
+	assertDeepEquals(t, seen.SupportedProtos, []string{"h2"})
+	assert(t, seen.Extensions.Find(&supportedVersionsExtension{roleIsServer: false}), "Extensions did not include supported_versions")
+	assertEquals(t, seen.Conn, server.conn)
+
+	// Test that rejecting a name aborts the handshake with the configured
+	// alert, and that the server returns the hook's error
+	_, _, clientErr, serverErr = handshakeOverPipe(&Config{ServerName: "blocked.example", InsecureSkipVerify: true}, serverConfig)
+	assertEquals(t, serverErr, errBlocked)
+	alertErr, ok := clientErr.(*AlertError)
+	assert(t, ok, "Client did not receive an alert")
+	assertEquals(t, alert(alertErr.Alert), alertAccessDenied)
+
+	// Test that handshake_failure is sent if no alert is configured
+	serverConfig.OnClientHelloAlert = 0
+	_, _, clientErr, serverErr = handshakeOverPipe(&Config{ServerName: "blocked.example", InsecureSkipVerify: true}, serverConfig)
+	assertEquals(t, serverErr, errBlocked)
+	alertErr, ok = clientErr.(*AlertError)
+	assert(t, ok, "Client did not receive an alert")
+	assertEquals(t, alert(alertErr.Alert), alertHandshakeFailure)
+}
+
+func TestExporterSecret(t *testing.T) {
+	// Test that the secret is not available by default
+	client, _, clientErr, serverErr := handshakeOverPipe(&Config{}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	_, err := client.ExporterSecret()
+	assertError(t, err, "Client exported the secret without being asked")
+
+	// Test that the secret is not available before the handshake
+	config := &Config{ExportExporterSecret: true}
+	cConn, _ := net.Pipe()
+	_, err = Client(cConn, config).ExporterSecret()
+	assertError(t, err, "Client exported the secret before the handshake")
+	cConn.Close()
+
+	// Test that when enabled, both sides return the same secret, with the
+	// length of the suite's hash, on every call
+	client, server, clientErr, serverErr := handshakeOverPipe(config, config)
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	secret, err := client.ExporterSecret()
+	assertNotError(t, err, "Client failed to export the secret")
+	assertEquals(t, len(secret), client.context.params.hash.Size())
+	again, err := client.ExporterSecret()
+	assertNotError(t, err, "Client failed to export the secret again")
+	assertByteEquals(t, again, secret)
+	serverSecret, err := server.ExporterSecret()
+	assertNotError(t, err, "Server failed to export the secret")
+	assertByteEquals(t, serverSecret, secret)
+
+	// Test that the secret is distinct from the traffic secrets, and that
+	// callers get their own copy
+	assert(t, !bytes.Equal(secret, client.context.clientTrafficSecret), "Exporter secret equals the client traffic secret")
+	assert(t, !bytes.Equal(secret, client.context.serverTrafficSecret), "Exporter secret equals the server traffic secret")
+	secret[0] ^= 0xff
+	again, _ = client.ExporterSecret()
+	assert(t, !bytes.Equal(again, secret), "Caller modified the exporter secret")
+}
+
+// readAfterRawRecord has the server write a raw record to the client after the
+// handshake, and returns the alert the client sends in response, along with
+// the client's Read error.
+func readAfterRawRecord(t *testing.T, record []byte) (*tlsPlaintext, error) {
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+
+	alertRecord := make(chan *tlsPlaintext, 1)
+	go func() {
+		server.conn.Write(record)
+		pt, _ := server.in.ReadRecord()
+		alertRecord <- pt
+	}()
+
+	_, err := client.Read(make([]byte, 10))
+	return <-alertRecord, err
+}
+
+func TestUnknownContentType(t *testing.T) {
+	pt, err := readAfterRawRecord(t, []byte{0x63, 0x03, 0x01, 0x00, 0x01, 0x00})
+	assertError(t, err, "Read succeeded after a record with an unknown content type")
+	assert(t, pt != nil, "Client did not send an alert")
+	assertEquals(t, pt.contentType, recordTypeAlert)
+	assertByteEquals(t, pt.fragment, []byte{alertLevelError, byte(alertUnexpectedMessage)})
+}
+
+func TestChangeCipherSpecAfterHandshake(t *testing.T) {
+	pt, err := readAfterRawRecord(t, []byte{0x14, 0x03, 0x01, 0x00, 0x01, 0x01})
+	assertError(t, err, "Read succeeded after a post-handshake ChangeCipherSpec")
+	assert(t, pt != nil, "Client did not send an alert")
+	assertEquals(t, pt.contentType, recordTypeAlert)
+	assertByteEquals(t, pt.fragment, []byte{alertLevelError, byte(alertUnexpectedMessage)})
+}
+
+func TestReadAlerts(t *testing.T) {
+	// Test that a fatal alert from the peer surfaces as an AlertError with
+	// its code, and keeps failing later reads
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+
+	go server.sendAlert(alertInternalError)
+	_, err := client.Read(make([]byte, 10))
+	alertErr, ok := err.(*AlertError)
+	assert(t, ok, "Read did not return an AlertError")
+	assertEquals(t, alert(alertErr.Alert), alertInternalError)
+	_, err = client.Read(make([]byte, 10))
+	assertEquals(t, err, error(alertErr))
+
+	// Test that warning alerts are skipped
+	client, server, clientErr, serverErr = handshakeOverPipe(&Config{}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+
+	go func() {
+		server.sendAlert(alertUserCanceled)
+		server.Write([]byte("hello"))
+	}()
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(client, buf)
+	assertNotError(t, err, "Warning alert broke the connection")
+	assertByteEquals(t, buf, []byte("hello"))
+
+	// Test that after closeNotify, every read returns EOF without touching
+	// the transport.  Nothing writes the other end of the pipe, so these
+	// would block otherwise.
+	go server.sendAlert(alertCloseNotify)
+	for i := 0; i < 3; i++ {
+		n, err := client.Read(make([]byte, 10))
+		assertEquals(t, n, 0)
+		assertEquals(t, err, io.EOF)
+	}
+}
+
+func TestReadDataBeforeCloseNotify(t *testing.T) {
+	cert, roots := testServerChain()
+	ln := newLocalListener(t)
+	defer ln.Close()
+	done := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		server := Server(conn, &Config{Certificates: []Certificate{cert}})
+		if _, err = server.Write([]byte("hello")); err != nil {
+			done <- err
+			return
+		}
+		done <- server.Close()
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assertNotError(t, err, "Failed to dial")
+	client := Client(conn, &Config{ServerName: "example.com", RootCAs: roots})
+	defer client.Close()
+	assertNotError(t, client.Handshake(), "Client failed handshake")
+	assertNotError(t, <-done, "Server failed to write and close")
+
+	// Test that data that arrives together with the closeNotify is read
+	// first, and the end of the stream is reported by the next Read
+	buf := make([]byte, 64)
+	n, err := 0, error(nil)
+	for n == 0 && err == nil {
+		n, err = client.Read(buf)
+	}
+	assertNotError(t, err, "Read reported an error along with the data")
+	assertByteEquals(t, buf[:n], []byte("hello"))
+	n, err = client.Read(buf)
+	assertEquals(t, n, 0)
+	assertEquals(t, err, io.EOF)
+}
+
+func TestReadSizes(t *testing.T) {
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+
+	write := func(data []byte) {
+		go func() {
+			_, err := server.Write(data)
+			assertNotError(t, err, "Failed to write")
+		}()
+	}
+	read := func(size int) []byte {
+		buf := make([]byte, size)
+		n, err := 0, error(nil)
+		for n == 0 && err == nil {
+			n, err = client.Read(buf)
+		}
+		assertNotError(t, err, "Failed to read")
+		return buf[:n]
+	}
+
+	// Test that a buffer smaller than a record gets the record in parts,
+	// and one of exactly the record's size gets all of it
+	write([]byte("abcdefgh"))
+	assertByteEquals(t, read(3), []byte("abc"))
+	assertByteEquals(t, read(3), []byte("def"))
+	assertByteEquals(t, read(3), []byte("gh"))
+	write([]byte("ijkl"))
+	assertByteEquals(t, read(4), []byte("ijkl"))
+
+	// Test that data spanning several records comes back whole, with no
+	// Read returning more than one record
+	records := [][]byte{[]byte("mnop"), []byte("qrstuv"), []byte("wxyz")}
+	go func() {
+		for _, record := range records {
+			_, err := server.Write(record)
+			assertNotError(t, err, "Failed to write")
+		}
+	}()
+	received := []byte{}
+	for len(received) < 14 {
+		chunk := read(64)
+		assert(t, len(chunk) <= len(records[1]), "Read returned more than a record")
+		received = append(received, chunk...)
+	}
+	assertByteEquals(t, received, []byte("mnopqrstuvwxyz"))
+
+	// Test that a Read returns the data it has without waiting for the
+	// rest of a record that has only partly arrived
+	var written bytes.Buffer
+	sConn := server.out.conn
+	server.out.conn = &written
+	_, err := server.Write([]byte("hello"))
+	assertNotError(t, err, "Failed to write")
+	first := written.Len()
+	_, err = server.Write([]byte("world"))
+	assertNotError(t, err, "Failed to write")
+	sent := written.Bytes()
+	go sConn.Write(sent[:first+3])
+	assertByteEquals(t, read(64), []byte("hello"))
+	go sConn.Write(sent[first+3:])
+	assertByteEquals(t, read(64), []byte("world"))
+}
+
+func TestStickyError(t *testing.T) {
+	// Test that a record that fails to decrypt is answered with
+	// bad_record_mac
+	record := append([]byte{0x17, 0x03, 0x01, 0x00, 0x20}, bytes.Repeat([]byte{0xa5}, 32)...)
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+
+	alertRecord := make(chan *tlsPlaintext, 1)
+	go func() {
+		server.conn.Write(record)
+		pt, _ := server.in.ReadRecord()
+		alertRecord <- pt
+	}()
+	_, err := client.Read(make([]byte, 10))
+	assertError(t, err, "Read succeeded after a corrupted record")
+	assertEquals(t, err.(*net.OpError).Err, error(alertBadRecordMAC))
+	pt := <-alertRecord
+	assert(t, pt != nil, "Client did not send an alert")
+	assertByteEquals(t, pt.fragment, []byte{alertLevelError, byte(alertBadRecordMAC)})
+
+	// Test that every later operation fails with the same error, without
+	// touching the transport.  Nothing reads or writes the other end of the
+	// pipe, so these would block otherwise.
+	for i := 0; i < 3; i++ {
+		n, readErr := client.Read(make([]byte, 10))
+		assertEquals(t, n, 0)
+		assertEquals(t, readErr, err)
+
+		n, writeErr := client.Write([]byte("hello"))
+		assertEquals(t, n, 0)
+		assertEquals(t, writeErr, err)
+	}
+	assertEquals(t, client.Flush(), err)
+
+	// Test that timeouts do not break the connection
+	assertEquals(t, server.setFatalError(timeoutError{}), error(timeoutError{}))
+	assertEquals(t, server.setFatalError(io.EOF), io.EOF)
+	assertNotError(t, server.fatalError(), "Timeout recorded as fatal")
+}
+
+func TestServerKeyShareForUnsentGroup(t *testing.T) {
+	c2s := pipe()
+	s2c := pipe()
+	client := &Conn{
+		config:   &Config{ServerName: "example.com", Groups: []namedGroup{namedGroupP256}},
+		isClient: true,
+		in:       newRecordLayer(s2c),
+		out:      newRecordLayer(c2s),
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.clientHandshake()
+	}()
+
+	serverIn := newRecordLayer(c2s)
+	ch := new(clientHelloBody)
+	_, err := newHandshakeLayer(serverIn).ReadMessageBody(ch)
+	assertNotError(t, err, "Failed to read ClientHello")
+
+	// Reply with a key share for a group the client did not send a share for
+	ks := keyShareExtension{
+		roleIsServer: true,
+		shares:       []keyShare{keyShare{group: namedGroupX25519, keyExchange: bytes.Repeat([]byte{0x09}, 32)}},
+	}
+	sh := &serverHelloBody{cipherSuite: ch.cipherSuites[0]}
+	sv := supportedVersionsExtension{roleIsServer: true, versions: []uint16{tls13Version}}
+	assertNotError(t, sh.extensions.Add(&sv), "Failed to add supported_versions")
+	assertNotError(t, sh.extensions.Add(&ks), "Failed to add key_share")
+
+	// The client's alert can only be read after the ServerHello is written
+	alertRecord := make(chan *tlsPlaintext, 1)
+	go func() {
+		pt, _ := serverIn.ReadRecord()
+		alertRecord <- pt
+	}()
+	_, err = newHandshakeLayer(newRecordLayer(s2c)).WriteMessageBody(sh)
+	assertNotError(t, err, "Failed to send ServerHello")
+
+	err = <-done
+	assertError(t, err, "Client accepted a key share for a group it did not send")
+	assertEquals(t, err.(*net.OpError).Err, error(alertIllegalParameter))
+
+	pt := <-alertRecord
+	assert(t, pt != nil, "Client did not send an alert")
+	assertEquals(t, pt.contentType, recordTypeAlert)
+	assertByteEquals(t, pt.fragment, []byte{alertLevelError, byte(alertIllegalParameter)})
+}
+
+func TestServerKeyShareNotOnCurve(t *testing.T) {
+	c2s := pipe()
+	s2c := pipe()
+	client := &Conn{
+		config:   &Config{ServerName: "example.com"},
+		isClient: true,
+		in:       newRecordLayer(s2c),
+		out:      newRecordLayer(c2s),
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.clientHandshake()
+	}()
+
+	serverIn := newRecordLayer(c2s)
+	ch := new(clientHelloBody)
+	_, err := newHandshakeLayer(serverIn).ReadMessageBody(ch)
+	assertNotError(t, err, "Failed to read ClientHello")
+
+	// Reply with a P-256 share that is the right size but not a point
+	pub := append([]byte{65, 0x04}, bytes.Repeat([]byte{0x00}, 64)...)
+	ks := keyShareExtension{
+		roleIsServer: true,
+		shares:       []keyShare{keyShare{group: namedGroupP256, keyExchange: pub}},
+	}
+	sh := &serverHelloBody{cipherSuite: ch.cipherSuites[0]}
+	sv := supportedVersionsExtension{roleIsServer: true, versions: []uint16{tls13Version}}
+	assertNotError(t, sh.extensions.Add(&sv), "Failed to add supported_versions")
+	assertNotError(t, sh.extensions.Add(&ks), "Failed to add key_share")
+
+	alertRecord := make(chan *tlsPlaintext, 1)
+	go func() {
+		pt, _ := serverIn.ReadRecord()
+		alertRecord <- pt
+	}()
+	_, err = newHandshakeLayer(newRecordLayer(s2c)).WriteMessageBody(sh)
+	assertNotError(t, err, "Failed to send ServerHello")
+
+	err = <-done
+	assertError(t, err, "Client accepted a key share that is not on the curve")
+	assertEquals(t, err.(*net.OpError).Err, error(alertIllegalParameter))
+
+	pt := <-alertRecord
+	assert(t, pt != nil, "Client did not send an alert")
+	assertByteEquals(t, pt.fragment, []byte{alertLevelError, byte(alertIllegalParameter)})
+}
+
+// countingTranscriptHash wraps the default transcript hash and counts the
+// bytes written to it and any of its clones.
+type countingTranscriptHash struct {
+	TranscriptHash
+	count *int
+}
+
+func (h countingTranscriptHash) Write(data []byte) (int, error) {
+	*h.count += len(data)
+	return h.TranscriptHash.Write(data)
+}
+
+func (h countingTranscriptHash) Clone() TranscriptHash {
+	return countingTranscriptHash{h.TranscriptHash.Clone(), h.count}
+}
+
+func TestCustomTranscriptHash(t *testing.T) {
+	var clientCount, serverCount int
+	countingConfig := func(count *int) *Config {
+		return &Config{
+			NewTranscriptHash: func(alg crypto.Hash) TranscriptHash {
+				return countingTranscriptHash{newStdTranscriptHash(alg), count}
+			},
+		}
+	}
+
+	client, server, clientErr, serverErr := handshakeOverPipe(countingConfig(&clientCount), countingConfig(&serverCount))
+	assertNotError(t, clientErr, "Client failed handshake with a custom transcript hash")
+	assertNotError(t, serverErr, "Server failed handshake with a custom transcript hash")
+	assertByteEquals(t, client.context.clientTrafficSecret, server.context.clientTrafficSecret)
+	assertByteEquals(t, client.context.serverTrafficSecret, server.context.serverTrafficSecret)
+
+	// Test that every transcript message went through the custom hash
+	transcriptLen := 0
+	for _, msg := range client.context.transcript {
+		transcriptLen += len(msg.Marshal())
+	}
+	assertEquals(t, clientCount, transcriptLen)
+	assertEquals(t, serverCount, transcriptLen)
+}
+
+func TestPeerPublicKeyPin(t *testing.T) {
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+
+	// Find the server's certificate in the transcript
+	var cert *x509.Certificate
+	for _, msg := range client.context.transcript {
+		if msg.msgType == handshakeTypeCertificate {
+			body := new(certificateBody)
+			_, err := body.Unmarshal(msg.body)
+			assertNotError(t, err, "Failed to parse Certificate")
+			cert = body.certificateList[0]
+		}
+	}
+	assert(t, cert != nil, "No Certificate in the transcript")
+
+	// Test that the SPKI matches the certificate's public key, and that the
+	// pin is its SHA-256
+	spki, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	assertNotError(t, err, "Failed to marshal public key")
+	pin := sha256.Sum256(spki)
+
+	state := client.ConnectionState()
+	assertByteEquals(t, state.PeerPublicKeyInfo, spki)
+	assertByteEquals(t, state.PeerPublicKeySHA256[:], pin[:])
+
+	// Without client authentication, the server has nothing to pin
+	assertEquals(t, len(server.ConnectionState().PeerPublicKeyInfo), 0)
+}
+
+func TestAlertInsteadOfServerHello(t *testing.T) {
+	c2s := pipe()
+	s2c := pipe()
+	client := &Conn{
+		config:   &Config{ServerName: "example.com"},
+		isClient: true,
+		in:       newRecordLayer(s2c),
+		out:      newRecordLayer(c2s),
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Handshake()
+	}()
+
+	// Read the ClientHello, then respond with internal_error
+	_, err := newHandshakeLayer(newRecordLayer(c2s)).ReadMessageBody(new(clientHelloBody))
+	assertNotError(t, err, "Failed to read ClientHello")
+	err = newRecordLayer(s2c).WriteRecord(&tlsPlaintext{
+		contentType: recordTypeAlert,
+		fragment:    []byte{alertLevelError, byte(alertInternalError)},
+	})
+	assertNotError(t, err, "Failed to send alert")
+
+	err = <-done
+	assertError(t, err, "Client handshake succeeded after an alert")
+	alertErr, ok := err.(*AlertError)
+	assert(t, ok, "Client did not report the alert")
+	assertEquals(t, alertErr.Alert, uint8(alertInternalError))
+}
+
+// scriptedServer plays the server side of a handshake by hand, through the
+// ServerHello and the switch to handshake keys, so that tests can follow it
+// with arbitrary messages.  If editHello is set, it can change the
+// ServerHello before it is sent.
+type scriptedServer struct {
+	in, out *recordLayer
+	hOut    *handshakeLayer
+	ctx     cryptoContext
+}
+
+func newScriptedServer(t *testing.T, c2s, s2c io.ReadWriter, editHello func(*serverHelloBody)) *scriptedServer {
+	s := &scriptedServer{in: newRecordLayer(c2s), out: newRecordLayer(s2c)}
+	s.hOut = newHandshakeLayer(s.out)
+
+	ch := new(clientHelloBody)
+	chm, err := newHandshakeLayer(s.in).ReadMessageBody(ch)
+	assertNotError(t, err, "Failed to read ClientHello")
+
+	clientShares := keyShareExtension{roleIsServer: false}
+	assert(t, ch.extensions.Find(&clientShares), "ClientHello has no key_share")
+	share := clientShares.shares[0]
+	pub, priv, err := newKeyShare(share.group, prng)
+	assertNotError(t, err, "Failed to generate key share")
+	ES, err := keyAgreement(share.group, share.keyExchange, priv)
+	assertNotError(t, err, "Failed key agreement")
+
+	sh := &serverHelloBody{cipherSuite: ch.cipherSuites[0]}
+	sv := supportedVersionsExtension{roleIsServer: true, versions: []uint16{tls13Version}}
+	assertNotError(t, sh.extensions.Add(&sv), "Failed to add supported_versions")
+	ks := keyShareExtension{
+		roleIsServer: true,
+		shares:       []keyShare{keyShare{group: share.group, keyExchange: pub}},
+	}
+	assertNotError(t, sh.extensions.Add(&ks), "Failed to add key_share")
+	if editHello != nil {
+		editHello(sh)
+	}
+	shm, err := s.hOut.WriteMessageBody(sh)
+	assertNotError(t, err, "Failed to send ServerHello")
+
+	assertNotError(t, s.ctx.Init(chm, shm, nil, ES, sh.cipherSuite), "Failed to init crypto context")
+	s.in.Rekey(s.ctx.suite, s.ctx.handshakeKeys.clientWriteKey, s.ctx.handshakeKeys.clientWriteIV)
+	s.out.Rekey(s.ctx.suite, s.ctx.handshakeKeys.serverWriteKey, s.ctx.handshakeKeys.serverWriteIV)
+	return s
+}
+
+func TestDowngradeSentinel(t *testing.T) {
+	// Test that the client aborts on either downgrade sentinel
+	for _, sentinel := range [][]byte{downgradeSentinelTLS12, downgradeSentinelTLS11} {
+		c2s := pipe()
+		s2c := pipe()
+		client := &Conn{
+			config:   &Config{ServerName: "example.com"},
+			isClient: true,
+			in:       newRecordLayer(s2c),
+			out:      newRecordLayer(c2s),
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- client.clientHandshake()
+		}()
+
+		newScriptedServer(t, c2s, s2c, func(sh *serverHelloBody) {
+			copy(sh.random[len(sh.random)-len(sentinel):], sentinel)
+		})
+
+		// The client has not switched keys, so its alert is in the clear
+		pt, err := newRecordLayer(c2s).ReadRecord()
+		assertNotError(t, err, "Failed to read the client's alert")
+		assertByteEquals(t, pt.fragment, []byte{alertLevelError, byte(alertIllegalParameter)})
+
+		err = <-done
+		assertError(t, err, "Client accepted a downgrade sentinel")
+		assertEquals(t, err.(*net.OpError).Err, error(alertIllegalParameter))
+	}
+}
+
+func TestDuplicateGroups(t *testing.T) {
+	pub, _, err := newKeyShare(namedGroupP256, prng)
+	assertNotError(t, err, "Failed to generate key share")
+	p256Share := keyShare{group: namedGroupP256, keyExchange: pub}
+
+	// Test that the server rejects a group listed twice, in either list
+	cases := []struct {
+		groups []namedGroup
+		shares []keyShare
+	}{
+		{[]namedGroup{namedGroupP256, namedGroupP256}, []keyShare{p256Share}},
+		{[]namedGroup{namedGroupP256}, []keyShare{p256Share, p256Share}},
+	}
+	for _, c := range cases {
+		cConn, sConn := net.Pipe()
+		server := Server(sConn, &Config{})
+		done := make(chan error, 1)
+		go func() {
+			done <- server.Handshake()
+		}()
+
+		ch := &clientHelloBody{cipherSuites: supportedCipherSuites}
+		sni := serverNameExtension("example.com")
+		for _, ext := range []extensionBody{
+			&sni,
+			&supportedVersionsExtension{versions: []uint16{tls13Version}},
+			&supportedGroupsExtension{groups: c.groups},
+			&signatureAlgorithmsExtension{algorithms: signatureAlgorithms},
+			&keyShareExtension{roleIsServer: false, shares: c.shares},
+		} {
+			assertNotError(t, ch.extensions.Add(ext), "Failed to add extension")
+		}
+		clientIn := newRecordLayer(cConn)
+		_, err = newHandshakeLayer(newRecordLayer(cConn)).WriteMessageBody(ch)
+		assertNotError(t, err, "Failed to send ClientHello")
+
+		pt, err := clientIn.ReadRecord()
+		assertNotError(t, err, "Failed to read the server's alert")
+		assertByteEquals(t, pt.fragment, []byte{alertLevelError, byte(alertIllegalParameter)})
+
+		err = <-done
+		assertError(t, err, "Server accepted a group listed twice")
+		assertEquals(t, err.(*net.OpError).Err, error(alertIllegalParameter))
+		cConn.Close()
+	}
+}
+
+func TestLowOrderX25519Rejected(t *testing.T) {
+	// Test that a server refuses a low-order X25519 share
+	cConn, sConn := net.Pipe()
+	defer cConn.Close()
+	server := Server(sConn, &Config{})
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Handshake()
+	}()
+
+	lowOrder := keyShare{group: namedGroupX25519, keyExchange: make([]byte, 32)}
+	ch := &clientHelloBody{cipherSuites: supportedCipherSuites}
+	sni := serverNameExtension("example.com")
+	for _, ext := range []extensionBody{
+		&sni,
+		&supportedVersionsExtension{versions: []uint16{tls13Version}},
+		&supportedGroupsExtension{groups: []namedGroup{namedGroupX25519}},
+		&signatureAlgorithmsExtension{algorithms: signatureAlgorithms},
+		&keyShareExtension{roleIsServer: false, shares: []keyShare{lowOrder}},
+	} {
+		assertNotError(t, ch.extensions.Add(ext), "Failed to add extension")
+	}
+	clientIn := newRecordLayer(cConn)
+	_, err := newHandshakeLayer(newRecordLayer(cConn)).WriteMessageBody(ch)
+	assertNotError(t, err, "Failed to send ClientHello")
+
+	pt, err := clientIn.ReadRecord()
+	assertNotError(t, err, "Failed to read the server's alert")
+	assertByteEquals(t, pt.fragment, []byte{alertLevelError, byte(alertIllegalParameter)})
+
+	err = <-done
+	assertError(t, err, "Server accepted a low-order X25519 share")
+}
+
+func TestClientHandshakeAlerts(t *testing.T) {
+	priv, err := newSigningKey(signatureAlgorithmECDSA)
+	assertNotError(t, err, "Failed to generate key")
+	alg := signatureAndHashAlgorithm{hashAlgorithmSHA256, signatureAlgorithmECDSA}
+	cert, err := newSelfSigned("example.com", alg, priv)
+	assertNotError(t, err, "Failed to generate certificate")
+
+	// sendFlight sends the server's first flight after the ServerHello.  The
+	// CertificateVerify is signed over the right transcript unless badSig is
+	// set, and the Finished is correct unless badFinished is set.
+	sendFlight := func(s *scriptedServer, withCert, badSig, badFinished bool) {
+		eem, _ := handshakeMessageFromBody(&encryptedExtensionsBody{})
+		flight := []*handshakeMessage{eem}
+		if withCert {
+			certm, _ := handshakeMessageFromBody(&certificateBody{certificateList: []*x509.Certificate{cert}})
+			signed := append(append([]*handshakeMessage{}, s.ctx.transcript...), eem, certm)
+			if badSig {
+				signed = signed[1:]
+			}
+			cv := &certificateVerifyBody{alg: alg}
+			assertNotError(t, cv.Sign(priv, signed, contextServerCertificateVerify), "Failed to sign CertificateVerify")
+			cvm, _ := handshakeMessageFromBody(cv)
+			flight = append(flight, certm, cvm)
+		}
+		s.ctx.Update(flight)
+		if badFinished {
+			s.ctx.serverFinished.verifyData[0] ^= 0xff
+		}
+		finm, _ := handshakeMessageFromBody(s.ctx.serverFinished)
+		assertNotError(t, s.hOut.WriteMessages(append(flight, finm)), "Failed to send flight")
+	}
+
+	// sendEncryptedExtensions sends EncryptedExtensions with the given
+	// extension, and nothing after it
+	sendEncryptedExtensions := func(s *scriptedServer, ext extensionBody) {
+		ee := &encryptedExtensionsBody{}
+		assertNotError(t, (*extensionList)(ee).Add(ext), "Failed to add extension")
+		_, err := s.hOut.WriteMessageBody(ee)
+		assertNotError(t, err, "Failed to send EncryptedExtensions")
+	}
+
+	cases := []struct {
+		name         string
+		suites       []cipherSuite
+		editHello    func(*serverHelloBody)
+		serverFlight func(s *scriptedServer)
+		alert        alert
+	}{
+		{
+			name:      "missing key_share",
+			editHello: func(sh *serverHelloBody) { sh.extensions = sh.extensions[:1] },
+			alert:     alertMissingExtension,
+		},
+		{
+			name:      "missing supported_versions",
+			editHello: func(sh *serverHelloBody) { sh.extensions = sh.extensions[1:] },
+			alert:     alertIllegalParameter,
+		},
+		{
+			name: "TLS 1.2 selected",
+			editHello: func(sh *serverHelloBody) {
+				sh.extensions[0].extensionData = []byte{0x03, 0x03}
+			},
+			alert: alertIllegalParameter,
+		},
+		{
+			name:   "suite not offered",
+			suites: []cipherSuite{TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			editHello: func(sh *serverHelloBody) {
+				sh.cipherSuite = TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+			},
+			alert: alertIllegalParameter,
+		},
+		{
+			name:         "no certificate",
+			serverFlight: func(s *scriptedServer) { sendFlight(s, false, false, false) },
+			alert:        alertUnexpectedMessage,
+		},
+		{
+			name: "unsolicited extension",
+			serverFlight: func(s *scriptedServer) {
+				sendEncryptedExtensions(s, &alpnExtension{protocols: []string{"h2"}})
+			},
+			alert: alertUnsupportedExtension,
+		},
+		{
+			name: "extension not allowed in EncryptedExtensions",
+			serverFlight: func(s *scriptedServer) {
+				sendEncryptedExtensions(s, &supportedVersionsExtension{roleIsServer: true, versions: []uint16{tls13Version}})
+			},
+			alert: alertIllegalParameter,
+		},
+		{
+			name:         "bad CertificateVerify",
+			serverFlight: func(s *scriptedServer) { sendFlight(s, true, true, false) },
+			alert:        alertDecryptError,
+		},
+		{
+			name:         "bad Finished",
+			serverFlight: func(s *scriptedServer) { sendFlight(s, true, false, true) },
+			alert:        alertDecryptError,
+		},
+	}
+	for _, c := range cases {
+		c2s := pipe()
+		s2c := pipe()
+		client := &Conn{
+			config:   &Config{ServerName: "example.com", InsecureSkipVerify: true, CipherSuites: c.suites},
+			isClient: true,
+			in:       newRecordLayer(s2c),
+			out:      newRecordLayer(c2s),
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- client.Handshake()
+		}()
+
+		// Before the server's flight, the client has not switched keys, so
+		// its alert is in the clear
+		server := newScriptedServer(t, c2s, s2c, c.editHello)
+		alertIn := newRecordLayer(c2s)
+		if c.serverFlight != nil {
+			c.serverFlight(server)
+			alertIn = server.in
+		}
+
+		pt, err := alertIn.ReadRecord()
+		assertNotError(t, err, "Failed to read the client's alert: "+c.name)
+		assertByteEquals(t, pt.fragment, []byte{alertLevelError, byte(c.alert)})
+
+		err = <-done
+		assertError(t, err, "Client accepted a bad handshake: "+c.name)
+		assertEquals(t, err.(*net.OpError).Err, error(c.alert))
+	}
+}
+
+func TestServerHandshakeAlerts(t *testing.T) {
+	pub, _, err := newKeyShare(namedGroupP256, prng)
+	assertNotError(t, err, "Failed to generate key share")
+	p256Share := keyShare{group: namedGroupP256, keyExchange: pub}
+	x448Share := keyShare{group: namedGroupX448, keyExchange: make([]byte, 56)}
+
+	cases := []struct {
+		name                string
+		signatureAlgorithms bool
+		share               keyShare
+		alert               alert
+	}{
+		{"missing signature_algorithms", false, p256Share, alertMissingExtension},
+		{"no matching key share", true, x448Share, alertHandshakeFailure},
+	}
+	for _, c := range cases {
+		cConn, sConn := net.Pipe()
+		server := Server(sConn, &Config{})
+		done := make(chan error, 1)
+		go func() {
+			done <- server.Handshake()
+		}()
+
+		ch := &clientHelloBody{cipherSuites: supportedCipherSuites}
+		sni := serverNameExtension("example.com")
+		extensions := []extensionBody{
+			&sni,
+			&supportedVersionsExtension{versions: []uint16{tls13Version}},
+			&supportedGroupsExtension{groups: []namedGroup{c.share.group}},
+			&keyShareExtension{roleIsServer: false, shares: []keyShare{c.share}},
+		}
+		if c.signatureAlgorithms {
+			extensions = append(extensions, &signatureAlgorithmsExtension{algorithms: signatureAlgorithms})
+		}
+		for _, ext := range extensions {
+			assertNotError(t, ch.extensions.Add(ext), "Failed to add extension")
+		}
+		clientIn := newRecordLayer(cConn)
+		_, err = newHandshakeLayer(newRecordLayer(cConn)).WriteMessageBody(ch)
+		assertNotError(t, err, "Failed to send ClientHello")
+
+		pt, err := clientIn.ReadRecord()
+		assertNotError(t, err, "Failed to read the server's alert: "+c.name)
+		assertByteEquals(t, pt.fragment, []byte{alertLevelError, byte(c.alert)})
+
+		err = <-done
+		assertError(t, err, "Server accepted a bad ClientHello: "+c.name)
+		assertEquals(t, err.(*net.OpError).Err, error(c.alert))
+		cConn.Close()
+	}
+}
+
+func TestMalformedServerHello(t *testing.T) {
+	shOverflow, _ := hex.DecodeString(shOverflowHex)
+	shTrailing, _ := hex.DecodeString(shEmptyHex + "0000" + "00")
+
+	// Test that a ServerHello whose extension list overflows the message, or
+	// that has trailing data, is rejected with decode_error
+	for _, body := range [][]byte{shOverflow, shTrailing} {
+		c2s := pipe()
+		s2c := pipe()
+		client := &Conn{
+			config:   &Config{ServerName: "example.com"},
+			isClient: true,
+			in:       newRecordLayer(s2c),
+			out:      newRecordLayer(c2s),
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- client.Handshake()
+		}()
+
+		_, err := newHandshakeLayer(newRecordLayer(c2s)).ReadMessage()
+		assertNotError(t, err, "Failed to read ClientHello")
+		err = newHandshakeLayer(newRecordLayer(s2c)).WriteMessage(&handshakeMessage{
+			msgType: handshakeTypeServerHello,
+			body:    body,
+		})
+		assertNotError(t, err, "Failed to send ServerHello")
+
+		pt, err := newRecordLayer(c2s).ReadRecord()
+		assertNotError(t, err, "Failed to read the client's alert")
+		assertByteEquals(t, pt.fragment, []byte{alertLevelError, byte(alertDecodeError)})
+
+		err = <-done
+		assertError(t, err, "Client accepted a malformed ServerHello")
+		assertEquals(t, err.(*net.OpError).Err, error(alertDecodeError))
+	}
+}
+
+func TestX25519Handshake(t *testing.T) {
+	// Test that X25519 is preferred by default, and that it works when it
+	// is the only group that the client offers
+	for _, clientConfig := range []*Config{&Config{}, &Config{Groups: []namedGroup{namedGroupX25519}}} {
+		client, server, clientErr, serverErr := handshakeOverPipe(clientConfig, &Config{})
+		assertNotError(t, clientErr, "Client failed handshake")
+		assertNotError(t, serverErr, "Server failed handshake")
+		assertEquals(t, client.ConnectionState().NamedGroup, namedGroupX25519)
+		assertEquals(t, server.ConnectionState().NamedGroup, namedGroupX25519)
+		assertByteEquals(t, client.context.clientTrafficSecret, server.context.clientTrafficSecret)
+	}
+}
+
+func TestKeyShareGroups(t *testing.T) {
+	allGroups := []namedGroup{namedGroupX25519, namedGroupP256, namedGroupP384, namedGroupP521}
+	cases := []struct {
+		name       string
+		config     *Config
+		shared     []namedGroup
+		roundTrips int
+	}{
+		{"default", &Config{}, allGroups[:1], 2},
+		{"configured", &Config{KeyShareGroups: []namedGroup{namedGroupP384, namedGroupX25519}}, []namedGroup{namedGroupP384, namedGroupX25519}, 2},
+		{"unsupported group", &Config{Groups: allGroups[:2], KeyShareGroups: []namedGroup{namedGroupP521, namedGroupP256}}, allGroups[1:2], 1},
+		{"count", &Config{KeyShareCount: 2}, allGroups[:2], 1},
+	}
+	for _, c := range cases {
+		// Test that supported_groups lists every group, but key_share only
+		// the configured ones, and that the server asks for a P-256 share
+		// with a HelloRetryRequest if there isn't one
+		cConn, sConn := net.Pipe()
+		recorder := &recordingConn{Conn: cConn}
+		c.config.ServerName = "example.com"
+		c.config.InsecureSkipVerify = true
+		client := Client(recorder, c.config)
+		server := Server(sConn, &Config{Groups: allGroups[1:2]})
+		done := make(chan error, 1)
+		go func() {
+			done <- server.Handshake()
+		}()
+		assertNotError(t, client.Handshake(), c.name+": Client failed handshake")
+		assertNotError(t, <-done, c.name+": Server failed handshake")
+		assertEquals(t, client.ConnectionState().NamedGroup, namedGroupP256)
+
+		record := recorder.written
+		recordLen := int(record[3])<<8 | int(record[4])
+		ch := new(clientHelloBody)
+		_, err := ch.Unmarshal(record[5+handshakeHeaderLen : 5+recordLen])
+		assertNotError(t, err, c.name+": Failed to unmarshal ClientHello")
+
+		sg := &supportedGroupsExtension{}
+		assert(t, ch.extensions.Find(sg), c.name+": ClientHello did not include supported_groups")
+		assertDeepEquals(t, sg.groups, c.config.groups())
+		ks := &keyShareExtension{roleIsServer: false}
+		assert(t, ch.extensions.Find(ks), c.name+": ClientHello did not include key shares")
+		shared := []namedGroup{}
+		for _, share := range ks.shares {
+			shared = append(shared, share.group)
+		}
+		assertDeepEquals(t, shared, c.shared)
+		assertEquals(t, client.ConnectionState().HandshakeRoundTrips, c.roundTrips)
+	}
+}
+
+func TestHelloRetryRequest(t *testing.T) {
+	// Test that a client whose only key share is in a group the server
+	// doesn't support completes the handshake after one HelloRetryRequest
+	client, server, clientErr, serverErr := handshakeOverPipe(
+		&Config{Groups: []namedGroup{namedGroupP256, namedGroupP384}, KeyShareCount: 1},
+		&Config{Groups: []namedGroup{namedGroupP384}})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	for _, state := range []ConnectionState{client.ConnectionState(), server.ConnectionState()} {
+		assertEquals(t, state.HandshakeRoundTrips, 2)
+		assertEquals(t, state.NamedGroup, namedGroupP384)
+	}
+	assertEquals(t, client.context.transcript[0].msgType, handshakeTypeMessageHash)
+	assertByteEquals(t, client.context.transcript[0].body, server.context.transcript[0].body)
+
+	// Test that the server rejects a second ClientHello that doesn't match
+	// the first, or that doesn't carry a share in the selected group
+	p256Pub, _, err := newKeyShare(namedGroupP256, prng)
+	assertNotError(t, err, "Failed to generate key share")
+	p384Pub, _, err := newKeyShare(namedGroupP384, prng)
+	assertNotError(t, err, "Failed to generate key share")
+	p256Share := keyShare{group: namedGroupP256, keyExchange: p256Pub}
+	p384Share := keyShare{group: namedGroupP384, keyExchange: p384Pub}
+
+	cases := []struct {
+		name         string
+		cipherSuites []cipherSuite
+		share        keyShare
+	}{
+		{"changed cipher suites", supportedCipherSuites[1:], p384Share},
+		{"share in the wrong group", supportedCipherSuites, p256Share},
+	}
+	for _, c := range cases {
+		cConn, sConn := net.Pipe()
+		server := Server(sConn, &Config{Groups: []namedGroup{namedGroupP384}})
+		done := make(chan error, 1)
+		go func() {
+			done <- server.Handshake()
+		}()
+
+		newClientHello := func(cipherSuites []cipherSuite, share keyShare) *clientHelloBody {
+			ch := &clientHelloBody{cipherSuites: cipherSuites}
+			sni := serverNameExtension("example.com")
+			for _, ext := range []extensionBody{
+				&sni,
+				&supportedVersionsExtension{versions: []uint16{tls13Version}},
+				&supportedGroupsExtension{groups: []namedGroup{namedGroupP256, namedGroupP384}},
+				&signatureAlgorithmsExtension{algorithms: signatureAlgorithms},
+				&keyShareExtension{roleIsServer: false, shares: []keyShare{share}},
+			} {
+				assertNotError(t, ch.extensions.Add(ext), "Failed to add extension")
+			}
+			return ch
+		}
+		clientIn := newRecordLayer(cConn)
+		clientOut := newHandshakeLayer(newRecordLayer(cConn))
+		_, err = clientOut.WriteMessageBody(newClientHello(supportedCipherSuites, p256Share))
+		assertNotError(t, err, "Failed to send ClientHello")
+
+		hrr := new(serverHelloBody)
+		_, err = newHandshakeLayer(clientIn).ReadMessageBody(hrr)
+		assertNotError(t, err, "Failed to read HelloRetryRequest")
+		assertEquals(t, hrr.random, helloRetryRequestRandom)
+		retryShare := keyShareExtension{helloRetry: true}
+		assert(t, hrr.extensions.Find(&retryShare), "HelloRetryRequest without key_share")
+		assertEquals(t, retryShare.selectedGroup, namedGroupP384)
+
+		_, err = clientOut.WriteMessageBody(newClientHello(c.cipherSuites, c.share))
+		assertNotError(t, err, "Failed to send second ClientHello")
+
+		pt, err := clientIn.ReadRecord()
+		assertNotError(t, err, "Failed to read the server's alert: "+c.name)
+		assertByteEquals(t, pt.fragment, []byte{alertLevelError, byte(alertIllegalParameter)})
+
+		err = <-done
+		assertError(t, err, "Server accepted a bad second ClientHello: "+c.name)
+		assertEquals(t, err.(*net.OpError).Err, error(alertIllegalParameter))
+		cConn.Close()
+	}
+}
+
+func TestMaxCertificateChainLength(t *testing.T) {
+	priv, err := newSigningKey(signatureAlgorithmECDSA)
+	assertNotError(t, err, "Failed to generate key")
+	cert, err := newSelfSigned("example.com",
+		signatureAndHashAlgorithm{hashAlgorithmSHA256, signatureAlgorithmECDSA}, priv)
+	assertNotError(t, err, "Failed to generate certificate")
+
+	chain := make([]*x509.Certificate, 11)
+	for i := range chain {
+		chain[i] = cert
+	}
+
+	// Test that an 11-certificate chain is rejected, both with the default
+	// limit of 10 and with a configured limit
+	for _, limit := range []int{0, 5} {
+		c2s := pipe()
+		s2c := pipe()
+		client := &Conn{
+			config:   &Config{ServerName: "example.com", MaxCertificateChainLength: limit},
+			isClient: true,
+			in:       newRecordLayer(s2c),
+			out:      newRecordLayer(c2s),
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- client.Handshake()
+		}()
+
+		server := newScriptedServer(t, c2s, s2c, nil)
+		_, err = server.hOut.WriteMessageBody(&encryptedExtensionsBody{})
+		assertNotError(t, err, "Failed to send EncryptedExtensions")
+		_, err = server.hOut.WriteMessageBody(&certificateBody{certificateList: chain})
+		assertNotError(t, err, "Failed to send Certificate")
+
+		pt, err := server.in.ReadRecord()
+		assertNotError(t, err, "Failed to read client alert")
+		assertEquals(t, pt.contentType, recordTypeAlert)
+		assertByteEquals(t, pt.fragment, []byte{alertLevelError, byte(alertBadCertificate)})
+
+		err = <-done
+		assertError(t, err, "Client accepted an overlong certificate chain")
+		assertEquals(t, err.(*net.OpError).Err, error(alertBadCertificate))
+	}
+}
+
+func TestEmptyServerCertificate(t *testing.T) {
+	// Test that the client rejects a server Certificate with no
+	// certificates in it, rather than failing on the missing leaf
+	c2s := pipe()
+	s2c := pipe()
+	client := &Conn{
+		config:   &Config{ServerName: "example.com", InsecureSkipVerify: true},
+		isClient: true,
+		in:       newRecordLayer(s2c),
+		out:      newRecordLayer(c2s),
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Handshake()
+	}()
+
+	server := newScriptedServer(t, c2s, s2c, nil)
+	_, err := server.hOut.WriteMessageBody(&encryptedExtensionsBody{})
+	assertNotError(t, err, "Failed to send EncryptedExtensions")
+	_, err = server.hOut.WriteMessageBody(&certificateBody{})
+	assertNotError(t, err, "Failed to send Certificate")
+
+	pt, err := server.in.ReadRecord()
+	assertNotError(t, err, "Failed to read client alert")
+	assertEquals(t, pt.contentType, recordTypeAlert)
+	assertByteEquals(t, pt.fragment, []byte{alertLevelError, byte(alertDecodeError)})
+
+	err = <-done
+	assertError(t, err, "Client accepted an empty Certificate")
+	assertEquals(t, err.(*net.OpError).Err, error(alertDecodeError))
+}
+
+func TestHandshakeCertificateRequestContext(t *testing.T) {
+	// Test that the client rejects a CertificateRequest during the handshake
+	// that carries a certificate_request_context
+	c2s := pipe()
+	s2c := pipe()
+	client := &Conn{
+		config:   &Config{ServerName: "example.com", InsecureSkipVerify: true},
+		isClient: true,
+		in:       newRecordLayer(s2c),
+		out:      newRecordLayer(c2s),
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Handshake()
+	}()
+
+	server := newScriptedServer(t, c2s, s2c, nil)
+	_, err := server.hOut.WriteMessageBody(&encryptedExtensionsBody{})
+	assertNotError(t, err, "Failed to send EncryptedExtensions")
+	cr := &certificateRequestBody{certificateRequestContext: []byte{0x01, 0x02}}
+	assertNotError(t, cr.extensions.Add(&signatureAlgorithmsExtension{algorithms: signatureAlgorithms}),
+		"Failed to add signature_algorithms")
+	_, err = server.hOut.WriteMessageBody(cr)
+	assertNotError(t, err, "Failed to send CertificateRequest")
+
+	pt, err := server.in.ReadRecord()
+	assertNotError(t, err, "Failed to read client alert")
+	assertEquals(t, pt.contentType, recordTypeAlert)
+	assertByteEquals(t, pt.fragment, []byte{alertLevelError, byte(alertIllegalParameter)})
+
+	err = <-done
+	assertError(t, err, "Client accepted a CertificateRequest with a context")
+	assertEquals(t, err.(*net.OpError).Err, error(alertIllegalParameter))
+}
+
+func TestCertificateChainSignatureAlgorithms(t *testing.T) {
+	rootKey, _ := newSigningKey(signatureAlgorithmECDSA)
+	intermediateKey, _ := newSigningKey(signatureAlgorithmECDSA)
+	leafKey, _ := newSigningKey(signatureAlgorithmECDSA)
+	root, err := newSelfSigned("root.example.com",
+		signatureAndHashAlgorithm{hashAlgorithmSHA256, signatureAlgorithmECDSA}, rootKey)
+	assertNotError(t, err, "Failed to create root")
+	intermediate, err := newIssuedCertificate("intermediate.example.com", x509.ECDSAWithSHA1, intermediateKey.Public(), root, rootKey)
+	assertNotError(t, err, "Failed to create intermediate")
+	leaf, err := newIssuedCertificate("example.com", x509.ECDSAWithSHA256, leafKey.Public(), intermediate, intermediateKey)
+	assertNotError(t, err, "Failed to create leaf")
+
+	// Test that the client rejects a chain with a SHA-1-signed intermediate,
+	// since it does not advertise SHA-1
+	c2s := pipe()
+	s2c := pipe()
+	client := &Conn{
+		config:   &Config{ServerName: "example.com"},
+		isClient: true,
+		in:       newRecordLayer(s2c),
+		out:      newRecordLayer(c2s),
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Handshake()
+	}()
+
+	server := newScriptedServer(t, c2s, s2c, nil)
+	_, err = server.hOut.WriteMessageBody(&encryptedExtensionsBody{})
+	assertNotError(t, err, "Failed to send EncryptedExtensions")
+	_, err = server.hOut.WriteMessageBody(&certificateBody{
+		certificateList: []*x509.Certificate{leaf, intermediate, root},
+	})
+	assertNotError(t, err, "Failed to send Certificate")
+
+	pt, err := server.in.ReadRecord()
+	assertNotError(t, err, "Failed to read client alert")
+	assertEquals(t, pt.contentType, recordTypeAlert)
+	assertByteEquals(t, pt.fragment, []byte{alertLevelError, byte(alertBadCertificate)})
+
+	err = <-done
+	assertError(t, err, "Client accepted a SHA-1-signed intermediate")
+	assertEquals(t, err.(*net.OpError).Err, error(alertBadCertificate))
+}
+
+func TestRSAPSSKeyEncodings(t *testing.T) {
+	// Test that the server uses an rsa_pss_rsae scheme for its
+	// rsaEncryption key when the client's first choices are refused
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{},
+		&Config{RejectDeprecatedSignatureAlgorithms: true})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assertEquals(t, client.ConnectionState().PeerSignatureScheme, RSA_PSS_RSAE_SHA256)
+	assertEquals(t, server.ConnectionState().LocalSignatureScheme, RSA_PSS_RSAE_SHA256)
+
+	// Test that the client requires the scheme to match the encoding of the
+	// server's key
+	priv, _ := rsa.GenerateKey(prng, 1024)
+	rsaeCert, err := newTestCertificate(priv)
+	assertNotError(t, err, "Failed to create rsaEncryption certificate")
+	pssCert, err := newRSAPSSTestCertificate(priv)
+	assertNotError(t, err, "Failed to create RSASSA-PSS certificate")
+
+	cases := []struct {
+		name   string
+		cert   *x509.Certificate
+		scheme SignatureScheme
+		ok     bool
+	}{
+		{"rsae scheme, rsaEncryption key", rsaeCert, RSA_PSS_RSAE_SHA256, true},
+		{"pss scheme, RSASSA-PSS key", pssCert, RSA_PSS_PSS_SHA256, true},
+		{"pss scheme, rsaEncryption key", rsaeCert, RSA_PSS_PSS_SHA256, false},
+		{"rsae scheme, RSASSA-PSS key", pssCert, RSA_PSS_RSAE_SHA256, false},
+		{"legacy scheme, RSASSA-PSS key", pssCert, RSA_PKCS1_SHA256, false},
+	}
+	for _, c := range cases {
+		c2s := pipe()
+		s2c := pipe()
+		client := &Conn{
+			config:   &Config{ServerName: "example.com", InsecureSkipVerify: true},
+			isClient: true,
+			in:       newRecordLayer(s2c),
+			out:      newRecordLayer(c2s),
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- client.Handshake()
+		}()
+
+		server := newScriptedServer(t, c2s, s2c, nil)
+		eem, _ := handshakeMessageFromBody(&encryptedExtensionsBody{})
+		certm, _ := handshakeMessageFromBody(&certificateBody{certificateList: []*x509.Certificate{c.cert}})
+		cv := &certificateVerifyBody{alg: c.scheme.algorithm()}
+		signed := append(append([]*handshakeMessage{}, server.ctx.transcript...), eem, certm)
+		assertNotError(t, cv.Sign(priv, signed, contextServerCertificateVerify), "Failed to sign CertificateVerify")
+		cvm, _ := handshakeMessageFromBody(cv)
+		flight := []*handshakeMessage{eem, certm, cvm}
+		server.ctx.Update(flight)
+		finm, _ := handshakeMessageFromBody(server.ctx.serverFinished)
+		assertNotError(t, server.hOut.WriteMessages(append(flight, finm)), "Failed to send flight")
+
+		pt, err := server.in.ReadRecord()
+		assertNotError(t, err, "Failed to read from the client: "+c.name)
+		err = <-done
+		if c.ok {
+			assertEquals(t, pt.contentType, recordTypeHandshake)
+			assertNotError(t, err, "Client rejected a valid scheme: "+c.name)
+			assertEquals(t, client.ConnectionState().PeerSignatureScheme, c.scheme)
+			continue
+		}
+
+		assertByteEquals(t, pt.fragment, []byte{alertLevelError, byte(alertIllegalParameter)})
+		assertError(t, err, "Client accepted a mismatched scheme: "+c.name)
+		assertEquals(t, err.(*net.OpError).Err, error(alertIllegalParameter))
+	}
+}
+
+func TestHandshakeReadBufferSize(t *testing.T) {
+	// Test the default, the lower bound, and a configured size
+	for _, sizes := range [][2]int{
+		{0, defaultHandshakeReadBufferSize},
+		{1, minHandshakeReadBufferSize},
+		{1024, 1024},
+	} {
+		conn := Client(nil, &Config{HandshakeReadBufferSize: sizes[0]})
+		hIn, _ := conn.handshakeLayers()
+		assertEquals(t, cap(hIn.buffer), sizes[1])
+	}
+
+	// Test that the handshake completes with the smallest buffer, even though
+	// the server's Certificate is longer
+	config := &Config{HandshakeReadBufferSize: 1}
+	client, server, clientErr, serverErr := handshakeOverPipe(config, config)
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assert(t, client.ConnectionState().HandshakeComplete, "Client handshake not complete")
+	assert(t, server.ConnectionState().HandshakeComplete, "Server handshake not complete")
+}
+
+func TestHandshakeTimings(t *testing.T) {
+	// Test that nothing is recorded by default
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assertEquals(t, client.ConnectionState().HandshakeTimings, HandshakeTimings{})
+	assertEquals(t, server.ConnectionState().HandshakeTimings, HandshakeTimings{})
+
+	// Test that each side records the steps it performs
+	config := &Config{RecordHandshakeTimings: true}
+	client, server, clientErr, serverErr = handshakeOverPipe(config, config)
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+
+	clientTimings := client.ConnectionState().HandshakeTimings
+	serverTimings := server.ConnectionState().HandshakeTimings
+	for _, d := range []time.Duration{
+		clientTimings.KeyShareGeneration, clientTimings.Verification,
+		clientTimings.NetworkRead, clientTimings.Total,
+		serverTimings.KeyShareGeneration, serverTimings.Signing,
+		serverTimings.NetworkRead, serverTimings.Total,
+	} {
+		assert(t, d > 0, "Timing not recorded")
+	}
+	assertEquals(t, clientTimings.Signing, time.Duration(0))
+	assertEquals(t, serverTimings.Verification, time.Duration(0))
+	for _, timings := range []HandshakeTimings{clientTimings, serverTimings} {
+		parts := timings.KeyShareGeneration + timings.Signing + timings.Verification + timings.NetworkRead
+		assert(t, parts <= timings.Total, "Steps took longer than the whole handshake")
+	}
+}
+
+func TestConnectionState(t *testing.T) {
+	clientConfig := &Config{
+		ServerName:         "mint.example.org",
+		InsecureSkipVerify: true,
+		CipherSuites:       []cipherSuite{TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+		NextProtos:         []string{"h2"},
+	}
+	serverConfig := &Config{NextProtos: []string{"h2"}}
+
+	// Test that nothing is reported before the handshake
+	cConn, sConn := net.Pipe()
+	client := Client(cConn, clientConfig)
+	server := Server(sConn, serverConfig)
+	assertDeepEquals(t, client.ConnectionState(), ConnectionState{})
+	assertDeepEquals(t, server.ConnectionState(), ConnectionState{})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Handshake()
+	}()
+	assertNotError(t, client.Handshake(), "Client failed handshake")
+	assertNotError(t, <-done, "Server failed handshake")
+
+	// Test that both sides agree on what was negotiated
+	for _, state := range []ConnectionState{client.ConnectionState(), server.ConnectionState()} {
+		assert(t, state.HandshakeComplete, "Handshake not reported complete")
+		assertEquals(t, state.Version, uint16(tls13Version))
+		assertEquals(t, state.CipherSuite, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384)
+		assertEquals(t, state.NamedGroup, supportedGroups[0])
+		assertEquals(t, state.ServerName, "mint.example.org")
+		assertEquals(t, state.NegotiatedProtocol, "h2")
+	}
+
+	// Test that only the client saw a certificate
+	clientState := client.ConnectionState()
+	assertEquals(t, len(clientState.PeerCertificates), 1)
+	assertEquals(t, clientState.PeerCertificates[0].Subject.CommonName, "example.com")
+	assertEquals(t, len(server.ConnectionState().PeerCertificates), 0)
+}
+
+func TestRequireStapling(t *testing.T) {
+	priv, err := newSigningKey(signatureAlgorithmECDSA)
+	assertNotError(t, err, "Failed to generate key")
+	mustStaple, err := newTestCertificate(priv, tlsFeatureExtension(tlsFeatureStatusRequest))
+	assertNotError(t, err, "Failed to create certificate")
+
+	// Test that a must-staple certificate without a staple is rejected
+	c2s := pipe()
+	s2c := pipe()
+	client := &Conn{
+		config:   &Config{ServerName: "example.com"},
+		isClient: true,
+		in:       newRecordLayer(s2c),
+		out:      newRecordLayer(c2s),
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Handshake()
+	}()
+
+	server := newScriptedServer(t, c2s, s2c, nil)
+	_, err = server.hOut.WriteMessageBody(&encryptedExtensionsBody{})
+	assertNotError(t, err, "Failed to send EncryptedExtensions")
+	_, err = server.hOut.WriteMessageBody(&certificateBody{certificateList: []*x509.Certificate{mustStaple}})
+	assertNotError(t, err, "Failed to send Certificate")
+
+	pt, err := server.in.ReadRecord()
+	assertNotError(t, err, "Failed to read client alert")
+	assertByteEquals(t, pt.fragment, []byte{alertLevelError, byte(alertBadCertStatusResponse)})
+	err = <-done
+	assertError(t, err, "Client accepted a must-staple certificate without a staple")
+	assertEquals(t, err.(*net.OpError).Err, error(alertBadCertStatusResponse))
+
+	// Test that the client can require a staple for any certificate
+	_, _, clientErr, _ := handshakeOverPipe(&Config{RequireStapling: true}, &Config{})
+	assertError(t, clientErr, "Client accepted a certificate without a required staple")
+	assertEquals(t, clientErr.(*net.OpError).Err, error(alertBadCertStatusResponse))
+}
+
+func TestAcceptableCertKeyTypes(t *testing.T) {
+	// Test that an RSA server certificate is rejected by a client that only
+	// accepts ECDSA
+	_, _, clientErr, serverErr := handshakeOverPipe(&Config{AcceptableCertKeyTypes: []x509.PublicKeyAlgorithm{x509.ECDSA}}, &Config{})
+	assertError(t, clientErr, "Client accepted an RSA certificate")
+	assertEquals(t, clientErr.(*net.OpError).Err, error(alertUnsupportedCertificate))
+	alertErr, ok := serverErr.(*AlertError)
+	assert(t, ok, "Server did not receive an alert")
+	assertEquals(t, alert(alertErr.Alert), alertUnsupportedCertificate)
+
+	// Test that it is accepted once RSA is listed
+	for _, keyTypes := range [][]x509.PublicKeyAlgorithm{{x509.RSA}, {x509.ECDSA, x509.RSA}} {
+		_, _, clientErr, serverErr = handshakeOverPipe(&Config{AcceptableCertKeyTypes: keyTypes}, &Config{})
+		assertNotError(t, clientErr, fmt.Sprintf("Client rejected an RSA certificate with %v", keyTypes))
+		assertNotError(t, serverErr, "Server failed handshake")
+	}
+
+	// Test that an ECDSA certificate is accepted by a client that only
+	// accepts ECDSA
+	leafKey, _ := newSigningKey(signatureAlgorithmECDSA)
+	now := time.Now()
+	cert, roots, err := newTestChain("example.com", leafKey, now.Add(-time.Hour), now.Add(time.Hour))
+	assertNotError(t, err, "Failed to issue certificate chain")
+	_, _, clientErr, serverErr = handshakeOverPipe(
+		&Config{RootCAs: roots, AcceptableCertKeyTypes: []x509.PublicKeyAlgorithm{x509.ECDSA}},
+		&Config{Certificates: []Certificate{cert}})
+	assertNotError(t, clientErr, "Client rejected an ECDSA certificate")
+	assertNotError(t, serverErr, "Server failed handshake")
+}
+
+func TestGetConfigForClient(t *testing.T) {
+	// Test that the server negotiates ALPN with the Config that it selects
+	// for the name that the client asked for
+	configs := map[string]*Config{
+		"a.example": &Config{NextProtos: []string{"h2", "http/1.1"}},
+		"b.example": &Config{NextProtos: []string{"http/1.1"}},
+	}
+	serverConfig := &Config{
+		GetConfigForClient: func(info *ClientHelloInfo) (*Config, error) {
+			return configs[info.ServerName], nil
+		},
+	}
+	for name, protocol := range map[string]string{"a.example": "h2", "b.example": "http/1.1"} {
+		clientConfig := &Config{
+			ServerName:         name,
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"h2", "http/1.1"},
+		}
+		client, server, clientErr, serverErr := handshakeOverPipe(clientConfig, serverConfig)
+		assertNotError(t, clientErr, "Client failed handshake")
+		assertNotError(t, serverErr, "Server failed handshake")
+		assertEquals(t, client.ConnectionState().NegotiatedProtocol, protocol)
+		assertEquals(t, server.ConnectionState().NegotiatedProtocol, protocol)
+	}
+
+	// Test that without a Config for the name, the original one is used
+	clientConfig := &Config{
+		ServerName:         "c.example",
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2"},
+	}
+	client, _, clientErr, serverErr := handshakeOverPipe(clientConfig, serverConfig)
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assertEquals(t, client.ConnectionState().NegotiatedProtocol, "")
+
+	// Test that an error aborts the handshake
+	serverConfig.GetConfigForClient = func(info *ClientHelloInfo) (*Config, error) {
+		return nil, fmt.Errorf("no config")
+	}
+	_, _, clientErr, serverErr = handshakeOverPipe(clientConfig, serverConfig)
+	assertError(t, serverErr, "Server ignored a GetConfigForClient error")
+	alertErr, ok := clientErr.(*AlertError)
+	assert(t, ok, "Client did not receive an alert")
+	assertEquals(t, alert(alertErr.Alert), alertInternalError)
+}
+
+func TestALPN(t *testing.T) {
+	// Test that the client offers its protocols in order and that both sides
+	// report the server's selection, even when it is not the client's first
+	// choice
+	clientConfig := &Config{
+		NextProtos:              []string{"h2", "http/1.1"},
+		ExportHandshakeMessages: true,
+	}
+	serverConfig := &Config{NextProtos: []string{"http/1.1"}}
+	client, server, clientErr, serverErr := handshakeOverPipe(clientConfig, serverConfig)
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assertEquals(t, client.ConnectionState().NegotiatedProtocol, "http/1.1")
+	assertEquals(t, server.ConnectionState().NegotiatedProtocol, "http/1.1")
+
+	ch := new(clientHelloBody)
+	_, err := ch.Unmarshal(client.HandshakeMessages()[0][handshakeHeaderLen:])
+	assertNotError(t, err, "Failed to unmarshal ClientHello")
+	alpn := new(alpnExtension)
+	assert(t, ch.extensions.Find(alpn), "ClientHello did not include ALPN")
+	assertDeepEquals(t, alpn.protocols, []string{"h2", "http/1.1"})
+
+	// Test that the server's selection is carried in EncryptedExtensions,
+	// which follows the ServerHello in the transcript
+	eem := client.HandshakeMessages()[2]
+	assertEquals(t, handshakeType(eem[0]), handshakeTypeEncryptedExtensions)
+	ee := new(encryptedExtensionsBody)
+	_, err = ee.Unmarshal(eem[handshakeHeaderLen:])
+	assertNotError(t, err, "Failed to unmarshal EncryptedExtensions")
+	alpn = new(alpnExtension)
+	assert(t, extensionList(*ee).Find(alpn), "EncryptedExtensions did not include ALPN")
+	assertDeepEquals(t, alpn.protocols, []string{"http/1.1"})
+
+	// Test that the server aborts without a common protocol
+	_, _, clientErr, serverErr = handshakeOverPipe(clientConfig, &Config{NextProtos: []string{"spdy/3"}})
+	assertError(t, serverErr, "Server accepted a client with no common protocol")
+	assertEquals(t, serverErr.(*net.OpError).Err, error(alertNoApplicationProtocol))
+	alertErr, ok := clientErr.(*AlertError)
+	assert(t, ok, "Client did not receive an alert")
+	assertEquals(t, alert(alertErr.Alert), alertNoApplicationProtocol)
+
+	// Test that nothing is negotiated if either side doesn't use ALPN
+	for _, configs := range [][2]*Config{
+		{&Config{}, serverConfig},
+		{clientConfig, &Config{}},
+	} {
+		client, server, clientErr, serverErr = handshakeOverPipe(configs[0], configs[1])
+		assertNotError(t, clientErr, "Client failed handshake")
+		assertNotError(t, serverErr, "Server failed handshake")
+		assertEquals(t, client.ConnectionState().NegotiatedProtocol, "")
+		assertEquals(t, server.ConnectionState().NegotiatedProtocol, "")
+	}
+}
+
+func TestApplicationSettings(t *testing.T) {
+	clientSettings := []byte{0x00, 0x04, 0x00, 0x00, 0x10, 0x00}
+	serverSettings := []byte{0x00, 0x03, 0x00, 0x00, 0x00, 0x64}
+
+	// Test that both sides see the other's settings for h2
+	clientConfig := &Config{
+		NextProtos:              []string{"h2", "http/1.1"},
+		ApplicationSettings:     map[string][]byte{"h2": clientSettings},
+		ExportHandshakeMessages: true,
+	}
+	serverConfig := &Config{
+		NextProtos:          []string{"h2"},
+		ApplicationSettings: map[string][]byte{"h2": serverSettings},
+	}
+	client, server, clientErr, serverErr := handshakeOverPipe(clientConfig, serverConfig)
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assertEquals(t, client.ConnectionState().NegotiatedProtocol, "h2")
+	assertByteEquals(t, client.ConnectionState().PeerApplicationSettings, serverSettings)
+	assertByteEquals(t, server.ConnectionState().PeerApplicationSettings, clientSettings)
+
+	// Test that the ClientHello only lists protocols with settings, and that
+	// the client's settings are covered by its Finished
+	ch := new(clientHelloBody)
+	_, err := ch.Unmarshal(client.HandshakeMessages()[0][handshakeHeaderLen:])
+	assertNotError(t, err, "Failed to unmarshal ClientHello")
+	alps := &applicationSettingsExtension{inClientHello: true}
+	assert(t, ch.extensions.Find(alps), "ClientHello did not include ALPS")
+	assertDeepEquals(t, alps.protocols, []string{"h2"})
+	messages := client.HandshakeMessages()
+	assertEquals(t, handshakeType(messages[len(messages)-2][0]), handshakeTypeClientEncryptedExtensions)
+
+	// Test that the data channel works after ALPS
+	go client.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(server, buf)
+	assertNotError(t, err, "Server failed to read after ALPS")
+	assertByteEquals(t, buf, []byte("ping"))
+
+	// Test that nothing is exchanged unless both sides have settings for the
+	// negotiated protocol
+	client, server, clientErr, serverErr = handshakeOverPipe(clientConfig, &Config{NextProtos: []string{"h2"}})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assert(t, client.ConnectionState().PeerApplicationSettings == nil, "Client got settings from the server")
+	assert(t, server.ConnectionState().PeerApplicationSettings == nil, "Server got settings from the client")
+}
+
+func TestRecordSizeLimit(t *testing.T) {
+	cases := []struct {
+		name                     string
+		clientLimit, serverLimit uint16
+		clientSees, serverSees   int
+	}{
+		{"neither", 0, 0, maxFragmentLen, maxFragmentLen},
+		{"client only", 1024, 0, maxFragmentLen, 1023},
+		{"server only", 0, 512, maxFragmentLen, maxFragmentLen},
+		{"both", 1024, 512, 511, 1023},
+	}
+	for _, c := range cases {
+		// Test that each side reports the limit that the other advertised,
+		// less the content type, and that a server only advertises one in
+		// reply to a client
+		client, server, clientErr, serverErr := handshakeOverPipe(
+			&Config{RecordSizeLimit: c.clientLimit}, &Config{RecordSizeLimit: c.serverLimit})
+		assertNotError(t, clientErr, c.name+": Client failed handshake")
+		assertNotError(t, serverErr, c.name+": Server failed handshake")
+		assertEquals(t, client.ConnectionState().PeerMaxRecordSize, c.clientSees)
+		assertEquals(t, server.ConnectionState().PeerMaxRecordSize, c.serverSees)
+	}
+}
+
+func TestRecordSizeLimitEnforced(t *testing.T) {
+	const clientLimit, serverLimit = 256, 128
+	cConn, sConn := net.Pipe()
+	clientWrites := &writeCountingConn{Conn: cConn}
+	serverWrites := &writeCountingConn{Conn: sConn}
+	client := Client(clientWrites, &Config{
+		ServerName:         "example.com",
+		InsecureSkipVerify: true,
+		RecordSizeLimit:    clientLimit,
+	})
+	server := Server(serverWrites, &Config{
+		RecordSizeLimit: serverLimit,
+		RecordPadding:   func(plaintextLen int) int { return 1 << 20 },
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Handshake()
+	}()
+	assertNotError(t, client.Handshake(), "Client failed handshake")
+	assertNotError(t, <-done, "Server failed handshake")
+
+	// Test that long writes in both directions arrive intact, even though
+	// the server pads every record as far as it can
+	data := bytes.Repeat([]byte{0xa5}, 1000)
+	for _, c := range []struct{ from, to *Conn }{{client, server}, {server, client}} {
+		written := make(chan error, 1)
+		go func() {
+			_, err := c.from.Write(data)
+			written <- err
+		}()
+		buf := make([]byte, len(data))
+		_, err := io.ReadFull(c.to, buf)
+		assertNotError(t, err, "Failed to read data")
+		assertByteEquals(t, buf, data)
+		assertNotError(t, <-written, "Failed to write data")
+	}
+
+	// Test that every protected record, handshake or not, fits in the limit
+	// that the peer advertised: its content, content type and padding
+	overhead := client.out.cipher.Overhead()
+	for _, c := range []struct {
+		name   string
+		writes [][]byte
+		limit  int
+	}{{"client", clientWrites.writes, serverLimit}, {"server", serverWrites.writes, clientLimit}} {
+		stream := bytes.Join(c.writes, nil)
+		records := 0
+		for len(stream) > 0 {
+			length := (int(stream[3]) << 8) + int(stream[4])
+			// The first record, a ClientHello or ServerHello, isn't protected
+			if records > 0 {
+				assert(t, length-overhead <= c.limit,
+					fmt.Sprintf("%s sent a record over the limit [%d > %d]", c.name, length-overhead, c.limit))
+			}
+			stream = stream[recordHeaderLen+length:]
+			records++
+		}
+		assert(t, records > 3, fmt.Sprintf("%s sent only %d records", c.name, records))
+	}
+}
+
+func TestRejectDeprecatedSignatureAlgorithms(t *testing.T) {
+	originalAlgorithms := signatureAlgorithms
+	signatureAlgorithms = []signatureAndHashAlgorithm{
+		signatureAndHashAlgorithm{hashAlgorithmSHA1, signatureAlgorithmRSA},
+	}
+	defer func() { signatureAlgorithms = originalAlgorithms }()
+
+	// Test that a client offering only rsa_pkcs1_sha1 is rejected
+	serverConfig := &Config{RejectDeprecatedSignatureAlgorithms: true}
+	_, _, clientErr, serverErr := handshakeOverPipe(&Config{}, serverConfig)
+	assertError(t, serverErr, "Server accepted only deprecated signature algorithms")
+	assertEquals(t, serverErr.(*net.OpError).Err, error(alertHandshakeFailure))
+	alertErr, ok := clientErr.(*AlertError)
+	assert(t, ok, "Client did not receive an alert")
+	assertEquals(t, alert(alertErr.Alert), alertHandshakeFailure)
+
+	assert(t, isDeprecatedSignatureAlgorithm(signatureAndHashAlgorithm{hashAlgorithmSHA1, signatureAlgorithmECDSA}), "SHA-1 not deprecated")
+	assert(t, isDeprecatedSignatureAlgorithm(signatureAndHashAlgorithm{hashAlgorithmSHA256, signatureAlgorithmRSA}), "PKCS#1 v1.5 not deprecated")
+	assert(t, !isDeprecatedSignatureAlgorithm(signatureAndHashAlgorithm{hashAlgorithmSHA256, signatureAlgorithmRSAPSS}), "RSA-PSS deprecated")
+}
+
+// newClientCertificate makes a self-signed certificate for client
+// authentication
+func newClientCertificate(t *testing.T) Certificate {
+	priv, err := newSigningKey(signatureAlgorithmECDSA)
+	assertNotError(t, err, "Failed to generate client key")
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(4),
+		Subject:      pkix.Name{CommonName: "client.example"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(prng, template, template, priv.Public(), priv)
+	assertNotError(t, err, "Failed to generate client certificate")
+	cert, err := x509.ParseCertificate(der)
+	assertNotError(t, err, "Failed to parse client certificate")
+	return Certificate{Chain: []*x509.Certificate{cert}, PrivateKey: priv}
+}
+
+func TestClientAuth(t *testing.T) {
+	clientCert := newClientCertificate(t)
+
+	// Test that the server doesn't ask for a certificate by default, even if
+	// the client has one
+	client, server, clientErr, serverErr := handshakeOverPipe(
+		&Config{Certificates: []Certificate{clientCert}}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assertEquals(t, len(server.ConnectionState().PeerCertificates), 0)
+
+	// Test that a requested certificate is optional
+	client, server, clientErr, serverErr = handshakeOverPipe(
+		&Config{}, &Config{ClientAuth: RequestClientCert})
+	assertNotError(t, clientErr, "Client failed handshake without a certificate")
+	assertNotError(t, serverErr, "Server failed handshake without a client certificate")
+	assertEquals(t, len(server.ConnectionState().PeerCertificates), 0)
+	assertEquals(t, client.ConnectionState().LocalSignatureScheme, SignatureScheme(0))
+
+	// Test that the client's certificate is verified and recorded, whether it
+	// is requested or required, and that the connection works afterward
+	for _, clientAuth := range []ClientAuthType{RequestClientCert, RequireAndVerifyClientCert} {
+		client, server, clientErr, serverErr = handshakeOverPipe(
+			&Config{Certificates: []Certificate{clientCert}}, &Config{ClientAuth: clientAuth})
+		assertNotError(t, clientErr, "Client failed handshake with a certificate")
+		assertNotError(t, serverErr, "Server failed handshake with a client certificate")
+
+		state := server.ConnectionState()
+		assertEquals(t, len(state.PeerCertificates), 1)
+		assert(t, state.PeerCertificates[0].Equal(clientCert.Chain[0]), "Wrong client certificate")
+		assertByteEquals(t, state.PeerPublicKeyInfo, clientCert.Chain[0].RawSubjectPublicKeyInfo)
+		assertEquals(t, state.PeerSignatureScheme, client.ConnectionState().LocalSignatureScheme)
+		assertEquals(t, state.PeerSignatureScheme, ECDSA_SECP256R1_SHA256)
+
+		go client.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(server, buf)
+		assertNotError(t, err, "Server failed to read after client auth")
+		assertByteEquals(t, buf, []byte("hello"))
+	}
+}
+
+func TestClientAuthenticated(t *testing.T) {
+	clientCert := newClientCertificate(t)
+
+	// Test that a client that sent an empty Certificate is not authenticated
+	_, server, clientErr, serverErr := handshakeOverPipe(&Config{}, &Config{ClientAuth: RequestClientCert})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assert(t, !server.ConnectionState().ClientAuthenticated, "Client without a certificate authenticated")
+
+	// Test that a certificate that was only requested, and so whose chain
+	// wasn't verified, doesn't count as authentication
+	_, server, clientErr, serverErr = handshakeOverPipe(
+		&Config{Certificates: []Certificate{clientCert}}, &Config{ClientAuth: RequestClientCert})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assert(t, !server.ConnectionState().ClientAuthenticated, "Client with an unverified certificate authenticated")
+	assertEquals(t, len(server.ConnectionState().PeerCertificates), 1)
+
+	// Test that the server reports a required certificate
+	client, server, clientErr, serverErr := handshakeOverPipe(
+		&Config{Certificates: []Certificate{clientCert}}, &Config{ClientAuth: RequireAndVerifyClientCert})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	state := server.ConnectionState()
+	assert(t, state.ClientAuthenticated, "Client not reported as authenticated")
+	assertEquals(t, len(state.PeerCertificates), 1)
+	assert(t, state.PeerCertificates[0].Equal(clientCert.Chain[0]), "Wrong client certificate")
+	assert(t, !client.ConnectionState().ClientAuthenticated, "Client reports itself as authenticated")
+}
+
+func TestClientAuthRequiredWithoutCertificate(t *testing.T) {
+	// The client only learns that it was rejected when it reads, so it has
+	// to keep reading for the server's alert to get through the pipe
+	cConn, sConn := net.Pipe()
+	client := Client(cConn, &Config{ServerName: "example.com", InsecureSkipVerify: true})
+	server := Server(sConn, &Config{ClientAuth: RequireAndVerifyClientCert})
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Handshake()
+		sConn.Close()
+	}()
+
+	assertNotError(t, client.Handshake(), "Client failed to send its flight")
+	_, err := client.Read(make([]byte, 10))
+	alertErr, ok := err.(*AlertError)
+	assert(t, ok, fmt.Sprintf("Client did not receive an alert: %v", err))
+	assertEquals(t, alert(alertErr.Alert), alertCertificateRequired)
+
+	err = <-done
+	assertError(t, err, "Server accepted a client without a certificate")
+	assertEquals(t, err.(*net.OpError).Err, error(alertCertificateRequired))
+}
+
+func TestClientCertificateVerification(t *testing.T) {
+	clientKey, _ := newSigningKey(signatureAlgorithmECDSA)
+	now := time.Now()
+	clientCert, clientCAs, err := newTestChain("client.example", clientKey, now.Add(-time.Hour), now.Add(time.Hour),
+		x509.ExtKeyUsageClientAuth)
+	assertNotError(t, err, "Failed to issue client certificate chain")
+	_, otherCAs, err := newTestChain("client.example", clientKey, now.Add(-time.Hour), now.Add(time.Hour),
+		x509.ExtKeyUsageClientAuth)
+	assertNotError(t, err, "Failed to issue client certificate chain")
+	serverCert, serverRoots := testServerChain()
+	var gotRaw [][]byte
+	var gotChains [][]*x509.Certificate
+	recording := func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		gotRaw, gotChains = rawCerts, verifiedChains
+		return nil
+	}
+
+	// Test that a required certificate that chains to one of ClientCAs is
+	// accepted, and that VerifyPeerCertificate sees it with the chain
+	_, server, clientErr, serverErr := handshakeOverPipe(
+		&Config{Certificates: []Certificate{clientCert}},
+		&Config{ClientAuth: RequireAndVerifyClientCert, ClientCAs: clientCAs, VerifyPeerCertificate: recording})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server rejected a trusted client certificate")
+	assert(t, server.ConnectionState().ClientAuthenticated, "Client not authenticated")
+	assertEquals(t, len(gotRaw), 2)
+	assertByteEquals(t, gotRaw[0], clientCert.Chain[0].Raw)
+	assertEquals(t, len(gotChains), 1)
+	assertEquals(t, len(gotChains[0]), 3)
+
+	// Test that a certificate that is only requested isn't checked against
+	// ClientCAs, but is still passed to VerifyPeerCertificate
+	_, server, clientErr, serverErr = handshakeOverPipe(
+		&Config{Certificates: []Certificate{clientCert}},
+		&Config{ClientAuth: RequestClientCert, ClientCAs: otherCAs, VerifyPeerCertificate: recording})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server rejected a requested client certificate")
+	assertEquals(t, len(gotRaw), 2)
+	assert(t, gotChains == nil, "Callback got verified chains without verification")
+
+	// Test that an untrusted certificate, one that isn't for client
+	// authentication, and one that VerifyPeerCertificate rejects are all
+	// refused with a bad_certificate alert
+	errRejected := fmt.Errorf("client certificate rejected")
+	cases := []struct {
+		name         string
+		clientCert   Certificate
+		serverConfig *Config
+	}{
+		{"untrusted root", clientCert, &Config{ClientAuth: RequireAndVerifyClientCert, ClientCAs: otherCAs}},
+		{"server certificate", serverCert, &Config{ClientAuth: RequireAndVerifyClientCert, ClientCAs: serverRoots}},
+		{"rejected by callback", clientCert, &Config{
+			ClientAuth: RequireAndVerifyClientCert,
+			ClientCAs:  clientCAs,
+			VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+				return errRejected
+			},
+		}},
+	}
+	for _, c := range cases {
+		// The client only learns that it was rejected when it reads
+		cConn, sConn := net.Pipe()
+		client := Client(cConn, &Config{ServerName: "example.com", InsecureSkipVerify: true, Certificates: []Certificate{c.clientCert}})
+		server := Server(sConn, c.serverConfig)
+		done := make(chan error, 1)
+		go func() {
+			done <- server.Handshake()
+			sConn.Close()
+		}()
+
+		assertNotError(t, client.Handshake(), fmt.Sprintf("Client failed to send its flight [%s]", c.name))
+		_, err := client.Read(make([]byte, 10))
+		alertErr, ok := err.(*AlertError)
+		assert(t, ok, fmt.Sprintf("Client did not receive an alert [%s]: %v", c.name, err))
+		assertEquals(t, alert(alertErr.Alert), alertBadCertificate)
+
+		err = <-done
+		assertError(t, err, fmt.Sprintf("Server accepted a bad client certificate [%s]", c.name))
+		assert(t, !server.ConnectionState().ClientAuthenticated, fmt.Sprintf("Client authenticated [%s]", c.name))
+		switch c.name {
+		case "untrusted root":
+			_, ok = err.(x509.UnknownAuthorityError)
+			assert(t, ok, fmt.Sprintf("Server did not return an x509.UnknownAuthorityError: %v", err))
+		case "rejected by callback":
+			assertEquals(t, err, errRejected)
+		}
+		cConn.Close()
+	}
+}
+
+// filteringTranscriptHash wraps the default transcript hash and leaves out
+// the messages that skip selects
+type filteringTranscriptHash struct {
+	TranscriptHash
+	skip func(msg []byte) bool
+}
+
+func (h filteringTranscriptHash) Write(data []byte) (int, error) {
+	if h.skip(data) {
+		return len(data), nil
+	}
+	return h.TranscriptHash.Write(data)
+}
+
+func (h filteringTranscriptHash) Clone() TranscriptHash {
+	return filteringTranscriptHash{h.TranscriptHash.Clone(), h.skip}
+}
+
+func TestStrictTranscriptCheck(t *testing.T) {
+	// A transcript hash that leaves EncryptedExtensions out, on both sides,
+	// still produces matching Finished messages, so only the strict check
+	// notices
+	dropEncryptedExtensions := func(alg crypto.Hash) TranscriptHash {
+		return filteringTranscriptHash{newStdTranscriptHash(alg), func(msg []byte) bool {
+			return handshakeType(msg[0]) == handshakeTypeEncryptedExtensions
+		}}
+	}
+	_, _, clientErr, serverErr := handshakeOverPipe(
+		&Config{NewTranscriptHash: dropEncryptedExtensions},
+		&Config{NewTranscriptHash: dropEncryptedExtensions})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+
+	// Test that in strict mode, the corrupted transcript is caught by
+	// whichever side checks it
+	_, _, clientErr, serverErr = handshakeOverPipe(
+		&Config{NewTranscriptHash: dropEncryptedExtensions, Strict: true},
+		&Config{NewTranscriptHash: dropEncryptedExtensions})
+	assertError(t, clientErr, "Strict client accepted a corrupted transcript")
+	assertEquals(t, clientErr.(*net.OpError).Err, error(alertInternalError))
+
+	// The client only learns that the server gave up when it reads
+	cert, roots := testServerChain()
+	cConn, sConn := net.Pipe()
+	client := Client(cConn, &Config{ServerName: "example.com", RootCAs: roots, NewTranscriptHash: dropEncryptedExtensions})
+	server := Server(sConn, &Config{Certificates: []Certificate{cert}, NewTranscriptHash: dropEncryptedExtensions, Strict: true})
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Handshake()
+		sConn.Close()
+	}()
+	assertNotError(t, client.Handshake(), "Client failed handshake")
+	_, err := client.Read(make([]byte, 1))
+	alertErr, ok := err.(*AlertError)
+	assert(t, ok, "Client did not receive an alert")
+	assertEquals(t, alert(alertErr.Alert), alertInternalError)
+	serverErr = <-done
+	assertError(t, serverErr, "Strict server accepted a corrupted transcript")
+	assertEquals(t, serverErr.(*net.OpError).Err, error(alertInternalError))
+
+	// Test that a correct transcript passes the check, including after a
+	// HelloRetryRequest and with client authentication
+	clientCert := newClientCertificate(t)
+	_, _, clientErr, serverErr = handshakeOverPipe(
+		&Config{Strict: true, Groups: []namedGroup{namedGroupX25519, namedGroupP256}, KeyShareCount: 1, Certificates: []Certificate{clientCert}},
+		&Config{Strict: true, Groups: []namedGroup{namedGroupP256}, ClientAuth: RequireAndVerifyClientCert})
+	assertNotError(t, clientErr, "Strict client rejected a correct transcript")
+	assertNotError(t, serverErr, "Strict server rejected a correct transcript")
+}
+
+func TestClientFinishedCoversClientAuth(t *testing.T) {
+	clientCert := newClientCertificate(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert.Chain[0])
+	serverConfig := &Config{ClientAuth: RequireAndVerifyClientCert, ClientCAs: clientCAs, ExportHandshakeMessages: true}
+
+	// Test that the client's Certificate and CertificateVerify are in the
+	// transcript that both sides computed the client's Finished over
+	client, server, clientErr, serverErr := handshakeOverPipe(
+		&Config{Certificates: []Certificate{clientCert}}, serverConfig)
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assertByteEquals(t, server.context.clientFinished.verifyData, client.context.clientFinished.verifyData)
+	messages := server.HandshakeMessages()
+	types := []handshakeType{}
+	for _, msg := range messages[len(messages)-3:] {
+		types = append(types, handshakeType(msg[0]))
+	}
+	assertDeepEquals(t, types, []handshakeType{
+		handshakeTypeCertificate, handshakeTypeCertificateVerify, handshakeTypeFinished,
+	})
+
+	// Test that a Finished that leaves the client's certificate flight out
+	// of the transcript is rejected, even though the CertificateVerify in it
+	// is valid
+	serverFinished := false
+	forgingConfig := &Config{
+		ServerName:         "example.com",
+		InsecureSkipVerify: true,
+		Certificates:       []Certificate{clientCert},
+		NewTranscriptHash: func(alg crypto.Hash) TranscriptHash {
+			return filteringTranscriptHash{newStdTranscriptHash(alg), func(msg []byte) bool {
+				if handshakeType(msg[0]) == handshakeTypeFinished {
+					serverFinished = true
+				}
+				return serverFinished && (handshakeType(msg[0]) == handshakeTypeCertificate ||
+					handshakeType(msg[0]) == handshakeTypeCertificateVerify)
+			}}
+		},
+	}
+
+	cConn, sConn := net.Pipe()
+	client = Client(cConn, forgingConfig)
+	server = Server(sConn, serverConfig)
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Handshake()
+		sConn.Close()
+	}()
+
+	assertNotError(t, client.Handshake(), "Client failed to send its flight")
+	_, err := client.Read(make([]byte, 10))
+	alertErr, ok := err.(*AlertError)
+	assert(t, ok, fmt.Sprintf("Client did not receive an alert: %v", err))
+	assertEquals(t, alert(alertErr.Alert), alertDecryptError)
+
+	err = <-done
+	assertError(t, err, "Server accepted a Finished without the client's certificate flight")
+	assertEquals(t, err.(*net.OpError).Err, error(alertDecryptError))
+}
+
+func TestClientCertificateSelection(t *testing.T) {
+	ecdsaCert := newClientCertificate(t)
+	rsaKey, err := newSigningKey(signatureAlgorithmRSA)
+	assertNotError(t, err, "Failed to generate RSA key")
+	rsaLeaf, err := newTestCertificate(rsaKey)
+	assertNotError(t, err, "Failed to generate RSA certificate")
+	rsaCert := Certificate{Chain: []*x509.Certificate{rsaLeaf}, PrivateKey: rsaKey}
+
+	rsaOnly := &certificateRequestBody{}
+	err = rsaOnly.extensions.Add(&signatureAlgorithmsExtension{
+		algorithms: []signatureAndHashAlgorithm{RSA_PSS_RSAE_SHA256.algorithm()},
+	})
+	assertNotError(t, err, "Failed to add signature_algorithms")
+
+	// Test that the first certificate that can sign with an algorithm the
+	// server accepts is used
+	conn := &Conn{config: &Config{Certificates: []Certificate{ecdsaCert, rsaCert}}}
+	messages, err := conn.clientCertificateMessages(rsaOnly, nil)
+	assertNotError(t, err, "Failed to answer CertificateRequest")
+	assertEquals(t, len(messages), 2)
+	cert := new(certificateBody)
+	_, err = cert.Unmarshal(messages[0].body)
+	assertNotError(t, err, "Failed to parse Certificate")
+	assert(t, cert.certificateList[0].Equal(rsaLeaf), "Wrong certificate selected")
+	certVerify := new(certificateVerifyBody)
+	_, err = certVerify.Unmarshal(messages[1].body)
+	assertNotError(t, err, "Failed to parse CertificateVerify")
+	assertEquals(t, certVerify.alg.scheme(), RSA_PSS_RSAE_SHA256)
+	err = certVerify.Verify(rsaKey.Public(), messages[:1], contextClientCertificateVerify)
+	assertNotError(t, err, "CertificateVerify failed to verify")
+
+	// Test that without a usable certificate, the Certificate is empty and
+	// there is no CertificateVerify
+	conn = &Conn{config: &Config{Certificates: []Certificate{ecdsaCert}}}
+	messages, err = conn.clientCertificateMessages(rsaOnly, nil)
+	assertNotError(t, err, "Failed to answer CertificateRequest")
+	assertEquals(t, len(messages), 1)
+	cert = new(certificateBody)
+	_, err = cert.Unmarshal(messages[0].body)
+	assertNotError(t, err, "Failed to parse Certificate")
+	assertEquals(t, len(cert.certificateList), 0)
+
+	// Test that a CertificateRequest has to list signature algorithms
+	_, err = conn.clientCertificateMessages(&certificateRequestBody{}, nil)
+	assertEquals(t, err, error(alertMissingExtension))
+}
+
+func TestPostHandshakeAuthRequiresOffer(t *testing.T) {
+	// Test that the server refuses to request a certificate from a client
+	// that did not offer post-handshake auth.  Nothing is written, so this
+	// returns even though the client is not reading.
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assert(t, !server.postHandshakeAuth, "Server thinks post-handshake auth was offered")
+	_, err := server.RequestClientCertificate()
+	assertError(t, err, "Requested a certificate without post-handshake auth")
+
+	// Test that only the server can make a request
+	_, err = client.RequestClientCertificate()
+	assertError(t, err, "Client requested a certificate")
+
+	// Test that the request is sent when post-handshake auth was offered
+	client, server, clientErr, serverErr = handshakeOverPipe(&Config{PostHandshakeAuth: true}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assert(t, server.postHandshakeAuth, "Server did not see post-handshake auth offered")
+
+	request := make(chan *tlsPlaintext, 1)
+	go func() {
+		pt, _ := client.in.ReadRecord()
+		request <- pt
+	}()
+	_, err = server.RequestClientCertificate()
+	assertNotError(t, err, "Failed to request a certificate with post-handshake auth")
+
+	pt := <-request
+	assert(t, pt != nil, "Client did not receive a record")
+	assertEquals(t, pt.contentType, recordTypeHandshake)
+	assertEquals(t, handshakeType(pt.fragment[0]), handshakeTypeCertificateRequest)
+}
+
+func TestPostHandshakeCertificateRequests(t *testing.T) {
+	// The responses are written while requests are still being read, so
+	// this needs a buffered transport
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNotError(t, err, "Failed to listen")
+	defer ln.Close()
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		server := Server(conn, &Config{})
+		server.Handshake()
+		accepted <- server
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assertNotError(t, err, "Failed to dial")
+	clientCert := newClientCertificate(t)
+	client := Client(conn, &Config{
+		ServerName:         "example.com",
+		InsecureSkipVerify: true,
+		PostHandshakeAuth:  true,
+		Certificates:       []Certificate{clientCert},
+	})
+	assertNotError(t, client.Handshake(), "Client failed handshake")
+	server := <-accepted
+	assert(t, server != nil && server.handshakeComplete, "Server failed handshake")
+	defer client.Close()
+	defer server.Close()
+
+	// Test that two outstanding requests get distinct contexts
+	context1, err := server.RequestClientCertificate()
+	assertNotError(t, err, "Failed to send first request")
+	context2, err := server.RequestClientCertificate()
+	assertNotError(t, err, "Failed to send second request")
+	assert(t, !bytes.Equal(context1, context2), "Requests share a context")
+	_, ok := server.ClientCertificate(context1)
+	assert(t, !ok, "Response reported before it was read")
+
+	// The client answers both requests while reading up to the server's data,
+	// and the server reads both answers before the client's data
+	_, err = server.Write([]byte("ping"))
+	assertNotError(t, err, "Server failed to write")
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(client, buf)
+	assertNotError(t, err, "Client failed to read")
+	_, err = client.Write([]byte("pong"))
+	assertNotError(t, err, "Client failed to write")
+	_, err = io.ReadFull(server, buf)
+	assertNotError(t, err, "Server failed to read")
+
+	// Test that each response is matched to its request
+	chain, ok := server.ClientCertificate(context1)
+	assert(t, ok, "First response not matched")
+	assertEquals(t, len(chain), 1)
+	assert(t, chain[0].Equal(clientCert.Chain[0]), "Wrong client certificate")
+	_, ok = server.ClientCertificate(context2)
+	assert(t, ok, "Second response not matched")
+	_, ok = server.ClientCertificate([]byte("unknown"))
+	assert(t, !ok, "Response matched to an unknown context")
+	assertEquals(t, len(server.certRequests), 0)
+}
+
+func TestCertificateResponseUnknownContext(t *testing.T) {
+	_, server, clientErr, serverErr := handshakeOverPipe(&Config{PostHandshakeAuth: true}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+
+	// Test that a response for a context that was never requested is rejected
+	server.certRequests = map[string]*handshakeMessage{"context1": &handshakeMessage{}}
+	certm, err := handshakeMessageFromBody(&certificateBody{certificateRequestContext: []byte("context2")})
+	assertNotError(t, err, "Failed to marshal Certificate")
+	err = server.readCertificateResponse(certm)
+	assertEquals(t, err, error(alertIllegalParameter))
+
+	// Test that Finished without a Certificate is rejected
+	finm, err := handshakeMessageFromBody(server.context.clientFinished)
+	assertNotError(t, err, "Failed to marshal Finished")
+	err = server.readCertificateResponseFinished(finm)
+	assertEquals(t, err, error(alertUnexpectedMessage))
+
+	// Test that a Finished that doesn't match the transcript is rejected
+	certm, err = handshakeMessageFromBody(&certificateBody{certificateRequestContext: []byte("context1")})
+	assertNotError(t, err, "Failed to marshal Certificate")
+	err = server.readCertificateResponse(certm)
+	assertNotError(t, err, "Failed to read Certificate for a known context")
+	err = server.readCertificateResponseFinished(finm)
+	assertEquals(t, err, error(alertDecryptError))
+}
+
+// SHA-256 over the ClientHello and ServerHello of the reproducible handshake
+var reproducibleHelloHashHex = "8be7b061d568bba1f373afda503f2587755bb9540c296bee6f03da22b4ae1e32"
+
+func TestReproducibleHandshake(t *testing.T) {
+	handshake := func() (*Conn, *Conn) {
+		clientConfig := &Config{
+			Rand:                    bytes.NewReader(bytes.Repeat([]byte{0xc1}, 4096)),
+			ExportHandshakeMessages: true,
+		}
+		serverConfig := &Config{
+			Rand: bytes.NewReader(bytes.Repeat([]byte{0x5e}, 4096)),
+		}
+		client, server, clientErr, serverErr := handshakeOverPipe(clientConfig, serverConfig)
+		assertNotError(t, clientErr, "Client failed handshake")
+		assertNotError(t, serverErr, "Server failed handshake")
+		return client, server
+	}
+
+	client1, _ := handshake()
+	client2, _ := handshake()
+
+	// Test that the hellos, and so the handshake secrets, are the same on
+	// every run.  The server's certificate is generated afresh each time, so
+	// the rest of the transcript is not.
+	messages1 := client1.HandshakeMessages()
+	messages2 := client2.HandshakeMessages()
+	assertByteEquals(t, messages1[0], messages2[0])
+	assertByteEquals(t, messages1[1], messages2[1])
+	assertByteEquals(t, client1.context.clientHandshakeTrafficSecret, client2.context.clientHandshakeTrafficSecret)
+	assertByteEquals(t, client1.context.serverHandshakeTrafficSecret, client2.context.serverHandshakeTrafficSecret)
+
+	// Test that the hellos match the stored transcript
+	h := sha256.New()
+	h.Write(messages1[0])
+	h.Write(messages1[1])
+	assertEquals(t, hex.EncodeToString(h.Sum(nil)), reproducibleHelloHashHex)
+}
+
+func TestReplayRecordedRandom(t *testing.T) {
+	// Record the random streams of one handshake, with a key share in every
+	// group
+	allShareGroups := []namedGroup{namedGroupX25519, namedGroupP256, namedGroupP384, namedGroupP521}
+	var clientStream, serverStream bytes.Buffer
+	clientConfig := &Config{
+		Rand:                    io.TeeReader(prng, &clientStream),
+		KeyShareGroups:          allShareGroups,
+		ExportHandshakeMessages: true,
+	}
+	serverConfig := &Config{Rand: io.TeeReader(prng, &serverStream)}
+	client, _, clientErr, serverErr := handshakeOverPipe(clientConfig, serverConfig)
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	recorded := client.HandshakeMessages()
+
+	// Test that replaying the streams reproduces the hellos exactly
+	clientConfig = &Config{
+		Rand:                    bytes.NewReader(clientStream.Bytes()),
+		KeyShareGroups:          allShareGroups,
+		ExportHandshakeMessages: true,
+	}
+	serverConfig = &Config{Rand: bytes.NewReader(serverStream.Bytes())}
+	client, _, clientErr, serverErr = handshakeOverPipe(clientConfig, serverConfig)
+	assertNotError(t, clientErr, "Client failed replayed handshake")
+	assertNotError(t, serverErr, "Server failed replayed handshake")
+	replayed := client.HandshakeMessages()
+	assertByteEquals(t, replayed[0], recorded[0])
+	assertByteEquals(t, replayed[1], recorded[1])
+
+	// Test that the client's draws are made in the documented order: key
+	// shares for X25519, P-256, P-384 and P-521, then the random
+	stream := clientStream.Bytes()
+	assertEquals(t, len(stream), 32+32+48+66+32)
+	ch := new(clientHelloBody)
+	_, err := ch.Unmarshal(recorded[0][handshakeHeaderLen:])
+	assertNotError(t, err, "Failed to unmarshal ClientHello")
+	assertByteEquals(t, ch.random[:], stream[32+32+48+66:])
+
+	ks := &keyShareExtension{roleIsServer: false}
+	assert(t, ch.extensions.Find(ks), "ClientHello did not include key shares")
+	pub, _, err := newKeyShare(namedGroupX25519, bytes.NewReader(stream[:32]))
+	assertNotError(t, err, "Failed to regenerate X25519 key share")
+	assertByteEquals(t, ks.shares[0].keyExchange, pub)
+	pub, _, err = newKeyShare(namedGroupP256, bytes.NewReader(stream[32:64]))
+	assertNotError(t, err, "Failed to regenerate P-256 key share")
+	assertByteEquals(t, ks.shares[1].keyExchange, pub)
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += n
+	return n, err
+}
+
+func TestConcurrentHandshake(t *testing.T) {
+	cConn, sConn := net.Pipe()
+	random := &countingReader{Reader: prng}
+	client := Client(cConn, &Config{ServerName: "example.com", InsecureSkipVerify: true, Rand: random})
+	server := Server(sConn, &Config{})
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(server, buf); err != nil {
+			done <- err
+			return
+		}
+		_, err := server.Write(buf)
+		done <- err
+	}()
+
+	// Test that a Read, a Write and a Handshake started together share a
+	// single handshake: one key share and one random, 32 bytes each
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	buf := make([]byte, 4)
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		errs <- client.Handshake()
+	}()
+	go func() {
+		defer wg.Done()
+		_, err := client.Write([]byte("ping"))
+		errs <- err
+	}()
+	go func() {
+		defer wg.Done()
+		n, err := 0, error(nil)
+		for n == 0 && err == nil {
+			n, err = client.Read(buf)
+		}
+		errs <- err
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assertNotError(t, err, "Concurrent call failed")
+	}
+	assertNotError(t, <-done, "Server failed")
+	assertByteEquals(t, buf, []byte("ping"))
+	assertEquals(t, random.n, 64)
+	assert(t, client.ConnectionState().HandshakeComplete, "Handshake did not complete")
+}
+
+func TestReadContext(t *testing.T) {
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+
+	// Test that cancelling the context interrupts a blocked read
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	buf := make([]byte, 10)
+	n, err := client.ReadContext(ctx, buf)
+	assertEquals(t, n, 0)
+	assertEquals(t, err, context.Canceled)
+
+	// Test that a context that is already done fails without reading
+	n, err = client.ReadContext(ctx, buf)
+	assertEquals(t, err, context.Canceled)
+
+	// Test that the deadline is restored, so that reads work afterward
+	data := []byte("hello")
+	go server.Write(data)
+	n, err = client.ReadContext(context.Background(), buf)
+	assertNotError(t, err, "Failed to read after a cancelled read")
+	assertByteEquals(t, buf[:n], data)
+}
+
+// silentPeer returns one end of a pipe whose other end reads everything
+// and never answers
+func silentPeer() net.Conn {
+	cConn, sConn := net.Pipe()
+	go io.Copy(ioutil.Discard, sConn)
+	return cConn
+}
+
+func TestHandshakeContext(t *testing.T) {
+	// Test that cancelling the context aborts a handshake that is waiting
+	// for the peer, and that the failure sticks
+	client := Client(silentPeer(), &Config{ServerName: "example.com", InsecureSkipVerify: true})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	assertEquals(t, client.HandshakeContext(ctx), context.Canceled)
+	assert(t, time.Since(start) < 5*time.Second, "Handshake did not give up promptly")
+	assertEquals(t, client.Handshake(), context.Canceled)
+
+	// Test that a context that is already done fails without starting
+	server := Server(silentPeer(), &Config{})
+	assertEquals(t, server.HandshakeContext(ctx), context.Canceled)
+
+	// Test that Config.HandshakeTimeout applies under a context too
+	config := &Config{ServerName: "example.com", InsecureSkipVerify: true, HandshakeTimeout: 50 * time.Millisecond}
+	client = Client(silentPeer(), config)
+	assertEquals(t, client.HandshakeContext(context.Background()), context.DeadlineExceeded)
+}
+
+func TestConfigHandshakeTimeout(t *testing.T) {
+	// Test that a handshake on either side gives up once the timeout
+	// passes, if the peer never answers
+	const timeout = 100 * time.Millisecond
+	config := &Config{ServerName: "example.com", InsecureSkipVerify: true, HandshakeTimeout: timeout}
+	for _, conn := range []*Conn{Client(silentPeer(), config), Server(silentPeer(), config)} {
+		start := time.Now()
+		assertEquals(t, conn.Handshake(), context.DeadlineExceeded)
+		elapsed := time.Since(start)
+		assert(t, elapsed >= timeout && elapsed < 50*timeout, fmt.Sprintf("Handshake gave up after %v", elapsed))
+	}
+
+	// Test that a handshake that completes in time is unaffected, and that
+	// the deadline doesn't outlive it
+	const longTimeout = time.Second
+	client, server, clientErr, serverErr := handshakeOverPipe(
+		&Config{HandshakeTimeout: longTimeout}, &Config{HandshakeTimeout: longTimeout})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	time.Sleep(longTimeout + timeout)
+	go server.Write([]byte("late"))
+	buf := make([]byte, 4)
+	n, err := 0, error(nil)
+	for n == 0 && err == nil {
+		n, err = client.Read(buf)
+	}
+	assertNotError(t, err, "Read failed after the handshake timeout passed")
+	assertByteEquals(t, buf[:n], []byte("late"))
+}
+
+func TestTruncatedRecord(t *testing.T) {
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+
+	// Send the header of a 100-byte record and half of its body, then close
+	go func() {
+		record := append([]byte{0x17, 0x03, 0x01, 0x00, 0x64}, bytes.Repeat([]byte{0xA0}, 50)...)
+		server.conn.Write(record)
+		server.conn.Close()
+	}()
+
+	_, err := client.Read(make([]byte, 10))
+	assertEquals(t, err, io.ErrUnexpectedEOF)
+}
+
+// writeCountingConn records the writes made to the underlying connection.
+type writeCountingConn struct {
+	net.Conn
+	writes [][]byte
+}
+
+func (c *writeCountingConn) Write(b []byte) (int, error) {
+	c.writes = append(c.writes, append([]byte{}, b...))
+	return c.Conn.Write(b)
+}
+
+func TestServerFlightBatching(t *testing.T) {
+	cConn, sConn := net.Pipe()
+	counting := &writeCountingConn{Conn: sConn}
+	client := Client(cConn, &Config{ServerName: "example.com", InsecureSkipVerify: true})
+	server := Server(counting, &Config{})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Handshake()
+	}()
+	assertNotError(t, client.Handshake(), "Client failed handshake")
+	assertNotError(t, <-done, "Server failed handshake")
+
+	// Test that the whole server flight, from ServerHello through Finished,
+	// went out in a single write
+	assertEquals(t, len(counting.writes), 1)
+
+	// Test that the encrypted messages were coalesced into one record, after
+	// the plaintext ServerHello
+	records := 0
+	for data := counting.writes[0]; len(data) > 0; records++ {
+		assert(t, len(data) >= recordHeaderLen, "Truncated record header")
+		assertEquals(t, recordType(data[0]), recordTypeHandshake)
+		data = data[recordHeaderLen+(int(data[3])<<8)+int(data[4]):]
+	}
+	assertEquals(t, records, 2)
+}
+
+func TestWriteCoalescing(t *testing.T) {
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{WriteBufferSize: 4096}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+
+	// Test that small writes are held back.  Nothing is reading the pipe, so
+	// these would block if they were sent.
+	chunk := bytes.Repeat([]byte{0xa5}, 10)
+	for i := 0; i < 100; i++ {
+		n, err := client.Write(chunk)
+		assertNotError(t, err, "Failed to write to buffer")
+		assertEquals(t, n, len(chunk))
+	}
+
+	// Test that Flush sends them in a single record
+	flushed := make(chan error, 1)
+	go func() { flushed <- client.Flush() }()
+	pt, err := server.in.ReadRecord()
+	assertNotError(t, err, "Failed to read coalesced record")
+	assertEquals(t, pt.contentType, recordTypeApplicationData)
+	assertByteEquals(t, pt.fragment, bytes.Repeat([]byte{0xa5}, 1000))
+	assertNotError(t, <-flushed, "Failed to flush")
+
+	// Test that a flush with nothing buffered sends nothing
+	assertNotError(t, client.Flush(), "Failed to flush an empty buffer")
+
+	// Test that filling the buffer sends it without a Flush
+	written := make(chan error, 1)
+	go func() {
+		_, err := client.Write(bytes.Repeat([]byte{0x5a}, 4096))
+		written <- err
+	}()
+	pt, err = server.in.ReadRecord()
+	assertNotError(t, err, "Failed to read full buffer")
+	assertEquals(t, len(pt.fragment), 4096)
+	assertNotError(t, <-written, "Failed to write a full buffer")
+}
+
+func TestRecordPadding(t *testing.T) {
+	const paddedLen = 256
+	cConn, sConn := net.Pipe()
+	counting := &writeCountingConn{Conn: cConn}
+	client := Client(counting, &Config{
+		ServerName:         "example.com",
+		InsecureSkipVerify: true,
+		RecordPadding:      func(plaintextLen int) int { return paddedLen - plaintextLen },
+	})
+	server := Server(sConn, &Config{})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Handshake()
+	}()
+	assertNotError(t, client.Handshake(), "Client failed handshake")
+	assertNotError(t, <-done, "Server failed handshake")
+
+	// Test that every application data record has the same size on the wire,
+	// and that the server reads the content without the padding
+	overhead := client.out.cipher.Overhead()
+	for _, msg := range []string{"a", "hello", string(bytes.Repeat([]byte{'x'}, 200))} {
+		counting.writes = nil
+		go client.Write([]byte(msg))
+
+		buf := make([]byte, len(msg))
+		_, err := io.ReadFull(server, buf)
+		assertNotError(t, err, "Server failed to read padded record")
+		assertEquals(t, string(buf), msg)
+
+		assertEquals(t, len(counting.writes), 1)
+		assertEquals(t, len(counting.writes[0]), recordHeaderLen+paddedLen+1+overhead)
+	}
+
+	// Test that padding is limited to what fits in a record
+	pt := &tlsPlaintext{contentType: recordTypeApplicationData, fragment: make([]byte, 100)}
+	client.out.padding = func(int) int { return 1 << 20 }
+	assertEquals(t, client.out.padLength(pt), maxFragmentLen-100-1-overhead)
+	client.out.padding = func(int) int { return -5 }
+	assertEquals(t, client.out.padLength(pt), 0)
+
+	// Test that only application data is padded
+	pt.contentType = recordTypeAlert
+	client.out.padding = func(int) int { return 10 }
+	assertEquals(t, client.out.padLength(pt), 0)
+}
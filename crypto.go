@@ -3,6 +3,7 @@ package mint
 import (
 	"bytes"
 	"crypto"
+	"crypto/ecdh"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/hmac"
@@ -10,8 +11,11 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding"
 	"encoding/asn1"
 	"fmt"
+	"hash"
+	"io"
 	"math/big"
 
 	// Blank includes to ensure hash support
@@ -57,6 +61,16 @@ var (
 			keyLen: 32,
 			ivLen:  12,
 		},
+		TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256: cipherSuiteParams{
+			hash:   crypto.SHA256,
+			keyLen: 32,
+			ivLen:  12,
+		},
+		TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256: cipherSuiteParams{
+			hash:   crypto.SHA256,
+			keyLen: 32,
+			ivLen:  12,
+		},
 	}
 
 	x509AlgMap = map[signatureAlgorithm]map[hashAlgorithm]x509.SignatureAlgorithm{
@@ -74,8 +88,30 @@ var (
 		},
 	}
 
+	// The RSA-PSS signature schemes name their own hash, and the kind of
+	// RSA key that they can be used with
+	rsaPSSSchemes = map[SignatureScheme]struct {
+		hash   crypto.Hash
+		pssKey bool
+	}{
+		RSA_PSS_RSAE_SHA256: {crypto.SHA256, false},
+		RSA_PSS_RSAE_SHA384: {crypto.SHA384, false},
+		RSA_PSS_RSAE_SHA512: {crypto.SHA512, false},
+		RSA_PSS_PSS_SHA256:  {crypto.SHA256, true},
+		RSA_PSS_PSS_SHA384:  {crypto.SHA384, true},
+		RSA_PSS_PSS_SHA512:  {crypto.SHA512, true},
+	}
+
+	// The SPKI algorithm of an RSASSA-PSS key (RFC 4055)
+	oidRSAPSS = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+
 	defaultRSAKeySize = 2048
 	defaultECDSACurve = elliptic.P256()
+
+	// The TLS feature extension, and the feature number for status_request
+	// (RFC 7633)
+	oidTLSFeature           = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+	tlsFeatureStatusRequest = 5
 )
 
 func curveFromNamedGroup(group namedGroup) (crv elliptic.Curve) {
@@ -99,16 +135,20 @@ func keyExchangeSizeFromNamedGroup(group namedGroup) (size int) {
 		size = 98
 	case namedGroupP521:
 		size = 134
+	case namedGroupX25519:
+		size = 32
 	}
 	return
 }
 
-func newKeyShare(group namedGroup) (pub []byte, priv []byte, err error) {
+// newKeyShare generates an ephemeral key pair for the group.  The private key
+// is drawn from random, so a deterministic source yields a reproducible key.
+func newKeyShare(group namedGroup, random io.Reader) (pub []byte, priv []byte, err error) {
 	switch group {
 	case namedGroupP256, namedGroupP384, namedGroupP521:
 		var x, y *big.Int
 		crv := curveFromNamedGroup(group)
-		priv, x, y, err = elliptic.GenerateKey(crv, prng)
+		priv, x, y, err = elliptic.GenerateKey(crv, random)
 		if err != nil {
 			return
 		}
@@ -117,6 +157,26 @@ func newKeyShare(group namedGroup) (pub []byte, priv []byte, err error) {
 		pub = append([]byte{byte(len(pub))}, pub...)
 		return
 
+	case namedGroupX25519:
+		priv = make([]byte, 32)
+		_, err = io.ReadFull(random, priv)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Clamp the scalar as described in RFC 7748
+		priv[0] &= 248
+		priv[31] &= 127
+		priv[31] |= 64
+
+		var key *ecdh.PrivateKey
+		key, err = ecdh.X25519().NewPrivateKey(priv)
+		if err != nil {
+			return nil, nil, err
+		}
+		pub = key.PublicKey().Bytes()
+		return
+
 	default:
 		return nil, nil, fmt.Errorf("tls.newkeyshare: Unsupported group %v", group)
 	}
@@ -125,13 +185,15 @@ func newKeyShare(group namedGroup) (pub []byte, priv []byte, err error) {
 func keyAgreement(group namedGroup, pub []byte, priv []byte) ([]byte, error) {
 	switch group {
 	case namedGroupP256, namedGroupP384, namedGroupP521:
-		pubLen := int(pub[0])
-		if len(pub) != keyExchangeSizeFromNamedGroup(group) || len(pub) != pubLen+1 {
+		if len(pub) != keyExchangeSizeFromNamedGroup(group) || len(pub) != int(pub[0])+1 {
 			return nil, fmt.Errorf("tls.keyagreement: Wrong public key size")
 		}
 
 		crv := curveFromNamedGroup(group)
 		pubX, pubY := elliptic.Unmarshal(crv, pub[1:])
+		if pubX == nil {
+			return nil, fmt.Errorf("tls.keyagreement: Public key not on curve")
+		}
 		x, _ := crv.Params().ScalarMult(pubX, pubY, priv)
 
 		curveSize := len(crv.Params().P.Bytes())
@@ -139,8 +201,38 @@ func keyAgreement(group namedGroup, pub []byte, priv []byte) ([]byte, error) {
 		if len(xBytes) < curveSize {
 			xBytes = append(bytes.Repeat([]byte{0}, curveSize-len(xBytes)), xBytes...)
 		}
+
+		// An all-zero secret means that the exchange was degenerate, e.g.,
+		// the result was the point at infinity
+		if allZero(xBytes) {
+			return nil, fmt.Errorf("tls.keyagreement: All-zero shared secret")
+		}
 		return xBytes, nil
 
+	case namedGroupX25519:
+		if len(pub) != keyExchangeSizeFromNamedGroup(group) {
+			return nil, fmt.Errorf("tls.keyagreement: Wrong public key size")
+		}
+
+		key, err := ecdh.X25519().NewPrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		peer, err := ecdh.X25519().NewPublicKey(pub)
+		if err != nil {
+			return nil, err
+		}
+
+		// A low-order public key yields an all-zero secret, which must be
+		// rejected (RFC 8446, Section 7.4.2).  RFC 7748 leaves the check to
+		// the application, but TLS 1.3 always makes it.  crypto/ecdh refuses
+		// to return such a secret, so an error here means the same thing.
+		secret, err := key.ECDH(peer)
+		if err != nil || allZero(secret) {
+			return nil, fmt.Errorf("tls.keyagreement: All-zero shared secret")
+		}
+		return secret, nil
+
 	default:
 		return nil, fmt.Errorf("tls.keyagreement: Unsupported group %v", group)
 	}
@@ -187,7 +279,8 @@ type ecdsaSignature struct {
 }
 
 const (
-	contextCertificateVerify = "TLS 1.3, server CertificateVerify"
+	contextServerCertificateVerify = "TLS 1.3, server CertificateVerify"
+	contextClientCertificateVerify = "TLS 1.3, client CertificateVerify"
 )
 
 func encodeSignatureInput(hash crypto.Hash, data []byte, context string) []byte {
@@ -207,25 +300,154 @@ func (opts pkcs1Opts) HashFunc() crypto.Hash {
 	return opts.hash
 }
 
-func sign(hash crypto.Hash, privateKey crypto.Signer, data []byte, context string) (signatureAlgorithm, []byte, error) {
+// signatureHash returns the hash function used by a signature algorithm
+func signatureHash(alg signatureAndHashAlgorithm) (crypto.Hash, bool) {
+	if scheme, ok := rsaPSSSchemes[alg.scheme()]; ok {
+		return scheme.hash, true
+	}
+	hash, ok := hashMap[alg.hash]
+	return hash, ok
+}
+
+// usableWithRSAKey reports whether a signature algorithm can be used with an
+// RSA key.  An RSASSA-PSS key (pssKey) can only be used with the rsa_pss_pss
+// schemes, and an rsaEncryption key with anything else that uses RSA.
+func usableWithRSAKey(alg signatureAndHashAlgorithm, pssKey bool) bool {
+	if scheme, ok := rsaPSSSchemes[alg.scheme()]; ok {
+		return scheme.pssKey == pssKey
+	}
+	return !pssKey && (alg.signature == signatureAlgorithmRSA || alg.signature == signatureAlgorithmRSAPSS)
+}
+
+// certificatePublicKey returns the public key of a certificate, and whether
+// it is an RSASSA-PSS key.  crypto/x509 does not parse RSASSA-PSS keys, but
+// their encoding is the same as that of an rsaEncryption key.
+func certificatePublicKey(cert *x509.Certificate) (crypto.PublicKey, bool, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	_, err := asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &spki)
+	if err != nil {
+		return nil, false, err
+	}
+	if !spki.Algorithm.Algorithm.Equal(oidRSAPSS) {
+		return cert.PublicKey, false, nil
+	}
+
+	pub, err := x509.ParsePKCS1PublicKey(spki.PublicKey.RightAlign())
+	if err != nil {
+		return nil, false, err
+	}
+	return pub, true, nil
+}
+
+// selectSignatureAlgorithm returns the first of the peer's acceptable
+// signature algorithms that can be used with the given private key.  If the
+// key is an RSA key, pssKey says whether its certificate marks it as an
+// RSASSA-PSS key.  If there is no overlap, the second return value is false.
+func selectSignatureAlgorithm(privateKey crypto.Signer, pssKey bool, acceptable []signatureAndHashAlgorithm) (signatureAndHashAlgorithm, bool) {
+	for _, alg := range acceptable {
+		if _, ok := signatureHash(alg); !ok {
+			continue
+		}
+
+		switch privateKey.Public().(type) {
+		case *rsa.PublicKey:
+			if usableWithRSAKey(alg, pssKey) {
+				return alg, true
+			}
+		case *ecdsa.PublicKey:
+			if alg.signature == signatureAlgorithmECDSA {
+				return alg, true
+			}
+		}
+	}
+	return signatureAndHashAlgorithm{}, false
+}
+
+// isDeprecatedSignatureAlgorithm reports whether an algorithm uses SHA-1 or
+// PKCS#1 v1.5, which TLS 1.3 only keeps for compatibility
+func isDeprecatedSignatureAlgorithm(alg signatureAndHashAlgorithm) bool {
+	return alg.hash == hashAlgorithmSHA1 || alg.signature == signatureAlgorithmRSA
+}
+
+// checkCertificateSignatureAlgorithms verifies that each certificate in a
+// chain is signed with one of the acceptable algorithms.  Self-signed
+// certificates are skipped, since their signatures are not validated.
+func checkCertificateSignatureAlgorithms(chain []*x509.Certificate, acceptable []signatureAndHashAlgorithm) error {
+	for i, cert := range chain {
+		if bytes.Equal(cert.RawSubject, cert.RawIssuer) {
+			continue
+		}
+
+		allowed := false
+		for _, alg := range acceptable {
+			if sigAlg, ok := x509AlgMap[alg.signature][alg.hash]; ok && sigAlg == cert.SignatureAlgorithm {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("tls.certificate: Certificate %d signed with unacceptable algorithm %v", i, cert.SignatureAlgorithm)
+		}
+	}
+	return nil
+}
+
+// requiresStapling reports whether a certificate has the TLS feature
+// extension (RFC 7633) with status_request, i.e., OCSP must-staple.
+func requiresStapling(cert *x509.Certificate) bool {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidTLSFeature) {
+			continue
+		}
+
+		var features []int
+		if _, err := asn1.Unmarshal(ext.Value, &features); err != nil {
+			// An unreadable requirement is treated as a requirement
+			return true
+		}
+		for _, feature := range features {
+			if feature == tlsFeatureStatusRequest {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sign signs data with the hash of alg.  The signature algorithm is chosen
+// based on the key, except that an RSA-PSS scheme is always used as is.
+func sign(alg signatureAndHashAlgorithm, privateKey crypto.Signer, data []byte, context string) (signatureAlgorithm, []byte, error) {
 	var opts crypto.SignerOpts
 	var sigAlg signatureAlgorithm
 
+	hash, ok := signatureHash(alg)
+	if !ok {
+		return 0, nil, fmt.Errorf("tls.sign: Unsupported hash algorithm")
+	}
+
 	logf(logTypeCrypto, "digest to be verified: %x", data)
 	digest := encodeSignatureInput(hash, data, context)
 	logf(logTypeCrypto, "digest with context: %x", digest)
 
-	switch privateKey.(type) {
-	case *rsa.PrivateKey:
-		if allowPKCS1 {
+	_, isPSSScheme := rsaPSSSchemes[alg.scheme()]
+	switch privateKey.Public().(type) {
+	case *rsa.PublicKey:
+		if isPSSScheme {
+			sigAlg = alg.signature
+			opts = &rsa.PSSOptions{SaltLength: hash.Size(), Hash: hash}
+		} else if allowPKCS1 {
 			sigAlg = signatureAlgorithmRSA
 			opts = &pkcs1Opts{hash: hash}
 		} else {
 			sigAlg = signatureAlgorithmRSAPSS
 			opts = &rsa.PSSOptions{SaltLength: hash.Size(), Hash: hash}
 		}
-	case *ecdsa.PrivateKey:
+	case *ecdsa.PublicKey:
 		sigAlg = signatureAlgorithmECDSA
+		opts = hash
 	}
 
 	sig, err := privateKey.Sign(prng, digest, opts)
@@ -233,13 +455,129 @@ func sign(hash crypto.Hash, privateKey crypto.Signer, data []byte, context strin
 	return sigAlg, sig, err
 }
 
+// deterministicECDSASigner signs with an ECDSA key using the deterministic
+// nonce generation of RFC 6979, so that signing the same digest twice yields
+// the same signature.  The random source passed to Sign is ignored.
+type deterministicECDSASigner struct {
+	*ecdsa.PrivateKey
+}
+
+// newDeterministicSigner wraps ECDSA keys in a deterministicECDSASigner.
+// Other keys are returned unchanged.
+func newDeterministicSigner(privateKey crypto.Signer) crypto.Signer {
+	if priv, ok := privateKey.(*ecdsa.PrivateKey); ok {
+		return deterministicECDSASigner{priv}
+	}
+	return privateKey
+}
+
+func (d deterministicECDSASigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts == nil || !opts.HashFunc().Available() {
+		return nil, fmt.Errorf("tls.sign: Deterministic ECDSA requires a hash function")
+	}
+
+	q := d.Curve.Params().N
+	e := rfc6979BitsToInt(digest, q)
+	nextK := rfc6979Nonces(opts.HashFunc(), d.D, q, digest)
+	for {
+		k := nextK()
+
+		x, _ := d.Curve.ScalarBaseMult(k.Bytes())
+		r := new(big.Int).Mod(x, q)
+		if r.Sign() == 0 {
+			continue
+		}
+
+		// s = k^-1 * (e + r*d) mod q
+		s := new(big.Int).Mul(r, d.D)
+		s.Add(s, e)
+		s.Mul(s, new(big.Int).ModInverse(k, q))
+		s.Mod(s, q)
+		if s.Sign() == 0 {
+			continue
+		}
+
+		return asn1.Marshal(ecdsaSignature{r, s})
+	}
+}
+
+// From RFC 6979, Section 2.3.2
+func rfc6979BitsToInt(data []byte, q *big.Int) *big.Int {
+	x := new(big.Int).SetBytes(data)
+	if excess := len(data)*8 - q.BitLen(); excess > 0 {
+		x.Rsh(x, uint(excess))
+	}
+	return x
+}
+
+// From RFC 6979, Section 2.3.3
+func rfc6979IntToOctets(x *big.Int, q *big.Int) []byte {
+	out := make([]byte, (q.BitLen()+7)/8)
+	xBytes := x.Bytes()
+	copy(out[len(out)-len(xBytes):], xBytes)
+	return out
+}
+
+// rfc6979Nonces returns a generator for the sequence of candidate nonces
+// described in RFC 6979, Section 3.2.  Each call returns the next value of k
+// in the range [1, q-1].
+func rfc6979Nonces(hash crypto.Hash, x, q *big.Int, digest []byte) func() *big.Int {
+	mac := func(key []byte, data ...[]byte) []byte {
+		h := hmac.New(hash.New, key)
+		for _, d := range data {
+			h.Write(d)
+		}
+		return h.Sum(nil)
+	}
+
+	privOctets := rfc6979IntToOctets(x, q)
+	digestOctets := rfc6979IntToOctets(new(big.Int).Mod(rfc6979BitsToInt(digest, q), q), q)
+
+	V := bytes.Repeat([]byte{0x01}, hash.Size())
+	K := make([]byte, hash.Size())
+	K = mac(K, V, []byte{0x00}, privOctets, digestOctets)
+	V = mac(K, V)
+	K = mac(K, V, []byte{0x01}, privOctets, digestOctets)
+	V = mac(K, V)
+
+	first := true
+	return func() *big.Int {
+		for {
+			if !first {
+				K = mac(K, V, []byte{0x00})
+				V = mac(K, V)
+			}
+			first = false
+
+			T := []byte{}
+			for len(T)*8 < q.BitLen() {
+				V = mac(K, V)
+				T = append(T, V...)
+			}
+
+			k := rfc6979BitsToInt(T, q)
+			if k.Sign() > 0 && k.Cmp(q) < 0 {
+				return k
+			}
+		}
+	}
+}
+
 func verify(alg signatureAndHashAlgorithm, publicKey crypto.PublicKey, data []byte, context string, sig []byte) error {
-	hash := hashMap[alg.hash]
+	hash, ok := signatureHash(alg)
+	if !ok {
+		return fmt.Errorf("tls.verify: Unsupported hash algorithm")
+	}
 
 	digest := encodeSignatureInput(hash, data, context)
 
 	switch pub := publicKey.(type) {
 	case *rsa.PublicKey:
+		if _, ok := rsaPSSSchemes[alg.scheme()]; ok {
+			opts := &rsa.PSSOptions{SaltLength: hash.Size(), Hash: hash}
+			return rsa.VerifyPSS(pub, hash, digest, sig, opts)
+		}
+
 		if allowPKCS1 && alg.signature == signatureAlgorithmRSA {
 			return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
 		}
@@ -288,13 +626,13 @@ func hkdfExtract(hash crypto.Hash, saltIn, input []byte) []byte {
 	return h.Sum(nil)
 }
 
-// struct HkdfLabel {
-//    uint16 length;
-//    opaque label<9..255>;
-//    opaque hash_value<0..255>;
-// };
+// struct {
+//     uint16 length = Length;
+//     opaque label<7..255> = "tls13 " + Label;
+//     opaque context<0..255> = Context;
+// } HkdfLabel;
 func hkdfEncodeLabel(labelIn string, hashValue []byte, outLen int) []byte {
-	label := "TLS 1.3, " + labelIn
+	label := "tls13 " + labelIn
 
 	labelLen := len(label)
 	hashLen := len(hashValue)
@@ -331,7 +669,7 @@ func hkdfExpandLabel(hash crypto.Hash, secret []byte, label string, hashValue []
 	info := hkdfEncodeLabel(label, hashValue, outLen)
 	derived := hkdfExpand(hash, secret, info, outLen)
 
-	logf(logTypeCrypto, "HKDF Expand: label=[TLS 1.3, ] + '%s',requested length=%d\n", label, outLen)
+	logf(logTypeCrypto, "HKDF Expand: label=[tls13 ] + '%s',requested length=%d\n", label, outLen)
 	logf(logTypeCrypto, "PRK [%d]: %x\n", len(secret), secret)
 	logf(logTypeCrypto, "Hash [%d]: %x\n", len(hashValue), hashValue)
 	logf(logTypeCrypto, "Info [%d]: %x\n", len(info), info)
@@ -341,21 +679,20 @@ func hkdfExpandLabel(hash crypto.Hash, secret []byte, label string, hashValue []
 }
 
 const (
-	labelMSS            = "expanded static secret"
-	labelMES            = "expanded ephemeral secret"
-	labelTrafficSecret  = "traffic secret"
-	labelServerFinished = "server finished"
-	labelClientFinished = "client finished"
-
-	phaseEarlyHandshake = "early handshake key expansion"
-	phaseEarlyData      = "early application data key expansion"
-	phaseHandshake      = "handshake key expansion"
-	phaseApplication    = "application data key expansion"
-
-	purposeClientWriteKey = "client write key"
-	purposeServerWriteKey = "server write key"
-	purposeClientWriteIV  = "client write iv"
-	purposeServerWriteIV  = "server write iv"
+	labelDerived                        = "derived"
+	labelClientEarlyTrafficSecret       = "c e traffic"
+	labelClientHandshakeTrafficSecret   = "c hs traffic"
+	labelServerHandshakeTrafficSecret   = "s hs traffic"
+	labelClientApplicationTrafficSecret = "c ap traffic"
+	labelServerApplicationTrafficSecret = "s ap traffic"
+	labelExporterSecret                 = "exp master"
+	labelTrafficUpdate                  = "traffic upd"
+	labelResumptionBinderKey            = "res binder"
+	labelResumptionSecret               = "res master"
+	labelResumption                     = "resumption"
+	labelFinished                       = "finished"
+	labelKey                            = "key"
+	labelIV                             = "iv"
 )
 
 type keySet struct {
@@ -365,20 +702,131 @@ type keySet struct {
 	serverWriteIV  []byte
 }
 
+func (k keySet) wipe() {
+	zeroBytes(k.clientWriteKey)
+	zeroBytes(k.serverWriteKey)
+	zeroBytes(k.clientWriteIV)
+	zeroBytes(k.serverWriteIV)
+}
+
+// zeroBytes overwrites secret material so that it doesn't linger in memory
+// after we're done with it
+func allZero(data []byte) bool {
+	var acc byte
+	for _, b := range data {
+		acc |= b
+	}
+	return acc == 0
+}
+
+func zeroBytes(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
+
+// finished_key = HKDF-Expand-Label(BaseKey, "finished", "", Hash.length)
+// verify_data = HMAC(finished_key, Transcript-Hash(...))
+func computeFinishedData(hash crypto.Hash, baseKey, transcriptHash []byte) (finishedKey, verifyData []byte) {
+	finishedKey = hkdfExpandLabel(hash, baseKey, labelFinished, []byte{}, hash.Size())
+
+	mac := hmac.New(hash.New, finishedKey)
+	mac.Write(transcriptHash)
+	verifyData = mac.Sum(nil)
+	return
+}
+
+// This follows the key schedule in RFC 8446, Section 7.1:
+//
+//              0
+//              |
+//              v
+//    PSK ->  HKDF-Extract = Early Secret
+//              |
+//              +-----> Derive-Secret(., "res binder", "") = binder_key
+//              |
+//              +-----> Derive-Secret(., "c e traffic", ClientHello)
+//              |
+//              v
+//        Derive-Secret(., "derived", "")
+//              |
+//              v
+//  (EC)DHE -> HKDF-Extract = Handshake Secret
+//              |
+//              +-----> Derive-Secret(., "c hs traffic", ClientHello...ServerHello)
+//              +-----> Derive-Secret(., "s hs traffic", ClientHello...ServerHello)
+//              v
+//        Derive-Secret(., "derived", "")
+//              |
+//              v
+//    0 -> HKDF-Extract = Master Secret
+//              |
+//              +-----> Derive-Secret(., "c ap traffic", ClientHello...server Finished)
+//              +-----> Derive-Secret(., "s ap traffic", ClientHello...server Finished)
+//              +-----> Derive-Secret(., "exp master", ClientHello...server Finished)
+//              +-----> Derive-Secret(., "res master", ClientHello...client Finished)
+//
 // XXX: This might be specific to 1xRTT; we'll figure out how to adapt later
+// TranscriptHash is a running hash over the handshake transcript.  Messages
+// are added with Write.  Clone returns an independent copy of the hash in its
+// current state; Sum is only ever called on a clone, so an implementation may
+// finalize its state in Sum.
+type TranscriptHash interface {
+	io.Writer
+	Sum(b []byte) []byte
+	Clone() TranscriptHash
+}
+
+// stdTranscriptHash is the default TranscriptHash, computed with the standard
+// library implementation of the hash function.
+type stdTranscriptHash struct {
+	alg crypto.Hash
+	hash.Hash
+}
+
+func newStdTranscriptHash(alg crypto.Hash) TranscriptHash {
+	return stdTranscriptHash{alg: alg, Hash: alg.New()}
+}
+
+func (h stdTranscriptHash) Clone() TranscriptHash {
+	// The standard library hashes all support marshaling their state, so
+	// these errors cannot happen in practice
+	state, err := h.Hash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	clone := h.alg.New()
+	err = clone.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+	if err != nil {
+		panic(err)
+	}
+	return stdTranscriptHash{alg: h.alg, Hash: clone}
+}
+
 type cryptoContext struct {
 	initialized bool
 
 	suite  cipherSuite
 	params cipherSuiteParams
 
-	transcript []*handshakeMessage
+	// If newTranscriptHash is nil, the standard library hash is used
+	newTranscriptHash func(alg crypto.Hash) TranscriptHash
 
-	ES, SS        []byte
-	xES, xSS      []byte
-	handshakeKeys keySet
+	// If the server sent a HelloRetryRequest, the first ClientHello and the
+	// HelloRetryRequest come before the ClientHello and ServerHello in the
+	// transcript
+	firstClientHello  *handshakeMessage
+	helloRetryRequest *handshakeMessage
+	transcript        []*handshakeMessage
+	transcriptHasher  TranscriptHash
+
+	PSK, DHE                     []byte
+	earlySecret                  []byte
+	handshakeSecret              []byte
+	clientHandshakeTrafficSecret []byte
+	serverHandshakeTrafficSecret []byte
+	handshakeKeys                keySet
 
-	mES, mSS           []byte
 	masterSecret       []byte
 	serverFinishedKey  []byte
 	serverFinishedData []byte
@@ -388,28 +836,54 @@ type cryptoContext struct {
 	clientFinishedData []byte
 	clientFinished     *finishedBody
 
-	trafficSecret   []byte
-	applicationKeys keySet
+	clientTrafficSecret []byte
+	serverTrafficSecret []byte
+	applicationKeys     keySet
+	exporterSecret      []byte
+
+	resumptionSecret []byte // Derived when the first ticket is issued or read
 }
 
-func (c *cryptoContext) marshalTranscript() []byte {
-	data := []byte{}
-	for _, msg := range c.transcript {
-		data = append(data, msg.Marshal()...)
+func (c *cryptoContext) addToTranscript(messages ...*handshakeMessage) {
+	c.transcript = append(c.transcript, messages...)
+	for _, msg := range messages {
+		c.transcriptHasher.Write(msg.Marshal())
 	}
-	return data
 }
 
-func (c *cryptoContext) makeTrafficKeys(secret []byte, phase string, handshakeHash []byte) keySet {
+func (c *cryptoContext) transcriptHash() []byte {
+	return c.transcriptHasher.Clone().Sum(nil)
+}
+
+// Derive-Secret(Secret, Label, Messages) =
+//     HKDF-Expand-Label(Secret, Label, Transcript-Hash(Messages), Hash.length)
+func (c *cryptoContext) deriveSecret(secret []byte, label string, messageHash []byte) []byte {
+	return hkdfExpandLabel(c.params.hash, secret, label, messageHash, c.params.hash.Size())
+}
+
+func (c *cryptoContext) makeTrafficKeys(clientSecret, serverSecret []byte) keySet {
 	return keySet{
-		clientWriteKey: hkdfExpandLabel(c.params.hash, secret, phase+", "+purposeClientWriteKey, handshakeHash, c.params.keyLen),
-		serverWriteKey: hkdfExpandLabel(c.params.hash, secret, phase+", "+purposeServerWriteKey, handshakeHash, c.params.keyLen),
-		clientWriteIV:  hkdfExpandLabel(c.params.hash, secret, phase+", "+purposeClientWriteIV, handshakeHash, c.params.ivLen),
-		serverWriteIV:  hkdfExpandLabel(c.params.hash, secret, phase+", "+purposeServerWriteIV, handshakeHash, c.params.ivLen),
+		clientWriteKey: hkdfExpandLabel(c.params.hash, clientSecret, labelKey, []byte{}, c.params.keyLen),
+		serverWriteKey: hkdfExpandLabel(c.params.hash, serverSecret, labelKey, []byte{}, c.params.keyLen),
+		clientWriteIV:  hkdfExpandLabel(c.params.hash, clientSecret, labelIV, []byte{}, c.params.ivLen),
+		serverWriteIV:  hkdfExpandLabel(c.params.hash, serverSecret, labelIV, []byte{}, c.params.ivLen),
+	}
+}
+
+// retryTranscript returns the messages that precede the ClientHello in the
+// transcript, which are only present after a HelloRetryRequest.
+func (c *cryptoContext) retryTranscript() []*handshakeMessage {
+	if c.firstClientHello == nil {
+		return nil
 	}
+
+	h := c.params.hash.New()
+	h.Write(c.firstClientHello.Marshal())
+	messageHash := &handshakeMessage{msgType: handshakeTypeMessageHash, body: h.Sum(nil)}
+	return []*handshakeMessage{messageHash, c.helloRetryRequest}
 }
 
-func (c *cryptoContext) Init(ch, sh *handshakeMessage, SS, ES []byte, suite cipherSuite) error {
+func (c *cryptoContext) Init(ch, sh *handshakeMessage, PSK, DHE []byte, suite cipherSuite) error {
 	// Configure based on cipherSuite
 	params, ok := cipherSuiteMap[suite]
 	if !ok {
@@ -419,28 +893,48 @@ func (c *cryptoContext) Init(ch, sh *handshakeMessage, SS, ES []byte, suite ciph
 	c.params = params
 
 	// Set up transcript and initialize transcript hash
+	if c.newTranscriptHash == nil {
+		c.newTranscriptHash = newStdTranscriptHash
+	}
 	c.transcript = []*handshakeMessage{}
+	c.transcriptHasher = c.newTranscriptHash(c.params.hash)
+
+	// After a HelloRetryRequest, the first ClientHello is replaced by a
+	// synthetic message_hash message carrying its hash (RFC 8446, Section
+	// 4.4.1)
+	if (c.firstClientHello == nil) != (c.helloRetryRequest == nil) {
+		return fmt.Errorf("tls.cryptoinit: Incomplete HelloRetryRequest exchange")
+	}
+	c.addToTranscript(c.retryTranscript()...)
 
 	// Add ClientHello, ServerHello to transcript
 	if ch == nil || sh == nil {
 		return fmt.Errorf("tls.cryptoinit: Nil message provided")
 	}
-	c.transcript = append(c.transcript, []*handshakeMessage{ch, sh}...)
+	c.addToTranscript(ch, sh)
 
-	// Compute xSS, xES = HKDF-Extract(0, ES)
-	c.SS = make([]byte, len(SS))
-	c.ES = make([]byte, len(ES))
-	copy(c.ES, ES)
-	copy(c.SS, ES)
-	c.xSS = hkdfExtract(c.params.hash, nil, c.SS)
-	c.xES = hkdfExtract(c.params.hash, nil, c.ES)
+	// If there is no PSK, a string of zeros is used in its place
+	L := c.params.hash.Size()
+	c.PSK = make([]byte, len(PSK))
+	c.DHE = make([]byte, len(DHE))
+	copy(c.PSK, PSK)
+	copy(c.DHE, DHE)
+	if len(c.PSK) == 0 {
+		c.PSK = make([]byte, L)
+	}
 
-	// Compute handshakeKeys
-	context := c.marshalTranscript()
-	h := c.params.hash.New()
-	h.Write(context)
-	handshakeHash := h.Sum(nil)
-	c.handshakeKeys = c.makeTrafficKeys(c.xES, phaseHandshake, handshakeHash)
+	// Compute the early and handshake secrets
+	emptyHash := c.params.hash.New().Sum(nil)
+	c.earlySecret = hkdfExtract(c.params.hash, nil, c.PSK)
+	derived := c.deriveSecret(c.earlySecret, labelDerived, emptyHash)
+	c.handshakeSecret = hkdfExtract(c.params.hash, derived, c.DHE)
+	zeroBytes(derived)
+
+	// Compute handshake traffic secrets and keys
+	handshakeHash := c.transcriptHash()
+	c.clientHandshakeTrafficSecret = c.deriveSecret(c.handshakeSecret, labelClientHandshakeTrafficSecret, handshakeHash)
+	c.serverHandshakeTrafficSecret = c.deriveSecret(c.handshakeSecret, labelServerHandshakeTrafficSecret, handshakeHash)
+	c.handshakeKeys = c.makeTrafficKeys(c.clientHandshakeTrafficSecret, c.serverHandshakeTrafficSecret)
 
 	c.initialized = true
 	return nil
@@ -457,33 +951,13 @@ func (c *cryptoContext) Update(messages []*handshakeMessage) error {
 			return fmt.Errorf("tls.updatecontext: Nil message")
 		}
 	}
-	c.transcript = append(c.transcript, messages...)
-	handshakeSoFar := c.marshalTranscript()
+	c.addToTranscript(messages...)
 
-	// Compute handshake hash
-	h := c.params.hash.New()
-	h.Write(handshakeSoFar)
-	handshakeHash := h.Sum(nil)
-
-	// Compute mSS, mES = HKDF-Expand-Label(xSS, label, handshake_hash, L)
+	// Compute server Finished over the transcript through CertificateVerify,
+	// using the server handshake traffic secret as the base key
 	L := c.params.hash.Size()
-	c.mSS = hkdfExpandLabel(c.params.hash, c.xSS, labelMSS, handshakeHash, L)
-	c.mES = hkdfExpandLabel(c.params.hash, c.xSS, labelMES, handshakeHash, L)
-
-	// Compute master_secret, traffic_secret_0
-	c.masterSecret = hkdfExtract(c.params.hash, c.mSS, c.mES)
-
-	// Compute traffic_secret_0
-	c.trafficSecret = hkdfExpandLabel(c.params.hash, c.masterSecret, labelTrafficSecret, handshakeHash, L)
-
-	// Compute client and server Finished keys
-	c.serverFinishedKey = hkdfExpandLabel(c.params.hash, c.masterSecret, labelServerFinished, []byte{}, L)
-	c.clientFinishedKey = hkdfExpandLabel(c.params.hash, c.masterSecret, labelClientFinished, []byte{}, L)
-
-	// Compute ServerFinished and add to transcript
-	serverFinishedMAC := hmac.New(c.params.hash.New, c.serverFinishedKey)
-	serverFinishedMAC.Write(handshakeHash)
-	c.serverFinishedData = serverFinishedMAC.Sum(nil)
+	handshakeHash := c.transcriptHash()
+	c.serverFinishedKey, c.serverFinishedData = computeFinishedData(c.params.hash, c.serverHandshakeTrafficSecret, handshakeHash)
 	c.serverFinished = &finishedBody{
 		verifyDataLen: len(c.serverFinishedData),
 		verifyData:    c.serverFinishedData,
@@ -491,32 +965,159 @@ func (c *cryptoContext) Update(messages []*handshakeMessage) error {
 
 	// This call can only fail if there's a length mismatch, which can't happen here
 	finishedMessage, _ := handshakeMessageFromBody(c.serverFinished)
-	c.transcript = append(c.transcript, finishedMessage)
+	c.addToTranscript(finishedMessage)
 
-	// Compute client_finished_key and client Finished
-	h.Write(finishedMessage.Marshal())
-	handshakeHash = h.Sum(nil)
+	// Compute client Finished over the transcript through the server Finished,
+	// using the client handshake traffic secret as the base key
+	handshakeHash = c.transcriptHash()
 	logf(logTypeCrypto, "handshake hash for client Finished: [%d] %x", len(handshakeHash), handshakeHash)
 
-	clientFinishedMAC := hmac.New(c.params.hash.New, c.clientFinishedKey)
-	clientFinishedMAC.Write(handshakeHash)
-	c.clientFinishedData = clientFinishedMAC.Sum(nil)
-	logf(logTypeCrypto, "client Finished data: [%d] %x", len(handshakeHash), handshakeHash)
+	c.clientFinishedKey, c.clientFinishedData = computeFinishedData(c.params.hash, c.clientHandshakeTrafficSecret, handshakeHash)
+	logf(logTypeCrypto, "client Finished data: [%d] %x", len(c.clientFinishedData), c.clientFinishedData)
 
 	c.clientFinished = &finishedBody{
 		verifyDataLen: L,
 		verifyData:    c.clientFinishedData,
 	}
 
-	// application_key_0
-	c.applicationKeys = c.makeTrafficKeys(c.trafficSecret, phaseApplication, handshakeHash)
+	// Compute the master secret and application traffic secrets
+	emptyHash := c.params.hash.New().Sum(nil)
+	derived := c.deriveSecret(c.handshakeSecret, labelDerived, emptyHash)
+	c.masterSecret = hkdfExtract(c.params.hash, derived, make([]byte, L))
+	zeroBytes(derived)
+
+	c.clientTrafficSecret = c.deriveSecret(c.masterSecret, labelClientApplicationTrafficSecret, handshakeHash)
+	c.serverTrafficSecret = c.deriveSecret(c.masterSecret, labelServerApplicationTrafficSecret, handshakeHash)
+	c.applicationKeys = c.makeTrafficKeys(c.clientTrafficSecret, c.serverTrafficSecret)
+	c.exporterSecret = c.deriveSecret(c.masterSecret, labelExporterSecret, handshakeHash)
 
 	return nil
 }
 
+// UpdateClientFinished adds messages that the client sends after the server's
+// Finished, e.g., ClientEncryptedExtensions, to the transcript and recomputes
+// the client Finished over them.  The application traffic secrets are not
+// affected, since they cover the transcript only through the server Finished.
+func (c *cryptoContext) UpdateClientFinished(messages []*handshakeMessage) error {
+	if c.clientFinished == nil {
+		return fmt.Errorf("tls.updatecontext: Called before Update")
+	}
+	for _, msg := range messages {
+		if msg == nil {
+			return fmt.Errorf("tls.updatecontext: Nil message")
+		}
+	}
+	c.addToTranscript(messages...)
+
+	zeroBytes(c.clientFinishedKey)
+	c.clientFinishedKey, c.clientFinishedData = computeFinishedData(c.params.hash, c.clientHandshakeTrafficSecret, c.transcriptHash())
+	c.clientFinished = &finishedBody{
+		verifyDataLen: len(c.clientFinishedData),
+		verifyData:    c.clientFinishedData,
+	}
+	return nil
+}
+
+// postHandshakeFinishedData computes the verify_data of the client's Finished
+// in response to a post-handshake CertificateRequest.  The transcript runs
+// through the client's Finished from the handshake, followed by the given
+// messages, and the base key is the current client application traffic
+// secret.
+func (c *cryptoContext) postHandshakeFinishedData(messages ...*handshakeMessage) []byte {
+	h := c.transcriptHasher.Clone()
+	clientFinished, _ := handshakeMessageFromBody(c.clientFinished)
+	h.Write(clientFinished.Marshal())
+	for _, msg := range messages {
+		h.Write(msg.Marshal())
+	}
+
+	finishedKey, verifyData := computeFinishedData(c.params.hash, c.clientTrafficSecret, h.Sum(nil))
+	zeroBytes(finishedKey)
+	return verifyData
+}
+
+// resumptionPSK derives the PSK for the session ticket with the given nonce
+// (RFC 8446, Section 4.6.1).  The resumption master secret covers the
+// transcript through the client's Finished, so this can only be used once the
+// handshake is complete.
+func (c *cryptoContext) resumptionPSK(nonce []byte) []byte {
+	if c.resumptionSecret == nil {
+		h := c.transcriptHasher.Clone()
+		clientFinished, _ := handshakeMessageFromBody(c.clientFinished)
+		h.Write(clientFinished.Marshal())
+		c.resumptionSecret = c.deriveSecret(c.masterSecret, labelResumptionSecret, h.Sum(nil))
+	}
+
+	return hkdfExpandLabel(c.params.hash, c.resumptionSecret, labelResumption, nonce, c.params.hash.Size())
+}
+
+// computePSKBinder computes the binder for a PSK over the ClientHello that
+// offers it, truncated before the binders.  After a HelloRetryRequest, the
+// messages that precede the second ClientHello in the transcript are given
+// in prefix.
+func computePSKBinder(hash crypto.Hash, psk []byte, prefix []*handshakeMessage, truncatedHello []byte) []byte {
+	earlySecret := hkdfExtract(hash, nil, psk)
+	binderKey := hkdfExpandLabel(hash, earlySecret, labelResumptionBinderKey, hash.New().Sum(nil), hash.Size())
+
+	h := hash.New()
+	for _, msg := range prefix {
+		h.Write(msg.Marshal())
+	}
+	h.Write(truncatedHello)
+	finishedKey, binder := computeFinishedData(hash, binderKey, h.Sum(nil))
+
+	zeroBytes(earlySecret)
+	zeroBytes(binderKey)
+	zeroBytes(finishedKey)
+	return binder
+}
+
+// earlyTrafficKeys derives the key and IV that protect the client's early
+// data, from the PSK and the ClientHello that offers it
+func earlyTrafficKeys(suite cipherSuite, psk []byte, clientHello *handshakeMessage) (key, iv []byte) {
+	params := cipherSuiteMap[suite]
+	earlySecret := hkdfExtract(params.hash, nil, psk)
+
+	h := params.hash.New()
+	h.Write(clientHello.Marshal())
+	secret := hkdfExpandLabel(params.hash, earlySecret, labelClientEarlyTrafficSecret, h.Sum(nil), params.hash.Size())
+	key = hkdfExpandLabel(params.hash, secret, labelKey, []byte{}, params.keyLen)
+	iv = hkdfExpandLabel(params.hash, secret, labelIV, []byte{}, params.ivLen)
+
+	zeroBytes(earlySecret)
+	zeroBytes(secret)
+	return key, iv
+}
+
 func (c *cryptoContext) UpdateKeys() {
-	// XXX: Assumes that nothing further has been added after the ServerFinished
-	handshakeThroughFinished := c.marshalTranscript()
-	c.trafficSecret = hkdfExpandLabel(c.params.hash, c.trafficSecret, labelTrafficSecret, []byte{}, c.params.hash.Size())
-	c.applicationKeys = c.makeTrafficKeys(c.trafficSecret, phaseApplication, handshakeThroughFinished)
+	oldClientTrafficSecret := c.clientTrafficSecret
+	oldServerTrafficSecret := c.serverTrafficSecret
+	oldApplicationKeys := c.applicationKeys
+
+	L := c.params.hash.Size()
+	c.clientTrafficSecret = hkdfExpandLabel(c.params.hash, c.clientTrafficSecret, labelTrafficUpdate, []byte{}, L)
+	c.serverTrafficSecret = hkdfExpandLabel(c.params.hash, c.serverTrafficSecret, labelTrafficUpdate, []byte{}, L)
+	c.applicationKeys = c.makeTrafficKeys(c.clientTrafficSecret, c.serverTrafficSecret)
+
+	// The previous generation of keys is no longer needed
+	zeroBytes(oldClientTrafficSecret)
+	zeroBytes(oldServerTrafficSecret)
+	oldApplicationKeys.wipe()
+}
+
+// Wipe zeroes all of the secret material held by the context.  The context
+// cannot be used to derive further keys afterward.
+func (c *cryptoContext) Wipe() {
+	for _, secret := range [][]byte{
+		c.PSK, c.DHE, c.earlySecret, c.handshakeSecret,
+		c.clientHandshakeTrafficSecret, c.serverHandshakeTrafficSecret,
+		c.masterSecret, c.serverFinishedKey, c.clientFinishedKey,
+		c.clientTrafficSecret, c.serverTrafficSecret, c.exporterSecret,
+		c.resumptionSecret,
+	} {
+		zeroBytes(secret)
+	}
+	c.handshakeKeys.wipe()
+	c.applicationKeys.wipe()
+	c.initialized = false
 }
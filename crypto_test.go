@@ -7,8 +7,9 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
-	_ "crypto/sha256"
+	"crypto/sha256"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/asn1"
 	"encoding/hex"
 	"math/big"
@@ -23,6 +24,25 @@ var (
 		"bd3d68c0631b0ed8faf298c40c404bf59"
 	shortKeyPrivHex = "6f28e305a0975ead3b95c228082adcae852fca6af0c9385f670531657966cd6a"
 
+	// Test vectors from RFC 7748, Sections 5.2 and 6.1
+	x25519Vectors = []struct{ scalar, u, out string }{
+		{
+			"a546e36bf0527c9d3b16154b82465edd62144c0ac1fc5a18506a2244ba449ac4",
+			"e6db6867583030db3594c1a424b15f7c726624ec26b3353b10a903a6d0ab1c4c",
+			"c3da55379de9c6908e94ea4df28d084f32eccf03491c71f754b4075577a28552",
+		},
+		{
+			"4b66e9d4d1b4673c5ad22691957d6af5c11b6421e0ea01d42ca4169e7918ba0d",
+			"e5210f12786811d3f4b7959d0538ae2c31dbe7106fc03c3efc4cd549c715a493",
+			"95cbde9476e8907d7aade45cb4b873f88b595a68799fa152e6f8f7647aac7957",
+		},
+	}
+	x25519AlicePrivHex = "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a"
+	x25519AlicePubHex  = "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a"
+	x25519BobPrivHex   = "5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb"
+	x25519BobPubHex    = "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f"
+	x25519SharedHex    = "4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742"
+
 	// Test vectors from RFC 5869
 	hkdfSaltHex              = "000102030405060708090a0b0c"
 	hkdfInputHex             = "0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b"
@@ -33,15 +53,34 @@ var (
 	hkdfExpandLen            = 42
 	hkdfLabel                = "test"
 	hkdfHashHex              = "f9a54250131c827542664bcad131b87c09cdd92f0d5f84db3680ee4c0c0f8ed6" // random
-	hkdfEncodedLabelHex      = "002a" + "0d" + hex.EncodeToString([]byte("TLS 1.3, "+hkdfLabel)) + "20" + hkdfHashHex
-	hkdfExpandLabelOutputHex = "474de877d26b9e14ba50d91657bdf8bdb0fb7152f0ef8d908bb68eb697bb64c6bf2f2d81fa987e86bc32"
+	hkdfEncodedLabelHex      = "002a" + "0a" + hex.EncodeToString([]byte("tls13 "+hkdfLabel)) + "20" + hkdfHashHex
+	hkdfExpandLabelOutputHex = "a7c2b665154333b14f01762409173a6941d9c4e2edbe380e1cdd3091cb56f4aff8aced829cca286be245"
+
+	// Test vectors from RFC 8448, Section 3 (Simple 1-RTT Handshake)
+	rfc8448EarlySecretHex           = "33ad0a1c607ec03b09e6cd9893680ce210adf300aa1f2660e1b22e10f170f92a"
+	rfc8448DHEHex                   = "8bd4054fb55b9d63fdfbacf9f04b9f0d35e6d63f537563efd46272900f89492d"
+	rfc8448HandshakeSecretHex       = "1dc826e93606aa6fdc0aadc12f741b01046aa6b99f691ed221a9f0ca043fbeac"
+	rfc8448HelloHashHex             = "860c06edc07858ee8e78f0e7428c58edd6b43f2ca3e6e95f02ed063cf0e1cad8"
+	rfc8448ClientHandshakeSecretHex = "b3eddb126e067f35a780b3abf45e2d8f3b1a950738f52e9600746a0e27a55a21"
+	rfc8448ServerHandshakeSecretHex = "b67b7d690cc16c4e75e54213cb2d37b4e9c912bcded9105d42befd59d391ad38"
+	rfc8448ServerWriteKeyHex        = "3fce516009c21727d0f2e4e86ee403bc"
+	rfc8448ServerWriteIVHex         = "5d313eb2671276ee13000b30"
+	rfc8448CertVerifyHashHex        = "edb7725fa7a3473b031ec8ef65a2485493900138a2b91291407d7951a06110ed"
+	rfc8448ServerFinishedKeyHex     = "008d3b66f816ea559f96b537e885c31fc068bf492c652f01f288a1d8cdc19fc8"
+	rfc8448ServerFinishedDataHex    = "9b9b141d906337fbd2cbdce71df4deda4ab42c309572cb7fffee5454b78f0718"
+	rfc8448ServerFinishedHashHex    = "9608102a0f1ccc6db6250b7b7e417b1a000eaada3daae4777a7686c9ff83df13"
+	rfc8448ClientFinishedKeyHex     = "b80ad01015fb2f0bd65ff7d4da5d6bf83f84821d1f87fdc7d3c75b5a7b42d9c4"
+	rfc8448ClientFinishedDataHex    = "a8ec436d677634ae525ac1fcebe11a039ec17694fac6e98527b642f2edd5ce61"
+	rfc8448MasterSecretHex          = "18df06843d13a08bf2a449844c5f8a478001bc4d4c627984d5a41da8d0402919"
+	rfc8448ClientTrafficSecretHex   = "9e40646ce79a7f9dc05af8889bce6552875afa0b06df0087f792ebb7c17504a5"
+	rfc8448ServerTrafficSecretHex   = "a11af9f05531f856ad47116b45a950328204b4f44bfb6b3a4b4f1f3fcb631643"
 )
 
 func TestNewKeyShare(t *testing.T) {
 	// Test success cases for elliptic curve groups
 	for _, group := range ecGroups {
 		// priv is opaque, so there's nothing we can do to test besides use
-		pub, _, err := newKeyShare(group)
+		pub, _, err := newKeyShare(group, prng)
 		assertNotError(t, err, "Failed to generate new key pair")
 
 		crv := curveFromNamedGroup(group)
@@ -51,14 +90,20 @@ func TestNewKeyShare(t *testing.T) {
 	}
 
 	// Test failure case for an elliptic curve key generation failure
-	originalPRNG := prng
-	prng = bytes.NewReader(nil)
-	_, _, err := newKeyShare(namedGroupP256)
+	_, _, err := newKeyShare(namedGroupP256, bytes.NewReader(nil))
 	assertError(t, err, "Generated a key with no entropy")
-	prng = originalPRNG
+
+	// Test that the same randomness yields the same key pair
+	seed := bytes.Repeat([]byte{0x42}, 64)
+	pub1, priv1, err := newKeyShare(namedGroupP256, bytes.NewReader(seed))
+	assertNotError(t, err, "Failed to generate key pair from seed")
+	pub2, priv2, err := newKeyShare(namedGroupP256, bytes.NewReader(seed))
+	assertNotError(t, err, "Failed to generate key pair from seed")
+	assertByteEquals(t, pub1, pub2)
+	assertByteEquals(t, priv1, priv2)
 
 	// Test failure case for an unknown group
-	_, _, err = newKeyShare(namedGroupUnknown)
+	_, _, err = newKeyShare(namedGroupUnknown, prng)
 	assertError(t, err, "Generated a key for an unsupported group")
 }
 
@@ -68,9 +113,9 @@ func TestKeyAgreement(t *testing.T) {
 
 	// Test success cases for elliptic curve groups
 	for _, group := range ecGroups {
-		pubA, privA, err := newKeyShare(group)
+		pubA, privA, err := newKeyShare(group, prng)
 		assertNotError(t, err, "Failed to generate new key pair (A)")
-		pubB, privB, err := newKeyShare(group)
+		pubB, privB, err := newKeyShare(group, prng)
 		assertNotError(t, err, "Failed to generate new key pair (B)")
 
 		x1, err1 := keyAgreement(group, pubA, privB)
@@ -92,11 +137,80 @@ func TestKeyAgreement(t *testing.T) {
 	_, err = keyAgreement(namedGroupP256, shortKeyPub[:5], shortKeyPriv)
 	assertError(t, err, "Performed key agreement with a truncated public key")
 
+	// Test failure case for a point that is not on the curve
+	notOnCurve := append([]byte{}, shortKeyPub...)
+	notOnCurve[len(notOnCurve)-1] ^= 0x01
+	_, err = keyAgreement(namedGroupP256, notOnCurve, shortKeyPriv)
+	assertError(t, err, "Performed key agreement with a point not on the curve")
+
+	// Test failure case for an all-zero shared secret.  A zero private key
+	// yields the point at infinity, whose X coordinate is zero.
+	_, err = keyAgreement(namedGroupP256, shortKeyPub, make([]byte, len(shortKeyPriv)))
+	assertError(t, err, "Performed key agreement with an all-zero shared secret")
+	assert(t, allZero(make([]byte, 32)), "Zero buffer not detected")
+	assert(t, !allZero([]byte{0, 0, 1}), "Non-zero buffer detected as zero")
+
+	// Test failure case for an empty public key
+	_, err = keyAgreement(namedGroupP256, []byte{}, shortKeyPriv)
+	assertError(t, err, "Performed key agreement with an empty public key")
+
 	// Test failure case for an unknown group
 	_, err = keyAgreement(namedGroupUnknown, shortKeyPub, shortKeyPriv)
 	assertError(t, err, "Performed key agreement with an unsupported group")
 }
 
+func TestX25519(t *testing.T) {
+	// Test the scalar multiplication vectors
+	for _, v := range x25519Vectors {
+		scalar, _ := hex.DecodeString(v.scalar)
+		u, _ := hex.DecodeString(v.u)
+		out, _ := hex.DecodeString(v.out)
+		x, err := keyAgreement(namedGroupX25519, u, scalar)
+		assertNotError(t, err, "Failed X25519 scalar multiplication")
+		assertByteEquals(t, x, out)
+	}
+
+	// Test that key generation reproduces the Diffie-Hellman vectors, and
+	// that both sides agree on the shared secret
+	alicePriv, _ := hex.DecodeString(x25519AlicePrivHex)
+	alicePub, _ := hex.DecodeString(x25519AlicePubHex)
+	bobPriv, _ := hex.DecodeString(x25519BobPrivHex)
+	bobPub, _ := hex.DecodeString(x25519BobPubHex)
+	shared, _ := hex.DecodeString(x25519SharedHex)
+
+	pub, priv, err := newKeyShare(namedGroupX25519, bytes.NewReader(alicePriv))
+	assertNotError(t, err, "Failed to generate X25519 key share (Alice)")
+	assertByteEquals(t, pub, alicePub)
+	assertEquals(t, priv[0]&7, byte(0))
+	assertEquals(t, priv[31]&0xc0, byte(0x40))
+	pub, _, err = newKeyShare(namedGroupX25519, bytes.NewReader(bobPriv))
+	assertNotError(t, err, "Failed to generate X25519 key share (Bob)")
+	assertByteEquals(t, pub, bobPub)
+
+	x, err := keyAgreement(namedGroupX25519, bobPub, alicePriv)
+	assertNotError(t, err, "Key agreement failed (Ab)")
+	assertByteEquals(t, x, shared)
+	x, err = keyAgreement(namedGroupX25519, alicePub, bobPriv)
+	assertNotError(t, err, "Key agreement failed (aB)")
+	assertByteEquals(t, x, shared)
+
+	// Test failure case for key generation with no entropy
+	_, _, err = newKeyShare(namedGroupX25519, bytes.NewReader(nil))
+	assertError(t, err, "Generated an X25519 key with no entropy")
+
+	// Test failure case for a wrong-size public key
+	_, err = keyAgreement(namedGroupX25519, bobPub[:31], alicePriv)
+	assertError(t, err, "Performed X25519 key agreement with a truncated public key")
+
+	// Test failure case for low-order points, which yield an all-zero secret
+	one := make([]byte, 32)
+	one[0] = 1
+	for _, lowOrder := range [][]byte{make([]byte, 32), one} {
+		_, err = keyAgreement(namedGroupX25519, lowOrder, alicePriv)
+		assertError(t, err, "Performed X25519 key agreement with a low-order point")
+	}
+}
+
 func TestNewSigningKey(t *testing.T) {
 	// Test RSA success
 	privRSA, err := newSigningKey(signatureAlgorithmRSA)
@@ -137,6 +251,89 @@ func TestSelfSigned(t *testing.T) {
 	assertError(t, err, "Signed with a mismatched algorithm")
 }
 
+// newIssuedCertificate creates a CA certificate for the given public key,
+// signed by the issuer with the given algorithm
+func newIssuedCertificate(name string, sigAlg x509.SignatureAlgorithm, pub crypto.PublicKey, issuer *x509.Certificate, issuerKey crypto.Signer) (*x509.Certificate, error) {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(0xB0B0B0B0),
+		SignatureAlgorithm:    sigAlg,
+		Subject:               pkix.Name{CommonName: name},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(prng, template, issuer, pub, issuerKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+func TestCheckCertificateSignatureAlgorithms(t *testing.T) {
+	rootKey, _ := newSigningKey(signatureAlgorithmECDSA)
+	intermediateKey, _ := newSigningKey(signatureAlgorithmECDSA)
+	leafKey, _ := newSigningKey(signatureAlgorithmECDSA)
+	root, err := newSelfSigned("root.example.com",
+		signatureAndHashAlgorithm{hashAlgorithmSHA256, signatureAlgorithmECDSA}, rootKey)
+	assertNotError(t, err, "Failed to create root")
+	intermediate, err := newIssuedCertificate("intermediate.example.com", x509.ECDSAWithSHA1, intermediateKey.Public(), root, rootKey)
+	assertNotError(t, err, "Failed to create intermediate")
+	leaf, err := newIssuedCertificate("example.com", x509.ECDSAWithSHA256, leafKey.Public(), intermediate, intermediateKey)
+	assertNotError(t, err, "Failed to create leaf")
+
+	// Test that a chain with a SHA-1-signed intermediate is rejected unless
+	// SHA-1 is acceptable
+	chain := []*x509.Certificate{leaf, intermediate, root}
+	err = checkCertificateSignatureAlgorithms(chain, signatureAlgorithms)
+	assertError(t, err, "Accepted a SHA-1-signed intermediate")
+	withSHA1 := append([]signatureAndHashAlgorithm{{hashAlgorithmSHA1, signatureAlgorithmECDSA}}, signatureAlgorithms...)
+	err = checkCertificateSignatureAlgorithms(chain, withSHA1)
+	assertNotError(t, err, "Rejected a chain with acceptable algorithms")
+
+	// Test that the signature on a self-signed root is not checked
+	err = checkCertificateSignatureAlgorithms([]*x509.Certificate{root}, []signatureAndHashAlgorithm{})
+	assertNotError(t, err, "Checked the algorithm of a self-signed certificate")
+}
+
+// newTestCertificate creates a self-signed certificate with the given extra
+// extensions
+func newTestCertificate(priv crypto.Signer, extensions ...pkix.Extension) (*x509.Certificate, error) {
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(0xC0C0C0C0),
+		Subject:         pkix.Name{CommonName: "example.com"},
+		ExtraExtensions: extensions,
+	}
+	der, err := x509.CreateCertificate(prng, template, template, priv.Public(), priv)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// tlsFeatureExtension creates a TLS feature extension listing the given
+// features
+func tlsFeatureExtension(features ...int) pkix.Extension {
+	value, _ := asn1.Marshal(features)
+	return pkix.Extension{Id: oidTLSFeature, Value: value}
+}
+
+func TestRequiresStapling(t *testing.T) {
+	priv, _ := newSigningKey(signatureAlgorithmECDSA)
+	for _, c := range []struct {
+		extensions []pkix.Extension
+		required   bool
+	}{
+		{[]pkix.Extension{tlsFeatureExtension(tlsFeatureStatusRequest)}, true},
+		{[]pkix.Extension{{Id: oidTLSFeature, Value: []byte{0x05}}}, true},
+		{[]pkix.Extension{tlsFeatureExtension(17)}, false},
+		{nil, false},
+	} {
+		cert, err := newTestCertificate(priv, c.extensions...)
+		assertNotError(t, err, "Failed to create certificate")
+		assertEquals(t, requiresStapling(cert), c.required)
+	}
+}
+
 func TestSignVerify(t *testing.T) {
 	data := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9,
 		10, 11, 12, 13, 14, 15, 16, 17, 18, 19,
@@ -149,35 +346,51 @@ func TestSignVerify(t *testing.T) {
 	privECDSA, err := newSigningKey(signatureAlgorithmECDSA)
 	assertNotError(t, err, "failed to generate RSA private key")
 
+	algRSA := signatureAndHashAlgorithm{hashAlgorithmSHA256, signatureAlgorithmRSA}
+	algRSAPSS := signatureAndHashAlgorithm{hashAlgorithmSHA256, signatureAlgorithmRSAPSS}
+	algECDSA := signatureAndHashAlgorithm{hashAlgorithmSHA256, signatureAlgorithmECDSA}
+
 	// Test successful signing
-	sigAlgRSA, sigRSA, err := sign(crypto.SHA256, privRSA, data, context)
+	sigAlgRSA, sigRSA, err := sign(algRSA, privRSA, data, context)
 	assertNotError(t, err, "Failed to generate RSA signature")
 	assertEquals(t, sigAlgRSA, signatureAlgorithmRSA)
 
 	originalAllowPKCS1 := allowPKCS1
 	allowPKCS1 = false
-	sigAlgRSAPSS, sigRSAPSS, err := sign(crypto.SHA256, privRSA, data, context)
+	sigAlgRSAPSS, sigRSAPSS, err := sign(algRSA, privRSA, data, context)
 	assertNotError(t, err, "Failed to generate RSA-PSS signature")
 	assertEquals(t, sigAlgRSAPSS, signatureAlgorithmRSAPSS)
 	allowPKCS1 = originalAllowPKCS1
 
-	sigAlgECDSA, sigECDSA, err := sign(crypto.SHA256, privECDSA, data, context)
+	sigAlgECDSA, sigECDSA, err := sign(algECDSA, privECDSA, data, context)
 	assertNotError(t, err, "Failed to generate ECDSA signature")
 	assertEquals(t, sigAlgECDSA, signatureAlgorithmECDSA)
 
+	// Test that an RSA-PSS scheme is used as is, with its own hash
+	algPSSSHA384 := RSA_PSS_RSAE_SHA384.algorithm()
+	sigAlgPSSSHA384, sigPSSSHA384, err := sign(algPSSSHA384, privRSA, data, context)
+	assertNotError(t, err, "Failed to generate rsa_pss_rsae_sha384 signature")
+	assertEquals(t, sigAlgPSSSHA384, algPSSSHA384.signature)
+
+	// Test failure case for signing with an unknown hash
+	_, _, err = sign(signatureAndHashAlgorithm{hashAlgorithm(0xff), signatureAlgorithmECDSA}, privECDSA, data, context)
+	assertError(t, err, "Signed with an unknown hash")
+
 	// Test successful verification
-	algRSA := signatureAndHashAlgorithm{hashAlgorithmSHA256, signatureAlgorithmRSA}
 	err = verify(algRSA, privRSA.Public(), data, context, sigRSA)
 	assertNotError(t, err, "Failed to verify a valid RSA-PSS signature")
 
 	originalAllowPKCS1 = allowPKCS1
 	allowPKCS1 = false
-	algRSAPSS := signatureAndHashAlgorithm{hashAlgorithmSHA256, signatureAlgorithmRSAPSS}
 	err = verify(algRSAPSS, privRSA.Public(), data, context, sigRSAPSS)
 	assertNotError(t, err, "Failed to verify a valid RSA-PSS signature")
 	allowPKCS1 = originalAllowPKCS1
 
-	algECDSA := signatureAndHashAlgorithm{hashAlgorithmSHA256, signatureAlgorithmECDSA}
+	err = verify(algPSSSHA384, privRSA.Public(), data, context, sigPSSSHA384)
+	assertNotError(t, err, "Failed to verify a valid rsa_pss_rsae_sha384 signature")
+	err = verify(RSA_PSS_RSAE_SHA256.algorithm(), privRSA.Public(), data, context, sigPSSSHA384)
+	assertError(t, err, "Verified an RSA-PSS signature with the wrong hash")
+
 	err = verify(algECDSA, privECDSA.Public(), data, context, sigECDSA)
 	assertNotError(t, err, "Failed to verify a valid ECDSA signature")
 
@@ -220,6 +433,149 @@ func TestSignVerify(t *testing.T) {
 	assertError(t, err, "Verified with invalid public key type")
 }
 
+func TestSelectSignatureAlgorithm(t *testing.T) {
+	privRSA, err := newSigningKey(signatureAlgorithmRSA)
+	assertNotError(t, err, "Failed to generate RSA private key")
+	privECDSA, err := newSigningKey(signatureAlgorithmECDSA)
+	assertNotError(t, err, "Failed to generate ECDSA private key")
+
+	rsaSHA384 := signatureAndHashAlgorithm{hashAlgorithmSHA384, signatureAlgorithmRSA}
+	ecdsaSHA256 := signatureAndHashAlgorithm{hashAlgorithmSHA256, signatureAlgorithmECDSA}
+	acceptable := []signatureAndHashAlgorithm{rsaSHA384, ecdsaSHA256}
+
+	// Test that the first compatible algorithm is selected for each key type
+	alg, ok := selectSignatureAlgorithm(privRSA, false, acceptable)
+	assert(t, ok, "Failed to select an algorithm for an RSA key")
+	assertEquals(t, alg, rsaSHA384)
+
+	alg, ok = selectSignatureAlgorithm(privECDSA, false, acceptable)
+	assert(t, ok, "Failed to select an algorithm for an ECDSA key")
+	assertEquals(t, alg, ecdsaSHA256)
+
+	// Test failure when the key type isn't acceptable to the peer
+	_, ok = selectSignatureAlgorithm(privECDSA, false, []signatureAndHashAlgorithm{rsaSHA384})
+	assert(t, !ok, "Selected an algorithm incompatible with the key")
+
+	// Test that algorithms with unsupported hashes are skipped
+	unknownHash := signatureAndHashAlgorithm{hashAlgorithm(0xff), signatureAlgorithmECDSA}
+	_, ok = selectSignatureAlgorithm(privECDSA, false, []signatureAndHashAlgorithm{unknownHash})
+	assert(t, !ok, "Selected an algorithm with an unsupported hash")
+
+	// Test that the RSA-PSS schemes are selected by the kind of RSA key
+	pssSchemes := []signatureAndHashAlgorithm{
+		RSA_PSS_PSS_SHA256.algorithm(),
+		RSA_PSS_RSAE_SHA256.algorithm(),
+	}
+	alg, ok = selectSignatureAlgorithm(privRSA, false, pssSchemes)
+	assert(t, ok, "Failed to select an algorithm for an rsaEncryption key")
+	assertEquals(t, alg.scheme(), RSA_PSS_RSAE_SHA256)
+
+	alg, ok = selectSignatureAlgorithm(privRSA, true, pssSchemes)
+	assert(t, ok, "Failed to select an algorithm for an RSASSA-PSS key")
+	assertEquals(t, alg.scheme(), RSA_PSS_PSS_SHA256)
+
+	_, ok = selectSignatureAlgorithm(privRSA, true, []signatureAndHashAlgorithm{rsaSHA384, RSA_PSS_RSAE_SHA256.algorithm()})
+	assert(t, !ok, "Selected an rsaEncryption algorithm for an RSASSA-PSS key")
+}
+
+// newRSAPSSTestCertificate creates a certificate whose key is marked as an
+// RSASSA-PSS key.  crypto/x509 can't create one, so the SPKI algorithm of an
+// rsaEncryption certificate is replaced, keeping its NULL parameters so that
+// the length doesn't change.  The signature is no longer valid.
+func newRSAPSSTestCertificate(priv *rsa.PrivateKey) (*x509.Certificate, error) {
+	cert, err := newTestCertificate(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaEncryption, _ := asn1.Marshal(asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1})
+	rsaPSS, _ := asn1.Marshal(oidRSAPSS)
+	return x509.ParseCertificate(bytes.Replace(cert.Raw, rsaEncryption, rsaPSS, 1))
+}
+
+func TestCertificatePublicKey(t *testing.T) {
+	privRSA, _ := rsa.GenerateKey(prng, 1024)
+	privECDSA, _ := newSigningKey(signatureAlgorithmECDSA)
+
+	// Test that rsaEncryption and ECDSA keys come from crypto/x509
+	for _, priv := range []crypto.Signer{privRSA, privECDSA} {
+		cert, err := newTestCertificate(priv)
+		assertNotError(t, err, "Failed to create certificate")
+		pub, pssKey, err := certificatePublicKey(cert)
+		assertNotError(t, err, "Failed to read public key")
+		assertDeepEquals(t, pub, priv.Public())
+		assert(t, !pssKey, "Key marked as RSASSA-PSS")
+	}
+
+	// Test that an RSASSA-PSS key is parsed from the SPKI
+	cert, err := newRSAPSSTestCertificate(privRSA)
+	assertNotError(t, err, "Failed to create RSASSA-PSS certificate")
+	assert(t, cert.PublicKey == nil, "crypto/x509 parsed an RSASSA-PSS key")
+	pub, pssKey, err := certificatePublicKey(cert)
+	assertNotError(t, err, "Failed to read RSASSA-PSS public key")
+	assertDeepEquals(t, pub, privRSA.Public())
+	assert(t, pssKey, "Key not marked as RSASSA-PSS")
+
+	// Test that the kind of key limits the RSA-PSS schemes
+	assert(t, usableWithRSAKey(RSA_PSS_RSAE_SHA256.algorithm(), false), "rsae scheme unusable with rsaEncryption key")
+	assert(t, !usableWithRSAKey(RSA_PSS_PSS_SHA256.algorithm(), false), "pss scheme usable with rsaEncryption key")
+	assert(t, usableWithRSAKey(RSA_PSS_PSS_SHA384.algorithm(), true), "pss scheme unusable with RSASSA-PSS key")
+	assert(t, !usableWithRSAKey(RSA_PSS_RSAE_SHA384.algorithm(), true), "rsae scheme usable with RSASSA-PSS key")
+	assert(t, !usableWithRSAKey(signatureAndHashAlgorithm{hashAlgorithmSHA256, signatureAlgorithmRSAPSS}, true),
+		"Legacy RSA-PSS usable with RSASSA-PSS key")
+}
+
+func TestDeterministicECDSA(t *testing.T) {
+	// From RFC 6979, Appendix A.2.5 (P-256, SHA-256, message "sample")
+	priv := &ecdsa.PrivateKey{D: hexToBigInt(t, "C9AFA9D845BA75166B5C215767B1D6934E50C3DB36E89B127B8A622B120F6721")}
+	priv.Curve = elliptic.P256()
+	priv.PublicKey.X, priv.PublicKey.Y = priv.Curve.ScalarBaseMult(priv.D.Bytes())
+	expectedK := hexToBigInt(t, "A6E3C57DD01ABE90086538398355DD4C3B17AA873382B0F24D6129493D8AAD60")
+	expectedR := hexToBigInt(t, "EFD48B2AACB6A8FD1140DD9CD45E81D69D2C877B56AAF991C34D0EA84EAF3716")
+	expectedS := hexToBigInt(t, "F7CB1C942D657C41D436C7A1B6E29F65F3E900DBB9AFF4064DC4AB2F843ACDA8")
+	digest := sha256.Sum256([]byte("sample"))
+
+	// Test the nonce and signature against the known answer
+	k := rfc6979Nonces(crypto.SHA256, priv.D, priv.Curve.Params().N, digest[:])()
+	assertEquals(t, k.Cmp(expectedK), 0)
+
+	signer := newDeterministicSigner(priv)
+	sig, err := signer.Sign(nil, digest[:], crypto.SHA256)
+	assertNotError(t, err, "Failed to sign deterministically")
+	ecdsaSig := new(ecdsaSignature)
+	_, err = asn1.Unmarshal(sig, ecdsaSig)
+	assertNotError(t, err, "Failed to decode deterministic signature")
+	assertEquals(t, ecdsaSig.R.Cmp(expectedR), 0)
+	assertEquals(t, ecdsaSig.S.Cmp(expectedS), 0)
+
+	// Test failure without a hash function
+	_, err = signer.Sign(nil, digest[:], nil)
+	assertError(t, err, "Signed deterministically without a hash function")
+
+	// Test that non-ECDSA keys are left alone
+	privRSA, err := newSigningKey(signatureAlgorithmRSA)
+	assertNotError(t, err, "Failed to generate RSA private key")
+	assertEquals(t, newDeterministicSigner(privRSA), crypto.Signer(privRSA))
+
+	// Test that two CertificateVerify signatures over the same transcript
+	// are identical, and valid
+	transcript := []*handshakeMessage{
+		&handshakeMessage{msgType: handshakeTypeClientHello, body: []byte{0, 1, 2, 3}},
+	}
+	cv1 := &certificateVerifyBody{alg: signatureAndHashAlgorithm{hashAlgorithmSHA256, signatureAlgorithmECDSA}}
+	cv2 := &certificateVerifyBody{alg: signatureAndHashAlgorithm{hashAlgorithmSHA256, signatureAlgorithmECDSA}}
+	assertNotError(t, cv1.Sign(signer, transcript, contextServerCertificateVerify), "Failed to sign CertificateVerify")
+	assertNotError(t, cv2.Sign(signer, transcript, contextServerCertificateVerify), "Failed to sign CertificateVerify")
+	assertByteEquals(t, cv1.signature, cv2.signature)
+	assertNotError(t, cv1.Verify(priv.Public(), transcript, contextServerCertificateVerify), "Failed to verify deterministic signature")
+}
+
+func hexToBigInt(t *testing.T, h string) *big.Int {
+	x, ok := new(big.Int).SetString(h, 16)
+	assert(t, ok, "Invalid hex integer")
+	return x
+}
+
 func TestHKDF(t *testing.T) {
 	hash := crypto.SHA256
 	hkdfInput, _ := hex.DecodeString(hkdfInputHex)
@@ -281,8 +637,7 @@ var (
 		signature: random(64),
 	}
 
-	ESContextIn = random(32)
-	SSContextIn = ESContextIn
+	DHEContextIn = random(32)
 )
 
 func keySetEmpty(k keySet) bool {
@@ -338,28 +693,30 @@ func TestCryptoContext(t *testing.T) {
 
 	// Test successful Init
 	ctx := cryptoContext{}
-	err = ctx.Init(chm, shm, SSContextIn, ESContextIn, serverHelloContextIn.cipherSuite)
+	err = ctx.Init(chm, shm, nil, DHEContextIn, serverHelloContextIn.cipherSuite)
 	assertNotError(t, err, "Failed to init context")
 	assert(t, ctx.initialized, "Context not marked as initialized after Init")
 	assert(t, len(ctx.transcript) == 2, "Transcript not populated after Init")
-	assert(t, len(ctx.ES) > 0, "ES not populated after Init")
-	assert(t, len(ctx.SS) > 0, "SS not populated after Init")
-	assert(t, len(ctx.xES) > 0, "xES not populated after Init")
-	assert(t, len(ctx.xES) > 0, "xSS not populated after Init")
+	assert(t, len(ctx.PSK) > 0, "PSK not populated after Init")
+	assert(t, len(ctx.DHE) > 0, "DHE not populated after Init")
+	assert(t, len(ctx.earlySecret) > 0, "Early secret not populated after Init")
+	assert(t, len(ctx.handshakeSecret) > 0, "Handshake secret not populated after Init")
+	assert(t, len(ctx.clientHandshakeTrafficSecret) > 0, "Client handshake traffic secret not populated after Init")
+	assert(t, len(ctx.serverHandshakeTrafficSecret) > 0, "Server handshake traffic secret not populated after Init")
 	assert(t, !keySetEmpty(ctx.handshakeKeys), "HandshakeKeys not populated after Init")
 
 	// Test Init failure on usupported ciphersuite
 	ctx = cryptoContext{}
-	err = ctx.Init(chm, shm, SSContextIn, ESContextIn, TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256)
+	err = ctx.Init(chm, shm, nil, DHEContextIn, cipherSuite(0x0000))
 	assertError(t, err, "Init'ed context with an unsupported ciphersuite")
 
 	// Test Init failure on nil messages
 	ctx = cryptoContext{}
-	err = ctx.Init(nil, shm, SSContextIn, ESContextIn, serverHelloContextIn.cipherSuite)
+	err = ctx.Init(nil, shm, nil, DHEContextIn, serverHelloContextIn.cipherSuite)
 	assertError(t, err, "Init'ed context with nil clientHello")
 
 	ctx = cryptoContext{}
-	err = ctx.Init(chm, nil, SSContextIn, ESContextIn, serverHelloContextIn.cipherSuite)
+	err = ctx.Init(chm, nil, nil, DHEContextIn, serverHelloContextIn.cipherSuite)
 	assertError(t, err, "Init'ed context with nil clientHello")
 
 	// Test that Update failes on un-Init'ed context
@@ -369,12 +726,10 @@ func TestCryptoContext(t *testing.T) {
 
 	// Test succesful Update
 	ctx = cryptoContext{}
-	err = ctx.Init(chm, shm, SSContextIn, ESContextIn, serverHelloContextIn.cipherSuite)
+	err = ctx.Init(chm, shm, nil, DHEContextIn, serverHelloContextIn.cipherSuite)
 	assertNotError(t, err, "Failed to init context before update")
 	err = ctx.Update([]*handshakeMessage{cm, cvm})
 	assertNotError(t, err, "Failed to update context")
-	assert(t, len(ctx.mES) > 0, "mES not populated after Update")
-	assert(t, len(ctx.mSS) > 0, "mSS not populated after Update")
 	assert(t, len(ctx.masterSecret) > 0, "Master secret not populated after Update")
 	assert(t, len(ctx.serverFinishedKey) > 0, "Server finished key not populated after Update")
 	assert(t, len(ctx.serverFinishedData) > 0, "Server finished data not populated after Update")
@@ -382,12 +737,13 @@ func TestCryptoContext(t *testing.T) {
 	assert(t, len(ctx.clientFinishedKey) > 0, "Client finished key not populated after Update")
 	assert(t, len(ctx.clientFinishedData) > 0, "Client finished data not populated after Update")
 	assert(t, ctx.clientFinished != nil, "Client finished not populated after Update")
-	assert(t, len(ctx.trafficSecret) > 0, "Traffic secret not populated after Update")
+	assert(t, len(ctx.clientTrafficSecret) > 0, "Client traffic secret not populated after Update")
+	assert(t, len(ctx.serverTrafficSecret) > 0, "Server traffic secret not populated after Update")
 	assert(t, !keySetEmpty(ctx.applicationKeys), "Application keys not populated after Update")
 
 	// Test Update failure on nil message
 	ctx = cryptoContext{}
-	err = ctx.Init(chm, shm, SSContextIn, ESContextIn, serverHelloContextIn.cipherSuite)
+	err = ctx.Init(chm, shm, nil, DHEContextIn, serverHelloContextIn.cipherSuite)
 	assertNotError(t, err, "Failed to init context before update failure test")
 	err = ctx.Update([]*handshakeMessage{cm, nil})
 	assertError(t, err, "Updated context with nil message")
@@ -401,3 +757,47 @@ func TestCryptoContext(t *testing.T) {
 	assert(t, !bytes.Equal(oldKeys.clientWriteIV, newKeys.clientWriteIV), "Client write IV didn't change")
 	assert(t, !bytes.Equal(oldKeys.serverWriteIV, newKeys.serverWriteIV), "Server write IV didn't change")
 }
+
+func TestKeyScheduleKnownAnswer(t *testing.T) {
+	unhex := func(h string) []byte {
+		data, _ := hex.DecodeString(h)
+		return data
+	}
+
+	ctx := cryptoContext{params: cipherSuiteMap[TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256]}
+	hash := ctx.params.hash
+	emptyHash := hash.New().Sum(nil)
+
+	// Test the early and handshake secrets
+	earlySecret := hkdfExtract(hash, nil, make([]byte, hash.Size()))
+	assertByteEquals(t, earlySecret, unhex(rfc8448EarlySecretHex))
+	derived := ctx.deriveSecret(earlySecret, labelDerived, emptyHash)
+	handshakeSecret := hkdfExtract(hash, derived, unhex(rfc8448DHEHex))
+	assertByteEquals(t, handshakeSecret, unhex(rfc8448HandshakeSecretHex))
+
+	// Test the handshake traffic secrets and keys
+	clientSecret := ctx.deriveSecret(handshakeSecret, labelClientHandshakeTrafficSecret, unhex(rfc8448HelloHashHex))
+	serverSecret := ctx.deriveSecret(handshakeSecret, labelServerHandshakeTrafficSecret, unhex(rfc8448HelloHashHex))
+	assertByteEquals(t, clientSecret, unhex(rfc8448ClientHandshakeSecretHex))
+	assertByteEquals(t, serverSecret, unhex(rfc8448ServerHandshakeSecretHex))
+	keys := ctx.makeTrafficKeys(clientSecret, serverSecret)
+	assertByteEquals(t, keys.serverWriteKey, unhex(rfc8448ServerWriteKeyHex))
+	assertByteEquals(t, keys.serverWriteIV, unhex(rfc8448ServerWriteIVHex))
+
+	// Test the server and client Finished
+	finishedKey, verifyData := computeFinishedData(hash, serverSecret, unhex(rfc8448CertVerifyHashHex))
+	assertByteEquals(t, finishedKey, unhex(rfc8448ServerFinishedKeyHex))
+	assertByteEquals(t, verifyData, unhex(rfc8448ServerFinishedDataHex))
+	finishedKey, verifyData = computeFinishedData(hash, clientSecret, unhex(rfc8448ServerFinishedHashHex))
+	assertByteEquals(t, finishedKey, unhex(rfc8448ClientFinishedKeyHex))
+	assertByteEquals(t, verifyData, unhex(rfc8448ClientFinishedDataHex))
+
+	// Test the master secret and application traffic secrets
+	derived = ctx.deriveSecret(handshakeSecret, labelDerived, emptyHash)
+	masterSecret := hkdfExtract(hash, derived, make([]byte, hash.Size()))
+	assertByteEquals(t, masterSecret, unhex(rfc8448MasterSecretHex))
+	clientSecret = ctx.deriveSecret(masterSecret, labelClientApplicationTrafficSecret, unhex(rfc8448ServerFinishedHashHex))
+	serverSecret = ctx.deriveSecret(masterSecret, labelServerApplicationTrafficSecret, unhex(rfc8448ServerFinishedHashHex))
+	assertByteEquals(t, clientSecret, unhex(rfc8448ClientTrafficSecretHex))
+	assertByteEquals(t, serverSecret, unhex(rfc8448ServerTrafficSecretHex))
+}
@@ -0,0 +1,104 @@
+package mint
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// DTLSConn is a DTLS 1.3 connection with a single peer, carried over a
+// net.PacketConn.  It reuses the TLS handshake, but with DTLS record framing
+// (explicit epoch and sequence number), handshake message fragmentation and
+// reassembly, and retransmission of handshake flights.
+//
+// Besides the net.Conn interface provided by Conn, DTLSConn implements
+// net.PacketConn, with the handshake peer as its only valid address.
+//
+// XXX: This is groundwork.  There are no ACKs, so a lost final flight is not
+// recovered, and there is no cookie exchange or replay protection.
+type DTLSConn struct {
+	*Conn
+}
+
+// DTLSClient returns a new DTLS client side connection to the given peer,
+// using conn as the underlying transport.
+func DTLSClient(conn net.PacketConn, peer net.Addr, config *Config) *DTLSConn {
+	return newDTLSConn(&datagramConn{PacketConn: conn, peer: peer}, config, true)
+}
+
+// DTLSServer returns a new DTLS server side connection using conn as the
+// underlying transport.  The connection is bound to the address of the first
+// datagram it receives; datagrams from other addresses are ignored.
+func DTLSServer(conn net.PacketConn, config *Config) *DTLSConn {
+	return newDTLSConn(&datagramConn{PacketConn: conn}, config, false)
+}
+
+func newDTLSConn(conn *datagramConn, config *Config, isClient bool) *DTLSConn {
+	c := newConn(conn, config, isClient)
+	c.datagram = true
+	c.in.datagram = true
+	c.out.datagram = true
+	return &DTLSConn{c}
+}
+
+// ReadFrom reads application data, as with Read, and reports the peer as its
+// source.
+func (d *DTLSConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := d.Read(b)
+	return n, d.RemoteAddr(), err
+}
+
+// WriteTo writes application data, as with Write.  The address must be that
+// of the peer.
+func (d *DTLSConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	peer := d.RemoteAddr()
+	if peer == nil || addr.String() != peer.String() {
+		return 0, fmt.Errorf("tls.dtls: Cannot write to %v on a connection to %v", addr, peer)
+	}
+	return d.Write(b)
+}
+
+// datagramConn adapts a net.PacketConn to a net.Conn that exchanges
+// datagrams with a single peer.  Each Read returns one datagram, and each
+// Write sends one.
+type datagramConn struct {
+	net.PacketConn
+
+	peerMutex sync.Mutex
+	peer      net.Addr
+}
+
+func (d *datagramConn) RemoteAddr() net.Addr {
+	d.peerMutex.Lock()
+	defer d.peerMutex.Unlock()
+	return d.peer
+}
+
+func (d *datagramConn) Read(b []byte) (int, error) {
+	for {
+		n, addr, err := d.ReadFrom(b)
+		if err != nil {
+			return n, err
+		}
+
+		d.peerMutex.Lock()
+		if d.peer == nil {
+			d.peer = addr
+		}
+		fromPeer := addr.String() == d.peer.String()
+		d.peerMutex.Unlock()
+
+		if fromPeer {
+			return n, nil
+		}
+		logf(logTypeIO, "Dropping datagram from %v", addr)
+	}
+}
+
+func (d *datagramConn) Write(b []byte) (int, error) {
+	peer := d.RemoteAddr()
+	if peer == nil {
+		return 0, fmt.Errorf("tls.dtls: No peer to write to")
+	}
+	return d.WriteTo(b, peer)
+}
@@ -0,0 +1,303 @@
+package mint
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return "memory" }
+func (a memoryAddr) String() string  { return string(a) }
+
+// memoryPacketConn is one end of an in-memory packet pipe.  If drop is set,
+// it is called for each datagram written, and the datagram is discarded if it
+// returns true.
+type memoryPacketConn struct {
+	local, remote memoryAddr
+	in, out       chan []byte
+	closed        chan struct{}
+	closeOnce     *sync.Once
+
+	mutex    sync.Mutex
+	deadline time.Time
+	drop     func(data []byte) bool
+}
+
+func newPacketPipe() (*memoryPacketConn, *memoryPacketConn) {
+	a2b := make(chan []byte, 100)
+	b2a := make(chan []byte, 100)
+	closed := make(chan struct{})
+	closeOnce := new(sync.Once)
+	a := &memoryPacketConn{local: "a", remote: "b", in: b2a, out: a2b, closed: closed, closeOnce: closeOnce}
+	b := &memoryPacketConn{local: "b", remote: "a", in: a2b, out: b2a, closed: closed, closeOnce: closeOnce}
+	return a, b
+}
+
+func (p *memoryPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	p.mutex.Lock()
+	deadline := p.deadline
+	p.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(deadline.Sub(time.Now()))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case data := <-p.in:
+		return copy(b, data), p.remote, nil
+	case <-p.closed:
+		return 0, nil, &net.OpError{Op: "read", Net: "memory", Err: net.ErrClosed}
+	case <-timeout:
+		return 0, nil, &net.OpError{Op: "read", Net: "memory", Err: timeoutError{}}
+	}
+}
+
+func (p *memoryPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	p.mutex.Lock()
+	drop := p.drop
+	p.mutex.Unlock()
+
+	data := append([]byte{}, b...)
+	if drop != nil && drop(data) {
+		return len(b), nil
+	}
+
+	select {
+	case p.out <- data:
+		return len(b), nil
+	case <-p.closed:
+		return 0, &net.OpError{Op: "write", Net: "memory", Err: net.ErrClosed}
+	}
+}
+
+func (p *memoryPacketConn) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+	return nil
+}
+
+func (p *memoryPacketConn) LocalAddr() net.Addr { return p.local }
+
+func (p *memoryPacketConn) SetDeadline(t time.Time) error {
+	return p.SetReadDeadline(t)
+}
+
+func (p *memoryPacketConn) SetReadDeadline(t time.Time) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.deadline = t
+	return nil
+}
+
+func (p *memoryPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func dtlsHandshakeOverPipe(t *testing.T, clientPipe, serverPipe *memoryPacketConn, config *Config) (*DTLSConn, *DTLSConn) {
+	cert, roots := testServerChain()
+	clientConfig := *config
+	clientConfig.ServerName = "example.com"
+	clientConfig.RootCAs = roots
+	serverConfig := *config
+	serverConfig.Certificates = []Certificate{cert}
+	client := DTLSClient(clientPipe, clientPipe.remote, &clientConfig)
+	server := DTLSServer(serverPipe, &serverConfig)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Handshake()
+	}()
+
+	assertNotError(t, client.Handshake(), "Client failed DTLS handshake")
+	assertNotError(t, <-done, "Server failed DTLS handshake")
+	return client, server
+}
+
+func TestDTLSHandshake(t *testing.T) {
+	clientPipe, serverPipe := newPacketPipe()
+	defer clientPipe.Close()
+
+	// Count the datagrams each side sends
+	var clientDatagrams, serverDatagrams int
+	clientPipe.drop = func(data []byte) bool { clientDatagrams++; return false }
+	serverPipe.drop = func(data []byte) bool { serverDatagrams++; return false }
+
+	client, server := dtlsHandshakeOverPipe(t, clientPipe, serverPipe, &Config{})
+	assert(t, client.ConnectionState().HandshakeComplete, "Client handshake not complete")
+	assert(t, server.ConnectionState().HandshakeComplete, "Server handshake not complete")
+	assertByteEquals(t, client.context.clientTrafficSecret, server.context.clientTrafficSecret)
+	assertByteEquals(t, client.context.serverTrafficSecret, server.context.serverTrafficSecret)
+	assertEquals(t, server.RemoteAddr(), net.Addr(clientPipe.local))
+
+	// Without loss, each message is sent once, in its own datagram
+	assertEquals(t, clientDatagrams, 2)
+	assertEquals(t, serverDatagrams, 5)
+
+	// Test that application data flows in both directions, one datagram per
+	// write, via the net.PacketConn interface
+	var _ net.PacketConn = client
+	data := []byte("hello, datagram world")
+	buf := make([]byte, 100)
+
+	_, err := client.WriteTo(data, clientPipe.remote)
+	assertNotError(t, err, "Client failed to write")
+	n, addr, err := server.ReadFrom(buf)
+	assertNotError(t, err, "Server failed to read")
+	assertByteEquals(t, buf[:n], data)
+	assertEquals(t, addr, net.Addr(clientPipe.local))
+
+	_, err = server.Write(data)
+	assertNotError(t, err, "Server failed to write")
+	n, err = client.Read(buf)
+	assertNotError(t, err, "Client failed to read")
+	assertByteEquals(t, buf[:n], data)
+
+	// Test that writes to other addresses are refused
+	_, err = client.WriteTo(data, memoryAddr("c"))
+	assertError(t, err, "Wrote to an address other than the peer")
+}
+
+func TestDTLSRetransmission(t *testing.T) {
+	clientPipe, serverPipe := newPacketPipe()
+	defer clientPipe.Close()
+
+	// Drop the server's first datagram (carrying ServerHello) the first time
+	// it is sent.  The rest of the server's flight is in a later epoch, so the
+	// client discards it until the flight is retransmitted.
+	var first []byte
+	serverPipe.drop = func(data []byte) bool {
+		if first == nil {
+			first = data
+			return true
+		}
+		return false
+	}
+	var clientDatagrams int
+	clientPipe.drop = func(data []byte) bool { clientDatagrams++; return false }
+
+	config := &Config{HandshakeRetransmitTimeout: 50 * time.Millisecond}
+	client, server := dtlsHandshakeOverPipe(t, clientPipe, serverPipe, config)
+	assertByteEquals(t, client.context.clientTrafficSecret, server.context.clientTrafficSecret)
+	assert(t, clientDatagrams > 2, "Client did not retransmit its ClientHello")
+}
+
+func TestDTLSRetransmissionDeadlines(t *testing.T) {
+	// The server never answers, so the client would keep retransmitting for
+	// a second if nothing else stopped it
+	config := &Config{
+		ServerName:                 "example.com",
+		HandshakeRetransmitTimeout: 50 * time.Millisecond,
+		MaxHandshakeRetransmits:    20,
+	}
+
+	// Test that a read deadline set before the handshake still applies, and
+	// is restored afterwards
+	clientPipe, _ := newPacketPipe()
+	defer clientPipe.Close()
+	client := DTLSClient(clientPipe, clientPipe.remote, config)
+	deadline := time.Now().Add(120 * time.Millisecond)
+	client.SetReadDeadline(deadline)
+	err := client.Handshake()
+	assert(t, isTimeout(err), "Handshake did not time out")
+	assert(t, time.Now().Before(deadline.Add(500*time.Millisecond)), "Handshake ignored the read deadline")
+	assertEquals(t, clientPipe.deadline, deadline)
+
+	// Test that canceling the handshake stops the retransmissions
+	clientPipe, _ = newPacketPipe()
+	defer clientPipe.Close()
+	client = DTLSClient(clientPipe, clientPipe.remote, config)
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = client.HandshakeContext(ctx)
+	assertEquals(t, err, context.DeadlineExceeded)
+	assert(t, time.Since(start) < 600*time.Millisecond, "Handshake ignored the canceled context")
+	assert(t, clientPipe.deadline.IsZero(), "Read deadline not restored after cancellation")
+}
+
+func TestDatagramHandshakeLayer(t *testing.T) {
+	aPipe, bPipe := newPacketPipe()
+	defer aPipe.Close()
+	a := newRecordLayer(&datagramConn{PacketConn: aPipe, peer: aPipe.remote})
+	b := newRecordLayer(&datagramConn{PacketConn: bPipe, peer: bPipe.remote})
+	a.datagram = true
+	b.datagram = true
+
+	hOut := newDatagramHandshakeLayer(a)
+	hIn := newDatagramHandshakeLayer(b)
+
+	// Test that a large message is fragmented and reassembled, even when the
+	// fragments arrive out of order
+	msgs := []*handshakeMessage{
+		&handshakeMessage{msgType: handshakeTypeCertificate, body: bytes.Repeat([]byte{0xA0}, 3*maxDatagramFragmentLen+1)},
+		&handshakeMessage{msgType: handshakeTypeFinished, body: []byte{}},
+	}
+	err := hOut.WriteMessages(msgs)
+	assertNotError(t, err, "Failed to write messages")
+	assertEquals(t, len(aPipe.out), 5)
+
+	datagrams := [][]byte{}
+	for len(aPipe.out) > 0 {
+		datagrams = append(datagrams, <-aPipe.out)
+	}
+	for i := len(datagrams) - 1; i >= 0; i-- {
+		aPipe.out <- datagrams[i]
+	}
+
+	for _, msg := range msgs {
+		hm, err := hIn.ReadMessage()
+		assertNotError(t, err, "Failed to read message")
+		assertEquals(t, hm.msgType, msg.msgType)
+		assertByteEquals(t, hm.body, msg.body)
+	}
+
+	// Test that a retransmitted message is ignored
+	aPipe.out <- datagrams[len(datagrams)-1]
+	hOut.WriteMessage(&handshakeMessage{msgType: handshakeTypeFinished, body: []byte{1}})
+	hm, err := hIn.ReadMessage()
+	assertNotError(t, err, "Failed to read message after a retransmission")
+	assertByteEquals(t, hm.body, []byte{1})
+
+	// Test that a fragment extending past its message is rejected
+	bad := []byte{byte(handshakeTypeFinished), 0, 0, 1, 0, 3, 0, 0, 0, 0, 0, 2, 0, 0}
+	err = a.WriteRecord(&tlsPlaintext{contentType: recordTypeHandshake, fragment: bad})
+	assertNotError(t, err, "Failed to write record")
+	_, err = hIn.ReadMessage()
+	assertError(t, err, "Accepted a fragment extending past its message")
+
+	// Test that overlapping fragments are reassembled, and that the message
+	// is not delivered until every byte has arrived
+	hIn = newDatagramHandshakeLayer(b)
+	body := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	fragment := func(offset, end int) []byte {
+		header := []byte{byte(handshakeTypeFinished), 0, 0, byte(len(body)), 0, 0,
+			0, 0, byte(offset), 0, 0, byte(end - offset)}
+		return append(header, body[offset:end]...)
+	}
+	for _, frag := range [][2]int{{6, 8}, {2, 4}, {3, 7}, {0, 2}, {0, 0}} {
+		err = hIn.addFragments(fragment(frag[0], frag[1]))
+		assertNotError(t, err, "Failed to add fragment")
+	}
+	msg := hIn.fragments[0]
+	assertEquals(t, msg.remaining, 2)
+	assertDeepEquals(t, msg.received, []fragmentRange{{0, 8}})
+	err = hIn.addFragments(fragment(7, 10))
+	assertNotError(t, err, "Failed to add fragment")
+	assertEquals(t, msg.remaining, 0)
+	assertByteEquals(t, msg.body, body)
+
+	// Test that a message with no limit of its own is still bounded before
+	// its body is allocated
+	hIn = newDatagramHandshakeLayer(b)
+	huge := []byte{byte(handshakeTypeClientHello), 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0}
+	err = hIn.addFragments(huge)
+	assertEquals(t, err, alertDecodeError)
+	assertEquals(t, len(hIn.fragments), 0)
+}
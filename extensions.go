@@ -110,13 +110,54 @@ func (el *extensionList) Add(src extensionBody) error {
 }
 
 func (el extensionList) Find(dst extensionBody) bool {
+	found, err := el.Parse(dst)
+	return found && err == nil
+}
+
+// Contains reports whether an extension of the given type is present, without
+// parsing it
+func (el extensionList) Contains(extType helloExtensionType) bool {
+	for _, ext := range el {
+		if ext.extensionType == extType {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse is like Find, but reports why an extension that is present could not
+// be unmarshaled.
+func (el extensionList) Parse(dst extensionBody) (bool, error) {
 	for _, ext := range el {
 		if ext.extensionType == dst.Type() {
 			_, err := dst.Unmarshal(ext.extensionData)
-			return err == nil
+			return true, err
 		}
 	}
-	return false
+	return false, nil
+}
+
+// The extensions that a server may send in EncryptedExtensions, among those
+// that we know (RFC 8446, Section 4.2)
+var encryptedExtensionTypes = map[helloExtensionType]bool{
+	extensionTypeServerName:          true,
+	extensionTypeSupportedGroups:     true,
+	extensionTypeALPN:                true,
+	extensionTypeEarlyData:           true,
+	extensionTypeRecordSizeLimit:     true,
+	extensionTypeApplicationSettings: true,
+}
+
+// checkDuplicateGroups returns illegal_parameter if a group is listed twice
+func checkDuplicateGroups(groups []namedGroup) error {
+	seen := map[namedGroup]bool{}
+	for _, group := range groups {
+		if seen[group] {
+			return alertIllegalParameter
+		}
+		seen[group] = true
+	}
+	return nil
 }
 
 const (
@@ -208,11 +249,16 @@ type keyShare struct {
 //
 //         case server:
 //             KeyShareEntry server_share;
+//
+//         case hello_retry_request:
+//             NamedGroup selected_group;
 //     }
 // } KeyShare;
 type keyShareExtension struct {
-	roleIsServer bool
-	shares       []keyShare
+	roleIsServer  bool
+	helloRetry    bool // In a HelloRetryRequest, only selectedGroup is sent
+	selectedGroup namedGroup
+	shares        []keyShare
 }
 
 func (ks keyShareExtension) Type() helloExtensionType {
@@ -220,6 +266,10 @@ func (ks keyShareExtension) Type() helloExtensionType {
 }
 
 func (ks keyShareExtension) Marshal() ([]byte, error) {
+	if ks.helloRetry {
+		return []byte{byte(ks.selectedGroup >> 8), byte(ks.selectedGroup)}, nil
+	}
+
 	if ks.roleIsServer && len(ks.shares) > 1 {
 		return nil, fmt.Errorf("tls.keyshare: Server can only send one key share")
 	}
@@ -247,6 +297,14 @@ func (ks keyShareExtension) Marshal() ([]byte, error) {
 }
 
 func (ks *keyShareExtension) Unmarshal(data []byte) (int, error) {
+	if ks.helloRetry {
+		if len(data) < 2 {
+			return 0, fmt.Errorf("tls.keyshare: HelloRetryRequest key share too short")
+		}
+		ks.selectedGroup = (namedGroup(data[0]) << 8) + namedGroup(data[1])
+		return 2, nil
+	}
+
 	read := 0
 	totalLen := len(data)
 	if !ks.roleIsServer {
@@ -285,6 +343,13 @@ func (ks *keyShareExtension) Unmarshal(data []byte) (int, error) {
 		}
 	}
 
+	groups := make([]namedGroup, len(ks.shares))
+	for i, share := range ks.shares {
+		groups[i] = share.group
+	}
+	if err := checkDuplicateGroups(groups); err != nil {
+		return 0, err
+	}
 	return read, nil
 }
 
@@ -329,6 +394,9 @@ func (sg *supportedGroupsExtension) Unmarshal(data []byte) (int, error) {
 	for i := range sg.groups {
 		sg.groups[i] = (namedGroup(data[2*i+2]) << 8) + namedGroup(data[2*i+3])
 	}
+	if err := checkDuplicateGroups(sg.groups); err != nil {
+		return 0, err
+	}
 
 	return 2 + listLen, nil
 }
@@ -378,6 +446,459 @@ func (sa *signatureAlgorithmsExtension) Unmarshal(data []byte) (int, error) {
 	return 2 + listLen, nil
 }
 
+// struct {
+//     select (Handshake.msg_type) {
+//         case client_hello:
+//              ProtocolVersion versions<2..254>;
+//
+//         case server_hello:
+//              ProtocolVersion selected_version;
+//     };
+// } SupportedVersions;
+type supportedVersionsExtension struct {
+	roleIsServer bool
+	versions     []uint16
+}
+
+func (sv supportedVersionsExtension) Type() helloExtensionType {
+	return extensionTypeSupportedVersions
+}
+
+func (sv supportedVersionsExtension) Marshal() ([]byte, error) {
+	if sv.roleIsServer {
+		if len(sv.versions) != 1 {
+			return nil, fmt.Errorf("tls.supportedversions: Server must select exactly one version")
+		}
+		return []byte{byte(sv.versions[0] >> 8), byte(sv.versions[0])}, nil
+	}
+
+	listLen := 2 * len(sv.versions)
+	if listLen < 2 || listLen > 254 {
+		return nil, fmt.Errorf("tls.supportedversions: Wrong number of versions")
+	}
+
+	data := make([]byte, 1+listLen)
+	data[0] = byte(listLen)
+	for i, version := range sv.versions {
+		data[2*i+1] = byte(version >> 8)
+		data[2*i+2] = byte(version)
+	}
+	return data, nil
+}
+
+func (sv *supportedVersionsExtension) Unmarshal(data []byte) (int, error) {
+	if sv.roleIsServer {
+		if len(data) < 2 {
+			return 0, fmt.Errorf("tls.supportedversions: Too short for selected version")
+		}
+		sv.versions = []uint16{(uint16(data[0]) << 8) + uint16(data[1])}
+		return 2, nil
+	}
+
+	if len(data) < 1 {
+		return 0, fmt.Errorf("tls.supportedversions: Too short for length")
+	}
+
+	listLen := int(data[0])
+	if listLen < 2 || listLen%2 == 1 {
+		return 0, fmt.Errorf("tls.supportedversions: Invalid list length")
+	}
+	if len(data) < 1+listLen {
+		return 0, fmt.Errorf("tls.supportedversions: Too short for list")
+	}
+
+	sv.versions = make([]uint16, listLen/2)
+	for i := range sv.versions {
+		sv.versions[i] = (uint16(data[2*i+1]) << 8) + uint16(data[2*i+2])
+	}
+	return 1 + listLen, nil
+}
+
+// struct {} PostHandshakeAuth;
+type postHandshakeAuthExtension struct{}
+
+func (pha postHandshakeAuthExtension) Type() helloExtensionType {
+	return extensionTypePostHandshakeAuth
+}
+
+func (pha postHandshakeAuthExtension) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+func (pha *postHandshakeAuthExtension) Unmarshal(data []byte) (int, error) {
+	if len(data) != 0 {
+		return 0, fmt.Errorf("tls.posthandshakeauth: Extension must be empty")
+	}
+	return 0, nil
+}
+
+// struct {
+//     PskKeyExchangeMode ke_modes<1..255>;
+// } PskKeyExchangeModes;
+type pskKeyExchangeModesExtension struct {
+	modes []pskKeyExchangeMode
+}
+
+func (pkem pskKeyExchangeModesExtension) Type() helloExtensionType {
+	return extensionTypePSKKeyExchangeModes
+}
+
+func (pkem pskKeyExchangeModesExtension) Marshal() ([]byte, error) {
+	if len(pkem.modes) == 0 || len(pkem.modes) > 255 {
+		return nil, fmt.Errorf("tls.pskmodes: Invalid number of modes")
+	}
+
+	data := []byte{byte(len(pkem.modes))}
+	for _, mode := range pkem.modes {
+		data = append(data, byte(mode))
+	}
+	return data, nil
+}
+
+func (pkem *pskKeyExchangeModesExtension) Unmarshal(data []byte) (int, error) {
+	if len(data) < 1 {
+		return 0, fmt.Errorf("tls.pskmodes: Too short for length")
+	}
+
+	listLen := int(data[0])
+	if listLen == 0 {
+		return 0, fmt.Errorf("tls.pskmodes: Empty mode list")
+	}
+	if len(data) < 1+listLen {
+		return 0, fmt.Errorf("tls.pskmodes: Too short for list")
+	}
+
+	pkem.modes = make([]pskKeyExchangeMode, listLen)
+	for i := range pkem.modes {
+		pkem.modes[i] = pskKeyExchangeMode(data[1+i])
+	}
+	return 1 + listLen, nil
+}
+
+// struct {
+//     opaque identity<1..2^16-1>;
+//     uint32 obfuscated_ticket_age;
+// } PskIdentity;
+//
+// opaque PskBinderEntry<32..255>;
+//
+// struct {
+//     select (Handshake.msg_type) {
+//         case client_hello:
+//             PskIdentity identities<7..2^16-1>;
+//             PskBinderEntry binders<33..2^16-1>;
+//         case server_hello:
+//             uint16 selected_identity;
+//     };
+// } PreSharedKeyExtension;
+type pskIdentity struct {
+	identity            []byte
+	obfuscatedTicketAge uint32
+}
+
+type preSharedKeyExtension struct {
+	roleIsServer     bool
+	identities       []pskIdentity
+	binders          [][]byte
+	selectedIdentity uint16
+}
+
+func (psk preSharedKeyExtension) Type() helloExtensionType {
+	return extensionTypePreSharedKey
+}
+
+// bindersLen is the length of the encoded binders, which come last in the
+// ClientHello and are left out of the transcript that they are computed over
+func (psk preSharedKeyExtension) bindersLen() int {
+	n := 2
+	for _, binder := range psk.binders {
+		n += 1 + len(binder)
+	}
+	return n
+}
+
+func (psk preSharedKeyExtension) Marshal() ([]byte, error) {
+	if psk.roleIsServer {
+		return []byte{byte(psk.selectedIdentity >> 8), byte(psk.selectedIdentity)}, nil
+	}
+
+	if len(psk.identities) == 0 || len(psk.identities) != len(psk.binders) {
+		return nil, fmt.Errorf("tls.presharedkey: Need one binder per identity")
+	}
+
+	identities := []byte{0, 0}
+	for _, id := range psk.identities {
+		if len(id.identity) == 0 || len(id.identity) > 0xffff {
+			return nil, fmt.Errorf("tls.presharedkey: Invalid identity length")
+		}
+		age := id.obfuscatedTicketAge
+		identities = append(identities, byte(len(id.identity)>>8), byte(len(id.identity)))
+		identities = append(identities, id.identity...)
+		identities = append(identities, byte(age>>24), byte(age>>16), byte(age>>8), byte(age))
+	}
+
+	binders := []byte{0, 0}
+	for _, binder := range psk.binders {
+		if len(binder) < 32 || len(binder) > 255 {
+			return nil, fmt.Errorf("tls.presharedkey: Invalid binder length")
+		}
+		binders = append(binders, byte(len(binder)))
+		binders = append(binders, binder...)
+	}
+
+	if len(identities)-2 > 0xffff || len(binders)-2 > 0xffff {
+		return nil, fmt.Errorf("tls.presharedkey: Extension too long")
+	}
+	identities[0], identities[1] = byte((len(identities)-2)>>8), byte(len(identities)-2)
+	binders[0], binders[1] = byte((len(binders)-2)>>8), byte(len(binders)-2)
+	return append(identities, binders...), nil
+}
+
+func (psk *preSharedKeyExtension) Unmarshal(data []byte) (int, error) {
+	if psk.roleIsServer {
+		if len(data) != 2 {
+			return 0, fmt.Errorf("tls.presharedkey: Wrong length for selected identity")
+		}
+		psk.selectedIdentity = (uint16(data[0]) << 8) + uint16(data[1])
+		return 2, nil
+	}
+
+	if len(data) < 2 {
+		return 0, fmt.Errorf("tls.presharedkey: Too short for identities length")
+	}
+	identitiesLen := (int(data[0]) << 8) + int(data[1])
+	if len(data) < 2+identitiesLen {
+		return 0, fmt.Errorf("tls.presharedkey: Too short for identities")
+	}
+	psk.identities = []pskIdentity{}
+	list := data[2 : 2+identitiesLen]
+	for len(list) > 0 {
+		if len(list) < 2 {
+			return 0, fmt.Errorf("tls.presharedkey: Too short for identity length")
+		}
+		idLen := (int(list[0]) << 8) + int(list[1])
+		if idLen == 0 || len(list) < 2+idLen+4 {
+			return 0, fmt.Errorf("tls.presharedkey: Invalid identity")
+		}
+		age := list[2+idLen : 2+idLen+4]
+		psk.identities = append(psk.identities, pskIdentity{
+			identity:            append([]byte{}, list[2:2+idLen]...),
+			obfuscatedTicketAge: (uint32(age[0]) << 24) + (uint32(age[1]) << 16) + (uint32(age[2]) << 8) + uint32(age[3]),
+		})
+		list = list[2+idLen+4:]
+	}
+
+	data = data[2+identitiesLen:]
+	if len(data) < 2 {
+		return 0, fmt.Errorf("tls.presharedkey: Too short for binders length")
+	}
+	bindersLen := (int(data[0]) << 8) + int(data[1])
+	if len(data) < 2+bindersLen {
+		return 0, fmt.Errorf("tls.presharedkey: Too short for binders")
+	}
+	psk.binders = [][]byte{}
+	list = data[2 : 2+bindersLen]
+	for len(list) > 0 {
+		binderLen := int(list[0])
+		if binderLen < 32 || len(list) < 1+binderLen {
+			return 0, fmt.Errorf("tls.presharedkey: Invalid binder")
+		}
+		psk.binders = append(psk.binders, append([]byte{}, list[1:1+binderLen]...))
+		list = list[1+binderLen:]
+	}
+
+	if len(psk.identities) == 0 || len(psk.identities) != len(psk.binders) {
+		return 0, fmt.Errorf("tls.presharedkey: Need one binder per identity")
+	}
+	return 2 + identitiesLen + 2 + bindersLen, nil
+}
+
+// struct {
+//     select (Handshake.msg_type) {
+//         case new_session_ticket:   uint32 max_early_data_size;
+//         case client_hello:         Empty;
+//         case encrypted_extensions: Empty;
+//     };
+// } EarlyDataIndication;
+type earlyDataExtension struct {
+	inTicket         bool
+	maxEarlyDataSize uint32
+}
+
+func (ed earlyDataExtension) Type() helloExtensionType {
+	return extensionTypeEarlyData
+}
+
+func (ed earlyDataExtension) Marshal() ([]byte, error) {
+	if !ed.inTicket {
+		return []byte{}, nil
+	}
+
+	size := ed.maxEarlyDataSize
+	return []byte{byte(size >> 24), byte(size >> 16), byte(size >> 8), byte(size)}, nil
+}
+
+func (ed *earlyDataExtension) Unmarshal(data []byte) (int, error) {
+	if !ed.inTicket {
+		if len(data) != 0 {
+			return 0, fmt.Errorf("tls.earlydata: Non-empty early_data extension")
+		}
+		return 0, nil
+	}
+
+	if len(data) != 4 {
+		return 0, fmt.Errorf("tls.earlydata: Wrong length for max_early_data_size")
+	}
+	ed.maxEarlyDataSize = (uint32(data[0]) << 24) + (uint32(data[1]) << 16) + (uint32(data[2]) << 8) + uint32(data[3])
+	return 4, nil
+}
+
+// uint16 RecordSizeLimit;
+type recordSizeLimitExtension struct {
+	limit uint16
+}
+
+func (rsl recordSizeLimitExtension) Type() helloExtensionType {
+	return extensionTypeRecordSizeLimit
+}
+
+func (rsl recordSizeLimitExtension) Marshal() ([]byte, error) {
+	if rsl.limit < minRecordSizeLimit {
+		return nil, fmt.Errorf("tls.recordsizelimit: Limit too small")
+	}
+	return []byte{byte(rsl.limit >> 8), byte(rsl.limit)}, nil
+}
+
+func (rsl *recordSizeLimitExtension) Unmarshal(data []byte) (int, error) {
+	if len(data) != 2 {
+		return 0, fmt.Errorf("tls.recordsizelimit: Wrong length")
+	}
+	rsl.limit = (uint16(data[0]) << 8) + uint16(data[1])
+	if rsl.limit < minRecordSizeLimit {
+		return 0, fmt.Errorf("tls.recordsizelimit: Limit too small")
+	}
+	return 2, nil
+}
+
+// opaque ProtocolName<1..2^8-1>;
+//
+// struct {
+//     ProtocolName protocol_name_list<2..2^16-1>
+// } ProtocolNameList;
+type alpnExtension struct {
+	protocols []string
+}
+
+func (alpn alpnExtension) Type() helloExtensionType {
+	return extensionTypeALPN
+}
+
+func (alpn alpnExtension) Marshal() ([]byte, error) {
+	if len(alpn.protocols) == 0 {
+		return nil, fmt.Errorf("tls.alpn: No protocols")
+	}
+
+	listLen := 0
+	for _, protocol := range alpn.protocols {
+		if len(protocol) == 0 || len(protocol) > 255 {
+			return nil, fmt.Errorf("tls.alpn: Invalid protocol name length")
+		}
+		listLen += 1 + len(protocol)
+	}
+	if listLen > 0xffff {
+		return nil, fmt.Errorf("tls.alpn: Protocol list too long")
+	}
+
+	data := make([]byte, 2, 2+listLen)
+	data[0] = byte(listLen >> 8)
+	data[1] = byte(listLen)
+	for _, protocol := range alpn.protocols {
+		data = append(data, byte(len(protocol)))
+		data = append(data, []byte(protocol)...)
+	}
+	return data, nil
+}
+
+func (alpn *alpnExtension) Unmarshal(data []byte) (int, error) {
+	if len(data) < 2 {
+		return 0, fmt.Errorf("tls.alpn: Too short for length")
+	}
+
+	listLen := (int(data[0]) << 8) + int(data[1])
+	if listLen == 0 {
+		return 0, fmt.Errorf("tls.alpn: Empty protocol list")
+	}
+	if len(data) < 2+listLen {
+		return 0, fmt.Errorf("tls.alpn: Too short for list")
+	}
+
+	alpn.protocols = []string{}
+	list := data[2 : 2+listLen]
+	for len(list) > 0 {
+		nameLen := int(list[0])
+		if nameLen == 0 {
+			return 0, fmt.Errorf("tls.alpn: Empty protocol name")
+		}
+		if len(list) < 1+nameLen {
+			return 0, fmt.Errorf("tls.alpn: Too short for protocol name")
+		}
+		alpn.protocols = append(alpn.protocols, string(list[1:1+nameLen]))
+		list = list[1+nameLen:]
+	}
+	return 2 + listLen, nil
+}
+
+// The application_settings extension carries a list of ALPN protocols in
+// the ClientHello, and opaque settings for the negotiated protocol in
+// EncryptedExtensions and ClientEncryptedExtensions:
+//
+// struct {
+//     ProtocolName supported_protocols<2..2^16-1>;
+// } ApplicationSettingsSupport;
+//
+// struct {
+//     opaque application_settings<0..2^16-1>;
+// } ApplicationSettings;  // Encoded as the whole extension_data
+type applicationSettingsExtension struct {
+	inClientHello bool
+	protocols     []string
+	settings      []byte
+}
+
+func (alps applicationSettingsExtension) Type() helloExtensionType {
+	return extensionTypeApplicationSettings
+}
+
+func (alps applicationSettingsExtension) Marshal() ([]byte, error) {
+	if !alps.inClientHello {
+		if len(alps.settings) > 0xffff {
+			return nil, fmt.Errorf("tls.alps: Settings too long")
+		}
+		return append([]byte{}, alps.settings...), nil
+	}
+
+	data, err := alpnExtension{protocols: alps.protocols}.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("tls.alps: %v", err)
+	}
+	return data, nil
+}
+
+func (alps *applicationSettingsExtension) Unmarshal(data []byte) (int, error) {
+	if !alps.inClientHello {
+		alps.settings = append([]byte{}, data...)
+		return len(data), nil
+	}
+
+	list := new(alpnExtension)
+	read, err := list.Unmarshal(data)
+	if err != nil {
+		return 0, fmt.Errorf("tls.alps: %v", err)
+	}
+	alps.protocols = list.protocols
+	return read, nil
+}
+
 // This is required for NSS
 type draftVersionExtension struct {
 	version int
@@ -110,9 +110,25 @@ var (
 	serverNameIn  = serverNameExtension(serverNameRaw)
 	serverNameHex = "000e00000b" + hex.EncodeToString([]byte(serverNameRaw))
 
+	// SupportedVersions test cases
+	supportedVersionsClientIn = supportedVersionsExtension{
+		roleIsServer: false,
+		versions:     []uint16{0x0304, 0x0303},
+	}
+	supportedVersionsServerIn = supportedVersionsExtension{
+		roleIsServer: true,
+		versions:     []uint16{0x0304},
+	}
+	supportedVersionsClientHex = "0403040303"
+	supportedVersionsServerHex = "0304"
+
 	// DraftVersion test cases
 	draftVersionIn  = draftVersionExtension{0x2030}
 	draftVersionHex = "2030"
+
+	// RecordSizeLimit test cases
+	recordSizeLimitIn  = recordSizeLimitExtension{limit: 0x4001}
+	recordSizeLimitHex = "4001"
 )
 
 func TestExtensionMarshalUnmarshal(t *testing.T) {
@@ -331,6 +347,30 @@ func TestKeyShareMarshalUnmarshal(t *testing.T) {
 	ks = keyShareExtension{roleIsServer: true}
 	read, err = ks.Unmarshal(keyShareInvalid)
 	assertError(t, err, "Unmarshaled a key share with a wrong-size key")
+
+	// Test unmarshal failure on two shares for the same group
+	dup := keyShareExtension{
+		roleIsServer: false,
+		shares:       []keyShare{keyShareClientIn.shares[0], keyShareClientIn.shares[0]},
+	}
+	out, err = dup.Marshal()
+	assertNotError(t, err, "Failed to marshal duplicate key shares")
+	ks = keyShareExtension{roleIsServer: false}
+	_, err = ks.Unmarshal(out)
+	assertEquals(t, err, error(alertIllegalParameter))
+
+	// Test the HelloRetryRequest form, which carries only the selected group
+	hrr := keyShareExtension{roleIsServer: true, helloRetry: true, selectedGroup: namedGroupP384}
+	out, err = hrr.Marshal()
+	assertNotError(t, err, "Failed to marshal HelloRetryRequest KeyShare")
+	assertByteEquals(t, out, []byte{0x00, 0x18})
+	ks = keyShareExtension{roleIsServer: true, helloRetry: true}
+	read, err = ks.Unmarshal(out)
+	assertNotError(t, err, "Failed to unmarshal HelloRetryRequest KeyShare")
+	assertEquals(t, ks.selectedGroup, namedGroupP384)
+	assertEquals(t, read, 2)
+	_, err = ks.Unmarshal(out[:1])
+	assertError(t, err, "Unmarshaled a truncated HelloRetryRequest KeyShare")
 }
 
 func TestSupportedGroupsMarshalUnmarshal(t *testing.T) {
@@ -367,6 +407,11 @@ func TestSupportedGroupsMarshalUnmarshal(t *testing.T) {
 	read, err = sg.Unmarshal(supportedGroups)
 	assertError(t, err, "Unmarshaled a SupportedGroups with an odd-length list")
 	supportedGroups[1]++
+
+	// Test unmarshal failure on a group listed twice
+	sg = supportedGroupsExtension{}
+	_, err = sg.Unmarshal([]byte{0x00, 0x04, 0x00, 0x17, 0x00, 0x17})
+	assertEquals(t, err, error(alertIllegalParameter))
 }
 
 func TestSignatureAlgorithmsMarshalUnmarshal(t *testing.T) {
@@ -405,6 +450,105 @@ func TestSignatureAlgorithmsMarshalUnmarshal(t *testing.T) {
 	signatureAlgorithms[1]++
 }
 
+func TestPostHandshakeAuthMarshalUnmarshal(t *testing.T) {
+	// Test extension type
+	assertEquals(t, postHandshakeAuthExtension{}.Type(), extensionTypePostHandshakeAuth)
+
+	// Test successful marshal
+	out, err := postHandshakeAuthExtension{}.Marshal()
+	assertNotError(t, err, "Failed to marshal PostHandshakeAuth")
+	assertEquals(t, len(out), 0)
+
+	// Test successful unmarshal
+	pha := postHandshakeAuthExtension{}
+	read, err := pha.Unmarshal([]byte{})
+	assertNotError(t, err, "Failed to unmarshal valid PostHandshakeAuth")
+	assertEquals(t, read, 0)
+
+	// Test unmarshal failure on non-empty data
+	read, err = pha.Unmarshal([]byte{0x00})
+	assertError(t, err, "Unmarshaled a non-empty PostHandshakeAuth")
+}
+
+func TestApplicationSettingsMarshalUnmarshal(t *testing.T) {
+	supportIn := applicationSettingsExtension{inClientHello: true, protocols: []string{"h2"}}
+	supportHex := "0003026832"
+	support, _ := hex.DecodeString(supportHex)
+	settingsIn := applicationSettingsExtension{settings: []byte{0x00, 0x03, 0x00, 0x64}}
+
+	// Test extension type
+	assertEquals(t, applicationSettingsExtension{}.Type(), extensionTypeApplicationSettings)
+
+	// Test marshal and unmarshal of the protocol list in the ClientHello
+	out, err := supportIn.Marshal()
+	assertNotError(t, err, "Failed to marshal valid ALPS support")
+	assertByteEquals(t, out, support)
+	supportOut := applicationSettingsExtension{inClientHello: true}
+	read, err := supportOut.Unmarshal(support)
+	assertNotError(t, err, "Failed to unmarshal valid ALPS support")
+	assertDeepEquals(t, supportOut, supportIn)
+	assertEquals(t, read, len(support))
+
+	// Test marshal and unmarshal of opaque settings
+	out, err = settingsIn.Marshal()
+	assertNotError(t, err, "Failed to marshal valid ALPS settings")
+	assertByteEquals(t, out, settingsIn.settings)
+	var settingsOut applicationSettingsExtension
+	read, err = settingsOut.Unmarshal(out)
+	assertNotError(t, err, "Failed to unmarshal valid ALPS settings")
+	assertDeepEquals(t, settingsOut, settingsIn)
+	assertEquals(t, read, len(out))
+
+	// Test failures
+	_, err = applicationSettingsExtension{inClientHello: true}.Marshal()
+	assertError(t, err, "Marshaled an empty ALPS protocol list")
+	_, err = applicationSettingsExtension{settings: make([]byte, 0x10000)}.Marshal()
+	assertError(t, err, "Marshaled overlong ALPS settings")
+	_, err = supportOut.Unmarshal([]byte{0x00, 0x00})
+	assertError(t, err, "Unmarshaled an empty ALPS protocol list")
+}
+
+func TestALPNMarshalUnmarshal(t *testing.T) {
+	alpnIn := alpnExtension{protocols: []string{"h2", "http/1.1"}}
+	alpnHex := "000c02683208687474702f312e31"
+	alpn, _ := hex.DecodeString(alpnHex)
+
+	// Test extension type
+	assertEquals(t, alpnExtension{}.Type(), extensionTypeALPN)
+
+	// Test successful marshal, in order
+	out, err := alpnIn.Marshal()
+	assertNotError(t, err, "Failed to marshal valid ALPN")
+	assertByteEquals(t, out, alpn)
+
+	// Test marshal failures
+	_, err = alpnExtension{}.Marshal()
+	assertError(t, err, "Marshaled an empty ALPN list")
+	_, err = alpnExtension{protocols: []string{""}}.Marshal()
+	assertError(t, err, "Marshaled an empty protocol name")
+	_, err = alpnExtension{protocols: []string{string(make([]byte, 256))}}.Marshal()
+	assertError(t, err, "Marshaled an overlong protocol name")
+
+	// Test successful unmarshal
+	var alpnOut alpnExtension
+	read, err := alpnOut.Unmarshal(alpn)
+	assertNotError(t, err, "Failed to unmarshal valid ALPN")
+	assertDeepEquals(t, alpnOut, alpnIn)
+	assertEquals(t, read, len(alpn))
+
+	// Test unmarshal failures
+	_, err = alpnOut.Unmarshal(alpn[:1])
+	assertError(t, err, "Unmarshaled a ALPN extension too short for length")
+	_, err = alpnOut.Unmarshal(alpn[:len(alpn)-1])
+	assertError(t, err, "Unmarshaled a ALPN extension too short for list")
+	_, err = alpnOut.Unmarshal([]byte{0x00, 0x00})
+	assertError(t, err, "Unmarshaled an empty ALPN list")
+	_, err = alpnOut.Unmarshal([]byte{0x00, 0x01, 0x00})
+	assertError(t, err, "Unmarshaled an empty protocol name")
+	_, err = alpnOut.Unmarshal([]byte{0x00, 0x02, 0x02, 0x68})
+	assertError(t, err, "Unmarshaled a truncated protocol name")
+}
+
 func TestDraftVersionMarshalUnmarshal(t *testing.T) {
 	draftVersion, _ := hex.DecodeString(draftVersionHex)
 
@@ -428,3 +572,223 @@ func TestDraftVersionMarshalUnmarshal(t *testing.T) {
 	read, err = dv.Unmarshal(draftVersion[:1])
 	assertError(t, err, "Unmarshaled a DraftVersion with the wrong length")
 }
+
+func TestRecordSizeLimitMarshalUnmarshal(t *testing.T) {
+	recordSizeLimit, _ := hex.DecodeString(recordSizeLimitHex)
+
+	// Test extension type
+	assertEquals(t, recordSizeLimitExtension{}.Type(), extensionTypeRecordSizeLimit)
+
+	// Test successful marshal
+	out, err := recordSizeLimitIn.Marshal()
+	assertNotError(t, err, "Failed to marshal valid RecordSizeLimit")
+	assertByteEquals(t, out, recordSizeLimit)
+
+	// Test successful unmarshal
+	rsl := recordSizeLimitExtension{}
+	read, err := rsl.Unmarshal(recordSizeLimit)
+	assertNotError(t, err, "Failed to unmarshal valid RecordSizeLimit")
+	assertDeepEquals(t, rsl, recordSizeLimitIn)
+	assertEquals(t, read, len(recordSizeLimit))
+
+	// Test marshal failure on a limit below the minimum
+	_, err = recordSizeLimitExtension{limit: 63}.Marshal()
+	assertError(t, err, "Marshaled a RecordSizeLimit below the minimum")
+
+	// Test unmarshal failure on wrong data length or a limit below the
+	// minimum
+	rsl = recordSizeLimitExtension{}
+	_, err = rsl.Unmarshal(recordSizeLimit[:1])
+	assertError(t, err, "Unmarshaled a RecordSizeLimit with the wrong length")
+	_, err = rsl.Unmarshal([]byte{0x00, 0x3f})
+	assertError(t, err, "Unmarshaled a RecordSizeLimit below the minimum")
+}
+
+func TestSupportedVersionsMarshalUnmarshal(t *testing.T) {
+	clientVersions, _ := hex.DecodeString(supportedVersionsClientHex)
+	serverVersion, _ := hex.DecodeString(supportedVersionsServerHex)
+
+	// Test extension type
+	assertEquals(t, supportedVersionsExtension{}.Type(), extensionTypeSupportedVersions)
+
+	// Test successful marshal (client)
+	out, err := supportedVersionsClientIn.Marshal()
+	assertNotError(t, err, "Failed to marshal valid SupportedVersions (client)")
+	assertByteEquals(t, out, clientVersions)
+
+	// Test successful marshal (server)
+	out, err = supportedVersionsServerIn.Marshal()
+	assertNotError(t, err, "Failed to marshal valid SupportedVersions (server)")
+	assertByteEquals(t, out, serverVersion)
+
+	// Test marshal failure on an empty list
+	out, err = supportedVersionsExtension{}.Marshal()
+	assertError(t, err, "Marshaled a SupportedVersions with no versions")
+
+	// Test marshal failure on a server selecting multiple versions
+	out, err = supportedVersionsExtension{roleIsServer: true, versions: []uint16{0x0304, 0x0303}}.Marshal()
+	assertError(t, err, "Marshaled a server SupportedVersions with multiple versions")
+
+	// Test successful unmarshal (client)
+	sv := supportedVersionsExtension{roleIsServer: false}
+	read, err := sv.Unmarshal(clientVersions)
+	assertNotError(t, err, "Failed to unmarshal valid SupportedVersions (client)")
+	assertDeepEquals(t, sv, supportedVersionsClientIn)
+	assertEquals(t, read, len(clientVersions))
+
+	// Test successful unmarshal (server)
+	sv = supportedVersionsExtension{roleIsServer: true}
+	read, err = sv.Unmarshal(serverVersion)
+	assertNotError(t, err, "Failed to unmarshal valid SupportedVersions (server)")
+	assertDeepEquals(t, sv, supportedVersionsServerIn)
+	assertEquals(t, read, len(serverVersion))
+
+	// Test unmarshal failure on missing length
+	sv = supportedVersionsExtension{roleIsServer: false}
+	read, err = sv.Unmarshal(clientVersions[:0])
+	assertError(t, err, "Unmarshaled a SupportedVersions without a length")
+
+	// Test unmarshal failure on truncated list
+	sv = supportedVersionsExtension{roleIsServer: false}
+	read, err = sv.Unmarshal(clientVersions[:3])
+	assertError(t, err, "Unmarshaled a SupportedVersions with a truncated list")
+
+	// Test unmarshal failure on odd list length
+	clientVersions[0]--
+	sv = supportedVersionsExtension{roleIsServer: false}
+	read, err = sv.Unmarshal(clientVersions)
+	assertError(t, err, "Unmarshaled a SupportedVersions with an odd-length list")
+	clientVersions[0]++
+
+	// Test unmarshal failure on truncated selected version
+	sv = supportedVersionsExtension{roleIsServer: true}
+	read, err = sv.Unmarshal(serverVersion[:1])
+	assertError(t, err, "Unmarshaled a SupportedVersions with a truncated version")
+}
+
+func TestPSKKeyExchangeModesMarshalUnmarshal(t *testing.T) {
+	modesIn := pskKeyExchangeModesExtension{modes: []pskKeyExchangeMode{pskModeDHEKE}}
+	modes := []byte{0x01, 0x01}
+
+	// Test extension type
+	assertEquals(t, pskKeyExchangeModesExtension{}.Type(), extensionTypePSKKeyExchangeModes)
+
+	// Test successful marshal
+	out, err := modesIn.Marshal()
+	assertNotError(t, err, "Failed to marshal valid PSK key exchange modes")
+	assertByteEquals(t, out, modes)
+
+	// Test marshal failure on an empty list
+	_, err = pskKeyExchangeModesExtension{}.Marshal()
+	assertError(t, err, "Marshaled an empty list of PSK key exchange modes")
+
+	// Test successful unmarshal
+	var modesOut pskKeyExchangeModesExtension
+	read, err := modesOut.Unmarshal(modes)
+	assertNotError(t, err, "Failed to unmarshal valid PSK key exchange modes")
+	assertDeepEquals(t, modesOut, modesIn)
+	assertEquals(t, read, len(modes))
+
+	// Test unmarshal failures
+	_, err = modesOut.Unmarshal([]byte{})
+	assertError(t, err, "Unmarshaled PSK key exchange modes too short for length")
+	_, err = modesOut.Unmarshal([]byte{0x00})
+	assertError(t, err, "Unmarshaled an empty list of PSK key exchange modes")
+	_, err = modesOut.Unmarshal([]byte{0x02, 0x01})
+	assertError(t, err, "Unmarshaled a truncated list of PSK key exchange modes")
+}
+
+func TestPreSharedKeyMarshalUnmarshal(t *testing.T) {
+	binder := bytes.Repeat([]byte{0xa0}, 32)
+	clientIn := preSharedKeyExtension{
+		identities: []pskIdentity{{identity: []byte("ticket"), obfuscatedTicketAge: 0x01020304}},
+		binders:    [][]byte{binder},
+	}
+	clientHex := "000c00067469636b6574010203040021" + "20" + hex.EncodeToString(binder)
+	client, _ := hex.DecodeString(clientHex)
+	serverIn := preSharedKeyExtension{roleIsServer: true, selectedIdentity: 1}
+	server := []byte{0x00, 0x01}
+
+	// Test extension type
+	assertEquals(t, preSharedKeyExtension{}.Type(), extensionTypePreSharedKey)
+
+	// Test successful marshal, for both roles
+	out, err := clientIn.Marshal()
+	assertNotError(t, err, "Failed to marshal valid client PreSharedKey")
+	assertByteEquals(t, out, client)
+	assertEquals(t, clientIn.bindersLen(), 2+1+len(binder))
+	out, err = serverIn.Marshal()
+	assertNotError(t, err, "Failed to marshal valid server PreSharedKey")
+	assertByteEquals(t, out, server)
+
+	// Test marshal failures
+	_, err = preSharedKeyExtension{}.Marshal()
+	assertError(t, err, "Marshaled a PreSharedKey without identities")
+	_, err = preSharedKeyExtension{identities: clientIn.identities}.Marshal()
+	assertError(t, err, "Marshaled a PreSharedKey without binders")
+	_, err = preSharedKeyExtension{identities: clientIn.identities, binders: [][]byte{binder[:31]}}.Marshal()
+	assertError(t, err, "Marshaled a PreSharedKey with a short binder")
+	_, err = preSharedKeyExtension{identities: []pskIdentity{{}}, binders: clientIn.binders}.Marshal()
+	assertError(t, err, "Marshaled a PreSharedKey with an empty identity")
+
+	// Test successful unmarshal, for both roles
+	clientOut := preSharedKeyExtension{}
+	read, err := clientOut.Unmarshal(client)
+	assertNotError(t, err, "Failed to unmarshal valid client PreSharedKey")
+	assertDeepEquals(t, clientOut, clientIn)
+	assertEquals(t, read, len(client))
+	serverOut := preSharedKeyExtension{roleIsServer: true}
+	read, err = serverOut.Unmarshal(server)
+	assertNotError(t, err, "Failed to unmarshal valid server PreSharedKey")
+	assertDeepEquals(t, serverOut, serverIn)
+	assertEquals(t, read, len(server))
+
+	// Test unmarshal failures
+	_, err = clientOut.Unmarshal(client[:1])
+	assertError(t, err, "Unmarshaled a PreSharedKey too short for identities length")
+	_, err = clientOut.Unmarshal(client[:10])
+	assertError(t, err, "Unmarshaled a PreSharedKey with truncated identities")
+	_, err = clientOut.Unmarshal(client[:15])
+	assertError(t, err, "Unmarshaled a PreSharedKey too short for binders length")
+	_, err = clientOut.Unmarshal(client[:len(client)-1])
+	assertError(t, err, "Unmarshaled a PreSharedKey with truncated binders")
+	_, err = clientOut.Unmarshal(append(client[:14:14], 0x00, 0x00))
+	assertError(t, err, "Unmarshaled a PreSharedKey without binders")
+	_, err = serverOut.Unmarshal(server[:1])
+	assertError(t, err, "Unmarshaled a truncated selected identity")
+}
+
+func TestEarlyDataMarshalUnmarshal(t *testing.T) {
+	ticketIn := earlyDataExtension{inTicket: true, maxEarlyDataSize: 0x01020304}
+	ticket := []byte{0x01, 0x02, 0x03, 0x04}
+
+	// Test extension type
+	assertEquals(t, earlyDataExtension{}.Type(), extensionTypeEarlyData)
+
+	// Test successful marshal, in a ClientHello and in a ticket
+	out, err := earlyDataExtension{}.Marshal()
+	assertNotError(t, err, "Failed to marshal valid EarlyData")
+	assertEquals(t, len(out), 0)
+	out, err = ticketIn.Marshal()
+	assertNotError(t, err, "Failed to marshal valid ticket EarlyData")
+	assertByteEquals(t, out, ticket)
+
+	// Test successful unmarshal, in a ClientHello and in a ticket
+	var edOut earlyDataExtension
+	read, err := edOut.Unmarshal([]byte{})
+	assertNotError(t, err, "Failed to unmarshal valid EarlyData")
+	assertEquals(t, read, 0)
+	ticketOut := earlyDataExtension{inTicket: true}
+	read, err = ticketOut.Unmarshal(ticket)
+	assertNotError(t, err, "Failed to unmarshal valid ticket EarlyData")
+	assertDeepEquals(t, ticketOut, ticketIn)
+	assertEquals(t, read, len(ticket))
+
+	// Test unmarshal failures
+	_, err = edOut.Unmarshal([]byte{0x00})
+	assertError(t, err, "Unmarshaled a non-empty EarlyData")
+	_, err = ticketOut.Unmarshal(ticket[:3])
+	assertError(t, err, "Unmarshaled a truncated max_early_data_size")
+	_, err = ticketOut.Unmarshal(append(ticket, 0x00))
+	assertError(t, err, "Unmarshaled an overlong max_early_data_size")
+}
@@ -1,12 +1,31 @@
 package mint
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"time"
 )
 
 const (
 	handshakeHeaderLen     = 4       // handshake message header length
 	maxHandshakeMessageLen = 1 << 24 // max handshake message length
+
+	datagramHandshakeHeaderLen = 12   // DTLS handshake message header length
+	maxDatagramFragmentLen     = 1024 // max handshake bytes per DTLS record
+	maxBufferedMessages        = 8    // how far ahead of message_seq to buffer
+
+	// In datagram mode, the body of a message is allocated when its first
+	// fragment arrives, so a message type without a limit of its own is held
+	// to one that fits any message made of fields with 16-bit lengths.
+	maxDatagramMessageLen = 1 << 18
+)
+
+const (
+	// Default retransmission parameters for handshake flights, which are
+	// only retransmitted in datagram mode.
+	defaultDatagramRetransmitTimeout = 1 * time.Second
+	defaultMaxHandshakeRetransmits   = 5
 )
 
 // struct {
@@ -46,10 +65,14 @@ func (hm handshakeMessage) toBody() (handshakeMessageBody, error) {
 		body = new(encryptedExtensionsBody)
 	case handshakeTypeCertificate:
 		body = new(certificateBody)
+	case handshakeTypeCertificateRequest:
+		body = new(certificateRequestBody)
 	case handshakeTypeCertificateVerify:
 		body = new(certificateVerifyBody)
 	case handshakeTypeFinished:
 		body = new(finishedBody)
+	case handshakeTypeClientEncryptedExtensions:
+		body = new(clientEncryptedExtensionsBody)
 	default:
 		return body, fmt.Errorf("tls.handshakemessage: Unsupported body type")
 	}
@@ -77,6 +100,86 @@ func handshakeMessageFromBody(body handshakeMessageBody) (*handshakeMessage, err
 type handshakeLayer struct {
 	conn   *recordLayer // Used for reading/writing records
 	buffer []byte       // Read buffer
+
+	// In datagram (DTLS) mode, messages carry a message_seq and may be split
+	// into fragments, each in its own record.
+	datagram   bool
+	messageSeq uint16                       // Next message_seq to send or receive
+	fragments  map[uint16]*messageFragments // Messages being reassembled
+
+	// If flightOut is set, the reading side retransmits the last flight
+	// written to it when the peer does not respond within retransmitTimeout.
+	// The timer is set with setReadDeadline, which keeps any earlier
+	// deadline on the connection, and restores it when given a zero time.
+	flightOut         *recordLayer
+	retransmitTimeout time.Duration
+	maxRetransmits    int
+	setReadDeadline   func(t time.Time) error
+
+	// Limits on the declared length of particular types of message from the
+	// peer.  A message over its limit is rejected as soon as its header
+	// arrives, before its body is buffered.
+	maxMessageLen map[handshakeType]int
+
+	// If set, the time spent waiting for records is added to readTime
+	readTime *time.Duration
+
+	// If set, application data records are passed to earlyData rather than
+	// rejected, as a server does with the client's early data
+	earlyData func(data []byte) error
+
+	// If set, exchanged is called with each complete message read or
+	// written, so that the transcript can be checked against them
+	exchanged func(hm *handshakeMessage)
+}
+
+// messageFragments collects the fragments of a handshake message received in
+// datagram mode.  The ranges of the body received so far are kept sorted and
+// disjoint.
+type messageFragments struct {
+	msgType   handshakeType
+	body      []byte
+	received  []fragmentRange
+	remaining int
+}
+
+type fragmentRange struct {
+	start, end int
+}
+
+// add copies a fragment into the message body and marks its range received,
+// merging it with any ranges that it overlaps or touches.
+func (m *messageFragments) add(offset int, fragment []byte) {
+	if len(fragment) == 0 {
+		return
+	}
+	copy(m.body[offset:], fragment)
+
+	r := fragmentRange{offset, offset + len(fragment)}
+	received := make([]fragmentRange, 0, len(m.received)+1)
+	for _, other := range m.received {
+		if other.end < r.start || r.end < other.start {
+			received = append(received, other)
+			continue
+		}
+		m.remaining += other.end - other.start
+		if other.start < r.start {
+			r.start = other.start
+		}
+		if other.end > r.end {
+			r.end = other.end
+		}
+	}
+	m.remaining -= r.end - r.start
+
+	i := 0
+	for i < len(received) && received[i].start < r.start {
+		i++
+	}
+	received = append(received, fragmentRange{})
+	copy(received[i+1:], received[i:])
+	received[i] = r
+	m.received = received
 }
 
 func newHandshakeLayer(r *recordLayer) *handshakeLayer {
@@ -86,13 +189,91 @@ func newHandshakeLayer(r *recordLayer) *handshakeLayer {
 	return &h
 }
 
+// newDatagramHandshakeLayer creates a handshake layer in datagram mode.
+func newDatagramHandshakeLayer(r *recordLayer) *handshakeLayer {
+	h := newHandshakeLayer(r)
+	h.datagram = true
+	h.fragments = map[uint16]*messageFragments{}
+	return h
+}
+
+// retransmitFlights has the reading layer h retransmit the last flight written
+// to out if the peer does not respond within the timeout, up to the given
+// number of times.  The timer is set with setReadDeadline.
+func (h *handshakeLayer) retransmitFlights(out *recordLayer, timeout time.Duration, maxRetransmits int, setReadDeadline func(t time.Time) error) {
+	out.keepFlight = true
+	h.flightOut = out
+	h.retransmitTimeout = timeout
+	h.maxRetransmits = maxRetransmits
+	h.setReadDeadline = setReadDeadline
+}
+
+// peerFlightReceived notes that a message from the peer has been read, so
+// that the next message written starts a new flight.
+func (h *handshakeLayer) peerFlightReceived() {
+	if h.flightOut != nil {
+		h.flightOut.newFlight = true
+	}
+}
+
+func (h *handshakeLayer) checkMessageLen(msgType handshakeType, msgLen int) error {
+	limit, ok := h.maxMessageLen[msgType]
+	if !ok && h.datagram {
+		limit, ok = maxDatagramMessageLen, true
+	}
+	if ok && msgLen > limit {
+		logf(logTypeHandshake, "Message of type %v too long [%d > %d]", msgType, msgLen, limit)
+		return alertDecodeError
+	}
+	return nil
+}
+
 func (h *handshakeLayer) extendBuffer(n int) error {
 	for len(h.buffer) < n {
-		pt, err := h.conn.ReadRecord()
+		pt, err := h.readRecord()
 		if err != nil {
 			return err
 		}
 
+		// A message fragmented across records has to be delivered in
+		// consecutive handshake records.  Only an alert may interrupt it.
+		interleaved := pt.contentType != recordTypeHandshake && pt.contentType != recordTypeAlert
+		if len(h.buffer) > 0 && interleaved {
+			logf(logTypeHandshake, "Record of type %d interleaved with a fragmented message", pt.contentType)
+			return alertUnexpectedMessage
+		}
+
+		// A ChangeCipherSpec may be sent during the handshake for middlebox
+		// compatibility.  It carries no information, so drop it.
+		if pt.contentType == recordTypeChangeCipherSpec {
+			if len(pt.fragment) != 1 || pt.fragment[0] != 1 {
+				logf(logTypeHandshake, "Invalid ChangeCipherSpec [%x]", pt.fragment)
+				return alertUnexpectedMessage
+			}
+			continue
+		}
+
+		// An alert in place of a handshake message means that the peer has
+		// given up on the handshake.  Except for close_notify and
+		// user_canceled, all TLS 1.3 alerts are fatal, and either ends the
+		// handshake anyway.
+		if pt.contentType == recordTypeAlert {
+			if len(pt.fragment) != 2 {
+				logf(logTypeHandshake, "Malformed alert [%x]", pt.fragment)
+				return alertDecodeError
+			}
+			logf(logTypeHandshake, "Received alert [%d] %v", pt.fragment[0], alert(pt.fragment[1]))
+			return &AlertError{Alert: pt.fragment[1]}
+		}
+
+		if pt.contentType == recordTypeApplicationData && h.earlyData != nil {
+			err = h.earlyData(pt.fragment)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
 		if pt.contentType != recordTypeHandshake {
 			return fmt.Errorf("tls.handshakelayer: Unexpected record type %04x", pt.contentType)
 		}
@@ -103,6 +284,14 @@ func (h *handshakeLayer) extendBuffer(n int) error {
 }
 
 func (h *handshakeLayer) ReadMessage() (*handshakeMessage, error) {
+	if h.datagram {
+		hm, err := h.readDatagramMessage()
+		if err == nil && h.exchanged != nil {
+			h.exchanged(hm)
+		}
+		return hm, err
+	}
+
 	// Read the header
 	err := h.extendBuffer(handshakeHeaderLen)
 	if err != nil {
@@ -112,6 +301,10 @@ func (h *handshakeLayer) ReadMessage() (*handshakeMessage, error) {
 	hm := &handshakeMessage{}
 	hm.msgType = handshakeType(h.buffer[0])
 	hmLen := (int(h.buffer[1]) << 16) + (int(h.buffer[2]) << 8) + int(h.buffer[3])
+	err = h.checkMessageLen(hm.msgType, hmLen)
+	if err != nil {
+		return nil, err
+	}
 
 	// Read the body
 	err = h.extendBuffer(handshakeHeaderLen + hmLen)
@@ -121,6 +314,10 @@ func (h *handshakeLayer) ReadMessage() (*handshakeMessage, error) {
 
 	hm.body = h.buffer[handshakeHeaderLen : handshakeHeaderLen+hmLen]
 	h.buffer = h.buffer[handshakeHeaderLen+hmLen:]
+	h.peerFlightReceived()
+	if h.exchanged != nil {
+		h.exchanged(hm)
+	}
 	return hm, nil
 }
 
@@ -152,6 +349,13 @@ func (h *handshakeLayer) WriteMessage(hm *handshakeMessage) error {
 func (h *handshakeLayer) WriteMessages(hms []*handshakeMessage) error {
 	for _, hm := range hms {
 		logf(logTypeHandshake, "WriteMessage [%d] %x", hm.msgType, hm.body)
+		if h.exchanged != nil {
+			h.exchanged(hm)
+		}
+	}
+
+	if h.datagram {
+		return h.writeDatagramMessages(hms)
 	}
 
 	// Write out headers and bodies
@@ -167,10 +371,11 @@ func (h *handshakeLayer) WriteMessages(hms []*handshakeMessage) error {
 
 	// Send full-size fragments
 	var start int
-	for start = 0; len(buffer)-start >= maxFragmentLen; start += maxFragmentLen {
+	fragmentLen := h.conn.fragmentLimit()
+	for start = 0; len(buffer)-start >= fragmentLen; start += fragmentLen {
 		err := h.conn.WriteRecord(&tlsPlaintext{
 			contentType: recordTypeHandshake,
-			fragment:    buffer[start : start+maxFragmentLen],
+			fragment:    buffer[start : start+fragmentLen],
 		})
 
 		if err != nil {
@@ -215,3 +420,181 @@ func (h *handshakeLayer) WriteMessageBodies(bodies []handshakeMessageBody) ([]*h
 
 	return hms, h.WriteMessages(hms)
 }
+
+// struct {
+//     HandshakeType msg_type;
+//     uint24 length;
+//     uint16 message_seq;
+//     uint24 fragment_offset;
+//     uint24 fragment_length;
+//     opaque body[fragment_length];
+// } DTLSHandshake;
+func (h *handshakeLayer) writeDatagramMessages(hms []*handshakeMessage) error {
+	// Fragments also have to fit in the peer's record_size_limit
+	maxLen := maxDatagramFragmentLen
+	if limit := h.conn.fragmentLimit() - datagramHandshakeHeaderLen; limit < maxLen {
+		maxLen = limit
+	}
+
+	for _, msg := range hms {
+		msgLen := len(msg.body)
+		if msgLen > maxHandshakeMessageLen {
+			return fmt.Errorf("tls.handshakelayer: Message too large to send")
+		}
+
+		// Always send at least one fragment, even for an empty message
+		for offset := 0; offset == 0 || offset < msgLen; offset += maxLen {
+			fragLen := msgLen - offset
+			if fragLen > maxLen {
+				fragLen = maxLen
+			}
+
+			fragment := make([]byte, datagramHandshakeHeaderLen+fragLen)
+			fragment[0] = byte(msg.msgType)
+			fragment[1] = byte(msgLen >> 16)
+			fragment[2] = byte(msgLen >> 8)
+			fragment[3] = byte(msgLen)
+			fragment[4] = byte(h.messageSeq >> 8)
+			fragment[5] = byte(h.messageSeq)
+			fragment[6] = byte(offset >> 16)
+			fragment[7] = byte(offset >> 8)
+			fragment[8] = byte(offset)
+			fragment[9] = byte(fragLen >> 16)
+			fragment[10] = byte(fragLen >> 8)
+			fragment[11] = byte(fragLen)
+			copy(fragment[datagramHandshakeHeaderLen:], msg.body[offset:offset+fragLen])
+
+			err := h.conn.WriteRecord(&tlsPlaintext{
+				contentType: recordTypeHandshake,
+				fragment:    fragment,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		h.messageSeq++
+	}
+	return nil
+}
+
+func (h *handshakeLayer) readDatagramMessage() (*handshakeMessage, error) {
+	for {
+		if msg := h.fragments[h.messageSeq]; msg != nil && msg.remaining == 0 {
+			delete(h.fragments, h.messageSeq)
+			h.messageSeq++
+			h.peerFlightReceived()
+			return &handshakeMessage{msgType: msg.msgType, body: msg.body}, nil
+		}
+
+		pt, err := h.readRecord()
+		if err != nil {
+			return nil, err
+		}
+
+		if pt.contentType != recordTypeHandshake {
+			return nil, fmt.Errorf("tls.handshakelayer: Unexpected record type %04x", pt.contentType)
+		}
+
+		err = h.addFragments(pt.fragment)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readRecord reads a record, retransmitting our last flight each time the
+// retransmission timeout passes without one arriving.
+func (h *handshakeLayer) readRecord() (*tlsPlaintext, error) {
+	if h.readTime != nil {
+		start := time.Now()
+		defer func() { *h.readTime += time.Since(start) }()
+	}
+
+	for retransmits := 0; ; retransmits++ {
+		pt, retransmit, err := h.readRecordOrTimeout()
+		if !retransmit || retransmits >= h.maxRetransmits {
+			return pt, err
+		}
+
+		err = h.flightOut.retransmitFlight()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readRecordOrTimeout reads a record, but gives up after the retransmission
+// timeout if there is a flight that could be retransmitted, and reports
+// whether it is time to retransmit it.  A read that times out on an earlier
+// deadline, e.g., because the handshake was canceled, is just a timeout.
+func (h *handshakeLayer) readRecordOrTimeout() (*tlsPlaintext, bool, error) {
+	canTimeout := h.flightOut != nil && len(h.flightOut.flight) > 0 && h.retransmitTimeout > 0
+	if !canTimeout {
+		pt, err := h.conn.ReadRecord()
+		return pt, false, err
+	}
+
+	timer := time.Now().Add(h.retransmitTimeout)
+	err := h.setReadDeadline(timer)
+	if err != nil {
+		return nil, false, err
+	}
+	defer h.setReadDeadline(time.Time{})
+
+	pt, err := h.conn.ReadRecord()
+	return pt, isTimeout(err) && !time.Now().Before(timer), err
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (h *handshakeLayer) addFragments(data []byte) error {
+	for len(data) > 0 {
+		if len(data) < datagramHandshakeHeaderLen {
+			return fmt.Errorf("tls.handshakelayer: Record too short for fragment header")
+		}
+
+		msgType := handshakeType(data[0])
+		msgLen := (int(data[1]) << 16) + (int(data[2]) << 8) + int(data[3])
+		seq := (uint16(data[4]) << 8) + uint16(data[5])
+		offset := (int(data[6]) << 16) + (int(data[7]) << 8) + int(data[8])
+		fragLen := (int(data[9]) << 16) + (int(data[10]) << 8) + int(data[11])
+		if len(data) < datagramHandshakeHeaderLen+fragLen {
+			return fmt.Errorf("tls.handshakelayer: Record too short for fragment")
+		}
+		if offset+fragLen > msgLen {
+			return fmt.Errorf("tls.handshakelayer: Fragment extends past end of message")
+		}
+		body := data[datagramHandshakeHeaderLen : datagramHandshakeHeaderLen+fragLen]
+		data = data[datagramHandshakeHeaderLen+fragLen:]
+
+		// Drop retransmitted messages we've already processed, and messages
+		// too far in the future to be worth buffering
+		if seq < h.messageSeq || seq >= h.messageSeq+maxBufferedMessages {
+			logf(logTypeHandshake, "Dropping fragment of message %d while expecting %d", seq, h.messageSeq)
+			continue
+		}
+
+		msg, ok := h.fragments[seq]
+		if !ok {
+			if err := h.checkMessageLen(msgType, msgLen); err != nil {
+				return err
+			}
+			msg = &messageFragments{
+				msgType:   msgType,
+				body:      make([]byte, msgLen),
+				remaining: msgLen,
+			}
+			h.fragments[seq] = msg
+		}
+		if msg.msgType != msgType || len(msg.body) != msgLen {
+			return fmt.Errorf("tls.handshakelayer: Fragment inconsistent with message %d", seq)
+		}
+
+		msg.add(offset, body)
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package mint
 import (
 	"bytes"
 	"encoding/hex"
+	"runtime"
 	"testing"
 )
 
@@ -63,6 +64,7 @@ var (
 
 	insufficientDataHex = "1603010004" + "01000004" + "1603010002" + "0000"
 	nonHandshakeHex     = "15030100020000"
+	ccsHex              = "140301000101"
 
 	// Also borrow ClientHello and ServerHello inputs from handshake-messages_test.go
 	finishedHex         = "1603010006" + "14000002" + "0000"
@@ -204,6 +206,31 @@ func TestReadHandshakeMessage(t *testing.T) {
 	h = newHandshakeLayer(newRecordLayer(b))
 	hm, err = h.ReadMessage()
 	assertError(t, err, "Read handshake message from a non-handshake record")
+
+	// Test that a ChangeCipherSpec during the handshake is ignored
+	ccs, _ := hex.DecodeString(ccsHex)
+	b = bytes.NewBuffer(append(ccs, short...))
+	h = newHandshakeLayer(newRecordLayer(b))
+	hm, err = h.ReadMessage()
+	assertNotError(t, err, "Failed to read a handshake message after ChangeCipherSpec")
+	assertDeepEquals(t, hm, shortMessageIn)
+
+	// Test read failure on a malformed ChangeCipherSpec
+	ccs[len(ccs)-1] = 0x02
+	b = bytes.NewBuffer(append(ccs, short...))
+	h = newHandshakeLayer(newRecordLayer(b))
+	hm, err = h.ReadMessage()
+	assertEquals(t, err, error(alertUnexpectedMessage))
+
+	// Test read failure on a ChangeCipherSpec between the fragments of a
+	// message
+	ccs[len(ccs)-1] = 0x01
+	split, _ := hex.DecodeString(recordHeaderHex(longFragment1) + hex.EncodeToString(longFragment1) +
+		ccsHex + recordHeaderHex(longFragment2) + hex.EncodeToString(longFragment2))
+	b = bytes.NewBuffer(split)
+	h = newHandshakeLayer(newRecordLayer(b))
+	hm, err = h.ReadMessage()
+	assertEquals(t, err, error(alertUnexpectedMessage))
 }
 
 func TestReadHandshakeMessageBody(t *testing.T) {
@@ -322,3 +349,49 @@ func TestWriteHandshakeMessageBody(t *testing.T) {
 	assertError(t, err, "Wrote a message body despite a marshal failure")
 	chValidIn.cipherSuites = chCipherSuites
 }
+
+func TestMaxMessageLen(t *testing.T) {
+	limits := map[handshakeType]int{handshakeTypeCertificate: 1000}
+
+	// Test that a message at the limit is read
+	atLimit := &handshakeMessage{msgType: handshakeTypeCertificate, body: bytes.Repeat([]byte{0xA0}, 1000)}
+	b := bytes.NewBuffer(nil)
+	assertNotError(t, newHandshakeLayer(newRecordLayer(b)).WriteMessage(atLimit), "Failed to write message")
+	h := newHandshakeLayer(newRecordLayer(b))
+	h.maxMessageLen = limits
+	hm, err := h.ReadMessage()
+	assertNotError(t, err, "Failed to read a message at the length limit")
+	assertDeepEquals(t, hm, atLimit)
+
+	// Test that a message declaring a huge length is rejected from its
+	// header, without buffering toward the declared length
+	huge := []byte{byte(handshakeTypeCertificate), 0xff, 0xff, 0xff, 0x00, 0x00}
+	record := append([]byte{0x16, 0x03, 0x01, 0x00, byte(len(huge))}, huge...)
+	h = newHandshakeLayer(newRecordLayer(bytes.NewBuffer(record)))
+	h.maxMessageLen = limits
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = h.ReadMessage()
+	runtime.ReadMemStats(&after)
+	assertEquals(t, err, error(alertDecodeError))
+	assert(t, after.TotalAlloc-before.TotalAlloc < 1<<16, "Allocated memory for an over-long message")
+
+	// Test that the limit only applies to the configured message types
+	short, _ := hex.DecodeString(shortHex)
+	h = newHandshakeLayer(newRecordLayer(bytes.NewBuffer(short)))
+	h.maxMessageLen = limits
+	_, err = h.ReadMessage()
+	assertNotError(t, err, "Applied a length limit to an unlimited message type")
+
+	// Test that in datagram mode, a fragment of a message declaring a huge
+	// length is rejected before the message is allocated
+	h = newDatagramHandshakeLayer(newRecordLayer(nil))
+	h.maxMessageLen = limits
+	fragment := []byte{byte(handshakeTypeCertificate), 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 1, 0}
+	runtime.ReadMemStats(&before)
+	err = h.addFragments(fragment)
+	runtime.ReadMemStats(&after)
+	assertEquals(t, err, error(alertDecodeError))
+	assert(t, after.TotalAlloc-before.TotalAlloc < 1<<16, "Allocated memory for an over-long fragmented message")
+}
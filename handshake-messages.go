@@ -1,6 +1,7 @@
 package mint
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/x509"
 	"fmt"
@@ -122,6 +123,59 @@ func (ch *clientHelloBody) Unmarshal(data []byte) (int, error) {
 	return 37 + cipherSuitesLen + 2 + extLen, nil
 }
 
+// checkRetriedClientHello verifies that a ClientHello sent in response to a
+// HelloRetryRequest matches the first one, except for the changes allowed by
+// RFC 8446 Section 4.1.2: a new key_share, an added cookie, an updated
+// pre_shared_key, dropping early_data, and different padding.
+func checkRetriedClientHello(first, retry *clientHelloBody) error {
+	if first.random != retry.random {
+		logf(logTypeHandshake, "Retried ClientHello changed its random")
+		return alertIllegalParameter
+	}
+
+	if len(first.cipherSuites) != len(retry.cipherSuites) {
+		logf(logTypeHandshake, "Retried ClientHello changed its cipher suites")
+		return alertIllegalParameter
+	}
+	for i, suite := range first.cipherSuites {
+		if retry.cipherSuites[i] != suite {
+			logf(logTypeHandshake, "Retried ClientHello changed its cipher suites")
+			return alertIllegalParameter
+		}
+	}
+
+	mayChange := map[helloExtensionType]bool{
+		extensionTypeKeyShare:     true,
+		extensionTypeCookie:       true,
+		extensionTypePreSharedKey: true,
+		extensionTypeEarlyData:    true,
+		extensionTypePadding:      true,
+	}
+	fixed := func(el extensionList) extensionList {
+		out := extensionList{}
+		for _, ext := range el {
+			if !mayChange[ext.extensionType] {
+				out = append(out, ext)
+			}
+		}
+		return out
+	}
+
+	firstExtensions, retryExtensions := fixed(first.extensions), fixed(retry.extensions)
+	if len(firstExtensions) != len(retryExtensions) {
+		logf(logTypeHandshake, "Retried ClientHello changed its extensions")
+		return alertIllegalParameter
+	}
+	for i, ext := range firstExtensions {
+		if retryExtensions[i].extensionType != ext.extensionType ||
+			!bytes.Equal(retryExtensions[i].extensionData, ext.extensionData) {
+			logf(logTypeHandshake, "Retried ClientHello changed extension %d", ext.extensionType)
+			return alertIllegalParameter
+		}
+	}
+	return nil
+}
+
 // struct {
 //     ProtocolVersion server_version;
 //     Random random;
@@ -134,7 +188,8 @@ func (ch *clientHelloBody) Unmarshal(data []byte) (int, error) {
 //     };
 // } ServerHello;
 type serverHelloBody struct {
-	// Omitted: server_version
+	// Omitted: legacy_version, which is always TLS 1.2.  The version is
+	// selected in the supported_versions extension.
 	random      [32]byte
 	cipherSuite cipherSuite
 	extensions  extensionList
@@ -148,7 +203,7 @@ func (sh serverHelloBody) Marshal() ([]byte, error) {
 	body := make([]byte, fixedServerHelloBodyLen)
 
 	body[0] = 0x03
-	body[1] = 0x04
+	body[1] = 0x03
 
 	copy(body[2:34], sh.random[:])
 
@@ -171,8 +226,8 @@ func (sh *serverHelloBody) Unmarshal(data []byte) (int, error) {
 		return 0, fmt.Errorf("tls.serverhello: Malformed ServerHello; too short")
 	}
 
-	if data[0] != 0x03 || data[1] != 0x04 {
-		return 0, fmt.Errorf("tls.serverhello: Malformed ServerHello; unsupported version %02x%02x", data[0], data[1])
+	if data[0] != 0x03 || data[1] != 0x03 {
+		return 0, fmt.Errorf("tls.serverhello: Malformed ServerHello; unexpected legacy version %02x%02x", data[0], data[1])
 	}
 
 	copy(sh.random[:], data[2:34])
@@ -264,6 +319,31 @@ func (ee *encryptedExtensionsBody) Unmarshal(data []byte) (int, error) {
 	return read, err
 }
 
+// struct {
+//     Extension extensions<0..2^16-1>;
+// } ClientEncryptedExtensions;
+//
+// Sent by the client after the server's Finished, to carry its ALPS settings.
+// Marshal() and Unmarshal() are handled by extensionList
+type clientEncryptedExtensionsBody extensionList
+
+func (cee clientEncryptedExtensionsBody) Type() handshakeType {
+	return handshakeTypeClientEncryptedExtensions
+}
+
+func (cee clientEncryptedExtensionsBody) Marshal() ([]byte, error) {
+	return extensionList(cee).Marshal()
+}
+
+func (cee *clientEncryptedExtensionsBody) Unmarshal(data []byte) (int, error) {
+	var el extensionList
+	read, err := el.Unmarshal(data)
+	if err == nil {
+		*cee = clientEncryptedExtensionsBody(el)
+	}
+	return read, err
+}
+
 // opaque ASN1Cert<1..2^24-1>;
 //
 // struct {
@@ -353,6 +433,53 @@ func (c *certificateBody) Unmarshal(data []byte) (int, error) {
 	return start, nil
 }
 
+// struct {
+//     opaque certificate_request_context<0..2^8-1>;
+//     Extension extensions<2..2^16-1>;
+// } CertificateRequest;
+type certificateRequestBody struct {
+	certificateRequestContext []byte
+	extensions                extensionList
+}
+
+func (cr certificateRequestBody) Type() handshakeType {
+	return handshakeTypeCertificateRequest
+}
+
+func (cr certificateRequestBody) Marshal() ([]byte, error) {
+	if len(cr.certificateRequestContext) > maxCertRequestContextLen {
+		return nil, fmt.Errorf("tls.certrequest: Request context too long")
+	}
+
+	extensions, err := cr.extensions.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	data := []byte{byte(len(cr.certificateRequestContext))}
+	data = append(data, cr.certificateRequestContext...)
+	return append(data, extensions...), nil
+}
+
+func (cr *certificateRequestBody) Unmarshal(data []byte) (int, error) {
+	if len(data) < 1 {
+		return 0, fmt.Errorf("tls.certrequest: Message too short for context length")
+	}
+
+	contextLen := int(data[0])
+	if len(data) < 1+contextLen {
+		return 0, fmt.Errorf("tls.certrequest: Message too short for context")
+	}
+	cr.certificateRequestContext = make([]byte, contextLen)
+	copy(cr.certificateRequestContext, data[1:1+contextLen])
+
+	read, err := cr.extensions.Unmarshal(data[1+contextLen:])
+	if err != nil {
+		return 0, err
+	}
+	return 1 + contextLen + read, nil
+}
+
 // CertificateVerify
 //
 // enum {... (255)} HashAlgorithm
@@ -423,7 +550,7 @@ func (cv *certificateVerifyBody) computeContext(transcript []*handshakeMessage)
 		handshakeContext = append(handshakeContext, msg.Marshal()...)
 	}
 
-	hash, ok := hashMap[cv.alg.hash]
+	hash, ok := signatureHash(cv.alg)
 	if !ok {
 		err = fmt.Errorf("tls.certverify: Unsupported hash algorithm")
 		return
@@ -434,17 +561,17 @@ func (cv *certificateVerifyBody) computeContext(transcript []*handshakeMessage)
 	return
 }
 
-func (cv *certificateVerifyBody) Sign(privateKey crypto.Signer, transcript []*handshakeMessage) error {
-	hash, hashedData, err := cv.computeContext(transcript)
+func (cv *certificateVerifyBody) Sign(privateKey crypto.Signer, transcript []*handshakeMessage, context string) error {
+	_, hashedData, err := cv.computeContext(transcript)
 	if err != nil {
 		return err
 	}
 
-	cv.alg.signature, cv.signature, err = sign(hash, privateKey, hashedData, contextCertificateVerify)
+	cv.alg.signature, cv.signature, err = sign(cv.alg, privateKey, hashedData, context)
 	return err
 }
 
-func (cv *certificateVerifyBody) Verify(publicKey crypto.PublicKey, transcript []*handshakeMessage) error {
+func (cv *certificateVerifyBody) Verify(publicKey crypto.PublicKey, transcript []*handshakeMessage, context string) error {
 	_, hashedData, err := cv.computeContext(transcript)
 	if err != nil {
 		return err
@@ -452,5 +579,95 @@ func (cv *certificateVerifyBody) Verify(publicKey crypto.PublicKey, transcript [
 
 	logf(logTypeHandshake, "Digest to be verified: [%d] %x", len(hashedData), hashedData)
 
-	return verify(cv.alg, publicKey, hashedData, contextCertificateVerify, cv.signature)
+	return verify(cv.alg, publicKey, hashedData, context, cv.signature)
+}
+
+// struct {
+//     uint32 ticket_lifetime;
+//     uint32 ticket_age_add;
+//     opaque ticket_nonce<0..255>;
+//     opaque ticket<1..2^16-1>;
+//     Extension extensions<0..2^16-2>;
+// } NewSessionTicket;
+type newSessionTicketBody struct {
+	ticketLifetime uint32
+	ticketAgeAdd   uint32
+	ticketNonce    []byte
+	ticket         []byte
+	extensions     extensionList
+}
+
+func (nst newSessionTicketBody) Type() handshakeType {
+	return handshakeTypeSessionTicket
+}
+
+func (nst newSessionTicketBody) Marshal() ([]byte, error) {
+	if len(nst.ticketNonce) > 255 {
+		return nil, fmt.Errorf("tls.newsessionticket: Nonce too long")
+	}
+	if len(nst.ticket) == 0 || len(nst.ticket) > 0xffff {
+		return nil, fmt.Errorf("tls.newsessionticket: Invalid ticket length")
+	}
+
+	lifetime, ageAdd := nst.ticketLifetime, nst.ticketAgeAdd
+	data := []byte{
+		byte(lifetime >> 24), byte(lifetime >> 16), byte(lifetime >> 8), byte(lifetime),
+		byte(ageAdd >> 24), byte(ageAdd >> 16), byte(ageAdd >> 8), byte(ageAdd),
+		byte(len(nst.ticketNonce)),
+	}
+	data = append(data, nst.ticketNonce...)
+	data = append(data, byte(len(nst.ticket)>>8), byte(len(nst.ticket)))
+	data = append(data, nst.ticket...)
+
+	extensions, err := nst.extensions.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return append(data, extensions...), nil
+}
+
+func (nst *newSessionTicketBody) Unmarshal(data []byte) (int, error) {
+	if len(data) < 9 {
+		return 0, fmt.Errorf("tls.newsessionticket: Message too short for header")
+	}
+
+	nst.ticketLifetime = (uint32(data[0]) << 24) + (uint32(data[1]) << 16) + (uint32(data[2]) << 8) + uint32(data[3])
+	nst.ticketAgeAdd = (uint32(data[4]) << 24) + (uint32(data[5]) << 16) + (uint32(data[6]) << 8) + uint32(data[7])
+	nonceLen := int(data[8])
+	if len(data) < 9+nonceLen+2 {
+		return 0, fmt.Errorf("tls.newsessionticket: Message too short for nonce")
+	}
+	nst.ticketNonce = append([]byte{}, data[9:9+nonceLen]...)
+
+	start := 9 + nonceLen
+	ticketLen := (int(data[start]) << 8) + int(data[start+1])
+	if ticketLen == 0 || len(data) < start+2+ticketLen {
+		return 0, fmt.Errorf("tls.newsessionticket: Invalid ticket")
+	}
+	nst.ticket = append([]byte{}, data[start+2:start+2+ticketLen]...)
+
+	start += 2 + ticketLen
+	read, err := nst.extensions.Unmarshal(data[start:])
+	if err != nil {
+		return 0, err
+	}
+	return start + read, nil
+}
+
+// struct {} EndOfEarlyData;
+type endOfEarlyDataBody struct{}
+
+func (eoed endOfEarlyDataBody) Type() handshakeType {
+	return handshakeTypeEndOfEarlyData
+}
+
+func (eoed endOfEarlyDataBody) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+func (eoed *endOfEarlyDataBody) Unmarshal(data []byte) (int, error) {
+	if len(data) != 0 {
+		return 0, fmt.Errorf("tls.endofearlydata: Non-empty EndOfEarlyData")
+	}
+	return 0, nil
 }
@@ -35,9 +35,9 @@ var (
 		random:      helloRandom,
 		cipherSuite: cipherSuite(0x0001),
 	}
-	shValidHex    = "0304" + hex.EncodeToString(helloRandom[:]) + "0001" + extListValidHex
-	shEmptyHex    = "0304" + hex.EncodeToString(helloRandom[:]) + "0001"
-	shOverflowHex = "0304" + hex.EncodeToString(helloRandom[:]) + "0001" + extListOverflowOuterHex
+	shValidHex    = "0303" + hex.EncodeToString(helloRandom[:]) + "0001" + extListValidHex
+	shEmptyHex    = "0303" + hex.EncodeToString(helloRandom[:]) + "0001"
+	shOverflowHex = "0303" + hex.EncodeToString(helloRandom[:]) + "0001" + extListOverflowOuterHex
 
 	// Finished test cases
 	finValidIn = finishedBody{
@@ -52,6 +52,23 @@ var (
 	encExtValidHex = extListValidHex
 	encExtEmptyHex = ""
 
+	// CertificateRequest test cases
+	certReqValidIn = certificateRequestBody{
+		certificateRequestContext: []byte{0x01, 0x02, 0x03, 0x04},
+		extensions:                extListValidIn,
+	}
+	certReqValidHex = "0401020304" + extListValidHex
+
+	// NewSessionTicket test cases
+	nstValidIn = newSessionTicketBody{
+		ticketLifetime: 0x00015180,
+		ticketAgeAdd:   0x01020304,
+		ticketNonce:    []byte{0x00, 0x01},
+		ticket:         []byte{0xa0, 0xa1, 0xa2},
+		extensions:     extListValidIn,
+	}
+	nstValidHex = "00015180" + "01020304" + "020001" + "0003a0a1a2" + extListValidHex
+
 	// Certificate test cases
 	cert1Hex = "308201653082010ba003020102020500a0a0a0a0300a0608" +
 		"2a8648ce3d0403023017311530130603550403130c657861" +
@@ -140,6 +157,7 @@ func TestHandshakeMessageTypes(t *testing.T) {
 	assertEquals(t, finishedBody{}.Type(), handshakeTypeFinished)
 	assertEquals(t, encryptedExtensionsBody{}.Type(), handshakeTypeEncryptedExtensions)
 	assertEquals(t, certificateBody{}.Type(), handshakeTypeCertificate)
+	assertEquals(t, certificateRequestBody{}.Type(), handshakeTypeCertificateRequest)
 	assertEquals(t, certificateVerifyBody{}.Type(), handshakeTypeCertificateVerify)
 }
 
@@ -231,6 +249,59 @@ func TestClientHelloMarshalUnmarshal(t *testing.T) {
 	assertError(t, err, "Unmarshaled a ClientHello with invalid extensions")
 }
 
+func TestCheckRetriedClientHello(t *testing.T) {
+	first := &clientHelloBody{
+		random:       helloRandom,
+		cipherSuites: chCipherSuites,
+		extensions: extensionList{
+			extension{extensionType: extensionTypeServerName, extensionData: []byte{0x01}},
+			extension{extensionType: extensionTypeKeyShare, extensionData: []byte{0x02}},
+			extension{extensionType: extensionTypeEarlyData, extensionData: []byte{}},
+		},
+	}
+
+	// Test that a new key share, an added cookie, and dropping early_data
+	// are allowed
+	retry := &clientHelloBody{
+		random:       helloRandom,
+		cipherSuites: chCipherSuites,
+		extensions: extensionList{
+			extension{extensionType: extensionTypeServerName, extensionData: []byte{0x01}},
+			extension{extensionType: extensionTypeKeyShare, extensionData: []byte{0x03}},
+			extension{extensionType: extensionTypeCookie, extensionData: []byte{0x04}},
+		},
+	}
+	assertNotError(t, checkRetriedClientHello(first, retry), "Rejected a valid retry")
+
+	// Test that changing the cipher suites is rejected
+	changedSuites := *retry
+	changedSuites.cipherSuites = chCipherSuites[:2]
+	err := checkRetriedClientHello(first, &changedSuites)
+	assertEquals(t, err, error(alertIllegalParameter))
+	changedSuites.cipherSuites = []cipherSuite{0x0003, 0x0002, 0x0001}
+	err = checkRetriedClientHello(first, &changedSuites)
+	assertEquals(t, err, error(alertIllegalParameter))
+
+	// Test that changing the random or any other extension is rejected
+	changedRandom := *retry
+	changedRandom.random[0] ^= 0xff
+	err = checkRetriedClientHello(first, &changedRandom)
+	assertEquals(t, err, error(alertIllegalParameter))
+	changedExtension := *retry
+	changedExtension.extensions = extensionList{
+		extension{extensionType: extensionTypeServerName, extensionData: []byte{0x05}},
+		extension{extensionType: extensionTypeKeyShare, extensionData: []byte{0x03}},
+	}
+	err = checkRetriedClientHello(first, &changedExtension)
+	assertEquals(t, err, error(alertIllegalParameter))
+	addedExtension := *retry
+	addedExtension.extensions = append(extensionList{
+		extension{extensionType: extensionTypeALPN, extensionData: []byte{0x06}},
+	}, retry.extensions...)
+	err = checkRetriedClientHello(first, &addedExtension)
+	assertEquals(t, err, error(alertIllegalParameter))
+}
+
 func TestServerHelloMarshalUnmarshal(t *testing.T) {
 	shValid, _ := hex.DecodeString(shValidHex)
 	shEmpty, _ := hex.DecodeString(shEmptyHex)
@@ -429,6 +500,42 @@ func TestCertificateMarshalUnmarshal(t *testing.T) {
 	certValid[11] ^= 0xFF
 }
 
+func TestCertificateRequestMarshalUnmarshal(t *testing.T) {
+	certReqValid, _ := hex.DecodeString(certReqValidHex)
+
+	// Test correctness of handshake type
+	assertEquals(t, (certificateRequestBody{}).Type(), handshakeTypeCertificateRequest)
+
+	// Test successful marshal
+	out, err := certReqValidIn.Marshal()
+	assertNotError(t, err, "Failed to marshal a valid CertificateRequest")
+	assertByteEquals(t, out, certReqValid)
+
+	// Test marshal failure on a context that is too long
+	tooLong := certificateRequestBody{certificateRequestContext: bytes.Repeat([]byte{0}, maxCertRequestContextLen+1)}
+	out, err = tooLong.Marshal()
+	assertError(t, err, "Marshaled a CertificateRequest with a context that was too long")
+
+	// Test successful unmarshal
+	var cr certificateRequestBody
+	read, err := cr.Unmarshal(certReqValid)
+	assertNotError(t, err, "Failed to unmarshal a valid CertificateRequest")
+	assertEquals(t, read, len(certReqValid))
+	assertDeepEquals(t, cr, certReqValidIn)
+
+	// Test unmarshal failure on an empty message
+	read, err = cr.Unmarshal(certReqValid[:0])
+	assertError(t, err, "Unmarshaled a CertificateRequest with no context length")
+
+	// Test unmarshal failure on a truncated context
+	read, err = cr.Unmarshal(certReqValid[:3])
+	assertError(t, err, "Unmarshaled a CertificateRequest with a truncated context")
+
+	// Test unmarshal failure on missing extensions
+	read, err = cr.Unmarshal(certReqValid[:5])
+	assertError(t, err, "Unmarshaled a CertificateRequest without extensions")
+}
+
 func TestCertificateVerifyMarshalUnmarshal(t *testing.T) {
 	certVerifyValid, _ := hex.DecodeString(certVerifyValidHex)
 
@@ -463,33 +570,93 @@ func TestCertificateVerifyMarshalUnmarshal(t *testing.T) {
 	assertError(t, err, "Unmarshaled a CertificateVerify with no header")
 
 	// Test successful sign
-	err = certVerifyValidIn.Sign(privRSA, transcript)
+	err = certVerifyValidIn.Sign(privRSA, transcript, contextServerCertificateVerify)
 	assertNotError(t, err, "Failed to sign CertificateVerify")
 
 	// Test sign failure on handshake marshal failure
-	err = certVerifyValidIn.Sign(privRSA, nilTranscript)
+	err = certVerifyValidIn.Sign(privRSA, nilTranscript, contextServerCertificateVerify)
 	assertError(t, err, "Signed CertificateVerify despite nil message")
 	chValidIn.extensions = extListValidIn
 
 	// Test sign failure on bad hash algorithm
 	certVerifyValidIn.alg.hash = hashAlgorithm(0)
-	err = certVerifyValidIn.Sign(privRSA, transcript)
+	err = certVerifyValidIn.Sign(privRSA, transcript, contextServerCertificateVerify)
 	assertError(t, err, "Signed CertificateVerify despite bad hash algorithm")
 	certVerifyValidIn.alg.hash = hashAlgorithmSHA256
 
 	// Test successful verify
-	err = certVerifyValidIn.Sign(privRSA, transcript)
+	err = certVerifyValidIn.Sign(privRSA, transcript, contextServerCertificateVerify)
 	assertNotError(t, err, "Failed to sign CertificateVerify")
-	err = certVerifyValidIn.Verify(privRSA.Public(), transcript)
+	err = certVerifyValidIn.Verify(privRSA.Public(), transcript, contextServerCertificateVerify)
 	assertNotError(t, err, "Failed to verify CertificateVerify")
 
 	// Test verify failure on bad hash algorithm
 	certVerifyValidIn.alg.hash = hashAlgorithm(0)
-	err = certVerifyValidIn.Verify(privRSA.Public(), transcript)
+	err = certVerifyValidIn.Verify(privRSA.Public(), transcript, contextServerCertificateVerify)
 	assertError(t, err, "Verified CertificateVerify despite bad hash algorithm")
 	certVerifyValidIn.alg.hash = hashAlgorithmSHA256
 
 	// Test veiryf failure on nil message
-	err = certVerifyValidIn.Verify(privRSA.Public(), nilTranscript)
+	err = certVerifyValidIn.Verify(privRSA.Public(), nilTranscript, contextServerCertificateVerify)
 	assertError(t, err, "Verified CertificateVerify despite nil message")
 }
+
+func TestNewSessionTicketMarshalUnmarshal(t *testing.T) {
+	nstValid, _ := hex.DecodeString(nstValidHex)
+
+	// Test correctness of handshake type
+	assertEquals(t, (newSessionTicketBody{}).Type(), handshakeTypeSessionTicket)
+
+	// Test successful marshal
+	out, err := nstValidIn.Marshal()
+	assertNotError(t, err, "Failed to marshal a valid NewSessionTicket")
+	assertByteEquals(t, out, nstValid)
+
+	// Test marshal failure on an empty ticket or an overlong nonce
+	noTicket := nstValidIn
+	noTicket.ticket = nil
+	_, err = noTicket.Marshal()
+	assertError(t, err, "Marshaled a NewSessionTicket without a ticket")
+	longNonce := nstValidIn
+	longNonce.ticketNonce = make([]byte, 256)
+	_, err = longNonce.Marshal()
+	assertError(t, err, "Marshaled a NewSessionTicket with a nonce that was too long")
+
+	// Test successful unmarshal
+	var nst newSessionTicketBody
+	read, err := nst.Unmarshal(nstValid)
+	assertNotError(t, err, "Failed to unmarshal a valid NewSessionTicket")
+	assertEquals(t, read, len(nstValid))
+	assertDeepEquals(t, nst, nstValidIn)
+
+	// Test unmarshal failure on a truncated header, nonce, ticket, or
+	// extensions
+	_, err = nst.Unmarshal(nstValid[:8])
+	assertError(t, err, "Unmarshaled a NewSessionTicket with a truncated header")
+	_, err = nst.Unmarshal(nstValid[:10])
+	assertError(t, err, "Unmarshaled a NewSessionTicket with a truncated nonce")
+	_, err = nst.Unmarshal(nstValid[:14])
+	assertError(t, err, "Unmarshaled a NewSessionTicket with a truncated ticket")
+	_, err = nst.Unmarshal(nstValid[:16])
+	assertError(t, err, "Unmarshaled a NewSessionTicket without extensions")
+}
+
+func TestEndOfEarlyDataMarshalUnmarshal(t *testing.T) {
+	// Test correctness of handshake type
+	assertEquals(t, (endOfEarlyDataBody{}).Type(), handshakeTypeEndOfEarlyData)
+
+	// Test successful marshal
+	out, err := endOfEarlyDataBody{}.Marshal()
+	assertNotError(t, err, "Failed to marshal EndOfEarlyData")
+	assertEquals(t, len(out), 0)
+
+	// Test successful unmarshal
+	var eoed endOfEarlyDataBody
+	read, err := eoed.Unmarshal([]byte{})
+	assertNotError(t, err, "Failed to unmarshal EndOfEarlyData")
+	assertEquals(t, read, 0)
+
+	// Test unmarshal failure on a non-empty body
+	_, err = eoed.Unmarshal([]byte{0x00})
+	assertError(t, err, "Unmarshaled a non-empty EndOfEarlyData")
+}
@@ -13,6 +13,13 @@ const (
 	sequenceNumberLen = 8       // sequence number length
 	recordHeaderLen   = 5       // record header length
 	maxFragmentLen    = 1 << 14 // max number of bytes in a record
+
+	minRecordSizeLimit = 64 // smallest record_size_limit allowed (RFC 8449)
+
+	datagramRecordHeaderLen = 13   // DTLS record header length
+	maxDatagramExpansion    = 256  // max bytes of protection overhead per record
+	datagramVersionMajor    = 0xfe // DTLS record_version {254, 253}
+	datagramVersionMinor    = 0xfd
 )
 
 // struct {
@@ -28,6 +35,32 @@ type tlsPlaintext struct {
 	fragment    []byte
 }
 
+// TransportError wraps an error returned by the underlying connection, so
+// that callers can distinguish transport failures from TLS failures.  The
+// original error is available via Unwrap.
+type TransportError struct {
+	Op  string // "read" or "write"
+	Err error  // The error returned by the underlying connection
+}
+
+func (e *TransportError) Error() string {
+	return "tls.transport: " + e.Op + ": " + e.Err.Error()
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// wrapTransportError wraps a non-nil error from the underlying connection in
+// a TransportError.  io.EOF is passed through unchanged, since callers rely on
+// comparing against it directly.
+func wrapTransportError(op string, err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	return &TransportError{Op: op, Err: err}
+}
+
 type recordLayer struct {
 	sync.Mutex
 
@@ -39,6 +72,38 @@ type recordLayer struct {
 	seq      []byte      // Zero-padded sequence number
 	nonce    []byte      // Buffer for per-record nonces
 	cipher   cipher.AEAD // AEAD cipher
+
+	// In datagram (DTLS) mode, each record is one datagram with an explicit
+	// epoch and sequence number, and the nonce is computed from those.
+	datagram    bool
+	epoch       uint16 // Incremented on every rekey
+	datagramSeq uint64 // Next 48-bit sequence number to send
+	iv          []byte // Static IV for the current epoch
+
+	// If keepFlight is set, handshake records are remembered so that the last
+	// flight can be retransmitted.
+	keepFlight bool
+	flight     [][]byte // Handshake records sent in the current flight
+	newFlight  bool     // The next handshake record starts a new flight
+
+	// While batching, stream records are collected in pending rather than
+	// written, so that they can be sent with a single write.
+	batching bool
+	pending  []byte
+
+	// If set, encrypted application data records are padded with as many
+	// zero bytes as padding returns for the length of their content.
+	padding func(plaintextLen int) int
+
+	// If positive, the most content and padding that a protected record may
+	// carry, under the record_size_limit that the peer advertised (RFC 8449)
+	maxProtectedLen int
+
+	// A server that rejects the client's early data skips it: records that
+	// fail to decrypt, or application data records that arrive before there
+	// are keys, are dropped until this many bytes have been skipped or a
+	// record decrypts.
+	skipEarlyData int
 }
 
 func newRecordLayer(conn io.ReadWriter) *recordLayer {
@@ -64,16 +129,55 @@ func (r *recordLayer) Rekey(suite cipherSuite, key []byte, iv []byte) error {
 		gcm, _ := cipher.NewGCMWithNonceSize(aes, len(iv))
 		r.cipher = gcm
 		r.ivLength = len(iv)
+	case TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+		TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256:
+		params := cipherSuiteMap[suite]
+
+		if len(key) != params.keyLen || len(iv) != params.ivLen {
+			return fmt.Errorf("tls.rekey: Crypto parameters are the wrong size")
+		}
+
+		r.cipher, _ = newChaCha20Poly1305(key)
+		r.ivLength = len(iv)
 	default:
 		return fmt.Errorf("tls.rekey: Unsupported ciphersuite: %x", suite)
 	}
 
+	// Clear the nonce derived from the previous IV before replacing it
+	zeroBytes(r.nonce)
 	r.seq = bytes.Repeat([]byte{0}, r.ivLength)
 	r.nonce = make([]byte, r.ivLength)
 	copy(r.nonce, iv)
+
+	if r.datagram {
+		zeroBytes(r.iv)
+		r.iv = make([]byte, r.ivLength)
+		copy(r.iv, iv)
+		r.epoch++
+		r.datagramSeq = 0
+	}
 	return nil
 }
 
+// Wipe clears the per-record nonce state and drops the cipher.  The record
+// layer must not be used for protected records afterward.
+func (r *recordLayer) Wipe() {
+	zeroBytes(r.nonce)
+	zeroBytes(r.seq)
+	zeroBytes(r.iv)
+	r.cipher = nil
+}
+
+// setDatagramNonce sets the nonce for a record with the given sequence number
+// in the current epoch, by XORing the IV with the 64-bit epoch || sequence.
+func (r *recordLayer) setDatagramNonce(seq uint64) {
+	epochSeq := uint64(r.epoch)<<48 | seq
+	copy(r.nonce, r.iv)
+	for i := 0; i < sequenceNumberLen; i++ {
+		r.nonce[r.ivLength-1-i] ^= byte(epochSeq >> uint(8*i))
+	}
+}
+
 func (r *recordLayer) incrementSequenceNumber() {
 	if r.ivLength == 0 {
 		return
@@ -117,6 +221,9 @@ func (r *recordLayer) encrypt(pt *tlsPlaintext, padLen int) *tlsPlaintext {
 }
 
 func (r *recordLayer) decrypt(pt *tlsPlaintext) (*tlsPlaintext, int, error) {
+	if len(pt.fragment) < r.cipher.Overhead() {
+		return nil, 0, fmt.Errorf("tls.record.decrypt: Record too short to decrypt")
+	}
 	decryptLen := len(pt.fragment) - r.cipher.Overhead()
 	out := &tlsPlaintext{
 		contentType: pt.contentType,
@@ -126,12 +233,18 @@ func (r *recordLayer) decrypt(pt *tlsPlaintext) (*tlsPlaintext, int, error) {
 	// Decrypt
 	_, err := r.cipher.Open(out.fragment[:0], r.nonce, pt.fragment, nil)
 	if err != nil {
-		return nil, 0, fmt.Errorf("tls.record.decrypt: AEAD decrypt failed")
+		logf(logTypeIO, "AEAD decrypt failed")
+		return nil, 0, alertBadRecordMAC
 	}
 
-	// Find the padding boundary
+	// Find the padding boundary.  The content type is the last non-zero byte,
+	// so a plaintext of only zeros has none.
 	padLen := 0
-	for ; padLen < decryptLen+1 && out.fragment[decryptLen-padLen-1] == 0; padLen++ {
+	for ; padLen < decryptLen && out.fragment[decryptLen-padLen-1] == 0; padLen++ {
+	}
+	if padLen == decryptLen {
+		logf(logTypeIO, "Decrypted record has no content type")
+		return nil, 0, alertUnexpectedMessage
 	}
 
 	// Transfer the content type
@@ -143,12 +256,27 @@ func (r *recordLayer) decrypt(pt *tlsPlaintext) (*tlsPlaintext, int, error) {
 	return out, padLen, nil
 }
 
+// readFullBuffer fills data up to its capacity, reading ahead by up to a
+// record header.  Bytes that were read but not used, e.g., the start of a
+// record body that arrived in the same segment as its header, are kept for the
+// next call, however the peer's writes were split.
 func (r *recordLayer) readFullBuffer(data []byte) error {
-	buffer := make([]byte, cap(data)+recordHeaderLen)
+	// What is left over from an earlier read can be longer than this read,
+	// e.g., when a record is put back to be read again after a timeout
+	bufferLen := cap(data) + recordHeaderLen
+	if len(r.nextData) > bufferLen {
+		bufferLen = len(r.nextData)
+	}
+	buffer := make([]byte, bufferLen)
 
 	var index int
 	copy(buffer, r.nextData)
 	index = len(r.nextData)
+	if index >= cap(data) {
+		copy(data[:cap(data)], buffer)
+		r.nextData = buffer[cap(data):index]
+		return nil
+	}
 
 	for {
 		m, err := r.conn.Read(buffer[index:])
@@ -160,65 +288,162 @@ func (r *recordLayer) readFullBuffer(data []byte) error {
 			return nil
 		}
 		if err != nil {
-			return err
+			// Keep what we have, in case the read is retried (e.g., after a
+			// timeout)
+			r.nextData = buffer[:index+m]
+			if err == io.EOF && index+m > 0 {
+				return io.ErrUnexpectedEOF
+			}
+			return wrapTransportError("read", err)
 		}
 		index = index + m
 	}
 }
 
 func (r *recordLayer) ReadRecord() (*tlsPlaintext, error) {
+	if r.datagram {
+		return r.readDatagramRecord()
+	}
+
+	for {
+		pt, skipped, err := r.readStreamRecord()
+		if !skipped {
+			return pt, err
+		}
+	}
+}
+
+// readStreamRecord reads the next record, or reports that it skipped one of
+// the client's rejected early data records.
+func (r *recordLayer) readStreamRecord() (*tlsPlaintext, bool, error) {
 	pt := &tlsPlaintext{}
 	header := make([]byte, recordHeaderLen)
 	err := r.readFullBuffer(header)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	// Validate content type
 	switch recordType(header[0]) {
 	default:
-		return nil, fmt.Errorf("tls.record: Unknown content type %02x", header[0])
-	case recordTypeAlert, recordTypeHandshake, recordTypeApplicationData:
+		logf(logTypeIO, "Unknown content type %02x", header[0])
+		return nil, false, alertUnexpectedMessage
+	case recordTypeChangeCipherSpec, recordTypeAlert, recordTypeHandshake, recordTypeApplicationData:
 		pt.contentType = recordType(header[0])
 	}
 
 	// Validate version
 	if !allowWrongVersionNumber && (header[1] != 0x03 || header[2] != 0x01) {
-		return nil, fmt.Errorf("tls.record: Invalid version %02x%02x", header[1], header[2])
+		return nil, false, fmt.Errorf("tls.record: Invalid version %02x%02x", header[1], header[2])
 	}
 
 	// Validate size < max
 	size := (int(header[3]) << 8) + int(header[4])
 	if size > maxFragmentLen {
-		return nil, fmt.Errorf("tls.record: Record size too big")
+		return nil, false, fmt.Errorf("tls.record: Record size too big")
 	}
 
 	// Attempt to read fragment
 	pt.fragment = make([]byte, size)
 	err = r.readFullBuffer(pt.fragment[:0])
 	if err != nil {
-		return nil, err
+		// Put the header back, so that a retried read starts at the record
+		r.nextData = append(header, r.nextData...)
+
+		// The connection closing anywhere but at a record boundary is a
+		// truncation, not a clean close
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, false, err
+	}
+
+	// ChangeCipherSpec is never protected, and is left to the caller to
+	// ignore or reject
+	if pt.contentType == recordTypeChangeCipherSpec {
+		logf(logTypeIO, "recordLayer.ReadRecord [%d] [%x]", pt.contentType, pt.fragment)
+		return pt, false, nil
+	}
+
+	if r.cipher == nil && pt.contentType == recordTypeApplicationData && r.skipEarlyData >= size {
+		logf(logTypeIO, "Skipping early data record before keys [%d]", size)
+		r.skipEarlyData -= size
+		return nil, true, nil
 	}
 
 	// Attempt to decrypt fragment
 	if r.cipher != nil {
 		pt, _, err = r.decrypt(pt)
+		if err == alertBadRecordMAC && r.skipEarlyData >= size {
+			logf(logTypeIO, "Skipping early data record that failed to decrypt [%d]", size)
+			r.skipEarlyData -= size
+			return nil, true, nil
+		}
 		if err != nil {
-			return nil, err
+			return nil, false, err
+		}
+		r.skipEarlyData = 0
+
+		// Validate the inner content type
+		switch pt.contentType {
+		default:
+			logf(logTypeIO, "Unknown inner content type %02x", pt.contentType)
+			return nil, false, alertUnexpectedMessage
+		case recordTypeAlert, recordTypeHandshake, recordTypeApplicationData:
 		}
 	}
 
 	logf(logTypeIO, "recordLayer.ReadRecord [%d] [%x]", pt.contentType, pt.fragment)
 
 	r.incrementSequenceNumber()
-	return pt, nil
+	return pt, false, nil
+}
+
+// fragmentLimit returns the most content that the next record can carry.
+// Protected records are also held to the peer's record_size_limit.
+func (r *recordLayer) fragmentLimit() int {
+	if r.cipher != nil && r.maxProtectedLen > 0 && r.maxProtectedLen < maxFragmentLen {
+		return r.maxProtectedLen
+	}
+	return maxFragmentLen
 }
 
 func (r *recordLayer) WriteRecord(pt *tlsPlaintext) error {
-	return r.WriteRecordWithPadding(pt, 0)
+	return r.WriteRecordWithPadding(pt, r.padLength(pt))
+}
+
+// padLength returns the amount of padding to add to a record, limited so
+// that the padded record still fits in a fragment, and within the peer's
+// record_size_limit.
+func (r *recordLayer) padLength(pt *tlsPlaintext) int {
+	if r.padding == nil || r.cipher == nil || pt.contentType != recordTypeApplicationData {
+		return 0
+	}
+
+	padLen := r.padding(len(pt.fragment))
+	maxPadLen := maxFragmentLen - len(pt.fragment) - 1 - r.cipher.Overhead()
+	if r.maxProtectedLen > 0 && maxPadLen > r.maxProtectedLen-len(pt.fragment) {
+		maxPadLen = r.maxProtectedLen - len(pt.fragment)
+	}
+	if padLen > maxPadLen {
+		padLen = maxPadLen
+	}
+	if padLen < 0 {
+		padLen = 0
+	}
+	return padLen
 }
 
 func (r *recordLayer) WriteRecordWithPadding(pt *tlsPlaintext, padLen int) error {
+	if r.cipher != nil && r.maxProtectedLen > 0 && len(pt.fragment)+padLen > r.maxProtectedLen {
+		return fmt.Errorf("tls.record: Record exceeds the peer's record_size_limit")
+	}
+
+	if r.datagram {
+		return r.writeDatagramRecord(pt, padLen)
+	}
+
+	isHandshake := pt.contentType == recordTypeHandshake
 	if r.cipher != nil {
 		pt = r.encrypt(pt, padLen)
 	} else if padLen > 0 {
@@ -236,6 +461,168 @@ func (r *recordLayer) WriteRecordWithPadding(pt *tlsPlaintext, padLen int) error
 	logf(logTypeIO, "recordLayer.WriteRecord [%d] [%x]", pt.contentType, pt.fragment)
 
 	r.incrementSequenceNumber()
+	if isHandshake {
+		r.rememberFlight(record)
+	}
+	if r.batching {
+		r.pending = append(r.pending, record...)
+		return nil
+	}
+	_, err := r.conn.Write(record)
+	return wrapTransportError("write", err)
+}
+
+// beginBatch starts holding back records, until flushBatch writes them all at
+// once.  Datagram records are always written immediately.
+func (r *recordLayer) beginBatch() {
+	r.batching = true
+}
+
+// flushBatch writes any records held back since beginBatch, and goes back to
+// writing records as they are sent.
+func (r *recordLayer) flushBatch() error {
+	r.batching = false
+	if len(r.pending) == 0 {
+		return nil
+	}
+
+	pending := r.pending
+	r.pending = nil
+	_, err := r.conn.Write(pending)
+	return wrapTransportError("write", err)
+}
+
+// struct {
+//     ContentType type;
+//     ProtocolVersion version = { 254, 253 };
+//     uint16 epoch;
+//     uint48 sequence_number;
+//     uint16 length;
+//     opaque fragment[DTLSPlaintext.length];
+// } DTLSPlaintext;
+//
+// Records that can't be processed are dropped rather than treated as fatal,
+// since they may be stale, reordered, or forged datagrams.
+func (r *recordLayer) readDatagramRecord() (*tlsPlaintext, error) {
+	buffer := make([]byte, datagramRecordHeaderLen+maxFragmentLen+maxDatagramExpansion)
+	for {
+		n, err := r.conn.Read(buffer)
+		if err != nil {
+			return nil, wrapTransportError("read", err)
+		}
+		data := buffer[:n]
+
+		if len(data) < datagramRecordHeaderLen {
+			logf(logTypeIO, "Dropping datagram too short for a record header")
+			continue
+		}
+
+		contentType := recordType(data[0])
+		switch contentType {
+		case recordTypeAlert, recordTypeHandshake, recordTypeApplicationData:
+		default:
+			logf(logTypeIO, "Dropping record with unknown content type %02x", data[0])
+			continue
+		}
+
+		if !allowWrongVersionNumber && (data[1] != datagramVersionMajor || data[2] != datagramVersionMinor) {
+			logf(logTypeIO, "Dropping record with invalid version %02x%02x", data[1], data[2])
+			continue
+		}
+
+		epoch := (uint16(data[3]) << 8) + uint16(data[4])
+		if epoch != r.epoch {
+			logf(logTypeIO, "Dropping record from epoch %d in epoch %d", epoch, r.epoch)
+			continue
+		}
+
+		var seq uint64
+		for _, b := range data[5:11] {
+			seq = (seq << 8) + uint64(b)
+		}
+
+		size := (int(data[11]) << 8) + int(data[12])
+		if size != len(data)-datagramRecordHeaderLen {
+			logf(logTypeIO, "Dropping record with wrong length")
+			continue
+		}
+
+		pt := &tlsPlaintext{
+			contentType: contentType,
+			fragment:    make([]byte, size),
+		}
+		copy(pt.fragment, data[datagramRecordHeaderLen:])
+
+		if r.cipher != nil {
+			r.setDatagramNonce(seq)
+			pt, _, err = r.decrypt(pt)
+			if err != nil {
+				logf(logTypeIO, "Dropping record that failed to decrypt")
+				continue
+			}
+		}
+
+		logf(logTypeIO, "recordLayer.ReadRecord [%d] [%x]", pt.contentType, pt.fragment)
+		return pt, nil
+	}
+}
+
+func (r *recordLayer) writeDatagramRecord(pt *tlsPlaintext, padLen int) error {
+	isHandshake := pt.contentType == recordTypeHandshake
+
+	if r.cipher != nil {
+		r.setDatagramNonce(r.datagramSeq)
+		pt = r.encrypt(pt, padLen)
+	} else if padLen > 0 {
+		return fmt.Errorf("tls.record: Padding can only be done on encrypted records")
+	}
+
+	if len(pt.fragment) > maxFragmentLen {
+		return fmt.Errorf("tls.record: Record size too big")
+	}
+
+	length := len(pt.fragment)
+	seq := r.datagramSeq
+	header := []byte{
+		byte(pt.contentType), datagramVersionMajor, datagramVersionMinor,
+		byte(r.epoch >> 8), byte(r.epoch),
+		byte(seq >> 40), byte(seq >> 32), byte(seq >> 24), byte(seq >> 16), byte(seq >> 8), byte(seq),
+		byte(length >> 8), byte(length),
+	}
+	record := append(header, pt.fragment...)
+
+	logf(logTypeIO, "recordLayer.WriteRecord [%d] [%x]", pt.contentType, pt.fragment)
+
+	r.datagramSeq++
+	if isHandshake {
+		r.rememberFlight(record)
+	}
+
 	_, err := r.conn.Write(record)
-	return err
+	return wrapTransportError("write", err)
+}
+
+func (r *recordLayer) rememberFlight(record []byte) {
+	if !r.keepFlight {
+		return
+	}
+
+	if r.newFlight {
+		r.flight = nil
+		r.newFlight = false
+	}
+	r.flight = append(r.flight, record)
+}
+
+// retransmitFlight resends the handshake records of the current flight, as
+// they were originally sent.
+func (r *recordLayer) retransmitFlight() error {
+	logf(logTypeIO, "Retransmitting flight of %d records", len(r.flight))
+	for _, record := range r.flight {
+		_, err := r.conn.Write(record)
+		if err != nil {
+			return wrapTransportError("write", err)
+		}
+	}
+	return nil
 }
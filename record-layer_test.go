@@ -3,6 +3,8 @@ package mint
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
+	"io"
 	"net"
 	"testing"
 )
@@ -36,8 +38,15 @@ func TestRekey(t *testing.T) {
 
 	// Test rekey failure on unknown ciphersuite
 	r = newRecordLayer(bytes.NewBuffer(nil))
-	err = r.Rekey(TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256, key, iv)
+	err = r.Rekey(cipherSuite(0x0000), key, iv)
 	assertError(t, err, "Allowed rekey with unknown ciphersuite")
+
+	// Test ChaCha20-Poly1305, which takes a 32-byte key
+	r = newRecordLayer(bytes.NewBuffer(nil))
+	err = r.Rekey(TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256, append(key, key...), iv)
+	assertNotError(t, err, "Failed to rekey with ChaCha20-Poly1305")
+	err = r.Rekey(TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256, key, iv)
+	assertError(t, err, "Allowed ChaCha20-Poly1305 rekey with wrong-size key")
 }
 
 func TestSequenceNumberRollover(t *testing.T) {
@@ -59,6 +68,8 @@ func TestSequenceNumberRollover(t *testing.T) {
 }
 
 func TestReadRecord(t *testing.T) {
+	key, _ := hex.DecodeString(keyHex)
+	iv, _ := hex.DecodeString(ivHex)
 	plaintext, _ := hex.DecodeString(plaintextHex)
 
 	// Test that a known-good frame decodes properly
@@ -73,8 +84,18 @@ func TestReadRecord(t *testing.T) {
 	r = newRecordLayer(bytes.NewBuffer(plaintext))
 	pt, err = r.ReadRecord()
 	assertError(t, err, "Failed to reject record with unknown type")
+	assertEquals(t, err, error(alertUnexpectedMessage))
 	plaintext[0] = 0x15
 
+	// Test that ChangeCipherSpec is passed through, even with a cipher set
+	ccs := []byte{0x14, 0x03, 0x01, 0x00, 0x01, 0x01}
+	r = newRecordLayer(bytes.NewBuffer(ccs))
+	r.Rekey(TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, key, iv)
+	pt, err = r.ReadRecord()
+	assertNotError(t, err, "Failed to read ChangeCipherSpec")
+	assertEquals(t, pt.contentType, recordTypeChangeCipherSpec)
+	assertByteEquals(t, pt.fragment, []byte{0x01})
+
 	// Test failure on wrong version
 	originalAllowWrongVersionNumber := allowWrongVersionNumber
 	allowWrongVersionNumber = false
@@ -92,15 +113,27 @@ func TestReadRecord(t *testing.T) {
 	assertError(t, err, "Failed to reject record exceeding size limit")
 	plaintext[3] = 0x00
 
-	// Test failure on header read failure
+	// Test that EOF at a record boundary is a clean close
+	r = newRecordLayer(bytes.NewBuffer(nil))
+	pt, err = r.ReadRecord()
+	assertEquals(t, err, io.EOF)
+
+	// Test failure on header read failure, as a truncation
 	r = newRecordLayer(bytes.NewBuffer(plaintext[:3]))
 	pt, err = r.ReadRecord()
 	assertError(t, err, "Didn't fail when unable to read header")
+	assertEquals(t, err, io.ErrUnexpectedEOF)
 
-	// Test failure on body read failure
+	// Test failure on body read failure, as a truncation, including when the
+	// connection ends right after the header
 	r = newRecordLayer(bytes.NewBuffer(plaintext[:7]))
 	pt, err = r.ReadRecord()
 	assertError(t, err, "Didn't fail when unable to read fragment")
+	assertEquals(t, err, io.ErrUnexpectedEOF)
+
+	r = newRecordLayer(bytes.NewBuffer(plaintext[:recordHeaderLen]))
+	pt, err = r.ReadRecord()
+	assertEquals(t, err, io.ErrUnexpectedEOF)
 }
 
 func TestWriteRecord(t *testing.T) {
@@ -132,6 +165,24 @@ func TestWriteRecord(t *testing.T) {
 	}
 	err = r.WriteRecordWithPadding(pt, 5)
 	assertError(t, err, "Allowed padding without encryption")
+
+	// Test that batched records are held back until flushed
+	pt = &tlsPlaintext{
+		contentType: recordType(plaintext[0]),
+		fragment:    plaintext[5:],
+	}
+	b = bytes.NewBuffer(nil)
+	r = newRecordLayer(b)
+	r.beginBatch()
+	assertNotError(t, r.WriteRecord(pt), "Failed to write first batched record")
+	assertNotError(t, r.WriteRecord(pt), "Failed to write second batched record")
+	assertEquals(t, b.Len(), 0)
+	assertNotError(t, r.flushBatch(), "Failed to flush batched records")
+	assertByteEquals(t, b.Bytes(), append(append([]byte{}, plaintext...), plaintext...))
+
+	// Test that records are written directly again after the flush
+	assertNotError(t, r.WriteRecord(pt), "Failed to write record after flush")
+	assertEquals(t, b.Len(), 3*len(plaintext))
 }
 
 func TestDecryptRecord(t *testing.T) {
@@ -169,6 +220,41 @@ func TestDecryptRecord(t *testing.T) {
 	ciphertext1[7] ^= 0xFF
 }
 
+func TestDecryptPadding(t *testing.T) {
+	key, _ := hex.DecodeString(keyHex)
+	iv, _ := hex.DecodeString(ivHex)
+	plaintext, _ := hex.DecodeString(plaintextHex)
+
+	// Test that 100 bytes of padding are stripped back to the content type
+	b := bytes.NewBuffer(nil)
+	w := newRecordLayer(b)
+	w.Rekey(TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, key, iv)
+	err := w.WriteRecordWithPadding(&tlsPlaintext{
+		contentType: recordTypeApplicationData,
+		fragment:    plaintext[5:],
+	}, 100)
+	assertNotError(t, err, "Failed to write padded record")
+	assertEquals(t, b.Len(), recordHeaderLen+len(plaintext[5:])+1+100+w.cipher.Overhead())
+
+	r := newRecordLayer(b)
+	r.Rekey(TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, key, iv)
+	pt, err := r.ReadRecord()
+	assertNotError(t, err, "Failed to read padded record")
+	assertEquals(t, pt.contentType, recordTypeApplicationData)
+	assertByteEquals(t, pt.fragment, plaintext[5:])
+
+	// Test that an inner plaintext of only zeros is rejected
+	w = newRecordLayer(nil)
+	w.Rekey(TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, key, iv)
+	sealed := w.cipher.Seal(nil, w.nonce, make([]byte, 100), nil)
+	record := append([]byte{byte(recordTypeApplicationData), 0x03, 0x01, 0x00, byte(len(sealed))}, sealed...)
+	r = newRecordLayer(bytes.NewBuffer(record))
+	r.Rekey(TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, key, iv)
+	pt, err = r.ReadRecord()
+	assertEquals(t, err, error(alertUnexpectedMessage))
+	assert(t, pt == nil, "Returned a record with no content type")
+}
+
 func TestEncryptRecord(t *testing.T) {
 	key, _ := hex.DecodeString(keyHex)
 	iv, _ := hex.DecodeString(ivHex)
@@ -258,6 +344,20 @@ func TestReadWrite(t *testing.T) {
 	assertNotError(t, err, "Failed to read record")
 	assertEquals(t, ptIn.contentType, ptOut.contentType)
 	assertByteEquals(t, ptIn.fragment, ptOut.fragment)
+
+	// Encrypted with ChaCha20-Poly1305, over several records so that the
+	// per-record nonce changes
+	chachaKey := append(key, key...)
+	in.Rekey(TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256, chachaKey, iv)
+	out.Rekey(TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256, chachaKey, iv)
+	for i := 0; i < 3; i++ {
+		err = out.WriteRecord(ptIn)
+		assertNotError(t, err, "Failed to write ChaCha20-Poly1305 record")
+		ptOut, err = in.ReadRecord()
+		assertNotError(t, err, "Failed to read ChaCha20-Poly1305 record")
+		assertEquals(t, ptIn.contentType, ptOut.contentType)
+		assertByteEquals(t, ptIn.fragment, ptOut.fragment)
+	}
 }
 
 func TestOverSocket(t *testing.T) {
@@ -304,3 +404,108 @@ func TestOverSocket(t *testing.T) {
 	assertEquals(t, ptIn.contentType, ptOut.contentType)
 	assertByteEquals(t, ptIn.fragment, ptOut.fragment)
 }
+
+type failingReadWriter struct {
+	err error
+}
+
+func (f failingReadWriter) Read(data []byte) (int, error) {
+	return 0, f.err
+}
+
+func (f failingReadWriter) Write(data []byte) (int, error) {
+	return 0, f.err
+}
+
+func TestTransportError(t *testing.T) {
+	plaintext, _ := hex.DecodeString(plaintextHex)
+	ptIn := &tlsPlaintext{
+		contentType: recordType(plaintext[0]),
+		fragment:    plaintext[5:],
+	}
+	netErr := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset")}
+	r := newRecordLayer(failingReadWriter{netErr})
+
+	// Test that read errors are wrapped, and the original is recoverable
+	_, err := r.ReadRecord()
+	var transportErr *TransportError
+	assert(t, errors.As(err, &transportErr), "Read error was not a TransportError")
+	assertEquals(t, transportErr.Op, "read")
+	var opErr *net.OpError
+	assert(t, errors.As(err, &opErr), "Could not recover underlying read error")
+	assertEquals(t, opErr, netErr)
+
+	// Test that write errors are wrapped, and the original is recoverable
+	err = r.WriteRecord(ptIn)
+	assert(t, errors.As(err, &transportErr), "Write error was not a TransportError")
+	assertEquals(t, transportErr.Op, "write")
+	assert(t, errors.Is(err, netErr), "Could not recover underlying write error")
+
+	// Test that io.EOF is passed through unwrapped
+	r = newRecordLayer(failingReadWriter{io.EOF})
+	_, err = r.ReadRecord()
+	assertEquals(t, err, io.EOF)
+}
+
+// segmentedReader returns one segment per Read, as a TCP connection might
+// deliver the peer's writes.  A nil segment is returned as a timeout.
+type segmentedReader struct {
+	segments [][]byte
+}
+
+func (s *segmentedReader) Read(data []byte) (int, error) {
+	if len(s.segments) == 0 {
+		return 0, io.EOF
+	}
+	if s.segments[0] == nil {
+		s.segments = s.segments[1:]
+		return 0, timeoutError{}
+	}
+	n := copy(data, s.segments[0])
+	s.segments[0] = s.segments[0][n:]
+	if len(s.segments[0]) == 0 {
+		s.segments = s.segments[1:]
+	}
+	return n, nil
+}
+
+func (s *segmentedReader) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func TestClientHelloSplitAcrossReads(t *testing.T) {
+	chIn := &clientHelloBody{cipherSuites: supportedCipherSuites}
+	sv := supportedVersionsExtension{versions: []uint16{tls13Version}}
+	sg := supportedGroupsExtension{groups: supportedGroups}
+	assertNotError(t, chIn.extensions.Add(&sv), "Failed to add supported_versions")
+	assertNotError(t, chIn.extensions.Add(&sg), "Failed to add supported_groups")
+	wire := new(bytes.Buffer)
+	_, err := newHandshakeLayer(newRecordLayer(wire)).WriteMessageBody(chIn)
+	assertNotError(t, err, "Failed to write ClientHello")
+	record := wire.Bytes()
+
+	// Test that the ClientHello is reassembled however the record is split,
+	// including between its header and body, and when a read times out
+	// partway through and is retried
+	cases := map[string][][]byte{
+		"header, body":      {record[:recordHeaderLen], record[recordHeaderLen:]},
+		"in the header":     {record[:3], record[3:]},
+		"after the header":  {record[:recordHeaderLen+2], record[recordHeaderLen+2:]},
+		"byte by byte":      nil,
+		"timeout in header": {record[:3], nil, record[3:]},
+		"timeout in body":   {record[:recordHeaderLen+20], nil, record[recordHeaderLen+20:]},
+	}
+	for i := range record {
+		cases["byte by byte"] = append(cases["byte by byte"], record[i:i+1])
+	}
+	for name, segments := range cases {
+		hIn := newHandshakeLayer(newRecordLayer(&segmentedReader{segments: segments}))
+		chOut := new(clientHelloBody)
+		_, err := hIn.ReadMessageBody(chOut)
+		if isTimeout(err) {
+			_, err = hIn.ReadMessageBody(chOut)
+		}
+		assertNotError(t, err, "Failed to read split ClientHello: "+name)
+		assertDeepEquals(t, chOut, chIn)
+	}
+}
@@ -0,0 +1,785 @@
+package mint
+
+import (
+	"container/list"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTicketLifetime   = 24 * time.Hour
+	maxTicketLifetime       = 7 * 24 * time.Hour // RFC 8446, Section 4.6.1
+	defaultMaxStoredTickets = 4
+	ticketNonceLen          = 8
+)
+
+// sessionState is what a ticket stands for: the PSK for resuming a session,
+// and the parameters that the session can only be resumed with.  The server
+// seals it into the ticket itself, and the client keeps it next to the ticket.
+type sessionState struct {
+	cipherSuite  cipherSuite
+	psk          []byte
+	serverName   string
+	alpn         string
+	issuedAt     time.Time
+	lifetime     time.Duration
+	ticketAgeAdd uint32
+	maxEarlyData uint32 // Zero if early data can't be sent
+
+	// The chain that the client authenticated with, if any.  Only a server
+	// records it, so that a resumed connection still knows its client.
+	clientCertificates []*x509.Certificate
+}
+
+func (s sessionState) expired(now time.Time) bool {
+	return now.After(s.issuedAt.Add(s.lifetime))
+}
+
+// struct {
+//     CipherSuite cipher_suite;
+//     uint32 ticket_age_add;
+//     uint64 issued_at;          // Milliseconds since the Unix epoch
+//     uint32 lifetime;           // Seconds
+//     uint32 max_early_data;
+//     opaque psk<1..255>;
+//     opaque server_name<0..2^16-1>;
+//     opaque alpn<0..255>;
+//     ASN1Cert client_certificates<0..2^24-1>;  // Each as opaque<1..2^24-1>
+// } SessionState;
+func (s sessionState) Marshal() ([]byte, error) {
+	if len(s.psk) == 0 || len(s.psk) > 255 || len(s.serverName) > 0xffff || len(s.alpn) > 255 {
+		return nil, fmt.Errorf("tls.session: Invalid session state")
+	}
+
+	certificates := []byte{}
+	for _, cert := range s.clientCertificates {
+		certLen := len(cert.Raw)
+		certificates = append(certificates, byte(certLen>>16), byte(certLen>>8), byte(certLen))
+		certificates = append(certificates, cert.Raw...)
+	}
+	if len(certificates) > 0xffffff {
+		return nil, fmt.Errorf("tls.session: Client certificates too long")
+	}
+
+	issuedAt := uint64(s.issuedAt.UnixNano() / int64(time.Millisecond))
+	lifetime := uint32(s.lifetime / time.Second)
+	data := []byte{byte(s.cipherSuite >> 8), byte(s.cipherSuite)}
+	for shift := 24; shift >= 0; shift -= 8 {
+		data = append(data, byte(s.ticketAgeAdd>>uint(shift)))
+	}
+	for shift := 56; shift >= 0; shift -= 8 {
+		data = append(data, byte(issuedAt>>uint(shift)))
+	}
+	for shift := 24; shift >= 0; shift -= 8 {
+		data = append(data, byte(lifetime>>uint(shift)))
+	}
+	for shift := 24; shift >= 0; shift -= 8 {
+		data = append(data, byte(s.maxEarlyData>>uint(shift)))
+	}
+	data = append(data, byte(len(s.psk)))
+	data = append(data, s.psk...)
+	data = append(data, byte(len(s.serverName)>>8), byte(len(s.serverName)))
+	data = append(data, s.serverName...)
+	data = append(data, byte(len(s.alpn)))
+	data = append(data, s.alpn...)
+	data = append(data, byte(len(certificates)>>16), byte(len(certificates)>>8), byte(len(certificates)))
+	data = append(data, certificates...)
+	return data, nil
+}
+
+func (s *sessionState) Unmarshal(data []byte) (int, error) {
+	if len(data) < 23 {
+		return 0, fmt.Errorf("tls.session: Too short for header")
+	}
+
+	s.cipherSuite = cipherSuite((uint16(data[0]) << 8) + uint16(data[1]))
+	s.ticketAgeAdd = 0
+	for _, b := range data[2:6] {
+		s.ticketAgeAdd = (s.ticketAgeAdd << 8) + uint32(b)
+	}
+	var issuedAt uint64
+	for _, b := range data[6:14] {
+		issuedAt = (issuedAt << 8) + uint64(b)
+	}
+	var lifetime uint32
+	for _, b := range data[14:18] {
+		lifetime = (lifetime << 8) + uint32(b)
+	}
+	s.maxEarlyData = 0
+	for _, b := range data[18:22] {
+		s.maxEarlyData = (s.maxEarlyData << 8) + uint32(b)
+	}
+	s.issuedAt = time.Unix(0, int64(issuedAt)*int64(time.Millisecond))
+	s.lifetime = time.Duration(lifetime) * time.Second
+
+	read := 22
+	pskLen := int(data[read])
+	if pskLen == 0 || len(data) < read+1+pskLen+2 {
+		return 0, fmt.Errorf("tls.session: Invalid PSK")
+	}
+	s.psk = append([]byte{}, data[read+1:read+1+pskLen]...)
+	read += 1 + pskLen
+
+	nameLen := (int(data[read]) << 8) + int(data[read+1])
+	if len(data) < read+2+nameLen+1 {
+		return 0, fmt.Errorf("tls.session: Too short for server name")
+	}
+	s.serverName = string(data[read+2 : read+2+nameLen])
+	read += 2 + nameLen
+
+	alpnLen := int(data[read])
+	if len(data) < read+1+alpnLen+3 {
+		return 0, fmt.Errorf("tls.session: Too short for ALPN")
+	}
+	s.alpn = string(data[read+1 : read+1+alpnLen])
+	read += 1 + alpnLen
+
+	certificatesLen := (int(data[read]) << 16) + (int(data[read+1]) << 8) + int(data[read+2])
+	read += 3
+	if len(data) < read+certificatesLen {
+		return 0, fmt.Errorf("tls.session: Too short for client certificates")
+	}
+	s.clientCertificates = nil
+	for end := read + certificatesLen; read < end; {
+		if end-read < 3 {
+			return 0, fmt.Errorf("tls.session: Too short for certificate length")
+		}
+		certLen := (int(data[read]) << 16) + (int(data[read+1]) << 8) + int(data[read+2])
+		if certLen == 0 || end-read-3 < certLen {
+			return 0, fmt.Errorf("tls.session: Invalid client certificate")
+		}
+		// The certificate keeps the slice it was parsed from, and the ticket
+		// plaintext is zeroed once it has been read
+		cert, err := x509.ParseCertificate(append([]byte{}, data[read+3:read+3+certLen]...))
+		if err != nil {
+			return 0, err
+		}
+		s.clientCertificates = append(s.clientCertificates, cert)
+		read += 3 + certLen
+	}
+	return read, nil
+}
+
+// ClientSessionState is a session that a client can resume: the ticket that
+// the server issued, together with the secret state that goes with it.  It
+// can be serialized with MarshalBinary, e.g., to keep tickets across
+// restarts, so the encoding has to be stored as securely as a private key.
+type ClientSessionState struct {
+	ticket  []byte
+	session sessionState
+}
+
+// MarshalBinary encodes the session, including its PSK
+func (cs *ClientSessionState) MarshalBinary() ([]byte, error) {
+	if len(cs.ticket) == 0 || len(cs.ticket) > 0xffff {
+		return nil, fmt.Errorf("tls.session: Invalid ticket")
+	}
+
+	session, err := cs.session.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	data := []byte{byte(len(cs.ticket) >> 8), byte(len(cs.ticket))}
+	data = append(data, cs.ticket...)
+	return append(data, session...), nil
+}
+
+// UnmarshalBinary decodes a session encoded with MarshalBinary
+func (cs *ClientSessionState) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return fmt.Errorf("tls.session: Too short for ticket length")
+	}
+	ticketLen := (int(data[0]) << 8) + int(data[1])
+	if ticketLen == 0 || len(data) < 2+ticketLen {
+		return fmt.Errorf("tls.session: Invalid ticket")
+	}
+
+	session := sessionState{}
+	read, err := session.Unmarshal(data[2+ticketLen:])
+	if err != nil {
+		return err
+	}
+	if 2+ticketLen+read != len(data) {
+		return fmt.Errorf("tls.session: Extra data after session")
+	}
+	cs.ticket = append([]byte{}, data[2:2+ticketLen]...)
+	cs.session = session
+	return nil
+}
+
+// ClientSessionCache stores the sessions that a client can resume, keyed by
+// server name.  Implementations must be safe for concurrent use.
+type ClientSessionCache interface {
+	// Get returns the session to resume with the server, if there is one
+	Get(sessionKey string) (session *ClientSessionState, ok bool)
+
+	// Put stores a session for the server, replacing any earlier one
+	Put(sessionKey string, cs *ClientSessionState)
+}
+
+type lruSessionCacheEntry struct {
+	sessionKey string
+	state      *ClientSessionState
+}
+
+// lruSessionCache is a ClientSessionCache that keeps a bounded number of
+// sessions, evicting the least recently used.
+type lruSessionCache struct {
+	sync.Mutex
+	m        map[string]*list.Element
+	q        *list.List
+	capacity int
+}
+
+// NewLRUClientSessionCache returns a ClientSessionCache that holds up to
+// capacity sessions, evicting the least recently used.  If capacity is less
+// than one, a default of 64 is used.
+func NewLRUClientSessionCache(capacity int) ClientSessionCache {
+	if capacity < 1 {
+		capacity = 64
+	}
+	return &lruSessionCache{
+		m:        map[string]*list.Element{},
+		q:        list.New(),
+		capacity: capacity,
+	}
+}
+
+func (c *lruSessionCache) Get(sessionKey string) (*ClientSessionState, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	elem, ok := c.m[sessionKey]
+	if !ok {
+		return nil, false
+	}
+	c.q.MoveToFront(elem)
+	return elem.Value.(*lruSessionCacheEntry).state, true
+}
+
+func (c *lruSessionCache) Put(sessionKey string, cs *ClientSessionState) {
+	c.Lock()
+	defer c.Unlock()
+
+	if elem, ok := c.m[sessionKey]; ok {
+		elem.Value.(*lruSessionCacheEntry).state = cs
+		c.q.MoveToFront(elem)
+		return
+	}
+
+	if c.q.Len() >= c.capacity {
+		oldest := c.q.Back()
+		c.q.Remove(oldest)
+		delete(c.m, oldest.Value.(*lruSessionCacheEntry).sessionKey)
+	}
+	c.m[sessionKey] = c.q.PushFront(&lruSessionCacheEntry{sessionKey, cs})
+}
+
+var (
+	defaultTicketKeyOnce sync.Once
+	defaultTicketKey     [32]byte
+)
+
+// ticketAEAD returns the AEAD that tickets are sealed with.  Without a
+// configured key, a random one is made for the life of the process, so that
+// tickets can't be resumed after a restart.
+func (c Config) ticketAEAD() (cipher.AEAD, error) {
+	key := c.SessionTicketKey
+	if key == [32]byte{} {
+		defaultTicketKeyOnce.Do(func() {
+			_, err := io.ReadFull(rand.Reader, defaultTicketKey[:])
+			if err != nil {
+				panic(err)
+			}
+		})
+		key = defaultTicketKey
+	}
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealTicket encrypts a session into a ticket, as nonce || ciphertext
+func (c Config) sealTicket(session sessionState) ([]byte, error) {
+	plaintext, err := session.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(plaintext)
+
+	aead, err := c.ticketAEAD()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(c.draw("ticket seal nonce"), nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// openTicket decrypts a ticket sealed with sealTicket.  Tickets that were
+// sealed under another key, or altered, are rejected.
+func (c Config) openTicket(ticket []byte) (*sessionState, bool) {
+	aead, err := c.ticketAEAD()
+	if err != nil || len(ticket) < aead.NonceSize() {
+		return nil, false
+	}
+
+	nonce, ciphertext := ticket[:aead.NonceSize()], ticket[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, false
+	}
+	defer zeroBytes(plaintext)
+
+	session := &sessionState{}
+	read, err := session.Unmarshal(plaintext)
+	if err != nil || read != len(plaintext) {
+		return nil, false
+	}
+	return session, true
+}
+
+func (c Config) maxStoredTickets() int {
+	if c.MaxStoredTickets <= 0 {
+		return defaultMaxStoredTickets
+	}
+	return c.MaxStoredTickets
+}
+
+// resumableSession returns the session in the cache that can be offered to
+// the server, if any.  A session is only offered to the server name it was
+// established with, and only if it could be resumed with this configuration.
+func (c *Conn) resumableSession() *ClientSessionState {
+	if c.config.SessionTicketsDisabled || c.config.ClientSessionCache == nil {
+		return nil
+	}
+
+	cs, ok := c.config.ClientSessionCache.Get(c.config.ServerName)
+	if !ok || cs == nil {
+		return nil
+	}
+	session := cs.session
+	if session.serverName != c.config.ServerName {
+		logf(logTypeHandshake, "Not resuming a session for another server [%s]", session.serverName)
+		return nil
+	}
+	if session.expired(time.Now()) {
+		logf(logTypeHandshake, "Not resuming an expired session")
+		return nil
+	}
+
+	offeredSuite := false
+	for _, suite := range c.config.cipherSuites() {
+		if suite == session.cipherSuite {
+			offeredSuite = true
+			break
+		}
+	}
+	offeredALPN := session.alpn == ""
+	for _, protocol := range c.config.NextProtos {
+		if protocol == session.alpn {
+			offeredALPN = true
+			break
+		}
+	}
+	if !offeredSuite || !offeredALPN {
+		logf(logTypeHandshake, "Not resuming a session with parameters we don't offer")
+		return nil
+	}
+	return cs
+}
+
+// offerSession replaces any pre_shared_key extension in the ClientHello with
+// one that offers the session, bound to the ClientHello by its binder.  After
+// a HelloRetryRequest, prefix holds the messages that precede the ClientHello
+// in the transcript.  With a nil session, the extension is just removed.
+func offerSession(ch *clientHelloBody, cs *ClientSessionState, prefix []*handshakeMessage) error {
+	extensions := extensionList{}
+	for _, ext := range ch.extensions {
+		if ext.extensionType != extensionTypePreSharedKey {
+			extensions = append(extensions, ext)
+		}
+	}
+	ch.extensions = extensions
+	if cs == nil {
+		return nil
+	}
+
+	// The binder is computed over the ClientHello up to the binders, so the
+	// extension is first added with a placeholder of the right length
+	session := cs.session
+	hash := cipherSuiteMap[session.cipherSuite].hash
+	age := uint32(time.Since(session.issuedAt) / time.Millisecond)
+	psk := &preSharedKeyExtension{
+		identities: []pskIdentity{{identity: cs.ticket, obfuscatedTicketAge: age + session.ticketAgeAdd}},
+		binders:    [][]byte{make([]byte, hash.Size())},
+	}
+	err := ch.extensions.Add(psk)
+	if err != nil {
+		return err
+	}
+
+	chm, err := handshakeMessageFromBody(ch)
+	if err != nil {
+		return err
+	}
+	truncated := chm.Marshal()
+	truncated = truncated[:len(truncated)-psk.bindersLen()]
+	psk.binders[0] = computePSKBinder(hash, session.psk, prefix, truncated)
+
+	ch.extensions = ch.extensions[:len(ch.extensions)-1]
+	return ch.extensions.Add(psk)
+}
+
+// acceptSession looks for a session that the client offered and that can be
+// resumed with the parameters negotiated so far.  It returns the session and
+// the server's pre_shared_key extension, or nil if the handshake can't be
+// resumed.  After a HelloRetryRequest, prefix holds the messages that precede
+// the ClientHello in the transcript.
+func (c *Conn) acceptSession(ch *clientHelloBody, chm *handshakeMessage, suite cipherSuite, prefix []*handshakeMessage) (*sessionState, *preSharedKeyExtension, error) {
+	offered := &preSharedKeyExtension{}
+	found, err := ch.extensions.Parse(offered)
+	if !found {
+		return nil, nil, nil
+	}
+	if err != nil {
+		logf(logTypeHandshake, "Error processing pre_shared_key: %v", err)
+		return nil, nil, alertDecodeError
+	}
+	if ch.extensions[len(ch.extensions)-1].extensionType != extensionTypePreSharedKey {
+		logf(logTypeHandshake, "pre_shared_key is not the last extension")
+		return nil, nil, alertIllegalParameter
+	}
+
+	// We only resume with a fresh key exchange
+	modes := &pskKeyExchangeModesExtension{}
+	if !ch.extensions.Find(modes) {
+		logf(logTypeHandshake, "pre_shared_key without psk_key_exchange_modes")
+		return nil, nil, alertMissingExtension
+	}
+	if !includesMode(modes.modes, pskModeDHEKE) {
+		return nil, nil, nil
+	}
+
+	hash := cipherSuiteMap[suite].hash
+	for i, id := range offered.identities {
+		session, ok := c.config.openTicket(id.identity)
+		if !ok {
+			logf(logTypeHandshake, "Ignoring a ticket that we can't open")
+			continue
+		}
+		if session.expired(time.Now()) || session.serverName != c.state.ServerName ||
+			session.alpn != c.state.NegotiatedProtocol || cipherSuiteMap[session.cipherSuite].hash != hash ||
+			!c.sessionAuthenticatesClient(session) {
+			logf(logTypeHandshake, "Ignoring a session that can't be resumed here")
+			zeroBytes(session.psk)
+			continue
+		}
+
+		// Only the binder for the session we accept is checked, but it has to
+		// be right
+		truncated := chm.Marshal()
+		truncated = truncated[:len(truncated)-offered.bindersLen()]
+		binder := computePSKBinder(hash, session.psk, prefix, truncated)
+		if !hmac.Equal(binder, offered.binders[i]) {
+			logf(logTypeHandshake, "PSK binder failed to verify")
+			zeroBytes(session.psk)
+			return nil, nil, alertDecryptError
+		}
+		return session, &preSharedKeyExtension{roleIsServer: true, selectedIdentity: uint16(i)}, nil
+	}
+	return nil, nil, nil
+}
+
+// sessionAuthenticatesClient checks that a session carries the client
+// authentication that this server asks for, since the client doesn't send its
+// certificate again when it resumes.  The chain in the session is checked as
+// if it had just been sent, so that a ticket issued under a laxer policy, or
+// by another server with the same ticket key, can't stand in for it.
+func (c *Conn) sessionAuthenticatesClient(session *sessionState) bool {
+	if c.config.ClientAuth == NoClientCert {
+		return true
+	}
+	if len(session.clientCertificates) == 0 {
+		return c.config.ClientAuth != RequireAndVerifyClientCert
+	}
+
+	err := c.config.verifyClientCertificateChain(session.clientCertificates)
+	if err != nil {
+		logf(logTypeHandshake, "Client certificate in session rejected: %v", err)
+		return false
+	}
+	return true
+}
+
+func includesMode(modes []pskKeyExchangeMode, mode pskKeyExchangeMode) bool {
+	for _, m := range modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// newSessionTicket makes a ticket for resuming this connection
+func (c *Conn) newSessionTicket() (*handshakeMessage, error) {
+	nst := &newSessionTicketBody{
+		ticketLifetime: uint32(defaultTicketLifetime / time.Second),
+		ticketNonce:    make([]byte, ticketNonceLen),
+	}
+	_, err := io.ReadFull(c.config.draw("ticket nonce"), nst.ticketNonce)
+	if err != nil {
+		return nil, err
+	}
+	ageAdd := make([]byte, 4)
+	_, err = io.ReadFull(c.config.draw("ticket age add"), ageAdd)
+	if err != nil {
+		return nil, err
+	}
+	nst.ticketAgeAdd = (uint32(ageAdd[0]) << 24) + (uint32(ageAdd[1]) << 16) + (uint32(ageAdd[2]) << 8) + uint32(ageAdd[3])
+	if c.config.MaxEarlyData > 0 {
+		err = nst.extensions.Add(&earlyDataExtension{inTicket: true, maxEarlyDataSize: c.config.MaxEarlyData})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	session := sessionState{
+		cipherSuite:  c.state.CipherSuite,
+		psk:          c.context.resumptionPSK(nst.ticketNonce),
+		serverName:   c.state.ServerName,
+		alpn:         c.state.NegotiatedProtocol,
+		issuedAt:     time.Now(),
+		lifetime:     defaultTicketLifetime,
+		ticketAgeAdd: nst.ticketAgeAdd,
+		maxEarlyData: c.config.MaxEarlyData,
+
+		clientCertificates: c.state.PeerCertificates,
+	}
+	nst.ticket, err = c.config.sealTicket(session)
+	zeroBytes(session.psk)
+	if err != nil {
+		return nil, err
+	}
+	return handshakeMessageFromBody(nst)
+}
+
+// sendSessionTicket issues a session ticket and writes it to the client.
+func (c *Conn) sendSessionTicket() error {
+	nstm, err := c.newSessionTicket()
+	if err != nil {
+		return err
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+	return newHandshakeLayer(c.out).WriteMessage(nstm)
+}
+
+// SendNewSessionTicket issues another session ticket after the handshake,
+// and sends it right away.  This is only allowed on the server side, and
+// only if the client can resume with a ticket, so that a client can be
+// handed a fresh ticket without reconnecting.
+func (c *Conn) SendNewSessionTicket() error {
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	if c.isClient {
+		return fmt.Errorf("tls.client: Only a server can send a session ticket")
+	}
+	if !c.ticketsAllowed {
+		return fmt.Errorf("tls.server: Client can't resume with a session ticket")
+	}
+	if err := c.fatalError(); err != nil {
+		return err
+	}
+
+	return c.setFatalError(c.sendSessionTicket())
+}
+
+// readNewSessionTicket stores a ticket from the server in the session cache,
+// unless tickets are disabled or this connection has stored enough of them.
+// c.in.Mutex <= L.
+func (c *Conn) readNewSessionTicket(nstm *handshakeMessage) error {
+	nst := new(newSessionTicketBody)
+	read, err := nst.Unmarshal(nstm.body)
+	if err != nil || read < len(nstm.body) {
+		logf(logTypeHandshake, "Error processing NewSessionTicket: %v", err)
+		return alertDecodeError
+	}
+
+	if c.config.SessionTicketsDisabled || c.config.ClientSessionCache == nil {
+		logf(logTypeHandshake, "Ignoring NewSessionTicket")
+		return nil
+	}
+	if c.storedTickets >= c.config.maxStoredTickets() {
+		logf(logTypeHandshake, "Dropping NewSessionTicket beyond the limit of %d", c.config.maxStoredTickets())
+		return nil
+	}
+	if nst.ticketLifetime == 0 {
+		return nil
+	}
+
+	lifetime := time.Duration(nst.ticketLifetime) * time.Second
+	if lifetime > maxTicketLifetime {
+		lifetime = maxTicketLifetime
+	}
+	earlyData := &earlyDataExtension{inTicket: true}
+	found, err := nst.extensions.Parse(earlyData)
+	if found && err != nil {
+		logf(logTypeHandshake, "Error processing early_data in NewSessionTicket: %v", err)
+		return alertDecodeError
+	}
+	cs := &ClientSessionState{
+		ticket: nst.ticket,
+		session: sessionState{
+			cipherSuite:  c.state.CipherSuite,
+			psk:          c.context.resumptionPSK(nst.ticketNonce),
+			serverName:   c.config.ServerName,
+			alpn:         c.state.NegotiatedProtocol,
+			issuedAt:     time.Now(),
+			lifetime:     lifetime,
+			ticketAgeAdd: nst.ticketAgeAdd,
+			maxEarlyData: earlyData.maxEarlyDataSize,
+		},
+	}
+	c.config.ClientSessionCache.Put(c.config.ServerName, cs)
+	c.storedTickets++
+	return nil
+}
+
+// WriteEarlyData queues data for the client to send as early data (0-RTT),
+// with its first flight, if the session that it resumes allows that much.
+// Otherwise, or if the server rejects the early data, the data is sent as
+// ordinary application data as soon as the handshake completes, so it
+// arrives exactly once either way.  ConnectionState.EarlyDataAccepted tells
+// which happened.
+//
+// Early data can be replayed by an attacker, so it should only carry
+// requests that are safe to repeat.  It has to be written before the
+// handshake.
+func (c *Conn) WriteEarlyData(data []byte) (int, error) {
+	if !c.isClient {
+		return 0, fmt.Errorf("tls.server: Only a client can write early data")
+	}
+	c.handshakeMutex.Lock()
+	defer c.unlockHandshake()
+	if c.handshakeComplete || c.handshakeErr != nil {
+		return 0, fmt.Errorf("tls.client: Early data can only be written before the handshake")
+	}
+
+	c.earlyData = append(c.earlyData, data...)
+	return len(data), nil
+}
+
+// sendEarlyData writes the queued early data under keys derived from the
+// session's PSK and the ClientHello.  It returns the record layer that it
+// used, which later carries the EndOfEarlyData message.
+func (c *Conn) sendEarlyData(cs *ClientSessionState, chm *handshakeMessage) (*recordLayer, error) {
+	suite := cs.session.cipherSuite
+	key, iv := earlyTrafficKeys(suite, cs.session.psk, chm)
+	defer zeroBytes(key)
+	defer zeroBytes(iv)
+
+	out := newRecordLayer(c.conn)
+	out.padding = c.config.RecordPadding
+	err := out.Rekey(suite, key, iv)
+	if err != nil {
+		return nil, err
+	}
+
+	for start := 0; start < len(c.earlyData); start += maxFragmentLen {
+		end := start + maxFragmentLen
+		if end > len(c.earlyData) {
+			end = len(c.earlyData)
+		}
+		err = out.WriteRecord(&tlsPlaintext{
+			contentType: recordTypeApplicationData,
+			fragment:    c.earlyData[start:end],
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	logf(logTypeHandshake, "Sent %d bytes of early data", len(c.earlyData))
+	return out, nil
+}
+
+// acceptEarlyData decides whether to accept the early data that came with a
+// resumed session.  It has to be sent for the first session offered and
+// under the same suite, and mustn't have been seen before.
+func (c *Conn) acceptEarlyData(session *sessionState, selected *preSharedKeyExtension, suite cipherSuite, chm *handshakeMessage) bool {
+	if c.config.MaxEarlyData == 0 || c.datagram {
+		return false
+	}
+	if selected.selectedIdentity != 0 || session.maxEarlyData == 0 || session.cipherSuite != suite {
+		logf(logTypeHandshake, "Rejecting early data that the session doesn't allow")
+		return false
+	}
+
+	if c.config.EarlyDataReplayCheck != nil {
+		h := cipherSuiteMap[suite].hash.New()
+		h.Write(chm.Marshal())
+		if c.config.EarlyDataReplayCheck(h.Sum(nil)) {
+			logf(logTypeHandshake, "Rejecting replayed early data")
+			return false
+		}
+	}
+	return true
+}
+
+// readEarlyData reads the client's early data into the read buffer, where it
+// is returned by Read once the handshake is complete, up to the
+// EndOfEarlyData message that ends it.
+func (c *Conn) readEarlyData(hIn *handshakeLayer) (*handshakeMessage, error) {
+	hIn.earlyData = func(data []byte) error {
+		if len(c.readBuffer)+len(data) > int(c.config.MaxEarlyData) {
+			logf(logTypeHandshake, "Client sent more than %d bytes of early data", c.config.MaxEarlyData)
+			return alertUnexpectedMessage
+		}
+		c.readBuffer = append(c.readBuffer, data...)
+		return nil
+	}
+	defer func() { hIn.earlyData = nil }()
+
+	eoedm, err := hIn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if eoedm.msgType != handshakeTypeEndOfEarlyData {
+		logf(logTypeHandshake, "Expected EndOfEarlyData, got message type %v", eoedm.msgType)
+		return nil, alertUnexpectedMessage
+	}
+	_, err = new(endOfEarlyDataBody).Unmarshal(eoedm.body)
+	if err != nil {
+		logf(logTypeHandshake, "Error processing EndOfEarlyData: %v", err)
+		return nil, alertDecodeError
+	}
+	logf(logTypeHandshake, "Read %d bytes of early data", len(c.readBuffer))
+	return eoedm, nil
+}
+
+// earlyDataSkipLimit is how much rejected early data a server skips before
+// it treats records that it can't decrypt as an error.  Protected records
+// are longer than the data they carry, so this is twice the larger of
+// MaxEarlyData and a full record.
+func (c Config) earlyDataSkipLimit() int {
+	limit := int(c.MaxEarlyData)
+	if limit < maxFragmentLen {
+		limit = maxFragmentLen
+	}
+	return 2 * limit
+}
@@ -0,0 +1,785 @@
+package mint
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// receiveTickets has the server send a byte of application data after the
+// tickets that it issued, and has the client read up to it
+func receiveTickets(t *testing.T, client, server *Conn) {
+	done := make(chan error, 1)
+	go func() {
+		_, err := server.Write([]byte{0})
+		done <- err
+	}()
+	// A Read that only consumes handshake records returns nothing
+	n, err := 0, error(nil)
+	for n == 0 && err == nil {
+		n, err = client.Read(make([]byte, 1))
+	}
+	assertNotError(t, err, "Client failed to read tickets")
+	assertNotError(t, <-done, "Server failed to send tickets")
+}
+
+// countingSessionCache counts the sessions that are stored in it
+type countingSessionCache struct {
+	ClientSessionCache
+	puts int
+}
+
+func (c *countingSessionCache) Put(sessionKey string, cs *ClientSessionState) {
+	c.puts++
+	c.ClientSessionCache.Put(sessionKey, cs)
+}
+
+func TestSessionResumption(t *testing.T) {
+	cache := NewLRUClientSessionCache(0)
+	clientConfig := &Config{ClientSessionCache: cache, NextProtos: []string{"h2"}}
+	serverConfig := &Config{NextProtos: []string{"h2"}}
+
+	// Test that a full handshake leaves a ticket in the cache
+	client, server, clientErr, serverErr := handshakeOverPipe(clientConfig, serverConfig)
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assert(t, !client.ConnectionState().DidResume, "Client resumed without a ticket")
+	_, ok := cache.Get("example.com")
+	assert(t, !ok, "Client stored a ticket before the server sent one")
+	receiveTickets(t, client, server)
+	cs, ok := cache.Get("example.com")
+	assert(t, ok, "Client did not store the ticket")
+	assertEquals(t, cs.session.serverName, "example.com")
+	assertEquals(t, cs.session.alpn, "h2")
+
+	// Test that the next handshake resumes with the ticket, without the
+	// server's certificate, and that the session works
+	client, server, clientErr, serverErr = handshakeOverPipe(clientConfig, serverConfig)
+	assertNotError(t, clientErr, "Client failed resumed handshake")
+	assertNotError(t, serverErr, "Server failed resumed handshake")
+	assert(t, client.ConnectionState().DidResume, "Client did not resume")
+	assert(t, server.ConnectionState().DidResume, "Server did not resume")
+	assertEquals(t, len(client.ConnectionState().PeerCertificates), 0)
+	assertEquals(t, client.ConnectionState().NegotiatedProtocol, "h2")
+	assert(t, client.ConnectionSummary().Resumed, "Summary does not show resumption")
+	receiveTickets(t, client, server)
+
+	// Test that a session can also be resumed after a HelloRetryRequest
+	retryConfig := &Config{
+		ClientSessionCache: cache,
+		NextProtos:         []string{"h2"},
+		Groups:             []namedGroup{namedGroupP256, namedGroupX25519},
+		KeyShareCount:      1,
+	}
+	client, server, clientErr, serverErr = handshakeOverPipe(retryConfig,
+		&Config{NextProtos: []string{"h2"}, Groups: []namedGroup{namedGroupX25519}})
+	assertNotError(t, clientErr, "Client failed resumed handshake after HelloRetryRequest")
+	assertNotError(t, serverErr, "Server failed resumed handshake after HelloRetryRequest")
+	assertEquals(t, client.ConnectionState().HandshakeRoundTrips, 2)
+	assert(t, client.ConnectionState().DidResume, "Client did not resume after HelloRetryRequest")
+	assert(t, server.ConnectionState().DidResume, "Server did not resume after HelloRetryRequest")
+}
+
+func TestSessionTicketFromReadingServer(t *testing.T) {
+	// Test that a server that only reads still issues its ticket when the
+	// handshake completes
+	cache := NewLRUClientSessionCache(0)
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{ClientSessionCache: cache}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+
+	go client.Write([]byte{1})
+	_, err := server.Read(make([]byte, 1))
+	assertNotError(t, err, "Server failed to read")
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	for err == nil {
+		_, err = client.Read(make([]byte, 1))
+	}
+	assert(t, isTimeout(err), "Client read something other than the ticket")
+	_, ok := cache.Get("example.com")
+	assert(t, ok, "Client did not store the ticket")
+}
+
+func TestSessionResumptionParameters(t *testing.T) {
+	cache := NewLRUClientSessionCache(0)
+	client, server, clientErr, serverErr := handshakeOverPipe(
+		&Config{ServerName: "a.example", InsecureSkipVerify: true, ClientSessionCache: cache, NextProtos: []string{"h2"}},
+		&Config{NextProtos: []string{"h2"}})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	receiveTickets(t, client, server)
+	cs, ok := cache.Get("a.example")
+	assert(t, ok, "Client did not store the ticket")
+
+	// Test that a session for one server is not offered to another, even if
+	// the cache returns it
+	cache.Put("b.example", cs)
+	client, server, clientErr, serverErr = handshakeOverPipe(
+		&Config{ServerName: "b.example", InsecureSkipVerify: true, ClientSessionCache: cache, NextProtos: []string{"h2"}},
+		&Config{NextProtos: []string{"h2"}})
+	assertNotError(t, clientErr, "Client failed handshake with another server")
+	assertNotError(t, serverErr, "Server failed handshake with another server")
+	assert(t, !server.ConnectionState().DidResume, "Session was resumed with another server")
+
+	// Test that the server doesn't resume a session for another protocol
+	client, server, clientErr, serverErr = handshakeOverPipe(
+		&Config{ServerName: "a.example", InsecureSkipVerify: true, ClientSessionCache: cache, NextProtos: []string{"h2", "http/1.1"}},
+		&Config{NextProtos: []string{"http/1.1"}})
+	assertNotError(t, clientErr, "Client failed handshake with another protocol")
+	assertNotError(t, serverErr, "Server failed handshake with another protocol")
+	assert(t, !client.ConnectionState().DidResume, "Session was resumed with another protocol")
+	assertEquals(t, client.ConnectionState().NegotiatedProtocol, "http/1.1")
+
+	// Test that an expired session is not offered
+	expired := *cs
+	expired.session.issuedAt = time.Now().Add(-2 * expired.session.lifetime)
+	cache.Put("a.example", &expired)
+	client, server, clientErr, serverErr = handshakeOverPipe(
+		&Config{ServerName: "a.example", InsecureSkipVerify: true, ClientSessionCache: cache, NextProtos: []string{"h2"}},
+		&Config{NextProtos: []string{"h2"}})
+	assertNotError(t, clientErr, "Client failed handshake with an expired session")
+	assertNotError(t, serverErr, "Server failed handshake with an expired session")
+	assert(t, !server.ConnectionState().DidResume, "Expired session was resumed")
+}
+
+func TestSessionResumptionBadBinder(t *testing.T) {
+	cache := NewLRUClientSessionCache(0)
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{ClientSessionCache: cache}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	receiveTickets(t, client, server)
+
+	// Test that the server aborts if the client doesn't know the PSK for the
+	// ticket it offers
+	cs, _ := cache.Get("example.com")
+	forged := *cs
+	forged.session.psk = make([]byte, len(cs.session.psk))
+	cache.Put("example.com", &forged)
+
+	cConn, sConn := net.Pipe()
+	client = Client(cConn, &Config{ServerName: "example.com", InsecureSkipVerify: true, ClientSessionCache: cache})
+	server = Server(sConn, &Config{})
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Handshake()
+		sConn.Close()
+	}()
+
+	err := client.Handshake()
+	alertErr, ok := err.(*AlertError)
+	assert(t, ok, fmt.Sprintf("Client did not receive an alert: %v", err))
+	assertEquals(t, alert(alertErr.Alert), alertDecryptError)
+	err = <-done
+	assertError(t, err, "Server accepted a bad binder")
+	assertEquals(t, err.(*net.OpError).Err, error(alertDecryptError))
+}
+
+func TestSessionResumptionWithCertificate(t *testing.T) {
+	cache := NewLRUClientSessionCache(0)
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{ClientSessionCache: cache}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	receiveTickets(t, client, server)
+
+	priv, err := newSigningKey(signatureAlgorithmECDSA)
+	assertNotError(t, err, "Failed to generate key")
+	alg := signatureAndHashAlgorithm{hashAlgorithmSHA256, signatureAlgorithmECDSA}
+	cert, err := newSelfSigned("example.com", alg, priv)
+	assertNotError(t, err, "Failed to generate certificate")
+
+	// Test that a client checks the certificate that a server sends with a
+	// resumed session, and aborts if its CertificateVerify is bad
+	for _, badSig := range []bool{false, true} {
+		c2s := pipe()
+		s2c := pipe()
+		client := &Conn{
+			config:   &Config{ServerName: "example.com", InsecureSkipVerify: true, ClientSessionCache: cache},
+			isClient: true,
+			in:       newRecordLayer(s2c),
+			out:      newRecordLayer(c2s),
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- client.Handshake()
+		}()
+
+		// Play a server that resumes the session, but also authenticates
+		// with its certificate
+		in, out := newRecordLayer(c2s), newRecordLayer(s2c)
+		hOut := newHandshakeLayer(out)
+		ch := new(clientHelloBody)
+		chm, err := newHandshakeLayer(in).ReadMessageBody(ch)
+		assertNotError(t, err, "Failed to read ClientHello")
+		offered := &preSharedKeyExtension{}
+		found, err := ch.extensions.Parse(offered)
+		assert(t, found && err == nil, "ClientHello has no pre_shared_key")
+		session, ok := (&Config{}).openTicket(offered.identities[0].identity)
+		assert(t, ok, "Failed to open the offered ticket")
+
+		clientShares := keyShareExtension{roleIsServer: false}
+		assert(t, ch.extensions.Find(&clientShares), "ClientHello has no key_share")
+		share := clientShares.shares[0]
+		pub, shPriv, err := newKeyShare(share.group, prng)
+		assertNotError(t, err, "Failed to generate key share")
+		ES, err := keyAgreement(share.group, share.keyExchange, shPriv)
+		assertNotError(t, err, "Failed key agreement")
+
+		sh := &serverHelloBody{cipherSuite: session.cipherSuite}
+		sv := supportedVersionsExtension{roleIsServer: true, versions: []uint16{tls13Version}}
+		assertNotError(t, sh.extensions.Add(&sv), "Failed to add supported_versions")
+		ks := keyShareExtension{
+			roleIsServer: true,
+			shares:       []keyShare{keyShare{group: share.group, keyExchange: pub}},
+		}
+		assertNotError(t, sh.extensions.Add(&ks), "Failed to add key_share")
+		assertNotError(t, sh.extensions.Add(&preSharedKeyExtension{roleIsServer: true}), "Failed to add pre_shared_key")
+		shm, err := hOut.WriteMessageBody(sh)
+		assertNotError(t, err, "Failed to send ServerHello")
+
+		var ctx cryptoContext
+		assertNotError(t, ctx.Init(chm, shm, session.psk, ES, sh.cipherSuite), "Failed to init crypto context")
+		in.Rekey(ctx.suite, ctx.handshakeKeys.clientWriteKey, ctx.handshakeKeys.clientWriteIV)
+		out.Rekey(ctx.suite, ctx.handshakeKeys.serverWriteKey, ctx.handshakeKeys.serverWriteIV)
+
+		eem, _ := handshakeMessageFromBody(&encryptedExtensionsBody{})
+		certm, _ := handshakeMessageFromBody(&certificateBody{certificateList: []*x509.Certificate{cert}})
+		signed := append(append([]*handshakeMessage{}, ctx.transcript...), eem, certm)
+		if badSig {
+			signed = signed[1:]
+		}
+		cv := &certificateVerifyBody{alg: alg}
+		assertNotError(t, cv.Sign(priv, signed, contextServerCertificateVerify), "Failed to sign CertificateVerify")
+		cvm, _ := handshakeMessageFromBody(cv)
+		flight := []*handshakeMessage{eem, certm, cvm}
+		ctx.Update(flight)
+		finm, _ := handshakeMessageFromBody(ctx.serverFinished)
+		assertNotError(t, hOut.WriteMessages(append(flight, finm)), "Failed to send flight")
+
+		if badSig {
+			pt, err := in.ReadRecord()
+			assertNotError(t, err, "Failed to read the client's alert")
+			assertByteEquals(t, pt.fragment, []byte{alertLevelError, byte(alertDecryptError)})
+			assertError(t, <-done, "Client accepted a bad CertificateVerify with a resumed session")
+			continue
+		}
+
+		_, err = newHandshakeLayer(in).ReadMessage()
+		assertNotError(t, err, "Failed to read the client's Finished")
+		assertNotError(t, <-done, "Client failed resumed handshake with a certificate")
+		assert(t, client.ConnectionState().DidResume, "Client did not resume")
+		assertEquals(t, len(client.ConnectionState().PeerCertificates), 1)
+	}
+}
+
+func TestSessionResumptionWithClientAuth(t *testing.T) {
+	clientCert := newClientCertificate(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert.Chain[0])
+	serverConfig := &Config{ClientAuth: RequireAndVerifyClientCert, ClientCAs: clientCAs}
+
+	// Test that a session resumed with a server that requires client
+	// certificates carries the chain that the client authenticated with
+	cache := NewLRUClientSessionCache(0)
+	clientConfig := &Config{ClientSessionCache: cache, Certificates: []Certificate{clientCert}}
+	client, server, clientErr, serverErr := handshakeOverPipe(clientConfig, serverConfig)
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	receiveTickets(t, client, server)
+
+	client, server, clientErr, serverErr = handshakeOverPipe(clientConfig, serverConfig)
+	assertNotError(t, clientErr, "Client failed resumed handshake")
+	assertNotError(t, serverErr, "Server failed resumed handshake")
+	state := server.ConnectionState()
+	assert(t, state.DidResume, "Server did not resume")
+	assert(t, state.ClientAuthenticated, "Client not authenticated after resumption")
+	assertEquals(t, len(state.PeerCertificates), 1)
+	assertByteEquals(t, state.PeerCertificates[0].Raw, clientCert.Chain[0].Raw)
+
+	// Test that a session from a server that didn't ask for a certificate,
+	// under the same ticket key, isn't resumed with one that requires it, so
+	// that a client without a certificate is still refused
+	cache = NewLRUClientSessionCache(0)
+	client, server, clientErr, serverErr = handshakeOverPipe(&Config{ClientSessionCache: cache}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	receiveTickets(t, client, server)
+
+	cConn, sConn := net.Pipe()
+	client = Client(cConn, &Config{ServerName: "example.com", InsecureSkipVerify: true, ClientSessionCache: cache})
+	server = Server(sConn, serverConfig)
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Handshake()
+		sConn.Close()
+	}()
+
+	// The client only learns that it was refused when it reads
+	assertNotError(t, client.Handshake(), "Client failed to send its flight")
+	_, err := client.Read(make([]byte, 10))
+	alertErr, ok := err.(*AlertError)
+	assert(t, ok, fmt.Sprintf("Client did not receive an alert: %v", err))
+	assertEquals(t, alert(alertErr.Alert), alertCertificateRequired)
+	assert(t, !client.ConnectionState().DidResume, "Client resumed a session without a client certificate")
+
+	err = <-done
+	assertError(t, err, "Server accepted a client without a certificate")
+	assertEquals(t, err.(*net.OpError).Err, error(alertCertificateRequired))
+	cConn.Close()
+}
+
+func TestSessionTicketsDisabled(t *testing.T) {
+	cache := &countingSessionCache{ClientSessionCache: NewLRUClientSessionCache(0)}
+
+	// Test that a client with tickets disabled doesn't ask for them, so the
+	// server doesn't issue any
+	client, server, clientErr, serverErr := handshakeOverPipe(
+		&Config{ClientSessionCache: cache, SessionTicketsDisabled: true}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assert(t, !server.ticketsAllowed, "Server issues tickets to a client that disabled them")
+
+	// Test that a server with tickets disabled doesn't issue any
+	client, server, clientErr, serverErr = handshakeOverPipe(
+		&Config{ClientSessionCache: cache}, &Config{SessionTicketsDisabled: true})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	receiveTickets(t, client, server)
+	assertEquals(t, cache.puts, 0)
+
+	// Test that a client with tickets disabled drops any that it is sent,
+	// and doesn't offer the ones it has
+	client, server, clientErr, serverErr = handshakeOverPipe(&Config{ClientSessionCache: cache}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	client.config.SessionTicketsDisabled = true
+	receiveTickets(t, client, server)
+	assertEquals(t, cache.puts, 0)
+
+	client, server, clientErr, serverErr = handshakeOverPipe(&Config{ClientSessionCache: cache}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	receiveTickets(t, client, server)
+	assertEquals(t, cache.puts, 1)
+	client, server, clientErr, serverErr = handshakeOverPipe(
+		&Config{ClientSessionCache: cache, SessionTicketsDisabled: true}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assert(t, !server.ConnectionState().DidResume, "Client with tickets disabled resumed")
+
+	// Test that a server with tickets disabled doesn't resume sessions
+	client, server, clientErr, serverErr = handshakeOverPipe(
+		&Config{ClientSessionCache: cache}, &Config{SessionTicketsDisabled: true})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assert(t, !client.ConnectionState().DidResume, "Server with tickets disabled resumed")
+}
+
+func TestMaxStoredTickets(t *testing.T) {
+	for _, test := range []struct {
+		max, stored int
+	}{
+		{0, defaultMaxStoredTickets},
+		{2, 2},
+	} {
+		cache := NewLRUClientSessionCache(0)
+		client, server, clientErr, serverErr := handshakeOverPipe(
+			&Config{ClientSessionCache: cache, MaxStoredTickets: test.max}, &Config{})
+		assertNotError(t, clientErr, "Client failed handshake")
+		assertNotError(t, serverErr, "Server failed handshake")
+
+		// Test that each ticket up to the limit replaces the stored one, and
+		// that tickets beyond it are dropped
+		var last []byte
+		for i := 0; i < 10; i++ {
+			if i > 0 {
+				assertNotError(t, server.SendNewSessionTicket(), "Failed to send a ticket")
+			}
+			receiveTickets(t, client, server)
+			cs, ok := cache.Get("example.com")
+			assert(t, ok, "Client did not store a ticket")
+			assertEquals(t, !bytes.Equal(cs.ticket, last), i < test.stored)
+			last = cs.ticket
+		}
+	}
+}
+
+func TestSendNewSessionTicket(t *testing.T) {
+	cache := &countingSessionCache{ClientSessionCache: NewLRUClientSessionCache(0)}
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{ClientSessionCache: cache}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	receiveTickets(t, client, server)
+	assertEquals(t, cache.puts, 1)
+	first, _ := cache.Get("example.com")
+
+	// Test that a ticket sent on demand is stored by the client, in place of
+	// the one it was issued with the handshake
+	done := make(chan error, 1)
+	go func() {
+		err := server.SendNewSessionTicket()
+		if err == nil {
+			_, err = server.Write([]byte{0})
+		}
+		done <- err
+	}()
+	n, err := 0, error(nil)
+	for n == 0 && err == nil {
+		n, err = client.Read(make([]byte, 1))
+	}
+	assertNotError(t, err, "Client failed to read the ticket")
+	assertNotError(t, <-done, "Server failed to send a ticket")
+	assertEquals(t, cache.puts, 2)
+	second, _ := cache.Get("example.com")
+	assert(t, !bytes.Equal(second.ticket, first.ticket), "Client did not store the new ticket")
+
+	// Test that the new ticket can be used to resume
+	client, _, clientErr, serverErr = handshakeOverPipe(&Config{ClientSessionCache: cache}, &Config{})
+	assertNotError(t, clientErr, "Client failed to resume")
+	assertNotError(t, serverErr, "Server failed to resume")
+	assert(t, client.ConnectionState().DidResume, "Client did not resume with the new ticket")
+
+	// Test that only a server can send a ticket
+	err = client.SendNewSessionTicket()
+	assertError(t, err, "Client sent a session ticket")
+
+	// Test that a client that can't use tickets isn't sent any
+	_, server, clientErr, serverErr = handshakeOverPipe(&Config{SessionTicketsDisabled: true}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	err = server.SendNewSessionTicket()
+	assertError(t, err, "Server sent a ticket to a client that can't use it")
+}
+
+func TestClientSessionStateMarshalUnmarshal(t *testing.T) {
+	cache := NewLRUClientSessionCache(0)
+	client, server, clientErr, serverErr := handshakeOverPipe(&Config{ClientSessionCache: cache}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	receiveTickets(t, client, server)
+	cs, _ := cache.Get("example.com")
+
+	// Test that a session survives a round trip through its encoding
+	data, err := cs.MarshalBinary()
+	assertNotError(t, err, "Failed to marshal session")
+	restored := &ClientSessionState{}
+	err = restored.UnmarshalBinary(data)
+	assertNotError(t, err, "Failed to unmarshal session")
+	assertByteEquals(t, restored.ticket, cs.ticket)
+	assertByteEquals(t, restored.session.psk, cs.session.psk)
+	assertEquals(t, restored.session.cipherSuite, cs.session.cipherSuite)
+	assertEquals(t, restored.session.serverName, cs.session.serverName)
+	assertEquals(t, restored.session.ticketAgeAdd, cs.session.ticketAgeAdd)
+	assertEquals(t, restored.session.lifetime, cs.session.lifetime)
+	assert(t, restored.session.issuedAt.Sub(cs.session.issuedAt) < time.Millisecond,
+		"Session changed its issue time")
+
+	// Test that the restored session can be resumed
+	restoredCache := NewLRUClientSessionCache(0)
+	restoredCache.Put("example.com", restored)
+	client, server, clientErr, serverErr = handshakeOverPipe(&Config{ClientSessionCache: restoredCache}, &Config{})
+	assertNotError(t, clientErr, "Client failed resumed handshake")
+	assertNotError(t, serverErr, "Server failed resumed handshake")
+	assert(t, client.ConnectionState().DidResume, "Client did not resume a restored session")
+
+	// Test unmarshal failures
+	err = restored.UnmarshalBinary(data[:1])
+	assertError(t, err, "Unmarshaled a session too short for the ticket length")
+	err = restored.UnmarshalBinary(data[:len(cs.ticket)])
+	assertError(t, err, "Unmarshaled a session with a truncated ticket")
+	err = restored.UnmarshalBinary(data[:len(data)-1])
+	assertError(t, err, "Unmarshaled a truncated session")
+	err = restored.UnmarshalBinary(append(data, 0))
+	assertError(t, err, "Unmarshaled a session with extra data")
+
+	// Test that a ticket sealed under another key can't be opened
+	_, ok := (&Config{}).openTicket(cs.ticket)
+	assert(t, ok, "Failed to open a ticket")
+	_, ok = (&Config{SessionTicketKey: [32]byte{1}}).openTicket(cs.ticket)
+	assert(t, !ok, "Opened a ticket sealed under another key")
+}
+
+func TestLRUClientSessionCache(t *testing.T) {
+	cache := NewLRUClientSessionCache(2)
+	a, b, c := &ClientSessionState{}, &ClientSessionState{}, &ClientSessionState{}
+
+	// Test that the least recently used session is evicted
+	cache.Put("a", a)
+	cache.Put("b", b)
+	got, ok := cache.Get("a")
+	assert(t, ok && got == a, "Failed to get a session")
+	cache.Put("c", c)
+	_, ok = cache.Get("b")
+	assert(t, !ok, "Least recently used session was not evicted")
+	got, ok = cache.Get("c")
+	assert(t, ok && got == c, "Failed to get a new session")
+
+	// Test that a session replaces an earlier one for the same key
+	cache.Put("a", b)
+	got, ok = cache.Get("a")
+	assert(t, ok && got == b, "Session was not replaced")
+}
+
+// handshakeWithEarlyData runs a handshake in which the client sends the given
+// early data.  The client writes its early data while the server writes its
+// flight, so this needs a real connection rather than a pipe.
+func handshakeWithEarlyData(t *testing.T, clientConfig, serverConfig *Config, data []byte) (*Conn, *Conn, error, error) {
+	listener := newLocalListener(t)
+	defer listener.Close()
+
+	var server *Conn
+	done := make(chan error, 1)
+	go func() {
+		sConn, err := listener.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		server = Server(sConn, serverConfig)
+		err = server.Handshake()
+		if err != nil {
+			sConn.Close()
+		}
+		done <- err
+	}()
+
+	cConn, err := net.Dial("tcp", listener.Addr().String())
+	assertNotError(t, err, "Failed to dial the server")
+	client := Client(cConn, clientConfig)
+	_, err = client.WriteEarlyData(data)
+	assertNotError(t, err, "Failed to write early data")
+	clientErr := client.Handshake()
+	if clientErr != nil {
+		cConn.Close()
+	}
+	serverErr := <-done
+	return client, server, clientErr, serverErr
+}
+
+// readFull reads exactly len(buffer) bytes from the connection
+func readFull(t *testing.T, conn *Conn, buffer []byte) {
+	read := 0
+	for read < len(buffer) {
+		n, err := conn.Read(buffer[read:])
+		assertNotError(t, err, "Failed to read application data")
+		read += n
+	}
+}
+
+// earlyDataSession leaves a ticket from a server that allows early data in
+// the cache
+func earlyDataSession(t *testing.T, cache ClientSessionCache, nextProtos []string) {
+	client, server, clientErr, serverErr := handshakeOverPipe(
+		&Config{ClientSessionCache: cache, NextProtos: nextProtos},
+		&Config{MaxEarlyData: 1024, NextProtos: nextProtos})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	receiveTickets(t, client, server)
+	cs, ok := cache.Get("example.com")
+	assert(t, ok, "Client did not store the ticket")
+	assertEquals(t, cs.session.maxEarlyData, uint32(1024))
+}
+
+func TestEarlyData(t *testing.T) {
+	cache := NewLRUClientSessionCache(0)
+	earlyDataSession(t, cache, nil)
+	data := []byte("GET / HTTP/1.1\r\n\r\n")
+
+	// Test that the server accepts the early data, and that it arrives ahead
+	// of the rest of the client's flight
+	clientConfig := &Config{ServerName: "example.com", ClientSessionCache: cache}
+	client, server, clientErr, serverErr := handshakeWithEarlyData(t, clientConfig, &Config{MaxEarlyData: 1024}, data)
+	assertNotError(t, clientErr, "Client failed handshake with early data")
+	assertNotError(t, serverErr, "Server failed handshake with early data")
+	assert(t, client.ConnectionState().EarlyDataAccepted, "Client did not see its early data accepted")
+	assert(t, server.ConnectionState().EarlyDataAccepted, "Server did not accept early data")
+	assertEquals(t, client.ConnectionState().HandshakeRoundTrips, 0)
+	assertEquals(t, server.ConnectionState().HandshakeRoundTrips, 0)
+	received := make([]byte, len(data))
+	readFull(t, server, received)
+	assertByteEquals(t, received, data)
+
+	// Test that the connection works in both directions afterward
+	_, err := client.Write([]byte{1})
+	assertNotError(t, err, "Client failed to write after early data")
+	readFull(t, server, received[:1])
+	assertEquals(t, received[0], byte(1))
+	_, err = server.Write([]byte{2})
+	assertNotError(t, err, "Server failed to write after early data")
+	readFull(t, client, received[:1])
+	assertEquals(t, received[0], byte(2))
+}
+
+func TestEarlyDataRejected(t *testing.T) {
+	cache := NewLRUClientSessionCache(0)
+	data := []byte("GET / HTTP/1.1\r\n\r\n")
+	cases := map[string]struct {
+		clientConfig *Config
+		serverConfig *Config
+		resumed      bool
+	}{
+		"disabled": {
+			clientConfig: &Config{ServerName: "example.com", ClientSessionCache: cache},
+			serverConfig: &Config{},
+			resumed:      true,
+		},
+		"replayed": {
+			clientConfig: &Config{ServerName: "example.com", ClientSessionCache: cache},
+			serverConfig: &Config{
+				MaxEarlyData:         1024,
+				EarlyDataReplayCheck: func(clientHelloHash []byte) bool { return true },
+			},
+			resumed: true,
+		},
+		"retry": {
+			clientConfig: &Config{
+				ServerName:         "example.com",
+				ClientSessionCache: cache,
+				Groups:             []namedGroup{namedGroupP256, namedGroupX25519},
+				KeyShareCount:      1,
+			},
+			serverConfig: &Config{MaxEarlyData: 1024, Groups: []namedGroup{namedGroupX25519}},
+			resumed:      true,
+		},
+		"not resumed": {
+			clientConfig: &Config{ServerName: "example.com", InsecureSkipVerify: true, ClientSessionCache: cache},
+			serverConfig: &Config{MaxEarlyData: 1024, SessionTicketsDisabled: true},
+			resumed:      false,
+		},
+	}
+
+	// Test that rejected early data is skipped by the server and sent again
+	// after the handshake, so that it arrives exactly once
+	for name, c := range cases {
+		earlyDataSession(t, cache, nil)
+		client, server, clientErr, serverErr := handshakeWithEarlyData(t, c.clientConfig, c.serverConfig, data)
+		assertNotError(t, clientErr, fmt.Sprintf("Client failed handshake [%s]", name))
+		assertNotError(t, serverErr, fmt.Sprintf("Server failed handshake [%s]", name))
+		assertEquals(t, server.ConnectionState().DidResume, c.resumed)
+		assert(t, !client.ConnectionState().EarlyDataAccepted, fmt.Sprintf("Client saw early data accepted [%s]", name))
+		assert(t, !server.ConnectionState().EarlyDataAccepted, fmt.Sprintf("Server accepted early data [%s]", name))
+
+		received := make([]byte, len(data)+1)
+		_, err := client.Write([]byte{1})
+		assertNotError(t, err, fmt.Sprintf("Client failed to write [%s]", name))
+		readFull(t, server, received)
+		assertByteEquals(t, received, append(data, 1))
+	}
+}
+
+// recordingConn keeps a copy of everything written to it
+type recordingConn struct {
+	net.Conn
+	written []byte
+}
+
+func (c *recordingConn) Write(data []byte) (int, error) {
+	c.written = append(c.written, data...)
+	return c.Conn.Write(data)
+}
+
+func TestEarlyDataReplay(t *testing.T) {
+	cache := NewLRUClientSessionCache(0)
+	earlyDataSession(t, cache, nil)
+
+	seen := map[string]bool{}
+	checks := 0
+	serverConfig := &Config{
+		MaxEarlyData: 1024,
+		EarlyDataReplayCheck: func(clientHelloHash []byte) bool {
+			checks++
+			replayed := seen[string(clientHelloHash)]
+			seen[string(clientHelloHash)] = true
+			return replayed
+		},
+	}
+
+	// Record a handshake in which the server accepts early data
+	listener := newLocalListener(t)
+	defer listener.Close()
+	var server *Conn
+	done := make(chan error, 1)
+	go func() {
+		sConn, err := listener.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		server = Server(sConn, serverConfig)
+		done <- server.Handshake()
+	}()
+	cConn, err := net.Dial("tcp", listener.Addr().String())
+	assertNotError(t, err, "Failed to dial the server")
+	recorder := &recordingConn{Conn: cConn}
+	client := Client(recorder, &Config{ServerName: "example.com", InsecureSkipVerify: true, ClientSessionCache: cache})
+	_, err = client.WriteEarlyData([]byte("early"))
+	assertNotError(t, err, "Failed to write early data")
+	assertNotError(t, client.Handshake(), "Client failed handshake")
+	assertNotError(t, <-done, "Server failed handshake")
+	assert(t, server.ConnectionState().EarlyDataAccepted, "Server did not accept early data")
+
+	// Test that the same bytes replayed to the server don't get the early
+	// data accepted a second time
+	replayConn, err := net.Dial("tcp", listener.Addr().String())
+	assertNotError(t, err, "Failed to dial the server")
+	go func() {
+		sConn, err := listener.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		server = Server(sConn, serverConfig)
+		err = server.Handshake()
+		sConn.Close()
+		done <- err
+	}()
+	go io.Copy(ioutil.Discard, replayConn)
+	_, err = replayConn.Write(recorder.written)
+	assertNotError(t, err, "Failed to replay the client's bytes")
+	replayConn.(*net.TCPConn).CloseWrite()
+	assertError(t, <-done, "Server completed a replayed handshake")
+	replayConn.Close()
+	assertEquals(t, checks, 2)
+	assertEquals(t, len(seen), 1)
+	assert(t, !server.ConnectionState().EarlyDataAccepted, "Server accepted replayed early data")
+	assertEquals(t, len(server.readBuffer), 0)
+}
+
+func TestEarlyDataProtocolMismatch(t *testing.T) {
+	cache := NewLRUClientSessionCache(0)
+	earlyDataSession(t, cache, []string{"h2"})
+
+	// Test that the client aborts if the server accepts early data but picks
+	// a different protocol from the one the early data was written for
+	cs, _ := cache.Get("example.com")
+	changed := *cs
+	changed.session.alpn = "h3"
+	cache.Put("example.com", &changed)
+	client, _, clientErr, serverErr := handshakeWithEarlyData(t,
+		&Config{ServerName: "example.com", ClientSessionCache: cache, NextProtos: []string{"h2", "h3"}},
+		&Config{MaxEarlyData: 1024, NextProtos: []string{"h2"}},
+		[]byte("early"))
+	assertError(t, clientErr, "Client accepted early data for another protocol")
+	assertEquals(t, clientErr.(*net.OpError).Err, error(alertIllegalParameter))
+	assertError(t, serverErr, "Server completed handshake after the client's alert")
+	assert(t, !client.ConnectionState().EarlyDataAccepted, "Client saw early data accepted")
+}
+
+func TestWriteEarlyDataErrors(t *testing.T) {
+	// Test that only a client can write early data, and only before the
+	// handshake
+	cConn, sConn := net.Pipe()
+	_, err := Server(sConn, &Config{}).WriteEarlyData([]byte("early"))
+	assertError(t, err, "Server wrote early data")
+
+	client, _, clientErr, serverErr := handshakeOverPipe(&Config{}, &Config{})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	_, err = client.WriteEarlyData([]byte("early"))
+	assertError(t, err, "Client wrote early data after the handshake")
+	cConn.Close()
+}
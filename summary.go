@@ -0,0 +1,103 @@
+package mint
+
+import (
+	"fmt"
+	"strings"
+)
+
+var versionText = map[uint16]string{
+	tls12Version:  "TLS1.2",
+	tls13Version:  "TLS1.3",
+	dtls13Version: "DTLS1.3",
+}
+
+var cipherSuiteText = map[cipherSuite]string{
+	TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:       "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:         "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:       "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256: "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+	TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:         "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256:   "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+}
+
+var namedGroupText = map[namedGroup]string{
+	namedGroupP256:   "P-256",
+	namedGroupP384:   "P-384",
+	namedGroupP521:   "P-521",
+	namedGroupX25519: "X25519",
+	namedGroupX448:   "X448",
+}
+
+func (cs cipherSuite) String() string {
+	s, ok := cipherSuiteText[cs]
+	if ok {
+		return s
+	}
+	return fmt.Sprintf("cipherSuite(0x%04x)", uint16(cs))
+}
+
+func (g namedGroup) String() string {
+	s, ok := namedGroupText[g]
+	if ok {
+		return s
+	}
+	return fmt.Sprintf("namedGroup(%d)", uint16(g))
+}
+
+// ConnectionSummary collects the negotiated parameters of a connection in one
+// place, e.g., for access logs.  It is derived from the ConnectionState.
+type ConnectionSummary struct {
+	Version             uint16
+	CipherSuite         cipherSuite
+	NamedGroup          namedGroup
+	NegotiatedProtocol  string // Empty if ALPN was not used
+	PeerSubject         string // Empty if the peer did not authenticate
+	Resumed             bool   // Whether an earlier session was resumed
+	ClientAuthenticated bool   // Whether a server verified the client's certificate
+}
+
+// ConnectionSummary returns a summary of the negotiated parameters.  Until
+// the handshake has completed, it returns a zero value.
+func (c *Conn) ConnectionSummary() ConnectionSummary {
+	state := c.ConnectionState()
+	summary := ConnectionSummary{
+		Version:             state.Version,
+		CipherSuite:         state.CipherSuite,
+		NamedGroup:          state.NamedGroup,
+		NegotiatedProtocol:  state.NegotiatedProtocol,
+		Resumed:             state.DidResume,
+		ClientAuthenticated: state.ClientAuthenticated,
+	}
+	if len(state.PeerCertificates) > 0 {
+		summary.PeerSubject = state.PeerCertificates[0].Subject.String()
+	}
+	return summary
+}
+
+// String formats the summary as space-separated key=value pairs, with "-"
+// for any value that was not negotiated, so that log lines always have the
+// same fields.
+func (s ConnectionSummary) String() string {
+	version, ok := versionText[s.Version]
+	if !ok {
+		version = fmt.Sprintf("0x%04x", s.Version)
+	}
+
+	fields := []string{
+		"version=" + version,
+		"suite=" + s.CipherSuite.String(),
+		"group=" + s.NamedGroup.String(),
+		"alpn=" + summaryValue(s.NegotiatedProtocol),
+		"peer=" + summaryValue(s.PeerSubject),
+		fmt.Sprintf("resumed=%t", s.Resumed),
+		fmt.Sprintf("clientauth=%t", s.ClientAuthenticated),
+	}
+	return strings.Join(fields, " ")
+}
+
+func summaryValue(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return fmt.Sprintf("%q", value)
+}
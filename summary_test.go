@@ -0,0 +1,48 @@
+package mint
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConnectionSummary(t *testing.T) {
+	client, server, clientErr, serverErr := handshakeOverPipe(
+		&Config{NextProtos: []string{"h2"}},
+		&Config{NextProtos: []string{"h2"}})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+
+	summary := client.ConnectionSummary()
+	assertEquals(t, summary.Version, tls13Version)
+	assertEquals(t, summary.CipherSuite, server.ConnectionSummary().CipherSuite)
+	assertEquals(t, summary.NamedGroup, server.ConnectionSummary().NamedGroup)
+	assertEquals(t, summary.PeerSubject, "CN=example.com")
+
+	line := summary.String()
+	assert(t, strings.Contains(line, "version=TLS1.3"), "Summary missing version: "+line)
+	assert(t, strings.Contains(line, "suite="+summary.CipherSuite.String()), "Summary missing suite: "+line)
+	assert(t, strings.Contains(line, "group=X25519"), "Summary missing group: "+line)
+	assert(t, strings.Contains(line, `alpn="h2"`), "Summary missing ALPN: "+line)
+	assert(t, strings.Contains(line, `peer="CN=example.com"`), "Summary missing peer: "+line)
+	assert(t, strings.Contains(line, "resumed=false"), "Summary missing resumption: "+line)
+	assert(t, strings.Contains(line, "clientauth=false"), "Summary missing client authentication: "+line)
+
+	// The server has no peer certificate, and nothing is known before the
+	// handshake
+	assert(t, strings.Contains(server.ConnectionSummary().String(), "peer=-"), "Server summary has a peer")
+	assertEquals(t, (&Conn{}).ConnectionSummary(), ConnectionSummary{})
+
+	// A server that verified the client's certificate says so
+	_, server, clientErr, serverErr = handshakeOverPipe(
+		&Config{Certificates: []Certificate{newClientCertificate(t)}},
+		&Config{ClientAuth: RequireAndVerifyClientCert})
+	assertNotError(t, clientErr, "Client failed handshake")
+	assertNotError(t, serverErr, "Server failed handshake")
+	assert(t, server.ConnectionSummary().ClientAuthenticated, "Summary does not show client authentication")
+	line = server.ConnectionSummary().String()
+	assert(t, strings.Contains(line, "clientauth=true"), "Summary missing client authentication: "+line)
+
+	// Unknown values are still printed
+	assertEquals(t, cipherSuite(0x1301).String(), "cipherSuite(0x1301)")
+	assertEquals(t, namedGroup(0x1234).String(), "namedGroup(4660)")
+}
@@ -11,8 +11,8 @@ import (
 
 // Server returns a new TLS server side connection
 // using conn as the underlying transport.
-// The configuration config must be non-nil and must include
-// at least one certificate or else set GetCertificate.
+// The configuration config must be non-nil.  Without
+// Certificates or GetCertificate, a self-signed certificate is used.
 func Server(conn net.Conn, config *Config) *Conn {
 	return newConn(conn, config, false)
 }
@@ -28,7 +28,8 @@ func Client(conn net.Conn, config *Config) *Conn {
 // A listener implements a network listener (net.Listener) for TLS connections.
 type listener struct {
 	net.Listener
-	config *Config
+	config         *Config
+	handshakeSlots chan struct{}
 }
 
 // Accept waits for and returns the next incoming TLS connection.
@@ -38,28 +39,31 @@ func (l *listener) Accept() (c net.Conn, err error) {
 	if err != nil {
 		return
 	}
-	c = Server(c, l.config)
+	conn := Server(c, l.config)
+	conn.handshakeSlots = l.handshakeSlots
+	c = conn
 	return
 }
 
 // NewListener creates a Listener which accepts connections from an inner
 // Listener and wraps each connection with Server.
-// The configuration config must be non-nil and must include
-// at least one certificate or else set GetCertificate.
+// The configuration config must be non-nil.
 func NewListener(inner net.Listener, config *Config) net.Listener {
 	l := new(listener)
 	l.Listener = inner
 	l.config = config
+	if config != nil && config.MaxConcurrentHandshakes > 0 {
+		l.handshakeSlots = make(chan struct{}, config.MaxConcurrentHandshakes)
+	}
 	return l
 }
 
 // Listen creates a TLS listener accepting connections on the
 // given network address using net.Listen.
-// The configuration config must be non-nil and must include
-// at least one certificate or else set GetCertificate.
+// The configuration config must be non-nil and valid for a server.
 func Listen(network, laddr string, config *Config) (net.Listener, error) {
 	if config == nil || !config.validForServer() {
-		return nil, errors.New("tls: neither Certificates nor GetCertificate set in Config")
+		return nil, errors.New("tls: invalid server configuration")
 	}
 	l, err := net.Listen(network, laddr)
 	if err != nil {
@@ -1,10 +1,14 @@
 package mint
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -134,6 +138,65 @@ func TestDialTimeout(t *testing.T) {
 // tests that Conn.Read returns (non-zero, io.EOF) instead of
 // (non-zero, nil) when a Close (alertCloseNotify) is sitting right
 // behind the application data in the buffer.
+func TestListenAndDial(t *testing.T) {
+	// Test that an invalid configuration is refused up front
+	_, err := Listen("tcp", "127.0.0.1:0", nil)
+	if err == nil {
+		t.Fatal("Listen accepted a nil configuration")
+	}
+	_, err = Listen("tcp", "127.0.0.1:0", &Config{CipherSuites: []cipherSuite{0xffff}})
+	if err == nil {
+		t.Fatal("Listen accepted a configuration without cipher suites")
+	}
+
+	// Test that a byte goes each way between a connection accepted from
+	// Listen and one from Dial
+	ln, err := Listen("tcp", "127.0.0.1:0", &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	done := make(chan error, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer c.Close()
+		if _, ok := c.(*Conn); !ok {
+			done <- fmt.Errorf("Accept returned a %T", c)
+			return
+		}
+		buf := make([]byte, 1)
+		if _, err = io.ReadFull(c, buf); err != nil {
+			done <- err
+			return
+		}
+		_, err = c.Write(buf)
+		done <- err
+	}()
+
+	conn, err := Dial("tcp", ln.Addr().String(), &Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte{0x42}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf[0] != 0x42 {
+		t.Fatalf("Read %x; want 42", buf[0])
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("Server failed: %v", err)
+	}
+}
+
 func TestConnReadNonzeroAndEOF(t *testing.T) {
 	// This test is racy: it assumes that after a write to a
 	// localhost TCP connection, the peer TCP connection can
@@ -176,7 +239,7 @@ func testConnReadNonzeroAndEOF(t *testing.T, delay time.Duration) error {
 		srvCh <- srv
 	}()
 
-	clientConfig := Config{}
+	clientConfig := Config{InsecureSkipVerify: true}
 	conn, err := Dial("tcp", ln.Addr().String(), &clientConfig)
 	if err != nil {
 		t.Fatal(err)
@@ -229,9 +292,208 @@ func testConnReadNonzeroAndEOF(t *testing.T, delay time.Duration) error {
 	if n != 2 || string(buf[0:2]) != "gh" {
 		return fmt.Errorf("Read = %d, buf= %q; want 2, gh", n, buf)
 	}
-	if err != io.EOF {
-		return fmt.Errorf("Second Read error = %v; want io.EOF", err)
+	if err != nil {
+		return fmt.Errorf("Second Read error = %v; want nil", err)
+	}
+
+	// The closeNotify is only reported once the data ahead of it is read
+	n, err = conn.Read(buf)
+	if n != 0 || err != io.EOF {
+		return fmt.Errorf("Third Read = %d, %v; want 0, io.EOF", n, err)
 	}
 
 	return nil
 }
+
+// readCountingListener counts the accepted connections that have started
+// reading, i.e., whose server handshake is in progress.
+type readCountingListener struct {
+	net.Listener
+	reading *int32
+}
+
+func (l readCountingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &readCountingConn{Conn: c, reading: l.reading}, nil
+}
+
+type readCountingConn struct {
+	net.Conn
+	reading *int32
+	once    sync.Once
+}
+
+func (c *readCountingConn) Read(b []byte) (int, error) {
+	c.once.Do(func() { atomic.AddInt32(c.reading, 1) })
+	return c.Conn.Read(b)
+}
+
+func TestMaxConcurrentHandshakes(t *testing.T) {
+	const maxHandshakes = 2
+	const numConns = 5
+
+	var reading int32
+	ln := NewListener(readCountingListener{newLocalListener(t), &reading},
+		&Config{MaxConcurrentHandshakes: maxHandshakes})
+	defer ln.Close()
+
+	// Open connections that never send a ClientHello, so that every
+	// handshake that starts stays in progress
+	clients := make([]net.Conn, numConns)
+	for i := range clients {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients[i] = c
+	}
+
+	done := make(chan error, numConns)
+	for i := 0; i < numConns; i++ {
+		c, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			done <- c.(*Conn).Handshake()
+			c.Close()
+		}()
+	}
+
+	waitForReading := func(n int32) {
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadInt32(&reading) < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d handshakes in progress; want %d", atomic.LoadInt32(&reading), n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Only the permitted number of handshakes should start
+	waitForReading(maxHandshakes)
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&reading); n != maxHandshakes {
+		t.Fatalf("%d handshakes in progress; want %d", n, maxHandshakes)
+	}
+
+	// Failing the in-progress handshakes lets the queued ones proceed
+	for _, c := range clients {
+		c.Close()
+	}
+	for i := 0; i < numConns; i++ {
+		if err := <-done; err == nil {
+			t.Fatal("Handshake succeeded with a closed client")
+		}
+	}
+	waitForReading(numConns)
+}
+
+func TestQueuedHandshakeCanceled(t *testing.T) {
+	ln := NewListener(newLocalListener(t), &Config{MaxConcurrentHandshakes: 1})
+	defer ln.Close()
+
+	clients := make([]net.Conn, 2)
+	for i := range clients {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		clients[i] = c
+	}
+
+	// Occupy the only slot with a handshake that never gets a ClientHello
+	first, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	go first.(*Conn).Handshake()
+
+	// Test that a handshake waiting for a slot gives up when its context is
+	// done, and keeps failing afterward
+	second, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = second.(*Conn).HandshakeContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Handshake returned %v; want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Queued handshake took %v to give up", elapsed)
+	}
+	if err := second.(*Conn).Handshake(); err != context.DeadlineExceeded {
+		t.Fatalf("Second Handshake returned %v; want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	ln := NewListener(newLocalListener(t), &Config{HandshakeTimeout: timeout})
+	defer ln.Close()
+
+	// Test that a client that stalls partway through its ClientHello is
+	// dropped once the timeout passes
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_, err = client.Write([]byte{0x16, 0x03, 0x01, 0x01, 0x00, 0x01})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = c.(*Conn).Handshake()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Handshake returned %v; want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > 10*timeout {
+		t.Fatalf("Handshake gave up after %v; want about %v", elapsed, timeout)
+	}
+
+	// The server closes the connection, which the client sees as either EOF
+	// or a reset, and the failure sticks
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = ioutil.ReadAll(client); isTimeout(err) {
+		t.Fatal("Server did not close the connection")
+	}
+	if err = c.(*Conn).Handshake(); err != context.DeadlineExceeded {
+		t.Fatalf("Second Handshake returned %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	// A handshake that completes in time is unaffected
+	ln = NewListener(newLocalListener(t), &Config{HandshakeTimeout: 10 * time.Second})
+	defer ln.Close()
+	done := make(chan error, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		done <- c.(*Conn).Handshake()
+	}()
+	conn, err := Dial("tcp", ln.Addr().String(), &Config{ServerName: "example.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = <-done; err != nil {
+		t.Fatalf("Server failed handshake: %v", err)
+	}
+}